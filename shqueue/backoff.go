@@ -0,0 +1,78 @@
+package shqueue
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Backoff is a strategy of waiting for the header lock when it's taken by someone else.
+type Backoff int
+
+const (
+	// FixedBackoff sleeps between the attempts for a time growing with every attempt, up to the cap set by
+	// WithMaxSpinSleep. It's the default.
+	FixedBackoff Backoff = iota
+	// AdaptiveBackoff spins (yielding the processor) for a number of attempts, and then sleeps like FixedBackoff. The
+	// number of spins adapts to the contention: all processes using this strategy keep a moving average of the number
+	// of attempts it took to take the lock in the header of the queue. While the lock is usually taken within a few
+	// attempts, spinning pays off, so up to twice the average is spun. When it usually takes longer than the spinning
+	// limit, spinning only burns CPU, so the process starts sleeping almost at once.
+	AdaptiveBackoff
+)
+
+const (
+	// minAdaptiveSpins is the number of attempts that AdaptiveBackoff always spins before sleeping.
+	minAdaptiveSpins = 4
+	// maxAdaptiveSpins is the max number of attempts that AdaptiveBackoff spins before sleeping.
+	maxAdaptiveSpins = 128
+	// adaptiveSpinsWeight is the inverse weight of a new sample in the moving average of AdaptiveBackoff.
+	adaptiveSpinsWeight = 8
+)
+
+// waitHeaderLock waits between the attempts to take the header lock according to the backoff strategy.
+func (s *segment) waitHeaderLock(iteration int) {
+	if s.backoff != AdaptiveBackoff {
+		backoff(iteration, s.maxSpinSleep)
+		return
+	}
+	limit := adaptiveSpinLimit(s.getAdaptiveSpins() / adaptiveSpinsWeight)
+	if iteration < limit {
+		runtime.Gosched()
+		return
+	}
+	backoff(iteration-limit, s.maxSpinSleep)
+}
+
+// recordHeaderLockWait adds the number of failed attempts it took to take the header lock to the moving average of
+// AdaptiveBackoff. The average is stored multiplied by adaptiveSpinsWeight, so small samples aren't lost to rounding.
+// It's called under the header lock, so the average isn't updated concurrently.
+func (s *segment) recordHeaderLockWait(iterations int) {
+	if s.backoff != AdaptiveBackoff {
+		return
+	}
+	sum := s.getAdaptiveSpins()
+	sum = sum - sum/adaptiveSpinsWeight + uint64(iterations)
+	atomic.StoreUint64(s.adaptiveSpinsPtr(), sum)
+}
+
+// adaptiveSpinLimit returns the number of attempts to spin before sleeping, given the average number of attempts it
+// takes to take the lock.
+func adaptiveSpinLimit(avg uint64) int {
+	if avg > maxAdaptiveSpins {
+		return minAdaptiveSpins
+	}
+	limit := 2*int(avg) + minAdaptiveSpins
+	if limit > maxAdaptiveSpins {
+		limit = maxAdaptiveSpins
+	}
+	return limit
+}
+
+func (s *segment) getAdaptiveSpins() uint64 {
+	return atomic.LoadUint64(s.adaptiveSpinsPtr())
+}
+
+func (s *segment) adaptiveSpinsPtr() *uint64 {
+	return (*uint64)(unsafe.Pointer(&s.mem[startAdaptiveSpins]))
+}
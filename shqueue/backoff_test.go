@@ -0,0 +1,88 @@
+package shqueue
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveBackoff(t *testing.T) {
+	t.Run("spin limit", func(t *testing.T) {
+		assert.Equal(t, minAdaptiveSpins, adaptiveSpinLimit(0))
+		assert.Equal(t, 2*10+minAdaptiveSpins, adaptiveSpinLimit(10))
+		assert.Equal(t, maxAdaptiveSpins, adaptiveSpinLimit(maxAdaptiveSpins))
+		assert.Equal(t, minAdaptiveSpins, adaptiveSpinLimit(maxAdaptiveSpins+1))
+	})
+
+	t.Run("moving average", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithBackoff(AdaptiveBackoff))
+
+		for i := 0; i < 100; i++ {
+			queue.seg.recordHeaderLockWait(1000)
+		}
+		assert.Greater(t, queue.seg.getAdaptiveSpins()/adaptiveSpinsWeight, uint64(maxAdaptiveSpins))
+
+		for i := 0; i < 100; i++ {
+			queue.seg.recordHeaderLockWait(1)
+		}
+		assert.Less(t, queue.seg.getAdaptiveSpins()/adaptiveSpinsWeight, uint64(10))
+	})
+
+	t.Run("fixed backoff doesn't record", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		queue.seg.recordHeaderLockWait(1000)
+		assert.Zero(t, queue.seg.getAdaptiveSpins())
+	})
+
+	t.Run("contended lock is recorded", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithBackoff(AdaptiveBackoff))
+
+		queue.seg.lockHeader()
+		done := make(chan struct{})
+		go func() {
+			queue.seg.lockHeader()
+			queue.seg.unlockHeader()
+			close(done)
+		}()
+		for queue.seg.getHeaderLockSpins() == 0 {
+			runtime.Gosched()
+		}
+		queue.seg.unlockHeader()
+		<-done
+
+		assert.NotZero(t, queue.seg.getAdaptiveSpins())
+	})
+}
+
+func BenchmarkBackoff(b *testing.B) {
+	for _, backoff := range []Backoff{FixedBackoff, AdaptiveBackoff} {
+		for _, parallelism := range []int{1, 4, 16} {
+			name := fmt.Sprintf("fixed/%dx", parallelism)
+			if backoff == AdaptiveBackoff {
+				name = fmt.Sprintf("adaptive/%dx", parallelism)
+			}
+			b.Run(name, func(b *testing.B) {
+				queue, err := CreatePrivate(1, 1024, WithBackoff(backoff))
+				require.NoError(b, err)
+				b.Cleanup(func() {
+					assert.NoError(b, queue.Close())
+					assert.NoError(b, queue.Delete())
+				})
+
+				b.SetParallelism(parallelism)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					msg := make([]byte, 8)
+					for pb.Next() {
+						queue.EnqueueTry(msg)
+						queue.DequeueTry(msg)
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package shqueue
+
+import (
+	"math"
+)
+
+// Bounds copies the oldest and the newest messages of the queue without dequeuing them, and returns the number of
+// messages from one to the other, inclusive. Both are copied under the header lock, so they come from the same instant,
+// which suits measuring the span of what's buffered, like the timestamps of the oldest and the newest events. If the
+// queue has one message, head and tail are equal copies. Only the committed messages count (see Reserve): the tail is
+// the last one before the first reserved slot. If there are no messages, ok is false.
+func (q *Queue) Bounds() (head []byte, tail []byte, depth uint32, ok bool) {
+	if q.deletedHere() {
+		return nil, nil, 0, false
+	}
+	if q.seg.lockHeader() != nil {
+		return nil, nil, 0, false
+	}
+
+	depth = q.seg.readyLen(math.MaxUint32)
+	if depth == 0 {
+		q.seg.unlockHeader()
+		return nil, nil, 0, false
+	}
+	headIdx := q.seg.getStartIdx()
+	tailIdx := (headIdx + depth - 1) % q.seg.getMaxLen()
+
+	idxs := []uint32{headIdx}
+	if tailIdx != headIdx {
+		idxs = append(idxs, tailIdx)
+	}
+	if err := q.seg.lockMsgs(idxs); err != nil {
+		q.seg.unlockHeader()
+		return nil, nil, 0, false
+	}
+	head = append([]byte(nil), q.seg.msgData(headIdx)...)
+	tail = append([]byte(nil), q.seg.msgData(tailIdx)...)
+	for _, idx := range idxs {
+		q.seg.unlockMsg(idx)
+	}
+	q.seg.unlockHeader()
+
+	return head, tail, depth, true
+}
@@ -0,0 +1,58 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBounds(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		head, tail, depth, ok := queue.Bounds()
+		assert.False(t, ok)
+		assert.Nil(t, head)
+		assert.Nil(t, tail)
+		assert.Zero(t, depth)
+	})
+
+	t.Run("single message", func(t *testing.T) {
+		queue := testQueue(t, 2, 0)
+		require.True(t, queue.EnqueueTry(testMsgA))
+
+		head, tail, depth, ok := queue.Bounds()
+		require.True(t, ok)
+		assert.Equal(t, testMsgA, head)
+		assert.Equal(t, testMsgA, tail)
+		assert.Equal(t, uint32(1), depth)
+	})
+
+	t.Run("wrapped ring", func(t *testing.T) {
+		queue := testQueue(t, 3, 0)
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC, testMsgB}))
+
+		head, tail, depth, ok := queue.Bounds()
+		require.True(t, ok)
+		assert.Equal(t, testMsgA, head)
+		assert.Equal(t, testMsgB, tail)
+		assert.Equal(t, uint32(4), depth)
+		assert.Equal(t, uint32(4), queue.seg.getQueueLen(), "nothing is dequeued")
+
+		head[0] = 0
+		assert.Equal(t, testMsgA, queue.seg.msgData(3), "copies are returned")
+	})
+
+	t.Run("reserved tail is excluded", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		_, _, ok := queue.Reserve()
+		require.True(t, ok)
+
+		_, tail, depth, ok := queue.Bounds()
+		require.True(t, ok)
+		assert.Equal(t, testMsgB, tail)
+		assert.Equal(t, uint32(2), depth)
+	})
+}
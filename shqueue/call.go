@@ -0,0 +1,177 @@
+package shqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// callIDSize is the size of the correlation ID at the start of the metadata of requests and responses (see Call).
+const callIDSize = 8
+
+var (
+	// lastCallSeq is the sequence number of the last call made by this process.
+	lastCallSeq uint32
+	// pendingCalls holds the correlation IDs of the calls of this process that wait for their responses.
+	pendingCalls sync.Map
+)
+
+// Call makes a request/response round trip over a pair of queues: it enqueues req to reqQueue, waiting for free space,
+// and then waits for the response in respQueue and returns its payload. Both queues must have at least 8 bytes of
+// metadata (see WithMetadataSize), otherwise an error wrapping ErrGeometryMismatch is returned.
+//
+// The first 8 bytes of the metadata of the request hold a correlation ID, unique among the calls of all processes, as
+// a little-endian uint64. The responder must dequeue the request with DequeueMeta and enqueue the response with
+// EnqueueMeta, passing the metadata of the request as is, so the caller finds the response by the ID.
+//
+// Several callers may share respQueue: a caller takes its response from wherever it is in the queue, and leaves the
+// responses to other calls in place. A response that nobody waits for, because its call has given up on the context
+// or its process has exited, is dropped by the next call that finds it, and counts as dropped in Stats.
+//
+// If the context is cancelled, its error is returned; the request may have been enqueued by then. If respQueue is
+// closed with CloseQueue and drained without the response, an error wrapping ErrQueueClosed is returned.
+func Call(ctx context.Context, reqQueue, respQueue *Queue, req []byte) ([]byte, error) {
+	for _, q := range []*Queue{reqQueue, respQueue} {
+		if metaSize := q.seg.getMetaSize(); metaSize < callIDSize {
+			return nil, newQueueError("call", q.key, q.id, fmt.Errorf(
+				"%w: metadata size %d bytes, at least %d needed for the correlation ID",
+				ErrGeometryMismatch, metaSize, callIDSize,
+			))
+		}
+	}
+
+	id := lockOwner<<32 | uint64(atomic.AddUint32(&lastCallSeq, 1))
+	pendingCalls.Store(id, struct{}{})
+	defer pendingCalls.Delete(id)
+
+	meta := make([]byte, reqQueue.seg.getMetaSize())
+	binary.LittleEndian.PutUint64(meta, id)
+	if err := reqQueue.enqueueBlockMeta(ctx, meta, req); err != nil {
+		return nil, err
+	}
+
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+			// Go on.
+		}
+
+		// The flag is read first: once it's set, nothing is enqueued, so an empty queue afterwards stays empty.
+		closed := respQueue.seg.isClosed()
+		resp, ok, err := respQueue.takeResponse(id)
+		if err != nil {
+			return nil, newQueueError("call", respQueue.key, respQueue.id, err)
+		}
+		if ok {
+			return resp, nil
+		}
+		if closed && respQueue.seg.getQueueLen() == 0 {
+			return nil, newQueueError("call", respQueue.key, respQueue.id, ErrQueueClosed)
+		}
+		if err := respQueue.checkDeleted(i); err != nil {
+			return nil, err
+		}
+		if respQueue.seg.getQueueLen() > 0 {
+			// The queue only holds responses to other calls, so the semaphore won't block until they're taken.
+			backoff(i, respQueue.opts.maxSpinSleep)
+			continue
+		}
+		if err := respQueue.waitLen(semFilled, i); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// takeResponse dequeues the response with the correlation ID wherever it is in the queue, dropping the responses that
+// nobody waits for on the way. false is returned if there's no such response yet. An error is returned if the header
+// is corrupted, or a slot doesn't fit into the segment.
+func (q *Queue) takeResponse(id uint64) (resp []byte, ok bool, err error) {
+	if q.deletedHere() {
+		return nil, false, nil
+	}
+	if err = q.seg.lockHeader(); err != nil {
+		return nil, false, err
+	}
+	defer q.seg.unlockHeader()
+
+	n := q.seg.readyLen(q.seg.getQueueLen())
+	for pos := uint32(0); pos < n; {
+		msgIdx := (q.seg.getStartIdx() + pos) % q.seg.getMaxLen()
+		if err = q.seg.lockMsg(msgIdx); err != nil {
+			return nil, false, err
+		}
+		msgID := binary.LittleEndian.Uint64(q.seg.msgMeta(msgIdx))
+		q.seg.unlockMsg(msgIdx)
+		ok = msgID == id
+		if !ok && !orphanedCall(msgID) {
+			pos++
+			continue
+		}
+		if ok {
+			resp = make([]byte, q.seg.getDataSize())
+		}
+		if err = q.removeAt(pos, resp); err != nil {
+			return nil, false, err
+		}
+		if ok {
+			q.seg.addDequeued(1)
+			return resp, true, nil
+		}
+		q.seg.addDropped(1)
+		n--
+	}
+	return nil, false, nil
+}
+
+// removeAt removes the message at the position from the head of the queue, copying it into into unless it's nil. The
+// messages before it are moved one slot towards the tail to close the gap, so their order is kept. The header lock
+// must be held, and the messages up to the position must be committed.
+func (q *Queue) removeAt(pos uint32, into []byte) error {
+	startIdx := q.seg.getStartIdx()
+	maxLen := q.seg.getMaxLen()
+	msgIdxs := make([]uint32, pos+1)
+	for i := range msgIdxs {
+		msgIdxs[i] = (startIdx + uint32(i)) % maxLen
+	}
+	if err := q.seg.lockMsgs(msgIdxs); err != nil {
+		return err
+	}
+	if into != nil {
+		q.seg.getMsgData(msgIdxs[pos], into)
+		q.seg.sumDequeued(msgIdxs[pos])
+	}
+	for i := pos; i > 0; i-- {
+		dst, src := msgIdxs[i], msgIdxs[i-1]
+		copy(q.seg.msgMeta(dst), q.seg.msgMeta(src))
+		copy(q.seg.msgData(dst), q.seg.msgData(src))
+		q.seg.copyMsgTime(dst, q.seg, src)
+	}
+	if q.opts.zeroOnDequeue {
+		q.seg.zeroMsgData(startIdx)
+	}
+	for _, msgIdx := range msgIdxs {
+		q.seg.unlockMsg(msgIdx)
+	}
+
+	q.seg.setQueueLen(q.seg.getQueueLen() - 1)
+	q.seg.setStartIdx((startIdx + 1) % maxLen)
+	return nil
+}
+
+// orphanedCall reports whether nobody waits for the response with the correlation ID anymore: the call of this
+// process has returned, or the process that made it has exited. A message without an ID isn't a response at all.
+func orphanedCall(id uint64) bool {
+	pid := id >> 32
+	if pid == 0 {
+		return true
+	}
+	if pid != lockOwner {
+		return !processAlive(pid)
+	}
+	_, pending := pendingCalls.Load(id)
+	return !pending
+}
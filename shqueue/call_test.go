@@ -0,0 +1,166 @@
+package shqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCall(t *testing.T) {
+	// callQueues creates a pair of request and response queues of 8-byte messages with room for the correlation ID.
+	callQueues := func(t *testing.T) (reqQueue, respQueue *Queue) {
+		t.Helper()
+		reqQueue = testQueue(t, 0, 0, WithMetadataSize(callIDSize))
+		respQueue = testQueue(t, 0, 0, WithMetadataSize(callIDSize))
+		return reqQueue, respQueue
+	}
+	// serve answers the requests with their payloads incremented by one until the context is done.
+	serve := func(ctx context.Context, reqQueue, respQueue *Queue) {
+		meta, msg := make([]byte, callIDSize), make([]byte, 16)
+		for ctx.Err() == nil {
+			if !reqQueue.DequeueMeta(meta, msg) {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			binary.LittleEndian.PutUint64(msg, binary.LittleEndian.Uint64(msg)+1)
+			for !respQueue.EnqueueMeta(meta, msg) && ctx.Err() == nil {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	request := func(n uint64) []byte {
+		msg := make([]byte, 16)
+		binary.LittleEndian.PutUint64(msg, n)
+		return msg
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		reqQueue, respQueue := callQueues(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go serve(ctx, reqQueue, respQueue)
+
+		resp, err := Call(ctx, reqQueue, respQueue, request(41))
+		require.NoError(t, err)
+		assert.Equal(t, request(42), resp)
+	})
+
+	t.Run("concurrent callers get their own responses", func(t *testing.T) {
+		reqQueue, respQueue := callQueues(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go serve(ctx, reqQueue, respQueue)
+
+		var wg sync.WaitGroup
+		for c := 0; c < 4; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					n := uint64(c*1000 + i)
+					resp, err := Call(ctx, reqQueue, respQueue, request(n))
+					if assert.NoError(t, err) {
+						assert.Equal(t, request(n+1), resp)
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+	})
+
+	t.Run("drop orphaned responses", func(t *testing.T) {
+		reqQueue, respQueue := callQueues(t)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := Call(ctx, reqQueue, respQueue, request(1))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		serveCtx, stopServe := context.WithCancel(context.Background())
+		defer stopServe()
+		go serve(serveCtx, reqQueue, respQueue)
+
+		resp, err := Call(context.Background(), reqQueue, respQueue, request(2))
+		require.NoError(t, err)
+		assert.Equal(t, request(3), resp)
+		assert.Equal(t, uint64(1), respQueue.Stats().Dropped)
+	})
+
+	t.Run("leave response to pending call", func(t *testing.T) {
+		_, respQueue := callQueues(t)
+		other := lockOwner<<32 | 0xFFFFFFFF
+		pendingCalls.Store(other, struct{}{})
+		defer pendingCalls.Delete(other)
+
+		meta := make([]byte, callIDSize)
+		binary.LittleEndian.PutUint64(meta, other)
+		require.True(t, respQueue.EnqueueMeta(meta, testMsgA))
+
+		_, ok, err := respQueue.takeResponse(1)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, uint32(1), respQueue.seg.getQueueLen())
+		resp, ok, err := respQueue.takeResponse(other)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, testMsgA, resp)
+	})
+
+	t.Run("take response behind others", func(t *testing.T) {
+		_, respQueue := callQueues(t)
+		pending := []uint64{lockOwner<<32 | 0xFFFFFFFD, lockOwner<<32 | 0xFFFFFFFE, lockOwner<<32 | 0xFFFFFFFF}
+		for _, id := range pending {
+			pendingCalls.Store(id, struct{}{})
+			defer pendingCalls.Delete(id)
+		}
+
+		meta := make([]byte, callIDSize)
+		for i, msg := range [][]byte{testMsgA, testMsgB, testMsgC} {
+			binary.LittleEndian.PutUint64(meta, pending[i])
+			require.True(t, respQueue.EnqueueMeta(meta, msg))
+		}
+		// A response nobody waits for, behind the pending ones.
+		binary.LittleEndian.PutUint64(meta, lockOwner<<32|0xFFFFFFFC)
+		require.True(t, respQueue.EnqueueMeta(meta, testMsgA))
+
+		resp, ok, err := respQueue.takeResponse(pending[1])
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, testMsgB, resp)
+		resp, ok, err = respQueue.takeResponse(1)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Nil(t, resp)
+		assert.Equal(t, uint32(2), respQueue.seg.getQueueLen())
+		assert.Equal(t, uint64(1), respQueue.Stats().Dropped)
+
+		for i, want := range [][]byte{testMsgA, testMsgC} {
+			toMsg := make([]byte, 16)
+			require.True(t, respQueue.DequeueMeta(meta, toMsg))
+			assert.Equal(t, want, toMsg)
+			assert.Equal(t, pending[2*i], binary.LittleEndian.Uint64(meta))
+		}
+	})
+
+	t.Run("closed response queue", func(t *testing.T) {
+		reqQueue, respQueue := callQueues(t)
+		respQueue.CloseQueue()
+
+		_, err := Call(context.Background(), reqQueue, respQueue, request(1))
+		assert.ErrorIs(t, err, ErrQueueClosed)
+	})
+
+	t.Run("metadata too small", func(t *testing.T) {
+		reqQueue := testQueue(t, 0, 0, WithMetadataSize(callIDSize))
+		respQueue := testQueue(t, 0, 0)
+
+		_, err := Call(context.Background(), reqQueue, respQueue, request(1))
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+		assert.Zero(t, reqQueue.seg.getQueueLen())
+	})
+}
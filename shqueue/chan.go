@@ -0,0 +1,88 @@
+package shqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// Message is a message received from DequeueChanPooled. Its buffer is leased from a pool: Data belongs to the receiver
+// only until Release is called, and must not be read, written or retained after that.
+type Message struct {
+	Data []byte
+	pool *sync.Pool
+}
+
+// Release returns the buffer of the message to the pool, so the next dequeued message may be copied into it. It must be
+// called at most once, when the receiver is done with Data. Messages that are never released are just collected by
+// the garbage collector, so releasing them is an optimization rather than an obligation.
+func (m *Message) Release() {
+	m.pool.Put(m)
+}
+
+// DequeueChan starts a goroutine that dequeues messages with DequeueBlock and sends them to the returned channel, which
+// has the given capacity. Each message is copied into a new slice, which the receiver owns. The channel is closed when
+// ctx is cancelled, the queue is deleted, or it's closed with CloseQueue and drained, and then err returns the reason.
+// Up to capacity+1 messages are dequeued ahead of the receiver, and they're lost if ctx is cancelled before they're
+// received. See DequeueChanPooled for an adapter that doesn't allocate per message.
+func (q *Queue) DequeueChan(ctx context.Context, capacity int) (msgs <-chan []byte, err func() error) {
+	ch := make(chan []byte, capacity)
+	var dequeueErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(ch)
+		for {
+			msg := make([]byte, q.MessageSize())
+			if dequeueErr = q.DequeueBlock(ctx, msg); dequeueErr != nil {
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				dequeueErr = ctx.Err()
+				return
+			}
+		}
+	}()
+	return ch, func() error {
+		<-done
+		return dequeueErr
+	}
+}
+
+// DequeueChanPooled works like DequeueChan, but copies messages into buffers leased from a pool instead of new slices.
+// Once the receiver calls Release on the received messages, their buffers are reused, so no allocation occurs in the
+// steady state. The pool belongs to the call, so buffers of different channels are never mixed up.
+func (q *Queue) DequeueChanPooled(ctx context.Context, capacity int) (msgs <-chan *Message, err func() error) {
+	pool := &sync.Pool{}
+	msgSize := q.MessageSize()
+	pool.New = func() any {
+		return &Message{Data: make([]byte, msgSize), pool: pool}
+	}
+
+	ch := make(chan *Message, capacity)
+	var dequeueErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(ch)
+		for {
+			msg := pool.Get().(*Message)
+			if dequeueErr = q.DequeueBlock(ctx, msg.Data); dequeueErr != nil {
+				msg.Release()
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				msg.Release()
+				dequeueErr = ctx.Err()
+				return
+			}
+		}
+	}()
+	return ch, func() error {
+		<-done
+		return dequeueErr
+	}
+}
@@ -0,0 +1,73 @@
+package shqueue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDequeueChan(t *testing.T) {
+	t.Run("receive until closed", func(t *testing.T) {
+		queue := testQueue(t, 2, 0)
+		for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC} {
+			require.True(t, queue.EnqueueTry(msg))
+		}
+		queue.CloseQueue()
+
+		msgs, errFn := queue.DequeueChan(context.Background(), 1)
+		var got [][]byte
+		for msg := range msgs {
+			got = append(got, msg)
+		}
+		assert.Equal(t, [][]byte{testMsgA, testMsgB, testMsgC}, got)
+		assert.ErrorIs(t, errFn(), ErrQueueClosed)
+	})
+
+	t.Run("stop on cancel", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		msgs, errFn := queue.DequeueChan(ctx, 0)
+		cancel()
+		_, ok := <-msgs
+		assert.False(t, ok)
+		assert.ErrorIs(t, errFn(), context.Canceled)
+	})
+}
+
+func TestDequeueChanPooled(t *testing.T) {
+	t.Run("receive until closed", func(t *testing.T) {
+		queue := testQueue(t, 4, 0)
+		for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC} {
+			require.True(t, queue.EnqueueTry(msg))
+		}
+		queue.CloseQueue()
+
+		msgs, errFn := queue.DequeueChanPooled(context.Background(), 2)
+		var got [][]byte
+		for msg := range msgs {
+			got = append(got, append([]byte(nil), msg.Data...))
+			msg.Release()
+		}
+		assert.Equal(t, [][]byte{testMsgA, testMsgB, testMsgC}, got)
+		assert.ErrorIs(t, errFn(), ErrQueueClosed)
+	})
+
+	t.Run("stop on cancel", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		ctx, cancel := context.WithCancel(context.Background())
+
+		msgs, errFn := queue.DequeueChanPooled(ctx, 0)
+		msg := <-msgs
+		assert.Equal(t, testMsgA, msg.Data)
+		msg.Release()
+		cancel()
+		for range msgs {
+			// Drain.
+		}
+		assert.ErrorIs(t, errFn(), context.Canceled)
+	})
+}
@@ -0,0 +1,60 @@
+package shqueue
+
+import (
+	"hash/crc64"
+	"sync/atomic"
+	"unsafe"
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// isRunningChecksum returns whether the checksums of enqueued and dequeued messages are maintained (see
+// WithRunningChecksum).
+func (s *segment) isRunningChecksum() bool {
+	return s.byteOrder.Uint32(s.mem[startRunningChecksum:endRunningChecksum]) != 0
+}
+
+func (s *segment) setRunningChecksum() {
+	s.byteOrder.PutUint32(s.mem[startRunningChecksum:endRunningChecksum], 1)
+}
+
+// msgChecksum computes the CRC-64 of the slot without the lock: the timestamp, the metadata, the data and the padding.
+func (s *segment) msgChecksum(idx uint32) uint64 {
+	start, end, err := s.slotBounds(idx)
+	if err != nil {
+		panic(err)
+	}
+	return crc64.Checksum(s.mem[start+msgLockSize:end], crc64Table)
+}
+
+// sumEnqueued adds the checksum of the message just written into the slot to the enqueued checksum, if it's
+// maintained. The message lock must be held.
+func (s *segment) sumEnqueued(idx uint32) {
+	if s.isRunningChecksum() {
+		s.addEnqueuedChecksum(s.msgChecksum(idx))
+	}
+}
+
+// sumDequeued adds the checksum of the message being dequeued from the slot to the dequeued checksum, if it's
+// maintained. The message lock must be held, and the slot must not be zeroed yet.
+func (s *segment) sumDequeued(idx uint32) {
+	if s.isRunningChecksum() {
+		s.addDequeuedChecksum(s.msgChecksum(idx))
+	}
+}
+
+func (s *segment) addEnqueuedChecksum(sum uint64) {
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startEnqueuedChecksum])), sum)
+}
+
+func (s *segment) getEnqueuedChecksum() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startEnqueuedChecksum])))
+}
+
+func (s *segment) addDequeuedChecksum(sum uint64) {
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startDequeuedChecksum])), sum)
+}
+
+func (s *segment) getDequeuedChecksum() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startDequeuedChecksum])))
+}
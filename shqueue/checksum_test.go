@@ -0,0 +1,229 @@
+package shqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderChecksum(t *testing.T) {
+	t.Run("maintained by operations", func(t *testing.T) {
+		queue := testQueue(t, 3, 0, WithHeaderChecksum())
+		require.True(t, queue.seg.isChecksummed())
+
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC}))
+		require.True(t, queue.EnqueueShift(testMsgA))
+		require.NoError(t, queue.SetSoftCap(4))
+		toMsg := make([]byte, 16)
+		require.True(t, queue.DequeueTry(toMsg))
+		require.NoError(t, queue.DequeueBlock(context.Background(), toMsg))
+		token, _, ok := queue.Reserve()
+		require.True(t, ok)
+		require.NoError(t, queue.Commit(token))
+		require.NoError(t, queue.Resize(7))
+		assert.True(t, queue.seg.isChecksummed())
+
+		assert.NoError(t, queue.Ping())
+		assert.NoError(t, queue.seg.checkHeaderChecksum())
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+	})
+
+	t.Run("wild write is detected", func(t *testing.T) {
+		queue := testQueue(t, 0, 2, WithHeaderChecksum())
+
+		queue.seg.setStartIdx(4)
+		assert.ErrorIs(t, queue.Ping(), ErrHeaderCorrupt)
+
+		assert.False(t, queue.EnqueueTry(testMsgA))
+		assert.ErrorIs(t, queue.EnqueueTryErr(testMsgA), ErrHeaderCorrupt)
+		assert.False(t, queue.DequeueTry(make([]byte, 16)))
+		assert.ErrorIs(t, queue.DequeueBlock(context.Background(), make([]byte, 16)), ErrHeaderCorrupt)
+		assert.ErrorIs(t, queue.SetSoftCap(3), ErrHeaderCorrupt)
+		assert.Zero(t, queue.Cap())
+		_, err := queue.RepairLocks()
+		assert.ErrorIs(t, err, ErrHeaderCorrupt)
+		assert.Zero(t, queue.seg.headerLockOwner(), "the lock is released")
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+
+		// The corruption stays visible.
+		assert.ErrorIs(t, queue.Ping(), ErrHeaderCorrupt)
+	})
+
+	t.Run("setting is stored in the queue", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithHeaderChecksum())
+		opened, err := AttachByID(queue.id)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, opened.Close()) }()
+
+		require.True(t, opened.EnqueueTry(testMsgA))
+		assert.NoError(t, queue.seg.checkHeaderChecksum())
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		queue := testQueue(t, 0, 2)
+		assert.False(t, queue.seg.isChecksummed())
+
+		queue.seg.setStartIdx(4)
+		assert.NoError(t, queue.Ping())
+	})
+}
+
+func TestRunningChecksum(t *testing.T) {
+	t.Run("match after drain", func(t *testing.T) {
+		queue := testQueue(t, 3, 0, WithRunningChecksum())
+		got := make([]byte, 16)
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgB, testMsgC}))
+		require.True(t, queue.EnqueueInPlaceTry(func(dst []byte) { copy(dst, testMsgA) }))
+		token, dst, ok := queue.Reserve()
+		require.True(t, ok)
+		copy(dst, testMsgB)
+		require.NoError(t, queue.Commit(token))
+
+		stats := queue.Stats()
+		assert.NotZero(t, stats.EnqueuedChecksum)
+		assert.Zero(t, stats.DequeuedChecksum)
+
+		require.True(t, queue.DequeueTry(got))
+		require.NoError(t, queue.DequeueBlock(context.Background(), got))
+		require.True(t, queue.DequeueInPlace(func(src []byte) {}))
+		assert.Equal(t, uint32(1), queue.DequeueSkip(1))
+		assert.Len(t, queue.DequeueAll(), 1)
+
+		stats = queue.Stats()
+		assert.Equal(t, stats.EnqueuedChecksum, stats.DequeuedChecksum)
+	})
+
+	t.Run("cover variable-length messages and metadata", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithRunningChecksum(), WithMetadataSize(8), WithZeroOnDequeue())
+
+		ok, err := queue.EnqueueVarTry([]byte("hello"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.True(t, queue.EnqueueMeta([]byte("metadata"), testMsgA))
+
+		_, err = queue.DequeueVarBlock(context.Background(), nil)
+		require.NoError(t, err)
+		stats := queue.Stats()
+		assert.NotEqual(t, stats.EnqueuedChecksum, stats.DequeuedChecksum)
+		require.True(t, queue.DequeueMeta(make([]byte, 8), make([]byte, 16)))
+		stats = queue.Stats()
+		assert.Equal(t, stats.EnqueuedChecksum, stats.DequeuedChecksum)
+	})
+
+	t.Run("detect dropped messages", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithRunningChecksum())
+		for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC, testMsgA, testMsgB, testMsgC} {
+			queue.EnqueueShift(msg)
+		}
+		assert.Len(t, queue.DequeueAll(), 5)
+
+		stats := queue.Stats()
+		assert.Equal(t, uint64(1), stats.Dropped)
+		assert.NotEqual(t, stats.EnqueuedChecksum, stats.DequeuedChecksum)
+	})
+
+	t.Run("detect corrupted messages", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithRunningChecksum())
+		require.True(t, queue.EnqueueTry(testMsgA))
+		queue.seg.msgData(0)[7] ^= 1
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+
+		stats := queue.Stats()
+		assert.NotEqual(t, stats.EnqueuedChecksum, stats.DequeuedChecksum)
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+
+		stats := queue.Stats()
+		assert.Zero(t, stats.EnqueuedChecksum)
+		assert.Zero(t, stats.DequeuedChecksum)
+	})
+
+	t.Run("followed by other handles", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithRunningChecksum())
+		other, err := AttachByID(queue.ExportID())
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, other.Close()) }()
+
+		require.True(t, other.EnqueueTry(testMsgA))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+		stats := other.Stats()
+		assert.NotZero(t, stats.DequeuedChecksum)
+		assert.Equal(t, stats.EnqueuedChecksum, stats.DequeuedChecksum)
+	})
+
+	t.Run("kept by reset stats and resize", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithRunningChecksum())
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC}))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+		before := queue.Stats()
+
+		queue.ResetStats()
+		require.NoError(t, queue.Resize(8))
+		after := queue.Stats()
+		assert.Equal(t, before.EnqueuedChecksum, after.EnqueuedChecksum)
+		assert.Equal(t, before.DequeuedChecksum, after.DequeuedChecksum)
+
+		assert.Len(t, queue.DequeueAll(), 2)
+		after = queue.Stats()
+		assert.Equal(t, after.EnqueuedChecksum, after.DequeuedChecksum)
+	})
+
+	t.Run("follow transferred messages", func(t *testing.T) {
+		src := testQueue(t, 0, 0, WithRunningChecksum())
+		dst := testQueue(t, 0, 0, WithRunningChecksum())
+		require.True(t, src.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+
+		assert.Equal(t, 2, TransferTry(src, dst, 2))
+		assert.Equal(t, src.Stats().EnqueuedChecksum, src.Stats().DequeuedChecksum)
+		assert.Equal(t, src.Stats().EnqueuedChecksum, dst.Stats().EnqueuedChecksum)
+	})
+
+	t.Run("concurrent producers and consumers", func(t *testing.T) {
+		queue, err := CreatePrivate(2, 64, WithRunningChecksum())
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		const producers, consumers, perProducer = 3, 3, 500
+		ctx := context.Background()
+		var wg sync.WaitGroup
+		for p := 0; p < producers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				msg := make([]byte, 16)
+				for i := 0; i < perProducer; i++ {
+					binary.LittleEndian.PutUint64(msg, uint64(p*perProducer+i))
+					assert.NoError(t, queue.EnqueueBlock(ctx, msg))
+				}
+			}(p)
+		}
+		for c := 0; c < consumers; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				msg := make([]byte, 16)
+				for i := 0; i < producers*perProducer/consumers; i++ {
+					assert.NoError(t, queue.DequeueBlock(ctx, msg))
+				}
+			}()
+		}
+		wg.Wait()
+
+		stats := queue.Stats()
+		assert.Equal(t, uint64(producers*perProducer), stats.Dequeued)
+		assert.Equal(t, stats.EnqueuedChecksum, stats.DequeuedChecksum)
+	})
+}
@@ -0,0 +1,71 @@
+package shqueue
+
+import (
+	"fmt"
+)
+
+// CopyOutChunked copies the message at the given position from the head of the queue (0 is the oldest one) into
+// into, which must be of the message size, without dequeuing it. The message is copied in pieces of chunk bytes, and
+// the message lock is released between them, so a big message doesn't block other processes for the whole copy. A
+// chunk of 0 or less copies the whole message at once.
+//
+// The price is consistency: the pieces are consistent one by one, but not with each other if the message is modified
+// in place in between (e.g. with Record). The queue is checked between the pieces, and if the message has been
+// dequeued or dropped meanwhile, so its slot may be overwritten, an error wrapping ErrMessageOverwritten is returned.
+// If there's no message at the position, an error wrapping ErrNoMessage is returned.
+func (q *Queue) CopyOutChunked(offset uint32, into []byte, chunk int) error {
+	q.seg.checkMsgSize(len(into))
+	if chunk <= 0 || chunk > len(into) {
+		chunk = len(into)
+	}
+	if q.deletedHere() {
+		return newQueueError("copy out", q.key, q.id, ErrSegmentDeleted)
+	}
+
+	if err := q.seg.lockHeader(); err != nil {
+		return newQueueError("copy out", q.key, q.id, err)
+	}
+	curLen := q.seg.getQueueLen()
+	if offset >= curLen {
+		q.seg.unlockHeader()
+		return newQueueError("copy out", q.key, q.id, fmt.Errorf("%w: position %d, length %d", ErrNoMessage, offset, curLen))
+	}
+	if q.seg.readyLen(offset+1) <= offset {
+		q.seg.unlockHeader()
+		return newQueueError("copy out", q.key, q.id, fmt.Errorf("%w: position %d isn't committed", ErrNoMessage, offset))
+	}
+	msgIdx := (q.seg.getStartIdx() + offset) % q.seg.getMaxLen()
+	removed := q.removedCount()
+	q.seg.unlockHeader()
+
+	for start := 0; start < len(into); start += chunk {
+		end := start + chunk
+		if end > len(into) {
+			end = len(into)
+		}
+
+		if err := q.seg.lockMsg(msgIdx); err != nil {
+			return newQueueError("copy out", q.key, q.id, err)
+		}
+		// The message has left the queue if at least offset+1 messages were removed from the head since the start.
+		// Removals update the head sequence under the header lock, which an enqueue holds while it takes the lock of the
+		// slot to overwrite, and EnqueueShift counts the message it drops while holding the lock of its slot. So a
+		// removal that could have overwritten the slot is always seen here.
+		gone := q.removedCount()-removed > uint64(offset)
+		if !gone {
+			copy(into[start:end], q.seg.msgData(msgIdx)[start:end])
+		}
+		q.seg.unlockMsg(msgIdx)
+
+		if gone {
+			return newQueueError("copy out", q.key, q.id, ErrMessageOverwritten)
+		}
+	}
+	return nil
+}
+
+// removedCount returns the number of messages ever removed from the head of the queue: dequeued or dropped. The new
+// messages discarded by a full queue aren't counted, since they never enter it, and ResetStats doesn't zero it.
+func (q *Queue) removedCount() uint64 {
+	return q.seg.getHeadSeq()
+}
@@ -0,0 +1,104 @@
+package shqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyOutChunked(t *testing.T) {
+	t.Run("copy in chunks", func(t *testing.T) {
+		queue := testQueue(t, 3, 3)
+		for _, chunk := range []int{0, 1, 3, 8, 16, 100} {
+			into := make([]byte, len(testMsgA))
+			require.NoError(t, queue.CopyOutChunked(1, into, chunk), "chunk %d", chunk)
+			assert.Equal(t, queue.seg.msgData(4), into, "chunk %d", chunk)
+		}
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+	})
+
+	t.Run("no message at position", func(t *testing.T) {
+		queue := testQueue(t, 0, 2)
+
+		err := queue.CopyOutChunked(2, make([]byte, len(testMsgA)), 4)
+		assert.ErrorIs(t, err, ErrNoMessage)
+	})
+
+	t.Run("message dequeued in between", func(t *testing.T) {
+		queue := testQueue(t, 0, 2)
+
+		// Hold the message lock, so the copy waits for it after taking the snapshot of the counters, and then remove
+		// the message from the queue: the counters are updated before the copy takes the message lock.
+		queue.seg.lockMsg(0)
+		spins := queue.seg.getMsgLockSpins()
+		errs := make(chan error)
+		go func() {
+			errs <- queue.CopyOutChunked(0, make([]byte, len(testMsgA)), 4)
+		}()
+		for queue.seg.getMsgLockSpins() == spins {
+			time.Sleep(time.Millisecond)
+		}
+		queue.seg.addDequeued(1)
+		queue.seg.unlockMsg(0)
+
+		assert.ErrorIs(t, <-errs, ErrMessageOverwritten)
+	})
+
+	t.Run("message behind dequeued one", func(t *testing.T) {
+		queue := testQueue(t, 0, 2)
+
+		queue.seg.lockMsg(1)
+		spins := queue.seg.getMsgLockSpins()
+		errs := make(chan error)
+		go func() {
+			errs <- queue.CopyOutChunked(1, make([]byte, len(testMsgA)), 4)
+		}()
+		for queue.seg.getMsgLockSpins() == spins {
+			time.Sleep(time.Millisecond)
+		}
+		queue.seg.addDequeued(1)
+		queue.seg.unlockMsg(1)
+
+		assert.NoError(t, <-errs)
+	})
+
+	t.Run("stats reset in between", func(t *testing.T) {
+		queue := testQueue(t, 0, 3)
+		require.True(t, queue.DequeueTry(make([]byte, len(testMsgA))))
+
+		queue.seg.lockMsg(1)
+		spins := queue.seg.getMsgLockSpins()
+		errs := make(chan error)
+		go func() {
+			errs <- queue.CopyOutChunked(0, make([]byte, len(testMsgA)), 4)
+		}()
+		for queue.seg.getMsgLockSpins() == spins {
+			time.Sleep(time.Millisecond)
+		}
+		queue.ResetStats()
+		queue.seg.unlockMsg(1)
+
+		assert.NoError(t, <-errs)
+	})
+
+	t.Run("new message discarded in between", func(t *testing.T) {
+		queue := testQueue(t, 0, 5, WithOverflowPolicy(DropNewest))
+
+		queue.seg.lockMsg(0)
+		spins := queue.seg.getMsgLockSpins()
+		errs := make(chan error)
+		go func() {
+			errs <- queue.CopyOutChunked(0, make([]byte, len(testMsgA)), 4)
+		}()
+		for queue.seg.getMsgLockSpins() == spins {
+			time.Sleep(time.Millisecond)
+		}
+		assert.False(t, queue.EnqueueShift(testMsgA))
+		queue.seg.unlockMsg(0)
+
+		assert.NoError(t, <-errs)
+		assert.Equal(t, uint64(1), queue.Stats().Dropped)
+	})
+}
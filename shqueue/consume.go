@@ -0,0 +1,89 @@
+package shqueue
+
+import (
+	"context"
+	"fmt"
+)
+
+// ConsumeBatch is an at-least-once consumer loop: it waits for messages, passes up to batchSize oldest ones to handle
+// without dequeuing them, and dequeues them only if handle returns nil. If handle returns an error, or the process
+// crashes before that, the batch stays in the queue and is handled again by the next call. The messages are
+// acknowledged once per batch, which amortizes the cost of the header lock.
+//
+// The loop runs until the context is cancelled, handle returns an error, or the queue is closed with CloseQueue and
+// drained, and returns that error. The slices passed to handle are reused between batches, so handle must not retain
+// them.
+//
+// The queue must have a single consumer: messages that handle is working on stay visible to other consumers. If any
+// message of the batch is dequeued or dropped by someone else in the meantime, an error wrapping ErrMessageOverwritten
+// is returned and nothing is acknowledged. A reserved message at the head (see Reserve) is waited for like by
+// DequeueBlock, so handle never gets an empty batch.
+func (q *Queue) ConsumeBatch(ctx context.Context, batchSize int, handle func(msgs [][]byte) error) error {
+	if batchSize <= 0 {
+		panic(fmt.Sprintf("batch size must be positive, but got %d", batchSize))
+	}
+
+	msgSize := q.seg.getDataSize()
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, msgSize)
+	}
+	msgIdxs := make([]uint32, batchSize)
+
+	for {
+		curLen, err := q.lockHeaderNotEmpty(ctx)
+		if err != nil {
+			return err
+		}
+
+		n := curLen
+		if uint64(batchSize) < uint64(n) {
+			n = uint32(batchSize)
+		}
+		n = q.seg.readyLen(n)
+		startIdx := q.seg.getStartIdx()
+		maxLen := q.seg.getMaxLen()
+		removed := q.removedCount()
+		for i := uint32(0); i < n; i++ {
+			msgIdxs[i] = (startIdx + i) % maxLen
+		}
+		if err = q.seg.lockMsgsCtx(ctx, msgIdxs[:n]); err != nil {
+			q.seg.unlockHeader()
+			return err
+		}
+		q.seg.unlockHeader()
+		for i, msgIdx := range msgIdxs[:n] {
+			q.seg.getMsgData(msgIdx, bufs[i])
+			q.seg.unlockMsg(msgIdx)
+		}
+
+		if err = handle(bufs[:n]); err != nil {
+			return err
+		}
+
+		if err = q.seg.lockHeader(); err != nil {
+			return newQueueError("consume", q.key, q.id, err)
+		}
+		if q.removedCount() != removed {
+			q.seg.unlockHeader()
+			return newQueueError("consume", q.key, q.id, ErrMessageOverwritten)
+		}
+		if q.opts.zeroOnDequeue || q.seg.isRunningChecksum() {
+			if err = q.seg.lockMsgs(msgIdxs[:n]); err != nil {
+				q.seg.unlockHeader()
+				return newQueueError("consume", q.key, q.id, err)
+			}
+			for _, msgIdx := range msgIdxs[:n] {
+				q.seg.sumDequeued(msgIdx)
+				if q.opts.zeroOnDequeue {
+					q.seg.zeroMsgData(msgIdx)
+				}
+				q.seg.unlockMsg(msgIdx)
+			}
+		}
+		q.seg.setQueueLen(q.seg.getQueueLen() - n)
+		q.seg.addDequeued(uint64(n))
+		q.seg.setStartIdx((startIdx + n) % maxLen)
+		q.seg.unlockHeader()
+	}
+}
@@ -0,0 +1,145 @@
+package shqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumeBatch(t *testing.T) {
+	t.Run("handle batches", func(t *testing.T) {
+		queue := testQueue(t, 3, 0)
+		for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC} {
+			require.True(t, queue.EnqueueTry(msg))
+		}
+
+		var got [][]byte
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		err := queue.ConsumeBatch(ctx, 2, func(msgs [][]byte) error {
+			assert.LessOrEqual(t, len(msgs), 2)
+			for _, msg := range msgs {
+				got = append(got, append([]byte(nil), msg...))
+			}
+			if len(got) == 3 {
+				cancel()
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, [][]byte{testMsgA, testMsgB, testMsgC}, got)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		assert.Equal(t, uint64(3), queue.Stats().Dequeued)
+	})
+
+	t.Run("failed batch stays in queue", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+
+		handleErr := errors.New("handle error")
+		err := queue.ConsumeBatch(context.Background(), 5, func(msgs [][]byte) error {
+			assert.Equal(t, [][]byte{testMsgA, testMsgB}, msgs)
+			return handleErr
+		})
+		assert.ErrorIs(t, err, handleErr)
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+
+		toMsg := make([]byte, 16)
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+	})
+
+	t.Run("batch taken by another consumer", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+
+		err := queue.ConsumeBatch(context.Background(), 1, func(msgs [][]byte) error {
+			require.True(t, queue.DequeueTry(make([]byte, 16)))
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrMessageOverwritten)
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+	})
+
+	t.Run("new message discarded in between", func(t *testing.T) {
+		queue := testQueue(t, 0, 5, WithOverflowPolicy(DropNewest))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		err := queue.ConsumeBatch(ctx, 1, func(msgs [][]byte) error {
+			assert.False(t, queue.EnqueueShift(testMsgA))
+			cancel()
+			return nil
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, uint32(4), queue.seg.getQueueLen())
+		assert.Equal(t, uint64(1), queue.Stats().Dequeued)
+	})
+
+	t.Run("stats reset in between", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		err := queue.ConsumeBatch(ctx, 1, func(msgs [][]byte) error {
+			queue.ResetStats()
+			cancel()
+			return nil
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+	})
+
+	t.Run("reserved head waits for commit", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		token, dst, ok := queue.Reserve()
+		require.True(t, ok)
+		copy(dst, testMsgA)
+		require.True(t, queue.EnqueueTry(testMsgB))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		calls := 0
+		err := queue.ConsumeBatch(ctx, 2, func(msgs [][]byte) error {
+			calls++
+			return nil
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Zero(t, calls)
+
+		require.NoError(t, queue.Commit(token))
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		err = queue.ConsumeBatch(ctx, 2, func(msgs [][]byte) error {
+			assert.Equal(t, [][]byte{testMsgA, testMsgB}, msgs)
+			cancel()
+			return nil
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+	})
+
+	t.Run("stop on closed queue", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithZeroOnDequeue())
+		require.True(t, queue.EnqueueTry(testMsgA))
+		queue.CloseQueue()
+
+		calls := 0
+		err := queue.ConsumeBatch(context.Background(), 4, func(msgs [][]byte) error {
+			calls++
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrQueueClosed)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, make([]byte, 16), queue.seg.msgData(0))
+	})
+}
@@ -0,0 +1,126 @@
+package shqueue
+
+import (
+	"fmt"
+)
+
+// Cursor is the position of a reader that follows the queue like a log, without dequeuing: the sequence number of the
+// next message to read, counted by the number of messages enqueued before it. Several readers keep their own cursors,
+// while producers keep enqueuing with EnqueueShift, which drops the oldest messages once the queue is full. A message
+// leaves the queue when it's dropped or dequeued, and a cursor that points before the oldest message has expired.
+// ResetStats doesn't affect the cursors, and Resize keeps them.
+type Cursor uint64
+
+// OldestCursor returns the cursor of the oldest message in the queue, or NewestCursor if it's empty.
+func (q *Queue) OldestCursor() Cursor {
+	if q.seg.lockHeader() != nil {
+		return 0
+	}
+	oldest, _ := q.cursorBounds()
+	q.seg.unlockHeader()
+	return oldest
+}
+
+// NewestCursor returns the cursor right after the newest message in the queue: the position of the next message to be
+// enqueued. A reader that starts with it only reads the messages enqueued afterwards.
+func (q *Queue) NewestCursor() Cursor {
+	if q.seg.lockHeader() != nil {
+		return 0
+	}
+	_, newest := q.cursorBounds()
+	q.seg.unlockHeader()
+	return newest
+}
+
+// ReadAt copies the message at the cursor into into, which must be of the message size, without dequeuing it, and
+// returns the cursor of the next message. If the message has already left the queue, an error wrapping
+// ErrMessageOverwritten is returned: the reader lags too far behind (see LagWindow) and may skip to OldestCursor. If
+// there's no such message yet, or it's reserved but not committed (see Reserve), an error wrapping ErrNoMessage is
+// returned.
+func (q *Queue) ReadAt(cursor Cursor, into []byte) (next Cursor, err error) {
+	q.seg.checkMsgSize(len(into))
+	if q.deletedHere() {
+		return cursor, newQueueError("read at", q.key, q.id, ErrSegmentDeleted)
+	}
+
+	if err = q.seg.lockHeader(); err != nil {
+		return cursor, newQueueError("read at", q.key, q.id, err)
+	}
+	oldest, newest := q.cursorBounds()
+	if cursor >= newest {
+		q.seg.unlockHeader()
+		err = fmt.Errorf("%w: cursor %d, newest %d", ErrNoMessage, cursor, newest)
+		return cursor, newQueueError("read at", q.key, q.id, err)
+	}
+	ready := uint32(0)
+	if cursor >= oldest {
+		ready = q.seg.readyLen(uint32(cursor-oldest) + 1)
+	}
+	// readyLen may have dropped reclaimed slots at the head, the one at the cursor among them, which moves the oldest
+	// cursor. The cursors of the other messages stay the same.
+	oldest, _ = q.cursorBounds()
+	switch {
+	case cursor < oldest:
+		err = fmt.Errorf("%w: cursor %d, oldest %d", ErrMessageOverwritten, cursor, oldest)
+	case ready <= uint32(cursor-oldest):
+		err = fmt.Errorf("%w: cursor %d isn't committed", ErrNoMessage, cursor)
+	}
+	if err != nil {
+		q.seg.unlockHeader()
+		return cursor, newQueueError("read at", q.key, q.id, err)
+	}
+
+	msgIdx := (q.seg.getStartIdx() + uint32(cursor-oldest)) % q.seg.getMaxLen()
+	if err = q.seg.lockMsg(msgIdx); err != nil {
+		q.seg.unlockHeader()
+		return cursor, newQueueError("read at", q.key, q.id, err)
+	}
+	q.seg.getMsgData(msgIdx, into)
+	q.seg.unlockMsg(msgIdx)
+	q.seg.unlockHeader()
+
+	return cursor + 1, nil
+}
+
+// Lag returns the number of messages between the cursor and the newest message, inclusive: how far behind the reader
+// is. The messages that have already left the queue count too.
+func (q *Queue) Lag(cursor Cursor) uint64 {
+	newest := q.NewestCursor()
+	if cursor >= newest {
+		return 0
+	}
+	return uint64(newest - cursor)
+}
+
+// LagWindow returns the retention headroom of the cursor: the number of messages that can still be enqueued before the
+// message at the cursor is dropped to make room, given the capacity of the queue (see Cap). It's 0 if the cursor has
+// already expired, or the next enqueue to a full queue drops its message. A reader with a small window is about to
+// lose messages and should catch up. Consumers that dequeue make messages leave the queue earlier, which the window
+// doesn't foresee.
+func (q *Queue) LagWindow(cursor Cursor) uint64 {
+	if q.seg.lockHeader() != nil {
+		return 0
+	}
+	oldest, newest := q.cursorBounds()
+	capLen := q.seg.getCap()
+	q.seg.unlockHeader()
+
+	if cursor < oldest {
+		return 0
+	}
+	if cursor > newest {
+		cursor = newest
+	}
+	lag := uint64(newest - cursor)
+	if lag >= uint64(capLen) {
+		return 0
+	}
+	return uint64(capLen) - lag
+}
+
+// cursorBounds returns the cursors of the oldest message in the queue and right after the newest one. The header must
+// be locked.
+func (q *Queue) cursorBounds() (oldest, newest Cursor) {
+	newest = Cursor(q.seg.getTailSeq())
+	return newest - Cursor(q.seg.getQueueLen()), newest
+}
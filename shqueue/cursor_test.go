@@ -0,0 +1,131 @@
+package shqueue
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	t.Run("read like a log", func(t *testing.T) {
+		queue := testQueue(t, 3, 0)
+		assert.Equal(t, Cursor(0), queue.OldestCursor())
+		assert.Equal(t, Cursor(0), queue.NewestCursor())
+
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC}))
+		into := make([]byte, 16)
+		cursor := queue.OldestCursor()
+		for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC} {
+			next, err := queue.ReadAt(cursor, into)
+			require.NoError(t, err)
+			assert.Equal(t, msg, into)
+			assert.Equal(t, cursor+1, next)
+			cursor = next
+		}
+		_, err := queue.ReadAt(cursor, into)
+		assert.ErrorIs(t, err, ErrNoMessage)
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen(), "nothing is dequeued")
+	})
+
+	t.Run("lag and expiry", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		reader := queue.NewestCursor()
+		for i := 0; i < 4; i++ {
+			require.True(t, queue.EnqueueShift(testMsgA))
+		}
+		assert.Equal(t, uint64(4), queue.Lag(reader))
+		assert.Equal(t, uint64(1), queue.LagWindow(reader))
+		assert.Equal(t, uint64(5), queue.LagWindow(queue.NewestCursor()))
+		assert.Zero(t, queue.Lag(queue.NewestCursor()))
+
+		require.True(t, queue.EnqueueShift(testMsgB))
+		assert.Zero(t, queue.LagWindow(reader))
+		_, err := queue.ReadAt(reader, make([]byte, 16))
+		assert.NoError(t, err)
+
+		require.True(t, queue.EnqueueShift(testMsgC))
+		assert.Equal(t, uint64(6), queue.Lag(reader))
+		assert.Zero(t, queue.LagWindow(reader))
+		_, err = queue.ReadAt(reader, make([]byte, 16))
+		assert.ErrorIs(t, err, ErrMessageOverwritten)
+		assert.Equal(t, reader+1, queue.OldestCursor())
+	})
+
+	t.Run("dequeue moves oldest cursor", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+
+		into := make([]byte, 16)
+		_, err := queue.ReadAt(queue.OldestCursor(), into)
+		require.NoError(t, err)
+		assert.Equal(t, testMsgB, into)
+		assert.Equal(t, Cursor(1), queue.OldestCursor())
+	})
+
+	t.Run("stats reset and resize keep cursors", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		queue.ResetStats()
+
+		into := make([]byte, 16)
+		next, err := queue.ReadAt(0, into)
+		require.NoError(t, err)
+		assert.Equal(t, testMsgA, into)
+		assert.Equal(t, Cursor(2), queue.NewestCursor())
+		assert.Equal(t, uint64(3), queue.LagWindow(0))
+
+		require.NoError(t, queue.Resize(8))
+		assert.Equal(t, Cursor(0), queue.OldestCursor())
+		next, err = queue.ReadAt(next, into)
+		require.NoError(t, err)
+		assert.Equal(t, testMsgB, into)
+		assert.Equal(t, Cursor(2), next)
+
+		dst := testQueue(t, 0, 0)
+		require.True(t, dst.EnqueueTry(testMsgC))
+		require.Equal(t, 2, TransferTry(queue, dst, 2))
+		assert.Equal(t, Cursor(2), queue.OldestCursor())
+		assert.Equal(t, Cursor(3), dst.NewestCursor())
+	})
+
+	t.Run("reserved message isn't read", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		_, _, ok := queue.Reserve()
+		require.True(t, ok)
+
+		_, err := queue.ReadAt(queue.OldestCursor(), make([]byte, 16))
+		assert.ErrorIs(t, err, ErrNoMessage)
+	})
+
+	t.Run("reclaimed message is overwritten", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		cmd := exec.Command("true")
+		require.NoError(t, cmd.Run())
+		deadPID := uint64(cmd.Process.Pid)
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		_, _, ok := queue.Reserve()
+		require.True(t, ok)
+		require.True(t, queue.EnqueueTry(testMsgB))
+		lockMsgAs(queue, 1, deadPID|msgReserved)
+		reclaimed, err := queue.Reclaim()
+		require.NoError(t, err)
+		require.Equal(t, 1, reclaimed)
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+		require.Equal(t, Cursor(1), queue.OldestCursor())
+
+		into := make([]byte, 16)
+		_, err = queue.ReadAt(1, into)
+		assert.ErrorIs(t, err, ErrMessageOverwritten)
+		assert.Equal(t, Cursor(2), queue.OldestCursor())
+
+		next, err := queue.ReadAt(2, into)
+		require.NoError(t, err)
+		assert.Equal(t, testMsgB, into)
+		assert.Equal(t, Cursor(3), next)
+	})
+}
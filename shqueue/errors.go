@@ -2,12 +2,20 @@ package shqueue
 
 import (
 	"fmt"
+	"strconv"
 
 	"golang.org/x/sys/unix"
 )
 
 var ErrInvalidMagic = fmt.Errorf("invalid magic")
+var ErrGeometryMismatch = fmt.Errorf("queue has a different geometry")
+var ErrUnaligned = fmt.Errorf("message size isn't a multiple of 8 bytes, so lock words would be unaligned")
+var ErrHeaderCorrupt = fmt.Errorf("queue header is corrupted")
+var ErrSegmentCorrupt = fmt.Errorf("segment is corrupted: slot offsets computed from its params are out of range")
+var ErrVersionMismatch = fmt.Errorf("segment has a different layout version")
+var ErrSchemaMismatch = fmt.Errorf("queue has a different schema ID")
 var ErrNoFreeKeys = fmt.Errorf("no free keys")
+var ErrInvalidKey = fmt.Errorf("invalid key")
 var ErrNotExist = fmt.Errorf("segment doesn't exist")
 var ErrNoAccess = fmt.Errorf("no access to segment")
 var ErrTooSmall = fmt.Errorf("segment exists, but it's too small to fit shqueue")
@@ -18,9 +26,54 @@ var ErrNoMem = fmt.Errorf("no memory for segment overhead / descriptor / page ta
 var ErrNoIDs = fmt.Errorf("all possible IDs are taken or system-wide memory limit exceeded")
 var ErrRemovedID = fmt.Errorf("segment ID is removed")
 var ErrInvalidAddrOrID = fmt.Errorf("invalid segment ID, unaligned or invalid addr, or can't attach segment")
+var ErrAttachAddr = fmt.Errorf("can't attach segment at the requested address")
 var ErrNotAttached = fmt.Errorf("there's no segment attached at this addr, or addr is invalid")
+var ErrInvalidID = fmt.Errorf("invalid segment ID")
+var ErrLockNotPermitted = fmt.Errorf("not permitted to lock segment in memory: " +
+	"CAP_IPC_LOCK or RLIMIT_MEMLOCK headroom is required")
+var ErrExceedsLimits = fmt.Errorf("queue doesn't fit into system limits")
+var ErrNotSupported = fmt.Errorf("not supported on this system")
+var ErrSegmentDeleted = fmt.Errorf("segment is marked for deletion")
+var ErrMessageTooLarge = fmt.Errorf("message doesn't fit into a slot")
+var ErrCorruptLength = fmt.Errorf("stored message length doesn't fit into a slot")
+var ErrLockTimeout = fmt.Errorf("timed out waiting for a lock")
+var ErrLockOwnerDead = fmt.Errorf("lock is held by a thread that no longer exists")
+var ErrInvalidDepth = fmt.Errorf("depth is greater than max length of queue")
+var ErrInvalidCap = fmt.Errorf("soft cap is greater than max length of queue")
+var ErrNoMessage = fmt.Errorf("no message at this position")
+var ErrMessageOverwritten = fmt.Errorf("message left the queue while being read")
+var ErrNoSpace = fmt.Errorf("not enough free space in queue")
+var ErrNotReserved = fmt.Errorf("slot isn't reserved by this process")
+var ErrQueueClosed = fmt.Errorf("queue is closed")
+var ErrFull = fmt.Errorf("queue is full")
+var ErrEmpty = fmt.Errorf("queue is empty")
 
-func wrapErrShmGet(err error, ipcCreat bool) error {
+// QueueError describes a failed operation on the shared memory of a queue. Err is one of the sentinel errors above,
+// or a wrapped system error, so errors.Is works for both.
+type QueueError struct {
+	Op  string // Operation, like "open shared memory".
+	Key int    // Key of the queue.
+	ID  int    // ID of the segment, or -1 if it's unknown yet.
+	Err error
+}
+
+func (e *QueueError) Error() string {
+	s := e.Op + " (key " + strconv.Itoa(e.Key)
+	if e.ID >= 0 {
+		s += ", id " + strconv.Itoa(e.ID)
+	}
+	return s + "): " + e.Err.Error()
+}
+
+func (e *QueueError) Unwrap() error {
+	return e.Err
+}
+
+func newQueueError(op string, key, id int, err error) error {
+	return &QueueError{Op: op, Key: key, ID: id, Err: err}
+}
+
+func wrapErrShmGet(err error, ipcCreat bool, key int) error {
 	var op string
 	if ipcCreat {
 		op = "create shared memory"
@@ -29,59 +82,125 @@ func wrapErrShmGet(err error, ipcCreat bool) error {
 	}
 	switch err {
 	case unix.ENOENT:
-		return fmt.Errorf("%s: %w", op, ErrNotExist)
+		return newQueueError(op, key, -1, ErrNotExist)
 	case unix.EACCES:
-		return fmt.Errorf("%s: %w", op, ErrNoAccess)
+		return newQueueError(op, key, -1, ErrNoAccess)
 	case unix.EINVAL:
 		if ipcCreat {
-			return fmt.Errorf("%s: %w", op, ErrInvalidSize)
+			return newQueueError(op, key, -1, ErrInvalidSize)
 		}
-		return fmt.Errorf("%s: %w", op, ErrTooSmall)
+		return newQueueError(op, key, -1, ErrTooSmall)
 	case unix.EEXIST:
-		return fmt.Errorf("%s: %w", op, ErrAlreadyExist)
+		return newQueueError(op, key, -1, ErrAlreadyExist)
 	case unix.ENFILE:
-		return fmt.Errorf("%s: %w", op, ErrTooManyFiles)
+		return newQueueError(op, key, -1, ErrTooManyFiles)
 	case unix.ENOMEM:
-		return fmt.Errorf("%s: %w", op, ErrNoMem)
+		return newQueueError(op, key, -1, ErrNoMem)
 	case unix.ENOSPC:
-		return fmt.Errorf("%s: %w", op, ErrNoIDs)
+		return newQueueError(op, key, -1, ErrNoIDs)
 	default:
-		return fmt.Errorf("%s: system error: %w", op, err)
+		return newQueueError(op, key, -1, fmt.Errorf("system error: %w", err))
 	}
 }
 
-func wrapErrShmAttach(err error) error {
+func wrapErrShmAttach(err error, key, id int) error {
 	op := "attach to shared memory"
 	switch err {
 	case unix.EACCES:
-		return fmt.Errorf("%s: %w", op, ErrNoAccess)
+		return newQueueError(op, key, id, ErrNoAccess)
 	case unix.EIDRM:
-		return fmt.Errorf("%s: %w", op, ErrRemovedID)
+		return newQueueError(op, key, id, ErrRemovedID)
 	case unix.EINVAL:
-		return fmt.Errorf("%s: %w", op, ErrInvalidAddrOrID)
+		return newQueueError(op, key, id, ErrInvalidAddrOrID)
 	case unix.ENOMEM:
-		return fmt.Errorf("%s: %w", op, ErrNoMem)
+		return newQueueError(op, key, id, ErrNoMem)
 	default:
-		return fmt.Errorf("%s: system error: %w", op, err)
+		return newQueueError(op, key, id, fmt.Errorf("system error: %w", err))
 	}
 }
 
-func wrapErrShmDetach(err error) error {
+func wrapErrShmDetach(err error, key, id int) error {
 	op := "detach from shared memory"
 	switch err {
 	case unix.EINVAL:
-		return fmt.Errorf("%s: %w", op, ErrNotAttached)
+		return newQueueError(op, key, id, ErrNotAttached)
 	default:
-		return fmt.Errorf("%s: system error: %w", op, err)
+		return newQueueError(op, key, id, fmt.Errorf("system error: %w", err))
 	}
 }
 
-func wrapErrShmDelete(err error) error {
+func wrapErrShmDelete(err error, key, id int) error {
 	op := "delete shared memory"
 	switch err {
 	case unix.EIDRM:
-		return fmt.Errorf("%s: %w", op, ErrRemovedID)
+		return newQueueError(op, key, id, ErrRemovedID)
+	default:
+		return newQueueError(op, key, id, fmt.Errorf("system error: %w", err))
+	}
+}
+
+func wrapErrShmStat(err error, key, id int) error {
+	op := "stat shared memory"
+	switch err {
+	case unix.EACCES:
+		return newQueueError(op, key, id, ErrNoAccess)
+	case unix.EIDRM:
+		return newQueueError(op, key, id, ErrRemovedID)
+	case unix.EINVAL:
+		return newQueueError(op, key, id, ErrInvalidID)
+	default:
+		return newQueueError(op, key, id, fmt.Errorf("system error: %w", err))
+	}
+}
+
+func wrapErrShmLock(err error, key, id int) error {
+	op := "lock shared memory"
+	switch err {
+	case unix.EPERM, unix.ENOMEM:
+		// ENOMEM means that locking would exceed RLIMIT_MEMLOCK.
+		return newQueueError(op, key, id, ErrLockNotPermitted)
+	case unix.EIDRM:
+		return newQueueError(op, key, id, ErrRemovedID)
+	case unix.EINVAL:
+		return newQueueError(op, key, id, ErrInvalidID)
+	default:
+		return newQueueError(op, key, id, fmt.Errorf("system error: %w", err))
+	}
+}
+
+func wrapErrSemGet(err error, key, id int) error {
+	op := "create semaphore"
+	switch err {
+	case unix.ENOSPC:
+		return newQueueError(op, key, id, ErrNoIDs)
+	case unix.ENOMEM:
+		return newQueueError(op, key, id, ErrNoMem)
+	case ErrNotSupported:
+		return newQueueError(op, key, id, ErrNotSupported)
+	default:
+		return newQueueError(op, key, id, fmt.Errorf("system error: %w", err))
+	}
+}
+
+func wrapErrSemWait(err error, key, id int) error {
+	op := "wait on semaphore"
+	switch err {
+	case unix.EIDRM, unix.EINVAL:
+		// The semaphore set is removed only along with the queue.
+		return newQueueError(op, key, id, ErrSegmentDeleted)
+	case unix.EACCES:
+		return newQueueError(op, key, id, ErrNoAccess)
+	default:
+		return newQueueError(op, key, id, fmt.Errorf("system error: %w", err))
+	}
+}
+
+func wrapErrSemDelete(err error, key, id int) error {
+	op := "delete semaphore"
+	switch err {
+	case unix.EPERM:
+		return newQueueError(op, key, id, ErrNoAccess)
 	default:
-		return fmt.Errorf("%s: system error: %w", op, err)
+		return newQueueError(op, key, id, fmt.Errorf("system error: %w", err))
 	}
 }
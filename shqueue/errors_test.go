@@ -0,0 +1,48 @@
+package shqueue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestQueueError(t *testing.T) {
+	t.Run("match sentinel and include key and id", func(t *testing.T) {
+		err := wrapErrShmAttach(unix.EACCES, 42, 7)
+		assert.ErrorIs(t, err, ErrNoAccess)
+		assert.EqualError(t, err, "attach to shared memory (key 42, id 7): no access to segment")
+
+		var queueErr *QueueError
+		require.True(t, errors.As(err, &queueErr))
+		assert.Equal(t, "attach to shared memory", queueErr.Op)
+		assert.Equal(t, 42, queueErr.Key)
+		assert.Equal(t, 7, queueErr.ID)
+	})
+
+	t.Run("omit unknown id", func(t *testing.T) {
+		err := wrapErrShmGet(unix.ENOENT, false, 42)
+		assert.ErrorIs(t, err, ErrNotExist)
+		assert.EqualError(t, err, "open shared memory (key 42): segment doesn't exist")
+	})
+
+	t.Run("wrap system error", func(t *testing.T) {
+		err := wrapErrShmDelete(unix.EPERM, 42, 7)
+		assert.ErrorIs(t, err, unix.EPERM)
+		assert.EqualError(t, err, "delete shared memory (key 42, id 7): system error: operation not permitted")
+	})
+
+	t.Run("open non-existing", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		_, err = Open(key)
+		assert.ErrorIs(t, err, ErrNotExist)
+
+		var queueErr *QueueError
+		require.True(t, errors.As(err, &queueErr))
+		assert.Equal(t, key, queueErr.Key)
+	})
+}
@@ -0,0 +1,175 @@
+package shqueue
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// eventFDs are the eventfds of a queue in this process (see WithEventFD), each kept signaled exactly while its
+// condition holds. They're synced under the header lock only (see docs/eventfd.md).
+type eventFDs struct {
+	readable    int  // Signaled while the queue has messages or is closed.
+	writable    int  // Signaled while the queue has free space or is closed.
+	readableSet bool // readable is signaled.
+	writableSet bool // writable is signaled.
+
+	// mu guards the flags above. The syncs are ordered by the header lock already, but it's a word in shared memory,
+	// which doesn't order the goroutines of this process for the Go memory model.
+	mu sync.Mutex
+
+	stop chan struct{} // Closed to stop the watcher. nil if there's no watcher.
+	done chan struct{} // Closed by the watcher when it returns.
+}
+
+// newEventFDs creates the eventfds of a queue. Both are unsignaled until the first sync.
+func newEventFDs() (*eventFDs, error) {
+	readable, err := createEventFD()
+	if err != nil {
+		return nil, err
+	}
+	writable, err := createEventFD()
+	if err != nil {
+		_ = closeEventFD(readable)
+		return nil, err
+	}
+	return &eventFDs{readable: readable, writable: writable}, nil
+}
+
+// sync signals or drains the eventfds to match the queue of the given length and capacity. Errors mean that the
+// application closed the fds, so they're ignored.
+func (e *eventFDs) sync(curLen, capLen uint32, closed bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.readableSet = syncEventFD(e.readable, e.readableSet, curLen > 0 || closed)
+	e.writableSet = syncEventFD(e.writable, e.writableSet, curLen < capLen || closed)
+}
+
+// syncEventFD signals or drains the eventfd, if its state differs from the wanted one, and returns the new state.
+func syncEventFD(fd int, set, want bool) bool {
+	switch {
+	case want && !set:
+		_ = signalEventFD(fd)
+	case !want && set:
+		_ = drainEventFD(fd)
+	}
+	return want
+}
+
+// close closes the eventfds.
+func (e *eventFDs) close() {
+	_ = closeEventFD(e.readable)
+	_ = closeEventFD(e.writable)
+}
+
+// ReadableFD returns the eventfd that is readable while the queue has messages or is closed, or -1 if the queue is
+// opened without WithEventFD. Poll it, but don't read from it: its counter is managed by the queue.
+func (q *Queue) ReadableFD() int {
+	if q.seg.events == nil {
+		return -1
+	}
+	return q.seg.events.readable
+}
+
+// WritableFD returns the eventfd that is readable while the queue has free space or is closed, or -1 if the queue is
+// opened without WithEventFD. Poll it, but don't read from it: its counter is managed by the queue.
+func (q *Queue) WritableFD() int {
+	if q.seg.events == nil {
+		return -1
+	}
+	return q.seg.events.writable
+}
+
+// setupEventFDs creates the eventfds of the queue and syncs them with its current state.
+func (q *Queue) setupEventFDs() error {
+	events, err := newEventFDs()
+	if err != nil {
+		return newQueueError("create eventfd", q.key, q.id, err)
+	}
+	q.seg.events = events
+	if err = q.seg.watchEvents(); err != nil {
+		q.seg.events = nil
+		events.close()
+		return newQueueError("create eventfd", q.key, q.id, err)
+	}
+	return nil
+}
+
+// moveEventFDs moves the eventfds of this process from the segment from to the segment to, closing the ones of to,
+// and syncs them with the state of the latter.
+func moveEventFDs(from, to *segment) {
+	if from.events == nil {
+		return
+	}
+	from.stopWatchingEvents()
+	if to.events != nil {
+		to.stopWatchingEvents()
+		to.events.close()
+	}
+	to.events, from.events = from.events, nil
+	_ = to.watchEvents()
+}
+
+// notifyEvents wakes up the watchers of the eventfds of all processes, if there are any, after a change of the queue
+// length, soft cap or closed flag. It must be called under the header lock.
+func (s *segment) notifyEvents() {
+	if atomic.LoadUint32(s.eventWatchers()) == 0 {
+		return
+	}
+	atomic.AddUint32(s.eventSeq(), 1)
+	_ = futexWake(s.eventSeq())
+}
+
+// watchEvents syncs the eventfds of the segment and starts the goroutine that syncs them again on every change made
+// by any process, until stopWatchingEvents.
+func (s *segment) watchEvents() error {
+	// Registered before the sync, so every change made after it bumps the sequence the watcher waits on.
+	atomic.AddUint32(s.eventWatchers(), 1)
+	if err := s.lockHeader(); err != nil {
+		atomic.AddUint32(s.eventWatchers(), ^uint32(0))
+		return err
+	}
+	s.syncEvents()
+	seq := atomic.LoadUint32(s.eventSeq())
+	s.unlockHeader()
+
+	events := s.events
+	events.stop, events.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(events.done)
+		for {
+			_ = futexWait(s.eventSeq(), seq)
+			select {
+			case <-events.stop:
+				return
+			default:
+				// Go on.
+			}
+			if s.lockHeader() != nil {
+				// The header is corrupted: the calls of all processes fail until it's repaired, so there's nothing
+				// to sync. Wait for the next change.
+				seq = atomic.LoadUint32(s.eventSeq())
+				continue
+			}
+			s.syncEvents()
+			seq = atomic.LoadUint32(s.eventSeq())
+			s.unlockHeader()
+		}
+	}()
+	return nil
+}
+
+// stopWatchingEvents stops the watcher started by watchEvents, if any, and waits for it to return, so the eventfds can
+// be closed and the segment detached.
+func (s *segment) stopWatchingEvents() {
+	events := s.events
+	if events.stop == nil {
+		return
+	}
+	close(events.stop)
+	// Bumped before the wakeup, so the watcher can't fall asleep on the sequence again.
+	atomic.AddUint32(s.eventSeq(), 1)
+	_ = futexWake(s.eventSeq())
+	<-events.done
+	events.stop, events.done = nil, nil
+	atomic.AddUint32(s.eventWatchers(), ^uint32(0))
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package shqueue
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func createEventFD() (int, error) {
+	return unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+}
+
+func closeEventFD(fd int) error {
+	return unix.Close(fd)
+}
+
+// signalEventFD makes the eventfd readable by adding 1 to its counter.
+func signalEventFD(fd int) error {
+	// The counter is written in the native byte order.
+	var buf [8]byte
+	*(*uint64)(unsafe.Pointer(&buf[0])) = 1
+	_, err := unix.Write(fd, buf[:])
+	return err
+}
+
+// drainEventFD makes the eventfd unreadable by resetting its counter to 0. Reading an unsignaled eventfd fails with
+// EAGAIN, which is fine.
+func drainEventFD(fd int) error {
+	var buf [8]byte
+	_, err := unix.Read(fd, buf[:])
+	if err == unix.EAGAIN {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package shqueue
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestEventFD(t *testing.T) {
+	// ready reports whether the fd is readable right now.
+	ready := func(t *testing.T, fd int) bool {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 0)
+		require.NoError(t, err)
+		return n == 1
+	}
+
+	t.Run("off by default", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		assert.Equal(t, -1, queue.ReadableFD())
+		assert.Equal(t, -1, queue.WritableFD())
+	})
+
+	t.Run("follow queue length", func(t *testing.T) {
+		queue := testQueue(t, 3, 0, WithEventFD())
+		readable, writable := queue.ReadableFD(), queue.WritableFD()
+		require.NotEqual(t, -1, readable)
+		require.NotEqual(t, -1, writable)
+		assert.False(t, ready(t, readable))
+		assert.True(t, ready(t, writable))
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		assert.True(t, ready(t, readable))
+		assert.True(t, ready(t, writable))
+
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgB, testMsgC, testMsgA, testMsgB}))
+		assert.True(t, ready(t, readable))
+		assert.False(t, ready(t, writable))
+
+		toMsg := make([]byte, 16)
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.True(t, ready(t, writable))
+		assert.Equal(t, uint32(4), queue.DequeueSkip(4))
+		assert.False(t, ready(t, readable))
+		assert.True(t, ready(t, writable))
+
+		require.NoError(t, queue.SetSoftCap(0))
+		assert.False(t, ready(t, writable))
+	})
+
+	t.Run("follow other processes", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithEventFD())
+		other, err := AttachByID(queue.ExportID())
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, other.Close()) }()
+
+		require.True(t, other.EnqueueTry(testMsgA))
+		assert.Eventually(t, func() bool { return ready(t, queue.ReadableFD()) }, time.Second, time.Millisecond)
+
+		require.True(t, other.DequeueTry(make([]byte, 16)))
+		assert.Eventually(t, func() bool { return !ready(t, queue.ReadableFD()) }, time.Second, time.Millisecond)
+
+		other.CloseQueue()
+		assert.Eventually(t, func() bool { return ready(t, queue.ReadableFD()) }, time.Second, time.Millisecond)
+	})
+
+	t.Run("stop following on close", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithEventFD())
+		assert.Equal(t, uint32(1), atomic.LoadUint32(queue.seg.eventWatchers()))
+		other, err := AttachByID(queue.ExportID(), WithEventFD())
+		require.NoError(t, err)
+		assert.Equal(t, uint32(2), atomic.LoadUint32(queue.seg.eventWatchers()))
+
+		require.NoError(t, other.Close())
+		assert.Equal(t, uint32(1), atomic.LoadUint32(queue.seg.eventWatchers()))
+		require.True(t, queue.EnqueueTry(testMsgA))
+		assert.True(t, ready(t, queue.ReadableFD()))
+	})
+
+	t.Run("closed queue", func(t *testing.T) {
+		queue := testQueue(t, 0, 5, WithEventFD())
+		require.Equal(t, uint32(5), queue.DequeueSkip(5))
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgA, testMsgA, testMsgA, testMsgA}))
+		assert.False(t, ready(t, queue.WritableFD()))
+
+		queue.CloseQueue()
+		assert.True(t, ready(t, queue.WritableFD()))
+		assert.Equal(t, ErrQueueClosed, queue.EnqueueTryErr(testMsgB))
+		assert.Equal(t, uint32(5), queue.DequeueSkip(5))
+		assert.True(t, ready(t, queue.ReadableFD()))
+		assert.Equal(t, ErrQueueClosed, queue.DequeueTryErr(make([]byte, 16)))
+	})
+
+	t.Run("kept by resize", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithEventFD())
+		readable := queue.ReadableFD()
+		require.True(t, queue.EnqueueTry(testMsgA))
+
+		require.NoError(t, queue.Resize(8))
+		assert.Equal(t, readable, queue.ReadableFD())
+		assert.True(t, ready(t, readable))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+		assert.False(t, ready(t, readable))
+	})
+
+	t.Run("closed by close", func(t *testing.T) {
+		queue, err := CreatePrivate(2, 5, WithEventFD())
+		require.NoError(t, err)
+		readable := queue.ReadableFD()
+
+		require.NoError(t, queue.Close())
+		require.NoError(t, queue.Delete())
+		assert.Equal(t, -1, queue.ReadableFD())
+		_, err = unix.FcntlInt(uintptr(readable), unix.F_GETFD, 0)
+		assert.ErrorIs(t, err, unix.EBADF)
+	})
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package shqueue
+
+// Eventfds are only supported on Linux. Elsewhere they can't be created, so no queue has them.
+
+func createEventFD() (int, error) {
+	return -1, ErrNotSupported
+}
+
+func closeEventFD(fd int) error {
+	return ErrNotSupported
+}
+
+func signalEventFD(fd int) error {
+	return ErrNotSupported
+}
+
+func drainEventFD(fd int) error {
+	return ErrNotSupported
+}
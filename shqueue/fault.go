@@ -0,0 +1,21 @@
+package shqueue
+
+// faultPoint identifies a place in an operation where a fault can be injected to test the recovery code paths. The
+// injection itself exists only in builds with the shqueue_faultinject tag (see fault_inject.go). In other builds,
+// segment.fault is an empty function, which the compiler inlines away.
+type faultPoint int
+
+const (
+	// faultEnqueueWrite is between the update of the header and the write of the message data in EnqueueTry: the
+	// header and message locks are held, and the slot holds stale data.
+	faultEnqueueWrite faultPoint = iota
+	// faultDequeueRead is between the update of the header and the read of the message data in DequeueTry: the
+	// message lock is held.
+	faultDequeueRead
+	// faultTransferPrepare is between the records of the destination and the source in TransferTry: the messages are
+	// copied into dst, but the transfer isn't committed yet. Both header locks are held.
+	faultTransferPrepare
+	// faultTransferCommit is right after the commit of TransferTry, before the headers are updated. Both header locks
+	// are held.
+	faultTransferCommit
+)
@@ -0,0 +1,64 @@
+//go:build shqueue_faultinject
+
+package shqueue
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// errSimulatedCrash is the panic value of a crash simulated by crashAs.
+var errSimulatedCrash = fmt.Errorf("simulated crash")
+
+// faults are the actions injected at fault points. They're global, so tests injecting faults must not run in parallel.
+var faults struct {
+	mu      sync.Mutex
+	actions map[faultPoint]func(s *segment)
+}
+
+// injectFault makes action run every time an operation reaches the point, until remove is called.
+func injectFault(point faultPoint, action func(s *segment)) (remove func()) {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	if faults.actions == nil {
+		faults.actions = map[faultPoint]func(s *segment){}
+	}
+	faults.actions[point] = action
+	return func() {
+		faults.mu.Lock()
+		defer faults.mu.Unlock()
+		delete(faults.actions, point)
+	}
+}
+
+func (s *segment) fault(point faultPoint) {
+	faults.mu.Lock()
+	action := faults.actions[point]
+	faults.mu.Unlock()
+	if action != nil {
+		action(s)
+	}
+}
+
+// crashAs returns an action that simulates a crash of the process: all the locks of the segment held by this process
+// are handed over to owner, which should be the PID of a dead process, and the operation is aborted with a panic of
+// errSimulatedCrash. The locks stay held, like after a real crash, so the recovery code can be tested without killing
+// processes.
+func crashAs(owner uint64) func(s *segment) {
+	return func(s *segment) {
+		handOverLocks(s, owner)
+		panic(errSimulatedCrash)
+	}
+}
+
+// handOverLocks hands the locks of the segment held by this process over to owner, like crashAs does. It's for the
+// other segments an operation holds locks of, like the other queue of a transfer.
+func handOverLocks(s *segment, owner uint64) {
+	headerLock := (*uint64)(unsafe.Pointer(&s.mem[startHeaderLock]))
+	atomic.CompareAndSwapUint64(headerLock, lockOwner, owner)
+	for idx := uint32(0); idx < s.getMaxLen(); idx++ {
+		atomic.CompareAndSwapUint64(s.msgLockPtr(idx), lockOwner, owner)
+	}
+}
@@ -0,0 +1,174 @@
+//go:build shqueue_faultinject
+
+package shqueue
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjection(t *testing.T) {
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	deadPID := uint64(cmd.Process.Pid)
+
+	crash := func(t *testing.T, op func()) {
+		defer func() {
+			assert.Equal(t, errSimulatedCrash, recover())
+		}()
+		op()
+	}
+
+	t.Run("crash in enqueue", func(t *testing.T) {
+		queue := testQueue(t, 0, 1)
+		remove := injectFault(faultEnqueueWrite, crashAs(deadPID))
+		crash(t, func() { queue.EnqueueTry(testMsgB) })
+		remove()
+
+		headerPID, msgPIDs := queue.LockOwners()
+		assert.Equal(t, int(deadPID), headerPID)
+		assert.Equal(t, map[uint32]int{1: int(deadPID)}, msgPIDs)
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+
+		repaired, err := queue.RepairLocks()
+		require.NoError(t, err)
+		assert.Equal(t, 2, repaired)
+
+		// The slot was never written, so the message is torn: it holds stale data.
+		toMsg := make([]byte, 16)
+		require.True(t, queue.DequeueTry(toMsg))
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.NotEqual(t, testMsgB, toMsg)
+	})
+
+	t.Run("crash in dequeue", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+		remove := injectFault(faultDequeueRead, crashAs(deadPID))
+		crash(t, func() { queue.DequeueTry(make([]byte, 16)) })
+		remove()
+
+		headerPID, msgPIDs := queue.LockOwners()
+		assert.Zero(t, headerPID)
+		assert.Equal(t, map[uint32]int{0: int(deadPID)}, msgPIDs)
+
+		repaired, err := queue.RepairLocks()
+		require.NoError(t, err)
+		assert.Equal(t, 1, repaired)
+
+		toMsg := make([]byte, 16)
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.Equal(t, testMsgB, toMsg)
+	})
+
+	// crashTransfer crashes a transfer of two messages at the point, with both header locks held by the dead process.
+	crashTransfer := func(t *testing.T, point faultPoint, src, dst *Queue) {
+		require.True(t, src.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		remove := injectFault(point, func(s *segment) {
+			handOverLocks(dst.seg, deadPID)
+			crashAs(deadPID)(s)
+		})
+		crash(t, func() { TransferTry(src, dst, 2) })
+		remove()
+
+		srcPID, _ := src.LockOwners()
+		dstPID, _ := dst.LockOwners()
+		assert.Equal(t, int(deadPID), srcPID)
+		assert.Equal(t, int(deadPID), dstPID)
+	}
+
+	// drain dequeues all the messages of the queue.
+	drain := func(t *testing.T, queue *Queue) [][]byte {
+		var msgs [][]byte
+		for {
+			msg := make([]byte, 16)
+			if !queue.DequeueTry(msg) {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	t.Run("crash in transfer before commit", func(t *testing.T) {
+		for _, first := range []string{"src", "dst"} {
+			t.Run("repair "+first, func(t *testing.T) {
+				src, dst := testQueue(t, 4, 0), testQueue(t, 3, 1)
+				crashTransfer(t, faultTransferPrepare, src, dst)
+				repairFirst, repairSecond := src, dst
+				if first == "dst" {
+					repairFirst, repairSecond = dst, src
+				}
+				repaired, err := repairFirst.RepairLocks()
+				require.NoError(t, err)
+				assert.Equal(t, 1, repaired)
+				repaired, err = repairSecond.RepairLocks()
+				require.NoError(t, err)
+				assert.Equal(t, 1, repaired)
+
+				// The transfer is rolled back: the messages stay in src only.
+				assert.Equal(t, [][]byte{testMsgA, testMsgB}, drain(t, src))
+				assert.Len(t, drain(t, dst), 1)
+				assert.Zero(t, dst.Stats().Enqueued)
+			})
+		}
+	})
+
+	t.Run("crash in transfer after commit", func(t *testing.T) {
+		for _, first := range []string{"src", "dst"} {
+			t.Run("repair "+first, func(t *testing.T) {
+				src, dst := testQueue(t, 4, 0), testQueue(t, 3, 1)
+				crashTransfer(t, faultTransferCommit, src, dst)
+				repairFirst, repairSecond := src, dst
+				if first == "dst" {
+					repairFirst, repairSecond = dst, src
+				}
+				// The first repair takes over both header locks, and finishes the transfer in both queues.
+				repaired, err := repairFirst.RepairLocks()
+				require.NoError(t, err)
+				assert.Equal(t, 1, repaired)
+				repaired, err = repairSecond.RepairLocks()
+				require.NoError(t, err)
+				assert.Zero(t, repaired)
+
+				// The transfer is rolled forward: the messages are in dst only.
+				assert.Empty(t, drain(t, src))
+				msgs := drain(t, dst)
+				require.Len(t, msgs, 3)
+				assert.Equal(t, [][]byte{testMsgA, testMsgB}, msgs[1:])
+				assert.Equal(t, uint64(2), src.Stats().Dequeued)
+				assert.Equal(t, uint64(2), dst.Stats().Enqueued)
+			})
+		}
+	})
+
+	t.Run("crash in transfer between channels", func(t *testing.T) {
+		mq := testMultiQueue(t, 2)
+		src, dst := mq.Channel(1), mq.Channel(0)
+		crashTransfer(t, faultTransferCommit, src, dst)
+
+		repaired, err := dst.RepairLocks()
+		require.NoError(t, err)
+		assert.Equal(t, 1, repaired)
+		assert.Empty(t, drain(t, src))
+		assert.Equal(t, [][]byte{testMsgA, testMsgB}, drain(t, dst))
+	})
+
+	t.Run("crash in transfer from deleted queue", func(t *testing.T) {
+		src, err := CreatePrivate(2, 5)
+		require.NoError(t, err)
+		dst := testQueue(t, 3, 1)
+		crashTransfer(t, faultTransferCommit, src, dst)
+		require.NoError(t, src.Delete())
+		require.NoError(t, src.Close())
+
+		// The source is gone, so the messages are kept in dst.
+		repaired, err := dst.RepairLocks()
+		require.NoError(t, err)
+		assert.Equal(t, 1, repaired)
+		assert.Len(t, drain(t, dst), 3)
+	})
+}
@@ -0,0 +1,6 @@
+//go:build !shqueue_faultinject
+
+package shqueue
+
+// fault does nothing in production builds.
+func (s *segment) fault(faultPoint) {}
@@ -0,0 +1,26 @@
+package shqueue
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// Fingerprint returns a stable 64-bit hash of the identity and layout of the queue: the magic, the layout version, the
+// schema ID, the message and metadata sizes, the max length and the byte order. Cooperating processes can exchange
+// fingerprints out of band to confirm that they talk about compatible queues before exchanging data. The fingerprint
+// doesn't depend on the key, the segment ID or the contents of the queue, so compatible queues have equal
+// fingerprints.
+func (q *Queue) Fingerprint() uint64 {
+	var buf [8 + 6*4]byte
+	copy(buf[:8], q.seg.mem[startMagic:endMagic])
+	binary.LittleEndian.PutUint32(buf[8:12], layoutVersion)
+	binary.LittleEndian.PutUint32(buf[12:16], q.seg.getSchemaID())
+	binary.LittleEndian.PutUint32(buf[16:20], q.seg.getDataSize())
+	binary.LittleEndian.PutUint32(buf[20:24], q.seg.getMaxLen())
+	copy(buf[24:28], q.seg.mem[startByteOrder:endByteOrder])
+	binary.LittleEndian.PutUint32(buf[28:32], q.seg.getMetaSize())
+
+	h := fnv.New64a()
+	_, _ = h.Write(buf[:])
+	return h.Sum64()
+}
@@ -0,0 +1,36 @@
+package shqueue
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := func(t *testing.T, msgSize, maxLen uint32, opts ...Option) uint64 {
+		queue, err := CreatePrivate(msgSize, maxLen, opts...)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+		return queue.Fingerprint()
+	}
+
+	t.Run("equal for compatible queues", func(t *testing.T) {
+		queue := testQueue(t, 3, 2)
+		assert.Equal(t, fingerprint(t, 2, 5), queue.Fingerprint())
+	})
+
+	t.Run("differ for incompatible queues", func(t *testing.T) {
+		base := fingerprint(t, 2, 5)
+		assert.NotEqual(t, base, fingerprint(t, 3, 5))
+		assert.NotEqual(t, base, fingerprint(t, 2, 6))
+		assert.NotEqual(t, base, fingerprint(t, 2, 5, WithSchemaID(7)))
+		assert.NotEqual(t, base, fingerprint(t, 2, 5, WithMetadataSize(8)))
+		assert.NotEqual(t, fingerprint(t, 2, 5, WithByteOrder(binary.BigEndian)),
+			fingerprint(t, 2, 5, WithByteOrder(binary.LittleEndian)))
+	})
+}
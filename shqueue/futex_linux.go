@@ -0,0 +1,73 @@
+//go:build linux
+
+package shqueue
+
+import (
+	"math"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// futexWaitOp, futexWakeOp, futexLockPI and futexUnlockPI are the FUTEX_WAIT, FUTEX_WAKE, FUTEX_LOCK_PI and
+	// FUTEX_UNLOCK_PI operations of futex, missing in x/sys/unix. The words are shared between processes, so
+	// FUTEX_PRIVATE_FLAG isn't used.
+	futexWaitOp   = 0
+	futexWakeOp   = 1
+	futexLockPI   = 6
+	futexUnlockPI = 7
+)
+
+// lockPISupported reports whether the header lock can be a priority-inheriting futex (see WithPriorityInheritance).
+const lockPISupported = true
+
+func gettid() uint32 {
+	return uint32(unix.Gettid())
+}
+
+// futexLock waits until the priority-inheriting futex word is free and takes it for this thread. The deadline is
+// absolute by CLOCK_REALTIME, as FUTEX_LOCK_PI expects; zero means no deadline.
+func futexLock(word *uint32, deadline time.Time) error {
+	var timeout *unix.Timespec
+	if !deadline.IsZero() {
+		ts := unix.NsecToTimespec(deadline.UnixNano())
+		timeout = &ts
+	}
+	_, _, errno := unix.Syscall6(
+		unix.SYS_FUTEX, uintptr(unsafe.Pointer(word)), futexLockPI, 0, uintptr(unsafe.Pointer(timeout)), 0, 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// futexWait sleeps until the futex word is woken up with futexWake, if it still holds val. It returns right away if
+// the word holds another value already. Spurious wakeups are possible, so the callers check the word again.
+func futexWait(word *uint32, val uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(word)), futexWaitOp, uintptr(val), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// futexWake wakes up all the threads of all processes sleeping on the futex word in futexWait.
+func futexWake(word *uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(word)), futexWakeOp, math.MaxInt32, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// futexUnlock releases the priority-inheriting futex word held by this thread and wakes up the top waiter.
+func futexUnlock(word *uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(word)), futexUnlockPI, 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
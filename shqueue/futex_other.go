@@ -0,0 +1,33 @@
+//go:build !linux
+
+package shqueue
+
+import (
+	"time"
+)
+
+// Priority-inheriting futexes are only supported on Linux. Elsewhere WithPriorityInheritance is ignored, and queues
+// created with it on Linux can't be opened, so these are never called. The plain futexes only wake up the watchers of
+// eventfds (see WithEventFD), which aren't supported either.
+
+const lockPISupported = false
+
+func gettid() uint32 {
+	return 0
+}
+
+func futexWait(word *uint32, val uint32) error {
+	return ErrNotSupported
+}
+
+func futexWake(word *uint32) error {
+	return ErrNotSupported
+}
+
+func futexLock(word *uint32, deadline time.Time) error {
+	return ErrNotSupported
+}
+
+func futexUnlock(word *uint32) error {
+	return ErrNotSupported
+}
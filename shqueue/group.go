@@ -0,0 +1,226 @@
+package shqueue
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The layout of the segment of a group (see docs/memory_layout.md). The fields are in the native byte order: the cap
+// and the length are accessed atomically.
+const (
+	startGroupMagic   = 0
+	endGroupMagic     = 8
+	startGroupVersion = 8
+	endGroupVersion   = 12
+	startGroupCap     = 12
+	endGroupCap       = 16
+	startGroupLen     = 16
+	endGroupLen       = 20
+	groupSize         = 24
+)
+
+var groupMagic = [8]byte{0x57, 0x6f, 0x72, 0x6b, 0x20, 0x66, 0x6f, 0x72}
+
+// Group bounds the total number of messages in several queues, e.g. to cap the memory held by the per-tenant queues of
+// a service as a whole, while each of them may take most of it. Queues join the group on creation (see WithGroup), and
+// the group is stored in their params, so every process that opens them follows it. Once the total reaches the cap of
+// the group, the member queues are full for producers, whatever their own length: EnqueueTry rejects, EnqueueBlock
+// waits, and EnqueueShift drops a message according to the overflow policy, like with any full queue.
+//
+// The total is a counter in a small companion segment of the group, updated atomically by every member on every change
+// of its length. That's the coordination cost of a group: the members, which otherwise share no memory, contend on
+// the cache line of the counter, and a blocked producer isn't woken up by a dequeue from another member, so it finds
+// out by polling (see WithSemaphore and WithEventFD). The cap is checked, not reserved, so concurrent enqueues to
+// different members may overshoot it by up to one call per member.
+type Group struct {
+	key int
+	id  int
+	mem []byte
+}
+
+// CreateGroup creates a new group of queues with the given key, which holds at most capLen messages in total. key may
+// be IPC_PRIVATE. If a segment with the key already exists, an error wrapping ErrAlreadyExist is returned: resetting
+// the group under the feet of its members would lose their count, so open it with OpenGroup instead. Only WithAccess
+// of the options applies.
+func CreateGroup(key int, capLen uint32, opts ...Option) (*Group, error) {
+	o := newOptions(opts)
+	flags := o.access | unix.IPC_CREAT
+	if key != unix.IPC_PRIVATE {
+		flags |= unix.IPC_EXCL
+	}
+	id, err := unix.SysvShmGet(key, groupSize, flags)
+	if err != nil {
+		return nil, wrapErrShmGet(err, true, key)
+	}
+	mem, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		_, _ = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+		return nil, wrapErrShmAttach(err, key, id)
+	}
+
+	g := &Group{key: key, id: id, mem: mem}
+	atomic.StoreUint32(g.word(startGroupVersion), layoutVersion)
+	g.SetCap(capLen)
+	copy(mem[startGroupMagic:endGroupMagic], groupMagic[:])
+	return g, nil
+}
+
+// OpenGroup opens the existing group of queues with the given key.
+func OpenGroup(key int, opts ...Option) (*Group, error) {
+	o := newOptions(opts)
+	id, err := unix.SysvShmGet(key, groupSize, o.access)
+	if err != nil {
+		return nil, wrapErrShmGet(err, false, key)
+	}
+	return attachGroup(key, id)
+}
+
+// attachGroup attaches the segment of the group and validates it.
+func attachGroup(key, id int) (*Group, error) {
+	mem, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		return nil, wrapErrShmAttach(err, key, id)
+	}
+	g := &Group{key: key, id: id, mem: mem}
+	switch {
+	case len(mem) < groupSize:
+		err = ErrTooSmall
+	case string(mem[startGroupMagic:endGroupMagic]) != string(groupMagic[:]):
+		err = ErrInvalidMagic
+	case atomic.LoadUint32(g.word(startGroupVersion)) != layoutVersion:
+		err = ErrVersionMismatch
+	}
+	if err != nil {
+		_ = unix.SysvShmDetach(mem)
+		return nil, newQueueError("open group", key, id, err)
+	}
+	return g, nil
+}
+
+// WithGroup makes Create put the queue into the group, so its messages count toward the cap of the group. The queue
+// stays in the group until it's deleted, and the processes that open it attach the group too; if they can't, Open
+// fails. Delete takes the messages left in the queue out of the group, unless its header is stuck, and the processes
+// that keep using the deleted queue stop counting toward the cap. Open ignores this option.
+func WithGroup(g *Group) Option {
+	return func(o *options) {
+		o.group = g
+	}
+}
+
+// Len returns the total number of messages in the member queues.
+func (g *Group) Len() uint32 {
+	return atomic.LoadUint32(g.word(startGroupLen))
+}
+
+// Cap returns the max total number of messages in the member queues.
+func (g *Group) Cap() uint32 {
+	return atomic.LoadUint32(g.word(startGroupCap))
+}
+
+// SetCap changes the max total number of messages in the member queues, for all processes. Messages that are already
+// in the queues are kept, even if there are more than n of them.
+func (g *Group) SetCap(n uint32) {
+	atomic.StoreUint32(g.word(startGroupCap), n)
+}
+
+// ExportID returns the ID of the segment of the group.
+func (g *Group) ExportID() int {
+	return g.id
+}
+
+// Close detaches the group. The member queues aren't affected: each of them keeps its own attachment.
+func (g *Group) Close() error {
+	if err := unix.SysvShmDetach(g.mem); err != nil {
+		return wrapErrShmDetach(err, g.key, g.id)
+	}
+	return nil
+}
+
+// Delete deletes the group from the system once all the processes detach it. Each open member queue keeps the group
+// attached, so delete it after its queues.
+func (g *Group) Delete() error {
+	if _, err := unix.SysvShmCtl(g.id, unix.IPC_RMID, nil); err != nil {
+		return wrapErrShmDelete(err, g.key, g.id)
+	}
+	return nil
+}
+
+// word returns the field of the group segment at the offset for atomic access.
+func (g *Group) word(offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&g.mem[offset]))
+}
+
+// addLen adds delta, which may be negative in two's complement, to the total length.
+func (g *Group) addLen(delta uint32) {
+	if delta != 0 {
+		atomic.AddUint32(g.word(startGroupLen), delta)
+	}
+}
+
+// free returns the number of messages that may be enqueued to the member queues before the group is full.
+func (g *Group) free() uint32 {
+	capLen, curLen := g.Cap(), g.Len()
+	if curLen >= capLen {
+		return 0
+	}
+	return capLen - curLen
+}
+
+// setupGroup attaches the group of the queue in this process, if the queue is in one. The error of a group that can't
+// be attached, e.g. because it's deleted, is returned: the queue would overfill the group otherwise.
+func (q *Queue) setupGroup() error {
+	id := q.seg.getGroupID()
+	if id < 0 {
+		return nil
+	}
+	g, err := attachGroup(unix.IPC_PRIVATE, id)
+	if err != nil {
+		return err
+	}
+	q.seg.group = g
+	return nil
+}
+
+// closeGroup detaches the group of the queue in this process, if any.
+func (q *Queue) closeGroup() {
+	if q.seg.group != nil {
+		_ = q.seg.group.Close()
+		q.seg.group = nil
+	}
+}
+
+// leaveGroup subtracts the messages of the queue in the segment from the total of its group, if any, before the segment
+// is reset or deleted, and takes the queue out of the group, so the processes that keep using it stop counting its
+// messages. The header must be locked, unless the segment is reset.
+func leaveGroup(seg *segment) {
+	id := seg.getGroupID()
+	if id < 0 {
+		return
+	}
+	seg.setGroupID(-1)
+	g, err := attachGroup(unix.IPC_PRIVATE, id)
+	if err != nil {
+		return
+	}
+	g.addLen(-seg.getQueueLen())
+	_ = g.Close()
+}
+
+// leaveGroupOnDelete takes the queue out of its group, if any, before Delete. The segment is attached anew, since
+// Delete may be called after Close. A queue whose header lock can't be taken, e.g. because it's stuck (see
+// RepairLocks), stays in the group, since Delete mustn't block. Resize deletes the segment without it, since the
+// messages move to a new member queue.
+func (q *Queue) leaveGroupOnDelete() {
+	seg, detach, err := attachTransferPeer(q.transferPeer())
+	if err != nil {
+		return
+	}
+	defer detach()
+	if seg.getGroupID() < 0 || !seg.tryLockHeader(leaveGroupLockTimeout) {
+		return
+	}
+	leaveGroup(seg)
+	seg.unlockHeader()
+}
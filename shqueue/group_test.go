@@ -0,0 +1,186 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestGroup(t *testing.T) {
+	// testGroup creates a private group that is deleted when the test completes.
+	testGroup := func(t *testing.T, capLen uint32) *Group {
+		group, err := CreateGroup(unix.IPC_PRIVATE, capLen)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			assert.NoError(t, group.Close())
+			assert.NoError(t, group.Delete())
+		})
+		return group
+	}
+
+	t.Run("enforce total cap", func(t *testing.T) {
+		group := testGroup(t, 3)
+		queueA := testQueue(t, 0, 0, WithGroup(group))
+		queueB := testQueue(t, 3, 1, WithGroup(group))
+		assert.Equal(t, uint32(1), group.Len())
+		assert.Equal(t, uint32(3), group.Cap())
+
+		require.True(t, queueA.EnqueueTry(testMsgA))
+		require.True(t, queueA.EnqueueTry(testMsgB))
+		assert.Equal(t, uint32(3), group.Len())
+		assert.Equal(t, ErrFull, queueA.EnqueueTryErr(testMsgC))
+		assert.Equal(t, ErrFull, queueB.EnqueueTryErr(testMsgC))
+		assert.Equal(t, uint32(2), queueA.Cap())
+		assert.Equal(t, uint32(1), queueB.Cap())
+
+		require.True(t, queueB.DequeueTry(make([]byte, 16)))
+		assert.Equal(t, uint32(2), group.Len())
+		require.True(t, queueA.EnqueueTry(testMsgC))
+		assert.Equal(t, uint32(3), queueA.seg.getQueueLen())
+		assert.Equal(t, uint32(3), group.Len())
+
+		group.SetCap(5)
+		assert.True(t, queueB.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		assert.Equal(t, uint32(5), group.Len())
+	})
+
+	t.Run("shift drops from full group", func(t *testing.T) {
+		group := testGroup(t, 2)
+		queueA := testQueue(t, 0, 1, WithGroup(group))
+		queueB := testQueue(t, 0, 1, WithGroup(group))
+
+		assert.True(t, queueA.EnqueueShift(testMsgB))
+		assert.Equal(t, uint32(1), queueA.seg.getQueueLen())
+		assert.Equal(t, uint32(1), queueB.seg.getQueueLen())
+		assert.Equal(t, uint32(2), group.Len())
+
+		got := make([]byte, 16)
+		require.True(t, queueA.DequeueTry(got))
+		assert.Equal(t, testMsgB, got)
+		assert.Equal(t, uint32(1), group.Len())
+	})
+
+	t.Run("followed by other handles", func(t *testing.T) {
+		group := testGroup(t, 1)
+		queue := testQueue(t, 0, 0, WithGroup(group))
+		other, err := AttachByID(queue.ExportID())
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, other.Close()) }()
+
+		require.True(t, other.EnqueueTry(testMsgA))
+		assert.Equal(t, uint32(1), group.Len())
+		assert.False(t, queue.EnqueueTry(testMsgB))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+		assert.Zero(t, group.Len())
+	})
+
+	t.Run("left on delete", func(t *testing.T) {
+		group := testGroup(t, 2)
+		queue, err := CreatePrivate(2, 5, WithGroup(group))
+		require.NoError(t, err)
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		other, err := AttachByID(queue.ExportID())
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, other.Close()) }()
+
+		require.NoError(t, queue.Close())
+		require.NoError(t, queue.Delete())
+		assert.Zero(t, group.Len())
+		require.True(t, other.DequeueTry(make([]byte, 16)))
+		assert.Zero(t, group.Len())
+		require.True(t, other.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC}))
+		assert.Zero(t, group.Len())
+	})
+
+	t.Run("kept by resize", func(t *testing.T) {
+		group := testGroup(t, 3)
+		queue := testQueue(t, 0, 3, WithGroup(group))
+
+		require.NoError(t, queue.Resize(8))
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+		assert.Equal(t, uint32(3), group.Len())
+		assert.False(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+		assert.Equal(t, uint32(2), group.Len())
+	})
+
+	t.Run("reset by create", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		group := testGroup(t, 5)
+		queue, err := Create(key, 2, 5, WithGroup(group))
+		require.NoError(t, err)
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		require.NoError(t, queue.Close())
+
+		queue, err = Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+		assert.Zero(t, group.Len())
+		require.True(t, queue.EnqueueTry(testMsgA))
+		assert.Zero(t, group.Len())
+	})
+
+	t.Run("open fails without group", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		group, err := CreateGroup(unix.IPC_PRIVATE, 5)
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5, WithGroup(group))
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, queue.Delete()) }()
+		require.NoError(t, queue.Close())
+		require.NoError(t, group.Close())
+		require.NoError(t, group.Delete())
+
+		_, err = Open(key)
+		assert.ErrorIs(t, err, ErrInvalidAddrOrID)
+	})
+
+	t.Run("open by key", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		group, err := CreateGroup(key, 7)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, group.Close())
+			assert.NoError(t, group.Delete())
+		}()
+
+		_, err = CreateGroup(key, 7)
+		assert.ErrorIs(t, err, ErrAlreadyExist)
+
+		other, err := OpenGroup(key)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, other.Close()) }()
+		assert.Equal(t, uint32(7), other.Cap())
+		assert.Equal(t, group.ExportID(), other.ExportID())
+	})
+
+	t.Run("open not a group", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		_, err = OpenGroup(key)
+		assert.ErrorIs(t, err, ErrInvalidMagic)
+	})
+
+	t.Run("not supported by multi queue", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		group := testGroup(t, 1)
+		_, err = CreateMulti(key, 2, 2, 5, WithGroup(group))
+		assert.ErrorIs(t, err, ErrNotSupported)
+	})
+}
@@ -0,0 +1,102 @@
+package shqueue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Harness estimates the throughput of a queue of the given geometry on the current hardware. It creates a temporary
+// queue, passes Messages messages through it from Producers goroutines to Consumers goroutines using the blocking
+// calls, and deletes the queue afterwards.
+type Harness struct {
+	MsgSize   uint32 // Message size in 64-bit words, as in Create.
+	MaxLen    uint32 // Max number of messages in the queue, as in Create.
+	Producers int    // Number of producer goroutines, at least 1.
+	Consumers int    // Number of consumer goroutines, at least 1.
+	Messages  int    // Total number of messages to pass through the queue.
+}
+
+// HarnessResult is the outcome of a Harness run.
+type HarnessResult struct {
+	Messages int
+	Bytes    int
+	Elapsed  time.Duration
+}
+
+// MsgsPerSec returns the number of messages passed through the queue per second.
+func (r HarnessResult) MsgsPerSec() float64 {
+	return float64(r.Messages) / r.Elapsed.Seconds()
+}
+
+// BytesPerSec returns the number of message bytes passed through the queue per second.
+func (r HarnessResult) BytesPerSec() float64 {
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+// Run the harness. If the context is cancelled before all messages are passed, its error is returned.
+func (h Harness) Run(ctx context.Context) (HarnessResult, error) {
+	if h.MsgSize == 0 || h.MaxLen == 0 || h.Producers < 1 || h.Consumers < 1 || h.Messages < 0 {
+		return HarnessResult{}, fmt.Errorf("invalid harness parameters: %+v", h)
+	}
+
+	key, err := FindFreeKey()
+	if err != nil {
+		return HarnessResult{}, err
+	}
+	queue, err := Create(key, h.MsgSize, h.MaxLen)
+	if err != nil {
+		return HarnessResult{}, err
+	}
+	defer func() {
+		_ = queue.Close()
+		_ = queue.Delete()
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, h.Producers+h.Consumers)
+	var wg sync.WaitGroup
+	run := func(workers int, work func(msg []byte) error) {
+		for w := 0; w < workers; w++ {
+			n := h.Messages / workers
+			if w < h.Messages%workers {
+				n++
+			}
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				msg := make([]byte, 8*h.MsgSize)
+				for i := 0; i < n; i++ {
+					if err := work(msg); err != nil {
+						errs <- err
+						cancel()
+						return
+					}
+				}
+			}(n)
+		}
+	}
+
+	start := time.Now()
+	run(h.Consumers, func(msg []byte) error {
+		return queue.DequeueBlock(ctx, msg)
+	})
+	run(h.Producers, func(msg []byte) error {
+		return queue.EnqueueBlock(ctx, msg)
+	})
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	close(errs)
+	if err = <-errs; err != nil {
+		return HarnessResult{}, err
+	}
+	return HarnessResult{
+		Messages: h.Messages,
+		Bytes:    h.Messages * int(8*h.MsgSize),
+		Elapsed:  elapsed,
+	}, nil
+}
@@ -0,0 +1,33 @@
+package shqueue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHarness(t *testing.T) {
+	t.Run("pass all messages", func(t *testing.T) {
+		h := Harness{MsgSize: 2, MaxLen: 8, Producers: 3, Consumers: 2, Messages: 1000}
+		res, err := h.Run(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, res.Messages)
+		assert.Equal(t, 1000*16, res.Bytes)
+		assert.Greater(t, res.MsgsPerSec(), float64(0))
+	})
+
+	t.Run("fail on invalid parameters", func(t *testing.T) {
+		h := Harness{MsgSize: 2, MaxLen: 8, Producers: 0, Consumers: 1, Messages: 10}
+		_, err := h.Run(context.Background())
+		assert.Error(t, err)
+	})
+
+	t.Run("return context error when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		h := Harness{MsgSize: 2, MaxLen: 8, Producers: 1, Consumers: 1, Messages: 10}
+		_, err := h.Run(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,85 @@
+package shqueue
+
+// EnqueueInPlaceTry enqueues a message written by fill directly into the queue slot, saving the copy from a temporary
+// buffer that EnqueueTry needs. If the queue is full, fill isn't called and false is returned.
+//
+// fill gets a slice of MessageSize bytes that aliases the shared memory. The slot still holds an old message, so fill
+// must overwrite all of it (or the queue must use WithZeroOnDequeue, so the slot is zeroed). fill must not retain the
+// slice: it's only valid until fill returns. fill runs under the lock of the slot, so it should be quick.
+func (q *Queue) EnqueueInPlaceTry(fill func(dst []byte)) (ok bool) {
+	if q.deletedHere() {
+		return false
+	}
+	if q.seg.lockHeader() != nil {
+		return false
+	}
+
+	curLen := q.seg.getQueueLen()
+	maxLen := q.seg.getMaxLen()
+	if curLen >= q.seg.getCap() || q.seg.isClosed() {
+		q.seg.unlockHeader()
+		return false
+	}
+
+	startIdx := q.seg.getStartIdx()
+	msgIdx := startIdx + curLen
+	msgIdx %= maxLen
+
+	if err := q.seg.lockMsg(msgIdx); err != nil {
+		q.seg.unlockHeader()
+		return false
+	}
+	q.seg.setQueueLen(curLen + 1)
+	q.seg.addEnqueued(1)
+	q.seg.unlockHeader()
+	q.seg.zeroMsgMeta(msgIdx)
+	data := q.seg.msgData(msgIdx)
+	fill(data[:len(data):len(data)])
+	q.seg.finishEnqueue(msgIdx)
+	q.seg.unlockMsg(msgIdx)
+
+	return true
+}
+
+// DequeueInPlace dequeues the oldest message and passes it to consume directly from the queue slot, saving the copy to
+// a buffer that DequeueTry needs. If the queue is empty, consume isn't called and false is returned.
+//
+// consume gets a slice of MessageSize bytes that aliases the shared memory. It must not retain or modify the slice:
+// it's only valid until consume returns. consume runs under the lock of the slot, so it should be quick.
+func (q *Queue) DequeueInPlace(consume func(src []byte)) (ok bool) {
+	if q.deletedHere() {
+		return false
+	}
+	if q.seg.lockHeader() != nil {
+		return false
+	}
+
+	if q.seg.readyLen(1) == 0 {
+		q.seg.unlockHeader()
+		return false
+	}
+	curLen := q.seg.getQueueLen()
+
+	startIdx := q.seg.getStartIdx()
+	if err := q.seg.lockMsg(startIdx); err != nil {
+		q.seg.unlockHeader()
+		return false
+	}
+
+	q.seg.setQueueLen(curLen - 1)
+	q.seg.addDequeued(1)
+
+	maxLen := q.seg.getMaxLen()
+	q.seg.setStartIdx((startIdx + 1) % maxLen)
+
+	q.seg.unlockHeader()
+	data := q.seg.msgData(startIdx)
+	consume(data[:len(data):len(data)])
+	q.seg.sumDequeued(startIdx)
+	if q.opts.zeroOnDequeue {
+		q.seg.zeroMsgData(startIdx)
+	}
+	q.seg.unlockMsg(startIdx)
+
+	return true
+}
@@ -0,0 +1,62 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInPlace(t *testing.T) {
+	t.Run("enqueue and dequeue", func(t *testing.T) {
+		queue := testQueue(t, 4, 0)
+
+		for _, msg := range [][]byte{testMsgA, testMsgB} {
+			ok := queue.EnqueueInPlaceTry(func(dst []byte) {
+				require.Len(t, dst, 16)
+				assert.Equal(t, 16, cap(dst))
+				copy(dst, msg)
+			})
+			require.True(t, ok)
+		}
+
+		toMsg := make([]byte, 16)
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+
+		ok := queue.DequeueInPlace(func(src []byte) {
+			assert.Equal(t, testMsgB, src)
+			assert.Equal(t, 16, cap(src))
+		})
+		require.True(t, ok)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		assert.Equal(t, uint32(1), queue.seg.getStartIdx())
+	})
+
+	t.Run("enqueue to full", func(t *testing.T) {
+		queue := testQueue(t, 0, 5)
+
+		ok := queue.EnqueueInPlaceTry(func(dst []byte) {
+			t.Error("fill called")
+		})
+		assert.False(t, ok)
+		assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+	})
+
+	t.Run("dequeue from empty", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		ok := queue.DequeueInPlace(func(src []byte) {
+			t.Error("consume called")
+		})
+		assert.False(t, ok)
+	})
+
+	t.Run("dequeue zeroes slot", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithZeroOnDequeue())
+		require.True(t, queue.EnqueueTry(testMsgC))
+
+		require.True(t, queue.DequeueInPlace(func(src []byte) {}))
+		assert.Equal(t, make([]byte, 16), queue.seg.msgData(0))
+	})
+}
@@ -0,0 +1,217 @@
+package shqueue
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The states of the transfer intent record in the header (see TransferTry and docs/memory_layout.md).
+const (
+	transferNone   = 0 // No transfer is in progress.
+	transferSource = 1 // The queue is the source of a committed transfer.
+	transferDest   = 2 // The queue is the destination of a transfer, and the messages are copied into its free slots.
+)
+
+// The kinds of shared memory the other queue of a transfer is in.
+const (
+	peerSysV  = 0
+	peerPOSIX = 1
+)
+
+// transferPeer identifies a queue across processes, so the other queue of an interrupted transfer can be found. Two
+// handles of the same queue have equal identities even if they're attached at different addresses.
+type transferPeer struct {
+	kind   uint32 // peerSysV or peerPOSIX.
+	id     uint64 // ID of the System V segment, or inode of the POSIX object.
+	offset uint32 // Offset of the magic of the queue in its segment, non-zero for channels of a MultiQueue.
+}
+
+// transferRecord is the intent record of a transfer in the header of one of its queues.
+type transferRecord struct {
+	state   uint32
+	peer    transferPeer // The other queue of the transfer.
+	count   uint32       // Number of moved messages.
+	start   uint32       // Start index of the source before the transfer, or 0 in the destination.
+	len     uint32       // Length of the queue before the transfer.
+	counter uint64       // Dequeued counter of the source, or enqueued counter of the destination, before the transfer.
+	seq     uint64       // Head sequence of the source, or tail sequence of the destination, before the transfer.
+}
+
+// transferPeer returns the identity of the queue that is written into the record of the other queue of a transfer.
+func (q *Queue) transferPeer() transferPeer {
+	if q.posix != nil {
+		return transferPeer{kind: peerPOSIX, id: q.posix.ino, offset: q.seg.offset}
+	}
+	return transferPeer{kind: peerSysV, id: uint64(q.id), offset: q.seg.offset}
+}
+
+// less orders queues for taking their locks together: by the kind of shared memory, the segment ID and the offset.
+func (p transferPeer) less(other transferPeer) bool {
+	if p.kind != other.kind {
+		return p.kind < other.kind
+	}
+	if p.id != other.id {
+		return p.id < other.id
+	}
+	return p.offset < other.offset
+}
+
+func (s *segment) getTransfer() transferRecord {
+	return transferRecord{
+		state: atomic.LoadUint32((*uint32)(unsafe.Pointer(&s.mem[startTransferState]))),
+		peer: transferPeer{
+			kind:   s.byteOrder.Uint32(s.mem[startTransferPeerKind:endTransferPeerKind]),
+			id:     s.byteOrder.Uint64(s.mem[startTransferPeerID:endTransferPeerID]),
+			offset: s.byteOrder.Uint32(s.mem[startTransferPeerOff:endTransferPeerOff]),
+		},
+		count:   s.byteOrder.Uint32(s.mem[startTransferCount:endTransferCount]),
+		start:   s.byteOrder.Uint32(s.mem[startTransferStart:endTransferStart]),
+		len:     s.byteOrder.Uint32(s.mem[startTransferLen:endTransferLen]),
+		counter: s.byteOrder.Uint64(s.mem[startTransferCounter:endTransferCounter]),
+		seq:     s.byteOrder.Uint64(s.mem[startTransferSeq:endTransferSeq]),
+	}
+}
+
+// setTransfer writes the record into the header. The state is written last, so a record in a valid state is complete.
+// The header lock must be held.
+func (s *segment) setTransfer(rec transferRecord) {
+	s.byteOrder.PutUint32(s.mem[startTransferPeerKind:endTransferPeerKind], rec.peer.kind)
+	s.byteOrder.PutUint64(s.mem[startTransferPeerID:endTransferPeerID], rec.peer.id)
+	s.byteOrder.PutUint32(s.mem[startTransferPeerOff:endTransferPeerOff], rec.peer.offset)
+	s.byteOrder.PutUint32(s.mem[startTransferCount:endTransferCount], rec.count)
+	s.byteOrder.PutUint32(s.mem[startTransferStart:endTransferStart], rec.start)
+	s.byteOrder.PutUint32(s.mem[startTransferLen:endTransferLen], rec.len)
+	s.byteOrder.PutUint64(s.mem[startTransferCounter:endTransferCounter], rec.counter)
+	s.byteOrder.PutUint64(s.mem[startTransferSeq:endTransferSeq], rec.seq)
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&s.mem[startTransferState])), rec.state)
+}
+
+// clearTransfer marks that no transfer is in progress. The header lock must be held.
+func (s *segment) clearTransfer() {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&s.mem[startTransferState])), transferNone)
+}
+
+// applyTransfer updates the header to the outcome of the recorded transfer: the messages are removed from the source,
+// or added to the destination. The values are computed from the record rather than from the header, so applying a
+// record again changes nothing. The header lock must be held.
+func (s *segment) applyTransfer(rec transferRecord) {
+	switch rec.state {
+	case transferSource:
+		s.setQueueLen(rec.len - rec.count)
+		s.setStartIdx((rec.start + rec.count) % s.getMaxLen())
+		atomic.StoreUint64((*uint64)(unsafe.Pointer(&s.mem[startDequeued])), rec.counter+uint64(rec.count))
+		atomic.StoreUint64((*uint64)(unsafe.Pointer(&s.mem[startHeadSeq])), rec.seq+uint64(rec.count))
+	case transferDest:
+		s.setQueueLen(rec.len + rec.count)
+		atomic.StoreUint64((*uint64)(unsafe.Pointer(&s.mem[startEnqueued])), rec.counter+uint64(rec.count))
+		atomic.StoreUint64((*uint64)(unsafe.Pointer(&s.mem[startTailSeq])), rec.seq+uint64(rec.count))
+	}
+}
+
+// matches reports whether rec, found in the header of the other queue of the transfer recorded in own, is the other
+// half of the same transfer.
+func (rec transferRecord) matches(own transferRecord, self transferPeer) bool {
+	return rec.state != transferNone && rec.state != own.state && rec.peer == self && rec.count == own.count
+}
+
+// repairTransfer finishes the transfer left in the header by a crashed process. A committed transfer is rolled forward
+// in both queues, and an uncommitted one is rolled back, so every message ends up in exactly one of them. The header
+// lock of the queue must be held, and the one of the other queue is taken over from the crashed process.
+func (q *Queue) repairTransfer() error {
+	rec := q.seg.getTransfer()
+	if rec.state == transferNone {
+		return nil
+	}
+
+	peer, detach, err := attachTransferPeer(rec.peer)
+	if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+		// The other queue may still hold its half of the record, so guessing the outcome could duplicate messages.
+		return newQueueError("repair transfer", q.key, q.id, fmt.Errorf("other queue: %w", err))
+	}
+	if err != nil {
+		// The other queue is gone along with its half of the transfer. The messages are kept in this queue either
+		// way: they're delivered if it's the destination, and the source of a committed transfer gave them away.
+		q.seg.applyTransfer(rec)
+		q.seg.clearTransfer()
+		return nil
+	}
+	defer detach()
+
+	peerRec := peer.getTransfer()
+	if !peerRec.matches(rec, q.transferPeer()) {
+		// The destination is cleared first, so the source is committed, and its destination is already updated, or
+		// the destination is marked, and its source never committed.
+		if rec.state == transferSource {
+			q.seg.applyTransfer(rec)
+		}
+		q.seg.clearTransfer()
+		return nil
+	}
+
+	if !peer.takeOverHeaderLock() && !peer.tryLockHeader(0) {
+		return newQueueError("repair transfer", q.key, q.id, fmt.Errorf(
+			"%w: the other queue of the transfer is locked by a live process", ErrLockTimeout,
+		))
+	}
+	src, srcRec, dst, dstRec := q.seg, rec, peer, peerRec
+	if rec.state == transferDest {
+		src, srcRec, dst, dstRec = peer, peerRec, q.seg, rec
+	}
+	if srcRec.state == transferSource {
+		dst.applyTransfer(dstRec)
+		src.applyTransfer(srcRec)
+	}
+	dst.clearTransfer()
+	src.clearTransfer()
+	peer.unlockHeader()
+	return nil
+}
+
+// attachTransferPeer attaches the segment of the other queue of a transfer, along with its group, without opening it
+// as a Queue. The returned function detaches them.
+func attachTransferPeer(peer transferPeer) (seg *segment, detach func(), err error) {
+	var mem []byte
+	switch peer.kind {
+	case peerSysV:
+		if peer.id > math.MaxInt32 {
+			return nil, nil, ErrInvalidID
+		}
+		if mem, err = unix.SysvShmAttach(int(peer.id), 0, 0); err != nil {
+			return nil, nil, err
+		}
+		detach = func() { _ = unix.SysvShmDetach(mem) }
+	case peerPOSIX:
+		if mem, err = mapPosixByInode(peer.id); err != nil {
+			return nil, nil, err
+		}
+		detach = func() { _ = unix.Munmap(mem) }
+	default:
+		return nil, nil, ErrHeaderCorrupt
+	}
+
+	if peer.offset == 0 {
+		seg, err = attachedSegment(mem)
+	} else {
+		seg, err = multiChannelSegment(mem, peer.offset)
+	}
+	if err != nil {
+		detach()
+		return nil, nil, err
+	}
+	if id := seg.getGroupID(); id >= 0 {
+		if g, err := attachGroup(unix.IPC_PRIVATE, id); err == nil {
+			seg.group = g
+			detachMem := detach
+			detach = func() {
+				_ = g.Close()
+				detachMem()
+			}
+		}
+	}
+	return seg, detach, nil
+}
@@ -1,6 +1,7 @@
 package shqueue
 
 import (
+	"fmt"
 	"math/rand"
 
 	"golang.org/x/sys/unix"
@@ -34,10 +35,33 @@ func isKeyFree(key int) bool {
 		// This value has a special meaning and can't be used as a key.
 		return false
 	}
-	_, err := unix.SysvShmGet(key, 0, access)
-	if err == unix.ENOENT {
+	// Probe with zero permission bits: only the existence of the segment is checked, so segments of other owners are
+	// found as well.
+	_, err := unix.SysvShmGet(key, 0, 0)
+	switch err {
+	case unix.ENOENT:
 		// The key is free.
 		return true
+	case nil, unix.EACCES:
+		// The segment exists, even if we have no access to it.
+		return false
+	default:
+		// Can't tell, so don't risk taking the key.
+		return false
+	}
+}
+
+// checkKey checks that the key can be used to create or open a queue by key: IPC_PRIVATE can't, and negative keys can't
+// with WithStrictKey.
+func checkKey(op string, key int, o options) error {
+	if key == unix.IPC_PRIVATE {
+		return newQueueError(op, key, -1, fmt.Errorf(
+			"%w: IPC_PRIVATE creates a new segment every time, so it can't be reopened by key; use CreatePrivate instead",
+			ErrInvalidKey,
+		))
+	}
+	if o.strictKey && key < 0 {
+		return newQueueError(op, key, -1, fmt.Errorf("%w: negative keys are rejected by WithStrictKey", ErrInvalidKey))
 	}
-	return false
+	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sys/unix"
 )
 
@@ -13,5 +14,96 @@ func Test_isKeyFree(t *testing.T) {
 		assert.False(t, free)
 	})
 
-	// TODO: Add more cases.
+	t.Run("key of existing segment is occupied", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+			err = queue.Delete()
+			assert.NoError(t, err)
+		}()
+
+		free := isKeyFree(key)
+		assert.False(t, free)
+	})
+
+	t.Run("key of existing segment without access is occupied", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		id, err := unix.SysvShmGet(key, 64, unix.IPC_CREAT|unix.IPC_EXCL)
+		require.NoError(t, err)
+		defer func() {
+			_, err = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+			assert.NoError(t, err)
+		}()
+
+		free := isKeyFree(key)
+		assert.False(t, free)
+	})
+
+	t.Run("key of deleted segment is free", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		err = queue.Delete()
+		assert.NoError(t, err)
+		err = queue.Close()
+		assert.NoError(t, err)
+
+		free := isKeyFree(key)
+		assert.True(t, free)
+	})
+}
+
+func Test_checkKey(t *testing.T) {
+	t.Run("IPC_PRIVATE is rejected", func(t *testing.T) {
+		_, err := Create(unix.IPC_PRIVATE, 2, 5)
+		assert.ErrorIs(t, err, ErrInvalidKey)
+		assert.Contains(t, err.Error(), "use CreatePrivate instead")
+
+		_, _, err = OpenOrCreate(unix.IPC_PRIVATE, 2, 5)
+		assert.ErrorIs(t, err, ErrInvalidKey)
+
+		_, err = Open(unix.IPC_PRIVATE)
+		assert.ErrorIs(t, err, ErrInvalidKey)
+	})
+
+	t.Run("negative key is rejected with strict option", func(t *testing.T) {
+		_, err := Create(-42, 2, 5, WithStrictKey())
+		assert.ErrorIs(t, err, ErrInvalidKey)
+
+		_, _, err = OpenOrCreate(-42, 2, 5, WithStrictKey())
+		assert.ErrorIs(t, err, ErrInvalidKey)
+
+		_, err = Open(-42, WithStrictKey())
+		assert.ErrorIs(t, err, ErrInvalidKey)
+	})
+
+	t.Run("negative key is accepted without strict option", func(t *testing.T) {
+		key := -42
+		for ; !isKeyFree(key); key-- {
+		}
+
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		opened, err := Open(key)
+		require.NoError(t, err)
+		assert.NoError(t, opened.Close())
+	})
+
+	t.Run("positive key is accepted with strict option", func(t *testing.T) {
+		assert.NoError(t, checkKey("create", 42, newOptions([]Option{WithStrictKey()})))
+	})
 }
@@ -0,0 +1,108 @@
+package shqueue
+
+import (
+	"encoding/binary"
+)
+
+// Layout describes the memory layout of a queue segment, so external tools can parse RawBytes without hard-coding the
+// offsets. See docs/memory_layout.md for the meaning of the fields.
+type Layout struct {
+	Version   int              // Layout version, stored in the VERSION field.
+	ByteOrder binary.ByteOrder // Byte order of the params and the plain header fields.
+	Fields    []LayoutField    // Magic, params and header fields in the order of offsets.
+
+	MessagesOffset int // Offset of the first message slot.
+	SlotSize       int // Size of a message slot: the lock, the metadata and the data with padding.
+	MsgLockSize    int // Size of the lock at the start of a slot.
+	MsgSize        int // Size of the timestamp, the metadata and the data with padding, right after the lock.
+	TimestampSize  int // Size of the enqueue timestamp, right after the lock (see WithTimestamps), or 0.
+	MetaSize       int // Size of the metadata, right after the timestamp (see WithMetadataSize).
+	DataSize       int // Size of the data without padding, right after the metadata.
+	MaxLen         int // Number of message slots.
+	TotalSize      int // Size of the whole queue in bytes.
+}
+
+// LayoutField is a field of the magic, params or header of a queue segment.
+type LayoutField struct {
+	Name   string // Name as in docs/memory_layout.md, like "QUEUE_LEN".
+	Offset int
+	Size   int
+}
+
+// layoutFields are the fields of the magic, params and header.
+var layoutFields = []LayoutField{
+	{"MAGIC", startMagic, endMagic - startMagic},
+	{"QUEUE_MAX_LEN", startMaxLen, endMaxLen - startMaxLen},
+	{"MSG_SIZE", startMsgSize, endMsgSize - startMsgSize},
+	{"VERSION", startVersion, endVersion - startVersion},
+	{"SEM_ID", startSemID, endSemID - startSemID},
+	{"DATA_SIZE", startDataSize, endDataSize - startDataSize},
+	{"BYTE_ORDER", startByteOrder, endByteOrder - startByteOrder},
+	{"SCHEMA_ID", startSchemaID, endSchemaID - startSchemaID},
+	{"META_SIZE", startMetaSize, endMetaSize - startMetaSize},
+	{"GROUP_ID", startGroupID, endGroupID - startGroupID},
+	{"HEADER_LOCK_PI", startLockPI, endLockPI - startLockPI},
+	{"HEADER_LOCK", startHeaderLock, endHeaderLock - startHeaderLock},
+	{"START_IDX", startStartIdx, endStartIdx - startStartIdx},
+	{"QUEUE_LEN", startQueueLen, endQueueLen - startQueueLen},
+	{"NEXT_TICKET", startNextTicket, endNextTicket - startNextTicket},
+	{"SERVING_TICKET", startServingTicket, endServingTicket - startServingTicket},
+	{"ABANDONED_TICKETS", startAbandonedTickets, endAbandonedTickets - startAbandonedTickets},
+	{"HEADER_LOCK_SPINS", startHeaderLockSpins, endHeaderLockSpins - startHeaderLockSpins},
+	{"MSG_LOCK_SPINS", startMsgLockSpins, endMsgLockSpins - startMsgLockSpins},
+	{"ENQUEUED", startEnqueued, endEnqueued - startEnqueued},
+	{"DEQUEUED", startDequeued, endDequeued - startDequeued},
+	{"DROPPED", startDropped, endDropped - startDropped},
+	{"STATS_RESET_TIME", startStatsResetTime, endStatsResetTime - startStatsResetTime},
+	{"SOFT_CAP", startSoftCap, endSoftCap - startSoftCap},
+	{"CLOSED", startClosed, endClosed - startClosed},
+	{"ADAPTIVE_SPINS", startAdaptiveSpins, endAdaptiveSpins - startAdaptiveSpins},
+	{"CHECKSUMMED", startChecksummed, endChecksummed - startChecksummed},
+	{"HEADER_CHECKSUM", startHeaderChecksum, endHeaderChecksum - startHeaderChecksum},
+	{"RUNNING_CHECKSUM", startRunningChecksum, endRunningChecksum - startRunningChecksum},
+	{"TIMESTAMPED", startTimestamped, endTimestamped - startTimestamped},
+	{"ENQUEUED_CHECKSUM", startEnqueuedChecksum, endEnqueuedChecksum - startEnqueuedChecksum},
+	{"DEQUEUED_CHECKSUM", startDequeuedChecksum, endDequeuedChecksum - startDequeuedChecksum},
+	{"TRANSFER_PEER_ID", startTransferPeerID, endTransferPeerID - startTransferPeerID},
+	{"TRANSFER_COUNTER", startTransferCounter, endTransferCounter - startTransferCounter},
+	{"TRANSFER_STATE", startTransferState, endTransferState - startTransferState},
+	{"TRANSFER_PEER_KIND", startTransferPeerKind, endTransferPeerKind - startTransferPeerKind},
+	{"TRANSFER_PEER_OFFSET", startTransferPeerOff, endTransferPeerOff - startTransferPeerOff},
+	{"TRANSFER_COUNT", startTransferCount, endTransferCount - startTransferCount},
+	{"TRANSFER_START", startTransferStart, endTransferStart - startTransferStart},
+	{"TRANSFER_LEN", startTransferLen, endTransferLen - startTransferLen},
+	{"EVENT_SEQ", startEventSeq, endEventSeq - startEventSeq},
+	{"EVENT_WATCHERS", startEventWatchers, endEventWatchers - startEventWatchers},
+	{"TICKET_OWNERS", startTicketOwners, endTicketOwners - startTicketOwners},
+	{"REJECTED", startRejected, endRejected - startRejected},
+	{"TAIL_SEQ", startTailSeq, endTailSeq - startTailSeq},
+	{"TRANSFER_SEQ", startTransferSeq, endTransferSeq - startTransferSeq},
+	{"HEAD_SEQ", startHeadSeq, endHeadSeq - startHeadSeq},
+}
+
+// LayoutDescriptor returns the memory layout of this queue.
+func (q *Queue) LayoutDescriptor() Layout {
+	msgSize := int(q.seg.getMsgSize())
+	maxLen := int(q.seg.getMaxLen())
+	return Layout{
+		Version:        layoutVersion,
+		ByteOrder:      q.seg.byteOrder,
+		Fields:         append([]LayoutField(nil), layoutFields...),
+		MessagesOffset: int(q.seg.msgsOffset),
+		SlotSize:       msgLockSize + msgSize,
+		MsgLockSize:    msgLockSize,
+		MsgSize:        msgSize,
+		TimestampSize:  int(q.seg.timestampSize()),
+		MetaSize:       int(q.seg.getMetaSize()),
+		DataSize:       int(q.seg.getDataSize()),
+		MaxLen:         maxLen,
+		TotalSize:      len(q.seg.mem),
+	}
+}
+
+// RawBytes returns a copy of the whole queue segment for diagnostics, e.g. to feed it to an external analyzer. It's a
+// copy, so it can't be used to modify the queue. No locks are taken, so with concurrent producers or consumers the
+// copy may be inconsistent. Parse it with LayoutDescriptor.
+func (q *Queue) RawBytes() []byte {
+	return append([]byte(nil), q.seg.mem...)
+}
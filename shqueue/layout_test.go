@@ -0,0 +1,59 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayout(t *testing.T) {
+	t.Run("descriptor matches segment", func(t *testing.T) {
+		queue := testQueue(t, 0, 3)
+		l := queue.LayoutDescriptor()
+
+		assert.Equal(t, layoutVersion, l.Version)
+		assert.Equal(t, queue.seg.byteOrder, l.ByteOrder)
+		assert.Equal(t, 24, l.SlotSize)
+		assert.Equal(t, 16, l.MsgSize)
+		assert.Equal(t, 16, l.DataSize)
+		assert.Equal(t, 5, l.MaxLen)
+		assert.Equal(t, l.MessagesOffset+l.MaxLen*l.SlotSize, l.TotalSize)
+
+		end := 0
+		for _, f := range l.Fields {
+			assert.GreaterOrEqual(t, f.Offset, end, f.Name)
+			end = f.Offset + f.Size
+		}
+		assert.LessOrEqual(t, end, l.MessagesOffset)
+	})
+
+	t.Run("raw bytes can be parsed with descriptor", func(t *testing.T) {
+		queue := testQueue(t, 0, 3)
+		raw := queue.RawBytes()
+		l := queue.LayoutDescriptor()
+		require.Len(t, raw, l.TotalSize)
+
+		fields := map[string]LayoutField{}
+		for _, f := range l.Fields {
+			fields[f.Name] = f
+		}
+		field := func(name string) []byte {
+			f := fields[name]
+			return raw[f.Offset : f.Offset+f.Size]
+		}
+		assert.Equal(t, magic[:], field("MAGIC"))
+		assert.Equal(t, uint32(5), l.ByteOrder.Uint32(field("QUEUE_MAX_LEN")))
+		assert.Equal(t, uint32(3), l.ByteOrder.Uint32(field("QUEUE_LEN")))
+
+		slot := raw[l.MessagesOffset+2*l.SlotSize : l.MessagesOffset+3*l.SlotSize]
+		assert.Equal(t, queue.seg.msgData(2), slot[l.MsgLockSize:l.MsgLockSize+l.DataSize])
+	})
+
+	t.Run("raw bytes are a copy", func(t *testing.T) {
+		queue := testQueue(t, 0, 3)
+		raw := queue.RawBytes()
+		raw[startQueueLen] = 0xFF
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+	})
+}
@@ -0,0 +1,37 @@
+package shqueue
+
+import (
+	"fmt"
+)
+
+// Limits are the system-wide limits and usage of IPC shared memory.
+type Limits struct {
+	MaxSegmentSize uint64 // SHMMAX: max size of a segment in bytes.
+	MaxTotalPages  uint64 // SHMALL: max total size of all segments in pages.
+	MaxSegments    uint64 // SHMMNI: max number of segments.
+	UsedSegments   uint64 // Number of currently existing segments.
+	UsedPages      uint64 // Total size of currently existing segments in pages.
+	PageSize       uint64 // Size of a page in bytes.
+}
+
+// CheckQueue checks that a new queue with the given msgSize (in 64-bit words, as in Create) and maxLen fits into the
+// limits, taking the current usage into account. If it doesn't, an error wrapping ErrExceedsLimits describes which
+// limit is exceeded.
+func (l Limits) CheckQueue(msgSize, maxLen uint32) error {
+	size := uint64(totalShmSize(8*msgSize, maxLen))
+	if size > l.MaxSegmentSize {
+		return fmt.Errorf("%w: queue size %d bytes, SHMMAX %d bytes", ErrExceedsLimits, size, l.MaxSegmentSize)
+	}
+	if l.UsedSegments >= l.MaxSegments {
+		return fmt.Errorf("%w: %d segments exist, SHMMNI %d", ErrExceedsLimits, l.UsedSegments, l.MaxSegments)
+	}
+	pages := size / l.PageSize
+	if size%l.PageSize != 0 {
+		pages++
+	}
+	if l.UsedPages > l.MaxTotalPages || pages > l.MaxTotalPages-l.UsedPages {
+		return fmt.Errorf("%w: queue size %d pages, %d pages used, SHMALL %d pages",
+			ErrExceedsLimits, pages, l.UsedPages, l.MaxTotalPages)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package shqueue
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	procShmMax = "/proc/sys/kernel/shmmax"
+	procShmAll = "/proc/sys/kernel/shmall"
+	procShmMni = "/proc/sys/kernel/shmmni"
+
+	// shmInfoCmd is the SHM_INFO command of shmctl.
+	shmInfoCmd = 14
+)
+
+// shmInfo mirrors struct shm_info, which shmctl(SHM_INFO) writes in place of struct shmid_ds.
+type shmInfo struct {
+	usedIDs       int32
+	shmTot        uint
+	shmRss        uint
+	shmSwp        uint
+	swapAttempts  uint
+	swapSuccesses uint
+}
+
+// SystemLimits reads the system-wide limits of IPC shared memory from /proc/sys/kernel and the current usage from
+// shmctl(SHM_INFO).
+func SystemLimits() (Limits, error) {
+	var l Limits
+	var err error
+	if l.MaxSegmentSize, err = readProcUint(procShmMax); err != nil {
+		return Limits{}, err
+	}
+	if l.MaxTotalPages, err = readProcUint(procShmAll); err != nil {
+		return Limits{}, err
+	}
+	if l.MaxSegments, err = readProcUint(procShmMni); err != nil {
+		return Limits{}, err
+	}
+
+	// SysvShmDesc is larger than shm_info, so it's used as a buffer.
+	var desc unix.SysvShmDesc
+	_, err = unix.SysvShmCtl(0, shmInfoCmd, &desc)
+	if err != nil {
+		return Limits{}, fmt.Errorf("get shared memory info: system error: %w", err)
+	}
+	info := (*shmInfo)(unsafe.Pointer(&desc))
+	l.UsedSegments = uint64(info.usedIDs)
+	l.UsedPages = uint64(info.shmTot)
+	l.PageSize = uint64(os.Getpagesize())
+
+	return l, nil
+}
+
+// SetSystemLimits writes the non-zero MaxSegmentSize, MaxTotalPages and MaxSegments to /proc/sys/kernel. It requires
+// the CAP_SYS_ADMIN capability. The other fields are ignored.
+func SetSystemLimits(l Limits) error {
+	for _, limit := range []struct {
+		path string
+		val  uint64
+	}{
+		{procShmMax, l.MaxSegmentSize},
+		{procShmAll, l.MaxTotalPages},
+		{procShmMni, l.MaxSegments},
+	} {
+		if limit.val == 0 {
+			continue
+		}
+		err := os.WriteFile(limit.path, []byte(strconv.FormatUint(limit.val, 10)), 0644)
+		if err != nil {
+			return fmt.Errorf("set shared memory limit: %w", err)
+		}
+	}
+	return nil
+}
+
+func readProcUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read shared memory limit: %w", err)
+	}
+	val, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse shared memory limit %s: %w", path, err)
+	}
+	return val, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package shqueue
+
+// SystemLimits is only supported on Linux. Elsewhere it returns ErrNotSupported.
+func SystemLimits() (Limits, error) {
+	return Limits{}, ErrNotSupported
+}
+
+// SetSystemLimits is only supported on Linux. Elsewhere it returns ErrNotSupported.
+func SetSystemLimits(l Limits) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,72 @@
+package shqueue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemLimits(t *testing.T) {
+	t.Run("read limits", func(t *testing.T) {
+		l, err := SystemLimits()
+		if errors.Is(err, ErrNotSupported) {
+			t.Skip("system limits aren't supported")
+		}
+		assert.NoError(t, err)
+		assert.NotZero(t, l.MaxSegmentSize)
+		assert.NotZero(t, l.MaxTotalPages)
+		assert.NotZero(t, l.MaxSegments)
+		assert.NotZero(t, l.PageSize)
+	})
+
+	t.Run("count own queue as used", func(t *testing.T) {
+		before, err := SystemLimits()
+		if errors.Is(err, ErrNotSupported) {
+			t.Skip("system limits aren't supported")
+		}
+		assert.NoError(t, err)
+
+		testQueue(t, 0, 0)
+
+		after, err := SystemLimits()
+		assert.NoError(t, err)
+		assert.Greater(t, after.UsedSegments, before.UsedSegments)
+	})
+}
+
+func TestLimits_CheckQueue(t *testing.T) {
+	limits := Limits{
+		MaxSegmentSize: 4096,
+		MaxTotalPages:  10,
+		MaxSegments:    5,
+		UsedSegments:   2,
+		UsedPages:      8,
+		PageSize:       1024,
+	}
+
+	t.Run("fit", func(t *testing.T) {
+		err := limits.CheckQueue(2, 10)
+		assert.NoError(t, err)
+	})
+
+	t.Run("exceed max segment size", func(t *testing.T) {
+		err := limits.CheckQueue(8, 100)
+		assert.ErrorIs(t, err, ErrExceedsLimits)
+		assert.Contains(t, err.Error(), "SHMMAX")
+	})
+
+	t.Run("exceed max segments", func(t *testing.T) {
+		l := limits
+		l.UsedSegments = 5
+		err := l.CheckQueue(2, 10)
+		assert.ErrorIs(t, err, ErrExceedsLimits)
+		assert.Contains(t, err.Error(), "SHMMNI")
+	})
+
+	t.Run("exceed max total pages", func(t *testing.T) {
+		err := limits.CheckQueue(8, 30)
+		assert.ErrorIs(t, err, ErrExceedsLimits)
+		assert.Contains(t, err.Error(), "SHMALL")
+	})
+}
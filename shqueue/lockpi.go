@@ -0,0 +1,100 @@
+package shqueue
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// futexWaiters is the FUTEX_WAITERS bit of a priority-inheriting futex word: the kernel sets it when a thread
+	// waits for the lock, and then the owner must release it with futexUnlock.
+	futexWaiters = 0x80000000
+	// futexTIDMask is FUTEX_TID_MASK: the bits of a priority-inheriting futex word that hold the owner thread ID.
+	futexTIDMask = 0x3fffffff
+)
+
+// isLockPI returns whether the header lock is a priority-inheriting futex (see WithPriorityInheritance). Then the
+// first 4 bytes of the lock word hold the ID of the owner thread and the futex bits, and the rest stays zero.
+func (s *segment) isLockPI() bool {
+	return s.byteOrder.Uint32(s.mem[startLockPI:endLockPI]) != 0
+}
+
+func (s *segment) setLockPI(val bool) {
+	var flag uint32
+	if val {
+		flag = 1
+	}
+	s.byteOrder.PutUint32(s.mem[startLockPI:endLockPI], flag)
+}
+
+// headerLockWord returns the futex word of the header lock.
+func (s *segment) headerLockWord() *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.mem[startHeaderLock]))
+}
+
+// lockHeaderPI takes the priority-inheriting header lock, like lockHeader does with the spinlock, and wires the calling
+// goroutine to its thread until unlockHeaderPI, since the kernel knows the owner by the thread ID. The free lock is
+// taken with a CAS, and a taken one is waited for in the kernel. A non-zero deadline makes it give up then and return
+// ErrLockTimeout. If the owner has died without releasing the lock, ErrLockOwnerDead is returned, and the lock stays
+// held until RepairLocks takes it over.
+func (s *segment) lockHeaderPI(deadline time.Time) error {
+	runtime.LockOSThread()
+	word := s.headerLockWord()
+	if atomic.CompareAndSwapUint32(word, 0, gettid()) {
+		return nil
+	}
+
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startHeaderLockSpins])), 1)
+	start := s.startSlow(time.Time{})
+	for {
+		err := futexLock(word, deadline)
+		if err == nil {
+			break
+		}
+		if err == unix.EINTR && (deadline.IsZero() || time.Now().Before(deadline)) {
+			continue
+		}
+		runtime.UnlockOSThread()
+		switch err {
+		case unix.EINTR, unix.ETIMEDOUT:
+			return ErrLockTimeout
+		case unix.ESRCH:
+			return ErrLockOwnerDead
+		default:
+			return err
+		}
+	}
+	s.logSlow("lock header", start)
+	return nil
+}
+
+// takeOverHeaderLockPI takes the priority-inheriting header lock if its owner thread no longer exists, keeping the
+// waiters bit, and wires the calling goroutine to its thread like lockHeaderPI.
+func (s *segment) takeOverHeaderLockPI() bool {
+	runtime.LockOSThread()
+	word := s.headerLockWord()
+	owner := atomic.LoadUint32(word)
+	tid := owner & futexTIDMask
+	if tid != 0 && !processAlive(uint64(tid)) && atomic.CompareAndSwapUint32(word, owner, gettid()|owner&futexWaiters) {
+		return true
+	}
+	runtime.UnlockOSThread()
+	return false
+}
+
+// unlockHeaderPI releases the priority-inheriting header lock held by this thread: with a CAS if nobody waits, or
+// with a futex syscall that hands it over to the top waiter otherwise.
+func (s *segment) unlockHeaderPI() {
+	word := s.headerLockWord()
+	owner := atomic.LoadUint32(word)
+	if owner&futexWaiters != 0 || !atomic.CompareAndSwapUint32(word, owner, 0) {
+		// An error means that this thread doesn't own the lock, which is a bug of the caller, like unlocking a
+		// spinlock taken by someone else, and there's nothing to fix.
+		_ = futexUnlock(word)
+	}
+	runtime.UnlockOSThread()
+}
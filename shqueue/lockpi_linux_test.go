@@ -0,0 +1,133 @@
+package shqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityInheritance(t *testing.T) {
+	t.Run("spinlock by default", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		assert.False(t, queue.seg.isLockPI())
+	})
+
+	t.Run("lock and unlock", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithPriorityInheritance())
+		require.True(t, queue.seg.isLockPI())
+
+		queue.seg.lockHeader()
+		headerPID, _ := queue.LockOwners()
+		assert.Equal(t, int(gettid()), headerPID)
+		queue.seg.unlockHeader()
+		assert.Zero(t, atomic.LoadUint64((*uint64)(unsafe.Pointer(&queue.seg.mem[startHeaderLock]))))
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		got := make([]byte, 16)
+		require.True(t, queue.DequeueTry(got))
+		assert.Equal(t, testMsgA, got)
+		assert.Zero(t, queue.Stats().HeaderLockSpins)
+	})
+
+	t.Run("hand over to waiter", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithPriorityInheritance())
+
+		queue.seg.lockHeader()
+		done := make(chan bool)
+		go func() {
+			queue.EnqueueTry(testMsgA)
+			done <- true
+		}()
+		time.Sleep(10 * time.Millisecond)
+		assert.NotZero(t, atomic.LoadUint32(queue.seg.headerLockWord())&futexWaiters, "the waiter sleeps in the kernel")
+		queue.seg.unlockHeader()
+		<-done
+
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+		assert.NotZero(t, queue.Stats().HeaderLockSpins)
+		assert.Zero(t, atomic.LoadUint32(queue.seg.headerLockWord()))
+	})
+
+	t.Run("mutual exclusion", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithPriorityInheritance())
+
+		// The counter is kept in the shared memory: the race detector doesn't see the lock handed over by the kernel.
+		counter := queue.seg.msgData(0)
+		const goroutines, iterations = 8, 1000
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					queue.seg.lockHeader()
+					binary.LittleEndian.PutUint64(counter, binary.LittleEndian.Uint64(counter)+1)
+					queue.seg.unlockHeader()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, uint64(goroutines*iterations), binary.LittleEndian.Uint64(counter))
+		assert.Zero(t, atomic.LoadUint32(queue.seg.headerLockWord()))
+	})
+
+	t.Run("try lock times out", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithPriorityInheritance())
+
+		locked, release := make(chan bool), make(chan bool)
+		go func() {
+			queue.seg.lockHeader()
+			locked <- true
+			<-release
+			queue.seg.unlockHeader()
+			locked <- true
+		}()
+		<-locked
+		assert.False(t, queue.seg.tryLockHeader(10*time.Millisecond))
+		assert.Equal(t, ErrLockTimeout, errors.Unwrap(queue.Ping()))
+		release <- true
+		<-locked
+		assert.NoError(t, queue.Ping())
+	})
+
+	t.Run("dead owner", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithPriorityInheritance())
+
+		// A goroutine that exits wired to its thread makes the runtime terminate the thread, unless it's the main one.
+		tids := make(chan uint32)
+		var tid uint32
+		for tid == 0 || tid == uint32(os.Getpid()) {
+			go func() {
+				runtime.LockOSThread()
+				tids <- gettid()
+			}()
+			tid = <-tids
+		}
+		require.Eventually(t, func() bool { return !processAlive(uint64(tid)) }, 5*time.Second, time.Millisecond)
+		atomic.StoreUint32(queue.seg.headerLockWord(), tid)
+
+		assert.Equal(t, ErrLockOwnerDead, queue.seg.lockHeader())
+		assert.ErrorIs(t, queue.EnqueueTryErr(testMsgA), ErrLockOwnerDead)
+
+		repaired, err := queue.RepairLocks()
+		require.NoError(t, err)
+		assert.Equal(t, 1, repaired)
+		assert.True(t, queue.EnqueueTry(testMsgA))
+	})
+
+	t.Run("carried over by resize", func(t *testing.T) {
+		queue := testQueue(t, 0, 2, WithPriorityInheritance())
+		require.NoError(t, queue.Resize(8))
+		assert.True(t, queue.seg.isLockPI())
+		assert.Equal(t, uint32(2), queue.DequeueSkip(2))
+	})
+}
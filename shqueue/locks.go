@@ -0,0 +1,77 @@
+package shqueue
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// RepairLocks unlocks the header and messages locked by processes that no longer exist, e.g. by a consumer that
+// crashed in the middle of a dequeue. Such a lock blocks the queue forever once the head reaches the message. The
+// number of unlocked locks is returned. The data of these messages may be partially written, so they're worth
+// validating. A transfer (see TransferTry) interrupted by the crash is finished in both of its queues first. The
+// tickets of crashed fair producers (see WithFairEnqueue) are abandoned, so their turns are skipped, and count as
+// repaired too.
+// The owners are identified by PIDs, so all processes using the queue must be in the same PID namespace, otherwise
+// live locks may be taken for stale ones. Slots reserved with Reserve aren't touched: see Reclaim. If the header
+// checksum doesn't match (see WithHeaderChecksum), an error wrapping ErrHeaderCorrupt is returned, unless the header
+// lock is taken over from a dead process, which may have been in the middle of an update. If the slots don't fit into
+// the segment, only the header lock is repaired, and an error wrapping ErrSegmentCorrupt is returned.
+func (q *Queue) RepairLocks() (repaired int, err error) {
+	if q.seg.takeOverHeaderLock() {
+		repaired++
+	} else if err = q.seg.lockHeader(); err != nil {
+		return 0, newQueueError("repair locks", q.key, q.id, err)
+	}
+	defer q.seg.unlockHeader()
+
+	repaired += q.seg.abandonDeadTickets()
+	if err = q.repairTransfer(); err != nil {
+		return repaired, err
+	}
+	if err = q.seg.checkSlots(); err != nil {
+		return repaired, newQueueError("repair locks", q.key, q.id, err)
+	}
+
+	maxLen := q.seg.getMaxLen()
+	for idx := uint32(0); idx < maxLen; idx++ {
+		owner := q.seg.msgLockOwner(idx)
+		if owner == 0 || owner&(msgReserved|msgReclaimed) != 0 || processAlive(owner) {
+			continue
+		}
+		if q.seg.releaseMsgLock(idx, owner) {
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// LockOwners returns the PIDs of the processes holding the header lock (0 if it's free) and the message locks, by the
+// physical index of the message, to find out who wedged the queue. Slots reserved with Reserve are reported as locked
+// by their producers. No locks are taken, so the result is a snapshot that may be inconsistent under load, but it
+// works even if the header lock is stuck. If the header lock is a priority-inheriting futex (see
+// WithPriorityInheritance), headerPID is the ID of the owner thread.
+func (q *Queue) LockOwners() (headerPID int, msgPIDs map[uint32]int) {
+	headerPID = int(q.seg.headerLockOwner())
+	msgPIDs = map[uint32]int{}
+	if q.seg.checkSlots() != nil {
+		// The message locks can't be found in a corrupted segment.
+		return headerPID, msgPIDs
+	}
+	maxLen := q.seg.getMaxLen()
+	for idx := uint32(0); idx < maxLen; idx++ {
+		owner := q.seg.msgLockOwner(idx)
+		if owner == 0 || owner == msgReclaimed {
+			continue
+		}
+		msgPIDs[idx] = int(owner &^ msgReserved)
+	}
+	return headerPID, msgPIDs
+}
+
+// processAlive reports if the process with the given PID exists. Signal 0 only checks that: EPERM means that the
+// process exists, but belongs to another user.
+func processAlive(pid uint64) bool {
+	if pid > 1<<31-1 {
+		return false
+	}
+	return unix.Kill(int(pid), 0) != unix.ESRCH
+}
@@ -0,0 +1,149 @@
+package shqueue
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairLocks(t *testing.T) {
+	t.Run("locks are owned by this process", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		queue.seg.lockMsg(1)
+		assert.Equal(t, uint64(os.Getpid()), queue.seg.msgLockOwner(1))
+		queue.seg.unlockMsg(1)
+		assert.Zero(t, queue.seg.msgLockOwner(1))
+	})
+
+	t.Run("unlock messages of dead processes", func(t *testing.T) {
+		queue := testQueue(t, 0, 3)
+
+		cmd := exec.Command("true")
+		require.NoError(t, cmd.Run())
+		deadPID := uint64(cmd.Process.Pid)
+
+		lockMsgAs(queue, 0, deadPID)
+		lockMsgAs(queue, 2, deadPID)
+		queue.seg.lockMsg(1)
+
+		repaired, err := queue.RepairLocks()
+		require.NoError(t, err)
+		assert.Equal(t, 2, repaired)
+		assert.Zero(t, queue.seg.msgLockOwner(0))
+		assert.Equal(t, lockOwner, queue.seg.msgLockOwner(1))
+		assert.Zero(t, queue.seg.msgLockOwner(2))
+		queue.seg.unlockMsg(1)
+
+		toMsg := make([]byte, len(testMsgA))
+		assert.True(t, queue.DequeueTry(toMsg))
+	})
+
+	t.Run("nothing to repair", func(t *testing.T) {
+		queue := testQueue(t, 0, 5)
+
+		repaired, err := queue.RepairLocks()
+		require.NoError(t, err)
+		assert.Zero(t, repaired)
+	})
+}
+
+func TestLockOwners(t *testing.T) {
+	t.Run("no locks", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		headerPID, msgPIDs := queue.LockOwners()
+		assert.Zero(t, headerPID)
+		assert.Empty(t, msgPIDs)
+	})
+
+	t.Run("header and messages", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		_, _, ok := queue.Reserve()
+		require.True(t, ok)
+		queue.seg.lockHeader()
+		queue.seg.lockMsg(1)
+		lockMsgAs(queue, 3, 4321)
+
+		headerPID, msgPIDs := queue.LockOwners()
+		assert.Equal(t, os.Getpid(), headerPID)
+		assert.Equal(t, map[uint32]int{0: os.Getpid(), 1: os.Getpid(), 3: 4321}, msgPIDs)
+
+		queue.seg.unlockHeader()
+		headerPID, _ = queue.LockOwners()
+		assert.Zero(t, headerPID)
+	})
+}
+
+func TestLockOrdering(t *testing.T) {
+	t.Run("overlapping message sets in opposite orders", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		done := make(chan struct{})
+		for _, idxs := range [][]uint32{{4, 0, 1, 2}, {2, 1, 0, 4, 3}} {
+			idxs := idxs
+			go func() {
+				defer func() { done <- struct{}{} }()
+				for i := 0; i < 1000; i++ {
+					queue.seg.lockMsgs(idxs)
+					for _, idx := range idxs {
+						queue.seg.unlockMsg(idx)
+					}
+				}
+			}()
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("deadlock")
+			}
+		}
+	})
+
+	t.Run("batch operations on wrapped ranges", func(t *testing.T) {
+		queue := testQueue(t, 3, 0)
+
+		done := make(chan struct{})
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 500; i++ {
+				for !queue.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC}) {
+					time.Sleep(time.Microsecond)
+				}
+			}
+		}()
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for n := 0; n < 1500; {
+				msgs, err := queue.DequeueBatchBlock(context.Background(), 4)
+				if !assert.NoError(t, err) {
+					return
+				}
+				n += len(msgs)
+			}
+		}()
+		for i := 0; i < 2; i++ {
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("deadlock")
+			}
+		}
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+	})
+}
+
+// lockMsgAs locks the message on behalf of another process.
+func lockMsgAs(q *Queue, idx uint32, owner uint64) {
+	lockPtr := (*uint64)(unsafe.Pointer(&q.seg.mem[q.seg.startMsgLock(idx)]))
+	atomic.StoreUint64(lockPtr, owner)
+}
@@ -0,0 +1,21 @@
+package shqueue
+
+// MetadataSize returns the size of the metadata of messages in this queue in bytes (see WithMetadataSize).
+func (q *Queue) MetadataSize() int {
+	return int(q.seg.getMetaSize())
+}
+
+// EnqueueMeta works like EnqueueTry, but also writes the metadata of the message (see WithMetadataSize), which must be
+// exactly MetadataSize bytes long. The metadata and the payload are written under the same message lock, so consumers
+// never see one without the other.
+func (q *Queue) EnqueueMeta(meta, payload []byte) (ok bool) {
+	_, err := q.enqueueTryAt(meta, payload)
+	return err == nil
+}
+
+// DequeueMeta works like DequeueTry, but also copies the metadata of the message into metaBuf, which must be exactly
+// MetadataSize bytes long. Messages enqueued without metadata have zero metadata.
+func (q *Queue) DequeueMeta(metaBuf, payloadBuf []byte) (ok bool) {
+	_, err := q.dequeueTry(metaBuf, payloadBuf)
+	return err == nil
+}
@@ -0,0 +1,100 @@
+package shqueue
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	metaA := bytes.Repeat([]byte{0x11}, 5)
+	metaB := bytes.Repeat([]byte{0x22}, 5)
+
+	t.Run("round trip", func(t *testing.T) {
+		queue := testQueue(t, 3, 0, WithMetadataSize(5))
+		assert.Equal(t, 5, queue.MetadataSize())
+		assert.Equal(t, 16, queue.MessageSize())
+
+		require.True(t, queue.EnqueueMeta(metaA, testMsgA))
+		require.True(t, queue.EnqueueMeta(metaB, testMsgB))
+		require.True(t, queue.EnqueueTry(testMsgC))
+
+		metaBuf, payloadBuf := make([]byte, 5), make([]byte, 16)
+		require.True(t, queue.DequeueMeta(metaBuf, payloadBuf))
+		assert.Equal(t, metaA, metaBuf)
+		assert.Equal(t, testMsgA, payloadBuf)
+
+		require.True(t, queue.DequeueTry(payloadBuf))
+		assert.Equal(t, testMsgB, payloadBuf)
+
+		require.True(t, queue.DequeueMeta(metaBuf, payloadBuf))
+		assert.Equal(t, make([]byte, 5), metaBuf, "enqueued without metadata")
+		assert.Equal(t, testMsgC, payloadBuf)
+
+		assert.False(t, queue.DequeueMeta(metaBuf, payloadBuf))
+	})
+
+	t.Run("overwritten slot gets zero metadata", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithMetadataSize(5))
+		for i := 0; i < 5; i++ {
+			require.True(t, queue.EnqueueMeta(metaA, testMsgA))
+		}
+		require.True(t, queue.EnqueueShift(testMsgB))
+
+		metaBuf, payloadBuf := make([]byte, 5), make([]byte, 16)
+		for i := 0; i < 4; i++ {
+			require.True(t, queue.DequeueMeta(metaBuf, payloadBuf))
+			assert.Equal(t, metaA, metaBuf)
+		}
+		require.True(t, queue.DequeueMeta(metaBuf, payloadBuf))
+		assert.Equal(t, make([]byte, 5), metaBuf)
+		assert.Equal(t, testMsgB, payloadBuf)
+	})
+
+	t.Run("no metadata by default", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		assert.Zero(t, queue.MetadataSize())
+		require.True(t, queue.EnqueueMeta(nil, testMsgA))
+		payloadBuf := make([]byte, 16)
+		require.True(t, queue.DequeueMeta(nil, payloadBuf))
+		assert.Equal(t, testMsgA, payloadBuf)
+	})
+
+	t.Run("wrong metadata size", func(t *testing.T) {
+		queue := testQueue(t, 0, 1, WithMetadataSize(5))
+		assert.Panics(t, func() { queue.EnqueueMeta(make([]byte, 4), testMsgA) })
+		assert.Panics(t, func() { queue.DequeueMeta(make([]byte, 6), make([]byte, 16)) })
+	})
+
+	t.Run("layout", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithMetadataSize(5))
+		l := queue.LayoutDescriptor()
+		assert.Equal(t, 5, l.MetaSize)
+		assert.Equal(t, 16, l.DataSize)
+		assert.Equal(t, 24, l.MsgSize)
+	})
+
+	t.Run("geometry mismatch on adopt", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5, WithMetadataSize(8))
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		_, _, err = OpenOrCreate(key, 2, 5, WithMetadataSize(16))
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+		_, _, err = OpenOrCreate(key, 3, 5)
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+
+		opened, created, err := OpenOrCreate(key, 2, 5, WithMetadataSize(8))
+		require.NoError(t, err)
+		assert.False(t, created)
+		assert.Equal(t, 8, opened.MetadataSize())
+		assert.NoError(t, opened.Close())
+	})
+}
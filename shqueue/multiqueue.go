@@ -0,0 +1,264 @@
+package shqueue
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/sys/unix"
+)
+
+// The segment of a MultiQueue starts with its own magic and params, followed by the magic, params and headers of all
+// channels one after another, and then by the message slots of all channels. The params are in the native byte order.
+const (
+	startMultiChannels = 8
+	endMultiChannels   = 12
+	startMultiVersion  = 12
+	endMultiVersion    = 16
+	startMultiMsgSize  = 16
+	endMultiMsgSize    = 20
+	startMultiMaxLen   = 20
+	endMultiMaxLen     = 24
+
+	startMultiHeaders = 24
+)
+
+var multiMagic = [8]byte{0x57, 0x6f, 0x72, 0x6b, 0x20, 0x61, 0x72, 0x65}
+
+var errChannel = fmt.Errorf("%w: the segment belongs to a MultiQueue, close or delete it instead", ErrNotSupported)
+
+// MultiQueue is a set of channels, independent queues of the same geometry that share one shared memory segment.
+// Programs that need many small queues save the per-segment overhead and IPC IDs this way, which are limited by
+// SHMMNI. The headers of all channels are laid out one after another at the start of the segment, followed by their
+// message slots.
+type MultiQueue struct {
+	key      int
+	id       int
+	mem      []byte
+	channels []*Queue
+}
+
+// CreateMulti creates a new MultiQueue with the given number of channels. msgSize (in 64-bit words) and maxLen are the
+// same as in Create and apply to each channel. If a segment with the key already exists, it's reset or recreated like
+// in Create. WithSemaphore, WithRecover, WithFairEnqueue, WithMetadataSize, WithTimestamps and WithGroup aren't
+// supported for channels.
+func CreateMulti(key, channels int, msgSize, maxLen uint32, opts ...Option) (*MultiQueue, error) {
+	o := newOptions(opts)
+	if err := checkKey("create shared memory", key, o); err != nil {
+		return nil, err
+	}
+	if o.semaphore || o.recover || o.fairEnqueue || o.metaSize != 0 || o.timestamps || o.group != nil {
+		return nil, newQueueError("create shared memory", key, -1, fmt.Errorf(
+			"%w: WithSemaphore, WithRecover, WithFairEnqueue, WithMetadataSize, WithTimestamps and WithGroup can't be "+
+				"used with a MultiQueue",
+			ErrNotSupported,
+		))
+	}
+	dataSize := 8 * msgSize
+	totalSize, ok := multiShmSize(channels, dataSize, maxLen)
+	if !ok {
+		return nil, newQueueError("create shared memory", key, -1, fmt.Errorf(
+			"%w: %d channels of %d messages of %d bytes", ErrInvalidSize, channels, maxLen, dataSize,
+		))
+	}
+
+	create := false
+	id, err := unix.SysvShmGet(key, totalSize, o.access)
+	for i := 0; (err == unix.ENOENT || err == unix.EINVAL) && i <= o.createRetries; i++ {
+		// The segment is missing or too small. Other processes may be recreating it at the same time, so it's deleted
+		// only while it's still too small (see recreateQueue), and if another process takes the key before the
+		// creation, its segment is looked up again and reset like an existing one.
+		if _, err = deleteSmallShm(key, totalSize); err != nil {
+			return nil, err
+		}
+		create = true
+		id, err = unix.SysvShmGet(key, totalSize, o.access|unix.IPC_CREAT|unix.IPC_EXCL)
+		if err == unix.EEXIST {
+			create = false
+			id, err = unix.SysvShmGet(key, totalSize, o.access)
+		}
+	}
+	if err != nil {
+		return nil, wrapErrShmGet(err, create, key)
+	}
+	mem, err := attachShm(key, id, o)
+	if err != nil {
+		return nil, err
+	}
+	mem = mem[:totalSize]
+
+	for i := range multiMagic {
+		mem[i] = 0
+	}
+	order := detectByteOrder()
+	order.PutUint32(mem[startMultiChannels:endMultiChannels], uint32(channels))
+	order.PutUint32(mem[startMultiVersion:endMultiVersion], layoutVersion)
+	order.PutUint32(mem[startMultiMsgSize:endMultiMsgSize], padMsgSize(dataSize))
+	order.PutUint32(mem[startMultiMaxLen:endMultiMaxLen], maxLen)
+	for i := 0; i < channels; i++ {
+		initSegment(channelSegment(mem, i, channels, padMsgSize(dataSize), maxLen), dataSize, maxLen, -1, o)
+	}
+	// The magic is written last, like in Create.
+	copy(mem, multiMagic[:])
+
+	return newMultiQueue(key, id, mem, o)
+}
+
+// OpenMulti opens an existing MultiQueue.
+func OpenMulti(key int, opts ...Option) (*MultiQueue, error) {
+	o := newOptions(opts)
+	if err := checkKey("open shared memory", key, o); err != nil {
+		return nil, err
+	}
+	id, err := unix.SysvShmGet(key, startMultiHeaders, o.access)
+	if err != nil {
+		return nil, wrapErrShmGet(err, false, key)
+	}
+	mem, err := attachShm(key, id, o)
+	if err != nil {
+		return nil, err
+	}
+
+	multiMem, err := checkMultiSegment(mem)
+	if err != nil {
+		_ = unix.SysvShmDetach(mem)
+		return nil, newQueueError("open shared memory", key, id, err)
+	}
+	return newMultiQueue(key, id, multiMem, o)
+}
+
+// checkMultiSegment validates that the attached memory contains a MultiQueue and trims it to its size.
+func checkMultiSegment(mem []byte) ([]byte, error) {
+	order := detectByteOrder()
+	if len(mem) < startMultiHeaders || [8]byte(mem[:8]) != multiMagic {
+		return nil, ErrInvalidMagic
+	}
+	if order.Uint32(mem[startMultiVersion:endMultiVersion]) != layoutVersion {
+		return nil, ErrVersionMismatch
+	}
+	totalSize, ok := multiShmSize(
+		int(order.Uint32(mem[startMultiChannels:endMultiChannels])),
+		order.Uint32(mem[startMultiMsgSize:endMultiMsgSize]),
+		order.Uint32(mem[startMultiMaxLen:endMultiMaxLen]),
+	)
+	if !ok || len(mem) < totalSize {
+		return nil, ErrTooSmall
+	}
+	return mem[:totalSize], nil
+}
+
+// multiChannelSegment returns the segment of the channel whose magic is at the offset in the attached MultiQueue
+// segment, validating it.
+func multiChannelSegment(mem []byte, offset uint32) (*segment, error) {
+	mem, err := checkMultiSegment(mem)
+	if err != nil {
+		return nil, err
+	}
+	order := detectByteOrder()
+	channels := int(order.Uint32(mem[startMultiChannels:endMultiChannels]))
+	if offset < startMultiHeaders || (offset-startMultiHeaders)%startQueue != 0 ||
+		(offset-startMultiHeaders)/startQueue >= uint32(channels) {
+		return nil, ErrHeaderCorrupt
+	}
+	seg := channelSegment(
+		mem, int((offset-startMultiHeaders)/startQueue), channels,
+		order.Uint32(mem[startMultiMsgSize:endMultiMsgSize]), order.Uint32(mem[startMultiMaxLen:endMultiMaxLen]),
+	)
+	if err = seg.checkMagic(); err != nil {
+		return nil, err
+	}
+	if err = seg.checkVersion(); err != nil {
+		return nil, err
+	}
+	return seg, seg.checkHeader()
+}
+
+// newMultiQueue creates the channels of the attached MultiQueue segment, validating their headers.
+func newMultiQueue(key, id int, mem []byte, o options) (*MultiQueue, error) {
+	order := detectByteOrder()
+	channels := int(order.Uint32(mem[startMultiChannels:endMultiChannels]))
+	msgSize := order.Uint32(mem[startMultiMsgSize:endMultiMsgSize])
+	maxLen := order.Uint32(mem[startMultiMaxLen:endMultiMaxLen])
+
+	mq := &MultiQueue{key: key, id: id, mem: mem, channels: make([]*Queue, channels)}
+	for i := range mq.channels {
+		seg := channelSegment(mem, i, channels, msgSize, maxLen)
+		err := seg.checkMagic()
+		if err == nil {
+			err = seg.checkVersion()
+		}
+		if err == nil {
+			err = seg.checkHeader()
+		}
+		if err != nil {
+			_ = unix.SysvShmDetach(mem)
+			return nil, newQueueError("open channel", key, id, fmt.Errorf("channel %d: %w", i, err))
+		}
+		mq.channels[i] = newQueue(key, id, seg, o)
+		mq.channels[i].channel = true
+	}
+	if o.lockedMemory {
+		if err := mq.channels[0].LockMemory(); err != nil {
+			_ = unix.SysvShmDetach(mem)
+			return nil, err
+		}
+	}
+	return mq, nil
+}
+
+// multiShmSize returns the size of a MultiQueue segment, or false if the geometry is invalid or too big.
+func multiShmSize(channels int, msgSize, maxLen uint32) (int, bool) {
+	if channels <= 0 || uint64(channels) > math.MaxUint32 {
+		return 0, false
+	}
+	slots := (uint64(padMsgSize(msgSize)) + msgLockSize) * uint64(maxLen)
+	size := startMultiHeaders + uint64(channels)*(startQueue+slots)
+	if size > uint64(maxInt) || size > math.MaxUint32 {
+		return 0, false
+	}
+	return int(size), true
+}
+
+// channelSegment returns the segment of the i-th channel of a MultiQueue: its mem starts at the magic of the channel
+// and spans its message slots, with the headers of the following channels and the slots of the preceding ones in
+// between.
+func channelSegment(mem []byte, i, channels int, msgSize, maxLen uint32) *segment {
+	slots := (msgSize + msgLockSize) * maxLen
+	start := startMultiHeaders + uint32(i)*startQueue
+	msgsStart := startMultiHeaders + uint32(channels)*startQueue + uint32(i)*slots
+	seg := newSegment(mem[start : msgsStart+slots])
+	seg.msgsOffset = msgsStart - start
+	seg.offset = start
+	return seg
+}
+
+// Channel returns the i-th channel, which must be less than Channels. It's a Queue with all the usual methods, except
+// that it can't be closed or deleted on its own: close or delete the MultiQueue instead.
+func (mq *MultiQueue) Channel(i int) *Queue {
+	if i < 0 || i >= len(mq.channels) {
+		panic(fmt.Sprintf("channel index must be less than %d, but got %d", len(mq.channels), i))
+	}
+	return mq.channels[i]
+}
+
+// Channels returns the number of channels.
+func (mq *MultiQueue) Channels() int {
+	return len(mq.channels)
+}
+
+// Close detaches the MultiQueue from the process memory. Its channels must not be used afterwards.
+func (mq *MultiQueue) Close() error {
+	err := unix.SysvShmDetach(mq.mem)
+	if err != nil {
+		return wrapErrShmDetach(err, mq.key, mq.id)
+	}
+	return nil
+}
+
+// Delete marks the MultiQueue for deletion. It's deleted once all processes detach it.
+func (mq *MultiQueue) Delete() error {
+	_, err := unix.SysvShmCtl(mq.id, unix.IPC_RMID, nil)
+	if err != nil {
+		return wrapErrShmDelete(err, mq.key, mq.id)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package shqueue
+
+import (
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiQueue(t *testing.T) {
+	t.Run("channels are independent", func(t *testing.T) {
+		mq := testMultiQueue(t, 3)
+		assert.Equal(t, 3, mq.Channels())
+
+		require.True(t, mq.Channel(0).EnqueueTry(testMsgA))
+		require.True(t, mq.Channel(2).EnqueueTry(testMsgB))
+		require.True(t, mq.Channel(2).EnqueueTry(testMsgC))
+
+		toMsg := make([]byte, 16)
+		assert.False(t, mq.Channel(1).DequeueTry(toMsg))
+		require.True(t, mq.Channel(2).DequeueTry(toMsg))
+		assert.Equal(t, testMsgB, toMsg)
+		require.True(t, mq.Channel(0).DequeueTry(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+		assert.Equal(t, uint32(1), mq.Channel(2).seg.getQueueLen())
+	})
+
+	t.Run("full channel doesn't overwrite neighbours", func(t *testing.T) {
+		mq := testMultiQueue(t, 3)
+
+		for i := 0; i < 5; i++ {
+			require.True(t, mq.Channel(1).EnqueueTry(testMsgB))
+		}
+		assert.False(t, mq.Channel(1).EnqueueTry(testMsgB))
+		for i := 0; i < 7; i++ {
+			mq.Channel(0).EnqueueShift(testMsgA)
+			mq.Channel(2).EnqueueShift(testMsgC)
+		}
+
+		toMsg := make([]byte, 16)
+		for i := 0; i < 5; i++ {
+			require.True(t, mq.Channel(1).DequeueTry(toMsg))
+			assert.Equal(t, testMsgB, toMsg)
+		}
+		assert.False(t, mq.Channel(1).DequeueTry(toMsg))
+	})
+
+	t.Run("headers are contiguous", func(t *testing.T) {
+		mq := testMultiQueue(t, 3)
+
+		for i := 0; i < 3; i++ {
+			seg := mq.Channel(i).seg
+			offset := uintptr(unsafe.Pointer(&seg.mem[0])) - uintptr(unsafe.Pointer(&mq.mem[0]))
+			assert.Equal(t, uintptr(startMultiHeaders+i*startQueue), offset)
+			assert.Zero(t, seg.startMsgLock(0)%8)
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		mq, err := CreateMulti(key, 4, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, mq.Close())
+			assert.NoError(t, mq.Delete())
+		}()
+		require.True(t, mq.Channel(3).EnqueueTry(testMsgC))
+
+		opened, err := OpenMulti(key)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, opened.Close())
+		}()
+		assert.Equal(t, 4, opened.Channels())
+		assert.Equal(t, 16, opened.Channel(3).MessageSize())
+
+		toMsg := make([]byte, 16)
+		require.True(t, opened.Channel(3).DequeueTry(toMsg))
+		assert.Equal(t, testMsgC, toMsg)
+
+		_, err = Open(key)
+		assert.ErrorIs(t, err, ErrInvalidMagic)
+	})
+
+	t.Run("open plain queue fails", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		_, err = OpenMulti(key)
+		assert.ErrorIs(t, err, ErrInvalidMagic)
+	})
+
+	t.Run("channel can't be closed or deleted", func(t *testing.T) {
+		mq := testMultiQueue(t, 1)
+
+		assert.ErrorIs(t, mq.Channel(0).Close(), ErrNotSupported)
+		assert.ErrorIs(t, mq.Channel(0).Delete(), ErrNotSupported)
+	})
+
+	t.Run("invalid geometry", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		_, err = CreateMulti(key, 0, 2, 5)
+		assert.ErrorIs(t, err, ErrInvalidSize)
+		_, err = CreateMulti(key, 1<<20, 1<<10, 1<<10)
+		assert.ErrorIs(t, err, ErrInvalidSize)
+		_, err = CreateMulti(key, 2, 2, 5, WithSemaphore())
+		assert.ErrorIs(t, err, ErrNotSupported)
+	})
+
+	t.Run("concurrent recreation of small segment", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		small, err := CreateMulti(key, 1, 1, 1)
+		require.NoError(t, err)
+		require.NoError(t, small.Close())
+
+		const creators = 8
+		mqs := make([]*MultiQueue, creators)
+		errs := make([]error, creators)
+		var wg sync.WaitGroup
+		for i := 0; i < creators; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				mqs[i], errs[i] = CreateMulti(key, 3, 2, 5)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range mqs {
+			require.NoError(t, errs[i])
+			assert.Equal(t, 3, mqs[i].Channels())
+		}
+		for i := range mqs {
+			assert.NoError(t, mqs[i].Close())
+		}
+		assert.NoError(t, deleteShm(key))
+	})
+
+	t.Run("channel index out of range", func(t *testing.T) {
+		mq := testMultiQueue(t, 2)
+		assert.Panics(t, func() { mq.Channel(2) })
+		assert.Panics(t, func() { mq.Channel(-1) })
+	})
+}
+
+func testMultiQueue(t *testing.T, channels int) *MultiQueue {
+	key, err := FindFreeKey()
+	require.NoError(t, err)
+	mq, err := CreateMulti(key, channels, 2, 5)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, mq.Close())
+		assert.NoError(t, mq.Delete())
+	})
+	return mq
+}
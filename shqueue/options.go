@@ -0,0 +1,328 @@
+package shqueue
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+const (
+	defaultAccess        = 0600
+	defaultMaxSpinSleep  = time.Millisecond
+	defaultCreateRetries = 100
+)
+
+// Option configures a queue on Create or Open.
+type Option func(*options)
+
+type options struct {
+	access         int
+	zeroOnDequeue  bool
+	lockedMemory   bool
+	fairEnqueue    bool
+	recover        bool
+	attachAddr     uintptr
+	highWater      float64
+	lowWater       float64
+	semaphore      bool
+	eventFD        bool
+	group          *Group
+	maxSpinSleep   time.Duration
+	overflowPolicy OverflowPolicy
+	readFromShift  bool
+	byteOrder      binary.ByteOrder
+	createRetries  int
+	schemaID       uint32
+	metaSize       uint32
+	headerChecksum bool
+	runningSum     bool
+	timestamps     bool
+	lockPI         bool
+	strictKey      bool
+	backoff        Backoff
+	slowThreshold  time.Duration
+	slowLog        func(op string, waited time.Duration)
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		access:        defaultAccess,
+		highWater:     1,
+		maxSpinSleep:  defaultMaxSpinSleep,
+		createRetries: defaultCreateRetries,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithAccess sets the permission bits of the shared memory (like 0660 for a queue shared by a group).
+// On Create they are applied to a newly created segment, on Open they are the permissions requested from an existing
+// one. The default is 0600.
+func WithAccess(mode int) Option {
+	return func(o *options) {
+		o.access = mode & 0777
+	}
+}
+
+// WithZeroOnDequeue makes dequeue calls overwrite a message slot with zeros after the message is copied out of it, so
+// sensitive data doesn't linger in the shared memory. It costs one extra pass over the message on every dequeue.
+// The option is per process: it only affects the dequeue calls of the queue it's passed to.
+func WithZeroOnDequeue() Option {
+	return func(o *options) {
+		o.zeroOnDequeue = true
+	}
+}
+
+// WithLockedMemory makes Create and Open lock the queue in RAM with LockMemory, so there are no page faults and no
+// swapping. If locking isn't permitted, Create and Open fail with ErrLockNotPermitted.
+func WithLockedMemory() Option {
+	return func(o *options) {
+		o.lockedMemory = true
+	}
+}
+
+// WithFairEnqueue makes EnqueueBlock serve blocked producers in the order of their arrival: when space frees up, the
+// producer that has been waiting the longest enqueues first. The order is kept by a shared ticket counter, so it works
+// across processes, but only among producers that use this option: EnqueueTry, EnqueueShift and EnqueueBlock without
+// the option can still take the freed space first. At most 64 fair producers can wait at the same time, and the ones
+// beyond that enqueue as without the option. A producer that crashes while waiting blocks the ones behind it until
+// RepairLocks skips its turn.
+func WithFairEnqueue() Option {
+	return func(o *options) {
+		o.fairEnqueue = true
+	}
+}
+
+// WithRecover makes Create adopt an existing queue with the same key as is, keeping its messages, e.g. after a restart
+// of the producer. The existing queue must have exactly the requested geometry and a consistent header, otherwise
+// Create fails with ErrGeometryMismatch or ErrHeaderCorrupt. If there's no queue with the key, a new one is created.
+func WithRecover() Option {
+	return func(o *options) {
+		o.recover = true
+	}
+}
+
+// WithReset makes Create reset an existing queue with the same key, dropping its messages. It's the default behavior,
+// the option just makes it explicit and overrides WithRecover passed earlier.
+func WithReset() Option {
+	return func(o *options) {
+		o.recover = false
+	}
+}
+
+// WithAttachAddr makes the queue attach at the given virtual address instead of the one chosen by the kernel. The
+// address must be page-aligned and must not overlap any existing mapping of the process, otherwise attaching fails
+// with ErrAttachAddr. Use BaseAddr to get the actual address.
+//
+// This is an option for experts who store self-referential structures (containing pointers into the segment) in the
+// queue and need the segment at the same address in every process. Such pointers are invisible to the Go garbage
+// collector and are only valid in processes that attached the segment at exactly the same address, so the address
+// must be chosen out of the ranges used by the Go runtime and the rest of the process on all participating hosts.
+func WithAttachAddr(addr uintptr) Option {
+	return func(o *options) {
+		o.attachAddr = addr
+	}
+}
+
+// WithHighWater sets the high-water mark used by EnqueueShiftNotify as a fraction of the capacity of the queue (see
+// Cap), from 0 to 1. For example, 0.8 means that producers are notified when the queue is at least 80% full. The default is 1,
+// that is, producers are notified only when the queue is full and the oldest message is dropped.
+func WithHighWater(frac float64) Option {
+	return func(o *options) {
+		o.highWater = math.Min(math.Max(frac, 0), 1)
+	}
+}
+
+// WithLowWater sets the low-water mark used by DequeueNotify and DequeueBlockNotify as a fraction of the capacity of
+// the queue (see Cap), from 0 to 1. For example, 0.2 means that consumers are notified when less than 20% of the queue is left
+// after a dequeue. The default is 0, that is, consumers are never notified.
+func WithLowWater(frac float64) Option {
+	return func(o *options) {
+		o.lowWater = math.Min(math.Max(frac, 0), 1)
+	}
+}
+
+// WithSemaphore makes Create also create a companion SysV semaphore set for the queue, holding the number of messages
+// and free slots. Then the blocking calls sleep in the kernel until the queue changes, instead of polling it. The
+// semaphores are updated under the header lock on every change of the queue length, which costs a syscall per
+// operation. The set has the same permission bits as the queue. Processes that Open the queue use the set
+// automatically, the option is ignored there. Delete removes the set immediately, and Create removes the set of the
+// queue it resets. If the set is removed in another way, e.g. by ipcrm, the blocking calls return an error wrapping
+// ErrSegmentDeleted. Semaphore sets aren't supported on some platforms, where Create returns ErrNotSupported.
+func WithSemaphore() Option {
+	return func(o *options) {
+		o.semaphore = true
+	}
+}
+
+// WithEventFD makes Create and Open create two eventfds for integrating the queue into an event loop: see ReadableFD,
+// WritableFD and docs/eventfd.md. Eventfds aren't supported on some platforms, where ErrNotSupported is returned.
+func WithEventFD() Option {
+	return func(o *options) {
+		o.eventFD = true
+	}
+}
+
+// WithMaxSpinSleep sets how long this process sleeps at most between the attempts to take the header lock, and between
+// the checks of the queue in EnqueueBlock and DequeueBlock. The sleep grows with every attempt up to this cap. Zero
+// means pure spinning that only yields the processor: the lowest latency at the cost of a busy core. Larger values
+// save CPU at the cost of latency. The default is 1ms. Message locks are held very briefly, so they aren't affected.
+func WithMaxSpinSleep(d time.Duration) Option {
+	return func(o *options) {
+		if d < 0 {
+			d = 0
+		}
+		o.maxSpinSleep = d
+	}
+}
+
+// WithBackoff sets the strategy of waiting for the header lock in this process. The default is FixedBackoff.
+func WithBackoff(b Backoff) Option {
+	return func(o *options) {
+		o.backoff = b
+	}
+}
+
+// WithSlowLog makes the queue call fn in this process when an operation waits at least threshold: a blocking enqueue
+// ("enqueue") or dequeue ("dequeue") waiting for space or messages, or taking the header lock ("lock header") or a
+// message lock ("lock message"). waited is the time spent waiting. The time is measured only once an operation has
+// to wait, so the fast path stays as it is. fn is called from the waiting goroutine, after the wait and possibly with
+// locks held, so it must be fast and must not call methods of the queue.
+func WithSlowLog(threshold time.Duration, fn func(op string, waited time.Duration)) Option {
+	return func(o *options) {
+		o.slowThreshold = threshold
+		o.slowLog = fn
+	}
+}
+
+// OverflowPolicy defines which message EnqueueShift drops when the queue is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest drops the oldest message to make room for the new one. It's the default.
+	DropOldest OverflowPolicy = iota
+	// DropNewest drops the new message: it isn't enqueued, and EnqueueShift returns false.
+	DropNewest
+	// DropAndNotify drops the oldest message like DropOldest, but EnqueueShift returns false to report it.
+	DropAndNotify
+)
+
+// WithOverflowPolicy sets which message EnqueueShift drops when the queue is full. The policy is applied under the
+// header lock, so the decision and the enqueue are atomic. It's a per-process setting: producers of one queue may use
+// different policies. The default is DropOldest.
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(o *options) {
+		o.overflowPolicy = policy
+	}
+}
+
+// WithReadFromShift makes ReadFrom enqueue the messages with EnqueueShift instead of EnqueueBlock, so it never waits
+// for free space, and the messages that don't fit are dropped according to the overflow policy (see
+// WithOverflowPolicy). The option is per process: it only affects the ReadFrom calls of the queue it's passed to.
+func WithReadFromShift() Option {
+	return func(o *options) {
+		o.readFromShift = true
+	}
+}
+
+// WithByteOrder sets the byte order of the integers in the params and the header of a queue created with Create,
+// instead of the native one. The order is stored in the segment, and Open, AttachByID and the other ways to attach a
+// queue read it and adapt, so processes of different endianness agree on the geometry and the header. The lock words
+// and the counters are accessed atomically, so they're always in the native order of the process. It's ignored by
+// Open.
+func WithByteOrder(order binary.ByteOrder) Option {
+	return func(o *options) {
+		o.byteOrder = order
+	}
+}
+
+// WithCreateRetries sets how many times Create retries to adopt a queue that another process creates with the same key
+// at the same time. If both see that the key is free, one of them creates the queue, and the other one opens it
+// instead of failing with ErrAlreadyExist. It waits up to n milliseconds for the first one to initialize the queue,
+// and then fails with ErrInvalidMagic. The geometry must match, otherwise ErrGeometryMismatch is returned. The default
+// is 100.
+func WithCreateRetries(n int) Option {
+	return func(o *options) {
+		o.createRetries = n
+	}
+}
+
+// WithSchemaID sets the identifier of the message format. On Create it's stored in the queue, and on Open (and on
+// adopting an existing queue in Create or OpenOrCreate) the stored one must be equal to it, otherwise the call fails
+// with ErrSchemaMismatch. Bump it whenever the message struct changes, so consumers built for the old format don't
+// misinterpret the new messages. The default 0 means no schema: it's stored on Create and disables the check on Open.
+func WithSchemaID(id uint32) Option {
+	return func(o *options) {
+		o.schemaID = id
+	}
+}
+
+// WithMetadataSize adds a metadata region of n bytes to every message slot of a queue created with Create, for small
+// application-level headers like a type tag or a routing key, separate from the payload. Use EnqueueMeta and
+// DequeueMeta to access it; the other enqueue calls write zero metadata, and the other dequeue calls ignore it. On
+// adopting an existing queue in Create or OpenOrCreate, its metadata size must be equal to n, otherwise the call fails
+// with ErrGeometryMismatch. Open takes the size from the queue. The default is 0: no metadata.
+func WithMetadataSize(n uint32) Option {
+	return func(o *options) {
+		o.metaSize = n
+	}
+}
+
+// WithHeaderChecksum makes Create maintain a checksum of the params and the ring state of the header (the start index,
+// the queue length and the soft cap) to detect their corruption by a wild write early, instead of failing on impossible
+// indexes later. The checksum is updated on every release of the header lock and verified on every acquisition. On a
+// mismatch, the call fails and leaves the header as is: the calls that return an error return one wrapping
+// ErrHeaderCorrupt, like Ping does, the ones that report success with a bool return false, and the ones that only
+// return a value, like Cap, return zero. The setting is stored in the queue, so it applies to all processes that open
+// it. The atomic counters and flags aren't covered.
+func WithHeaderChecksum() Option {
+	return func(o *options) {
+		o.headerChecksum = true
+	}
+}
+
+// WithRunningChecksum makes Create maintain two running checksums in the header for end-to-end verification: one of
+// every message enqueued and one of every message dequeued, both reported by Stats. Once the queue is drained, a
+// consumer can compare the two to confirm that nothing was dropped or corrupted in transit: they're equal unless a
+// message was dropped (see Stats.Dropped) or modified in the shared memory. The setting is stored in the queue, so it
+// applies to all processes that open it.
+//
+// Each checksum is the sum (modulo 2^64) of the CRC-64 (ECMA) of the messages with their metadata, so concurrent
+// producers and consumers don't have to compute them in the FIFO order under the header lock. The price is that
+// swapped messages aren't detected. Every enqueue and dequeue costs a CRC of the message, computed under its lock.
+// Messages skipped with DequeueSkip count as dequeued, and Record writes aren't covered.
+func WithRunningChecksum() Option {
+	return func(o *options) {
+		o.runningSum = true
+	}
+}
+
+// WithTimestamps makes Create stamp every message with the time it's enqueued, stored in its slot along with the
+// metadata, so HeadAge can tell how long the oldest message has been waiting. The stamp is the wall clock time in Unix
+// nanoseconds, so the processes sharing the queue must agree on the clock. It costs 8 bytes per slot. The setting is
+// stored in the queue, so it applies to all processes that open it. Messages moved by TransferTry keep their stamps if
+// both queues have them.
+func WithTimestamps() Option {
+	return func(o *options) {
+		o.timestamps = true
+	}
+}
+
+// WithPriorityInheritance makes Create back the header lock with a priority-inheriting futex instead of the spinlock,
+// for real-time workloads (see docs/priority_inheritance.md). It's only supported on Linux, and ignored elsewhere.
+func WithPriorityInheritance() Option {
+	return func(o *options) {
+		o.lockPI = true
+	}
+}
+
+// WithStrictKey makes Create, OpenOrCreate and Open reject negative keys with ErrInvalidKey. Keys are 32-bit in the
+// kernel, and negative ones are handled inconsistently by tools like ipcs and across systems, so it's safer to stick
+// to positive keys. IPC_PRIVATE is rejected regardless of the option.
+func WithStrictKey() Option {
+	return func(o *options) {
+		o.strictKey = true
+	}
+}
@@ -0,0 +1,366 @@
+package shqueue
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The shared memory backends of a queue, as returned by Backend.
+const (
+	BackendSysV  = "sysv"
+	BackendPOSIX = "posix"
+)
+
+// posixShm is the POSIX shared memory object backing a queue created by CreateAuto when System V IPC is unavailable.
+// The object is a file in posixShmDir, which is what shm_open uses on Linux.
+type posixShm struct {
+	path string // Path of the object, like /dev/shm/name.
+	ino  uint64 // Inode of the object, which tells it from another one created with the same name after Delete.
+}
+
+// KeyForName maps the name of a queue to a System V key deterministically, so processes that agree on the name agree
+// on the key without coordination. It's the key CreateAuto and OpenAuto use, so a queue created by CreateAuto with the
+// System V backend can be opened with Open(KeyForName(name)) as well. The key is positive, so it passes WithStrictKey.
+// Different names may map to the same key, so keep the names of the queues on one system distinct in a few characters.
+func KeyForName(name string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	key := int(h.Sum32() &^ (1 << 31))
+	if key == unix.IPC_PRIVATE {
+		key = 1
+	}
+	return key
+}
+
+// CreateAuto works like Create, but identifies the queue by name rather than by key, and picks the backend itself. It
+// tries System V shared memory first, with the key KeyForName(name). If System V IPC is disabled, e.g. by the kernel
+// config or the seccomp profile of a container, it falls back to the POSIX shared memory object with the name, which
+// is what shm_open("/name") opens. Backend tells which one was chosen.
+//
+// The POSIX backend is only supported on Linux, and it doesn't support WithSemaphore and WithAttachAddr. An existing
+// object is reset, or adopted with WithRecover, and one that another process creates at the same time is adopted,
+// like a System V segment in Create. Such a queue can't be opened by key or ID, but only with OpenAuto, and
+// LockMemory locks its pages only in this process.
+func CreateAuto(name string, msgSize, maxLen uint32, opts ...Option) (*Queue, error) {
+	o := newOptions(opts)
+	key := KeyForName(name)
+	if sysvDisabled(key) {
+		return createPosix(name, 8*msgSize, maxLen, o)
+	}
+	return createBytes(key, 8*msgSize, maxLen, o)
+}
+
+// OpenAuto opens the queue created by CreateAuto with the name, whichever backend it has: the System V segment with
+// the key KeyForName(name), or if there's none, or System V IPC is disabled, the POSIX shared memory object with the
+// name.
+func OpenAuto(name string, opts ...Option) (*Queue, error) {
+	key := KeyForName(name)
+	if sysvDisabled(key) {
+		return openPosix(name, newOptions(opts))
+	}
+	queue, err := Open(key, opts...)
+	if err == nil || !errors.Is(err, ErrNotExist) {
+		return queue, err
+	}
+	queue, posixErr := openPosix(name, newOptions(opts))
+	if errors.Is(posixErr, ErrNotExist) && errors.Is(err, ErrNotExist) {
+		// The queue exists in neither backend.
+		return nil, err
+	}
+	return queue, posixErr
+}
+
+// Backend returns the shared memory backend of the queue: BackendSysV, or BackendPOSIX for a queue created by
+// CreateAuto when System V IPC is unavailable.
+func (q *Queue) Backend() string {
+	if q.posix != nil {
+		return BackendPOSIX
+	}
+	return BackendSysV
+}
+
+// sysvDisabled reports whether System V IPC is disabled, probing it with a plain shmget of the key.
+func sysvDisabled(key int) bool {
+	_, err := unix.SysvShmGet(key, 0, 0)
+	return sysvUnavailable(err)
+}
+
+// sysvUnavailable reports whether the error of a plain shmget means that System V IPC is disabled: the syscalls don't
+// exist in the kernel, or are forbidden by the sandbox. Only this shmget is checked, since the later calls may fail
+// with EPERM for other reasons, e.g. IPC_RMID on a segment of another user.
+func sysvUnavailable(err error) bool {
+	return err == unix.ENOSYS || err == unix.EPERM
+}
+
+// posixPath returns the path of the POSIX shared memory object with the name.
+func posixPath(name string) (string, error) {
+	if posixShmDir == "" {
+		return "", ErrNotSupported
+	}
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") || len(name) > 255 {
+		return "", fmt.Errorf("%w: POSIX shared memory name %q", ErrInvalidKey, name)
+	}
+	return posixShmDir + "/" + name, nil
+}
+
+// createPosix creates a queue backed by the POSIX shared memory object with the name.
+func createPosix(name string, dataSize, maxLen uint32, o options) (*Queue, error) {
+	const op = "create shared memory"
+	key := KeyForName(name)
+	if o.semaphore || o.attachAddr != 0 {
+		return nil, newQueueError(op, key, -1, fmt.Errorf(
+			"%w: WithSemaphore and WithAttachAddr can't be used with POSIX shared memory", ErrNotSupported,
+		))
+	}
+	path, err := posixPath(name)
+	if err != nil {
+		return nil, newQueueError(op, key, -1, err)
+	}
+	totalSize := totalShmSize(slotMsgSize(dataSize, o), maxLen)
+
+	create := false
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT {
+		create = true
+		fd, err = unix.Open(path, unix.O_RDWR|unix.O_CREAT|unix.O_EXCL|unix.O_CLOEXEC, uint32(o.access))
+		if err == unix.EEXIST {
+			// Another process has created the queue in between, so adopt it instead of resetting.
+			return adoptPosix(path, key, totalSize, dataSize, maxLen, o)
+		}
+	}
+	if err != nil {
+		return nil, wrapErrShmGet(err, create, key)
+	}
+	defer func() { _ = unix.Close(fd) }()
+	var stat unix.Stat_t
+	if err = unix.Fstat(fd, &stat); err != nil {
+		return nil, newQueueError(op, key, -1, fmt.Errorf("system error: %w", err))
+	}
+	existing := stat.Size >= int64(totalSize)
+	if existing && o.recover {
+		return recoverPosix(fd, posixShm{path: path, ino: uint64(stat.Ino)}, key, stat.Size, dataSize, maxLen, o)
+	}
+	if !existing {
+		if o.recover && stat.Size > 0 {
+			// The existing object is too small to hold the requested geometry.
+			return nil, newQueueError(op, key, -1, ErrGeometryMismatch)
+		}
+		if err = unix.Ftruncate(fd, int64(totalSize)); err != nil {
+			return nil, newQueueError(op, key, -1, fmt.Errorf("%w: %v", ErrInvalidSize, err))
+		}
+	}
+	mem, err := unix.Mmap(fd, 0, totalSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, wrapErrShmAttach(err, key, -1)
+	}
+	seg := newSegment(mem)
+	initSegment(seg, dataSize, maxLen, -1, o)
+
+	queue := newQueue(key, int(stat.Ino), seg, o)
+	queue.posix = &posixShm{path: path, ino: uint64(stat.Ino)}
+	queue.created = true
+	if err = queue.setup(); err != nil {
+		_ = queue.Close()
+		return nil, err
+	}
+	return queue, nil
+}
+
+// adoptPosix adopts the queue just created by another process in the POSIX shared memory object at the path, like
+// adoptQueue. Until the creator sizes the object and writes the magic, the attempts fail with ErrInvalidMagic and are
+// retried.
+func adoptPosix(path string, key, totalSize int, dataSize, maxLen uint32, o options) (*Queue, error) {
+	for i := 0; ; i++ {
+		queue, err := adoptPosixOnce(path, key, totalSize, dataSize, maxLen, o)
+		if err == nil || !errors.Is(err, ErrInvalidMagic) || i >= o.createRetries {
+			return queue, err
+		}
+		time.Sleep(createRetryInterval)
+	}
+}
+
+// adoptPosixOnce makes one attempt of adoptPosix.
+func adoptPosixOnce(path string, key, totalSize int, dataSize, maxLen uint32, o options) (*Queue, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, wrapErrShmGet(err, false, key)
+	}
+	defer func() { _ = unix.Close(fd) }()
+	var stat unix.Stat_t
+	if err = unix.Fstat(fd, &stat); err != nil {
+		return nil, newQueueError("open shared memory", key, -1, fmt.Errorf("system error: %w", err))
+	}
+	id := int(stat.Ino)
+	switch {
+	case stat.Size == 0:
+		// The creator hasn't sized the object yet.
+		return nil, newQueueError("recover queue", key, id, ErrInvalidMagic)
+	case stat.Size < int64(totalSize):
+		// The existing object is too small to hold the requested geometry.
+		return nil, newQueueError("open shared memory", key, id, ErrGeometryMismatch)
+	}
+	return recoverPosix(fd, posixShm{path: path, ino: uint64(stat.Ino)}, key, stat.Size, dataSize, maxLen, o)
+}
+
+// recoverPosix adopts the existing queue with the given geometry in the open POSIX shared memory object of the size as
+// is, keeping its messages, like recoverQueue.
+func recoverPosix(fd int, shm posixShm, key int, size int64, dataSize, maxLen uint32, o options) (*Queue, error) {
+	id := int(shm.ino)
+	if size > int64(maxInt) {
+		return nil, newQueueError("recover queue", key, id, ErrGeometryMismatch)
+	}
+	mem, err := unix.Mmap(fd, 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, wrapErrShmAttach(err, key, id)
+	}
+	seg, err := attachedSegment(mem)
+	if err != nil {
+		_ = unix.Munmap(mem)
+		return nil, newQueueError("recover queue", key, id, err)
+	}
+
+	queue := newQueue(key, id, seg, o)
+	queue.posix = &shm
+	if err = queue.checkGeometry(dataSize, maxLen); err == nil {
+		err = queue.checkMetaSize(o.metaSize)
+	}
+	if err == nil {
+		if err = seg.checkHeader(); err != nil {
+			err = newQueueError("recover queue", key, id, err)
+		}
+	}
+	if err == nil {
+		err = queue.setup()
+	}
+	if err != nil {
+		_ = queue.Close()
+		return nil, err
+	}
+	return queue, nil
+}
+
+// openPosix opens the queue backed by the POSIX shared memory object with the name.
+func openPosix(name string, o options) (*Queue, error) {
+	const op = "open shared memory"
+	key := KeyForName(name)
+	path, err := posixPath(name)
+	if err != nil {
+		return nil, newQueueError(op, key, -1, err)
+	}
+
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, wrapErrShmGet(err, false, key)
+	}
+	defer func() { _ = unix.Close(fd) }()
+	var stat unix.Stat_t
+	if err = unix.Fstat(fd, &stat); err != nil {
+		return nil, newQueueError(op, key, -1, fmt.Errorf("system error: %w", err))
+	}
+	id := int(stat.Ino)
+	if stat.Size < magicSize+paramsSize || stat.Size > int64(maxInt) {
+		return nil, newQueueError(op, key, id, ErrTooSmall)
+	}
+	mem, err := unix.Mmap(fd, 0, int(stat.Size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, wrapErrShmAttach(err, key, id)
+	}
+	seg, err := attachedSegment(mem)
+	if err != nil {
+		_ = unix.Munmap(mem)
+		return nil, newQueueError(op, key, id, err)
+	}
+
+	queue := newQueue(key, id, seg, o)
+	queue.posix = &posixShm{path: path, ino: uint64(stat.Ino)}
+	if err = queue.setup(); err != nil {
+		_ = queue.Close()
+		return nil, err
+	}
+	return queue, nil
+}
+
+// mapPosixByInode maps the POSIX shared memory object with the inode, which identifies it like an ID identifies a
+// System V segment.
+func mapPosixByInode(ino uint64) ([]byte, error) {
+	if posixShmDir == "" {
+		return nil, ErrNotSupported
+	}
+	entries, err := os.ReadDir(posixShmDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		path := posixShmDir + "/" + entry.Name()
+		var stat unix.Stat_t
+		if !entry.Type().IsRegular() || unix.Stat(path, &stat) != nil || uint64(stat.Ino) != ino {
+			continue
+		}
+		fd, err := unix.Open(path, unix.O_RDWR|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = unix.Close(fd) }()
+		if stat.Size < magicSize+paramsSize || stat.Size > int64(maxInt) {
+			return nil, ErrTooSmall
+		}
+		return unix.Mmap(fd, 0, int(stat.Size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	}
+	return nil, ErrNotExist
+}
+
+// close unmaps the object from the process memory.
+func (p *posixShm) close(q *Queue) error {
+	if err := unix.Munmap(q.seg.mem); err != nil {
+		return wrapErrShmDetach(err, q.key, q.id)
+	}
+	return nil
+}
+
+// delete unlinks the object, unless it's already replaced by another one with the same name.
+func (p *posixShm) delete(q *Queue) error {
+	deleted, err := p.isDeleted(q)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return newQueueError("delete shared memory", q.key, q.id, ErrRemovedID)
+	}
+	if err = unix.Unlink(p.path); err != nil {
+		return wrapErrShmDelete(err, q.key, q.id)
+	}
+	return nil
+}
+
+// isDeleted reports whether the object is unlinked, or replaced by another one with the same name.
+func (p *posixShm) isDeleted(q *Queue) (bool, error) {
+	var stat unix.Stat_t
+	err := unix.Stat(p.path, &stat)
+	switch {
+	case err == unix.ENOENT:
+		return true, nil
+	case err != nil:
+		return false, wrapErrShmStat(err, q.key, q.id)
+	default:
+		return uint64(stat.Ino) != p.ino, nil
+	}
+}
+
+// mode returns the permission bits of the object.
+func (p *posixShm) mode(q *Queue) (int, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(p.path, &stat); err != nil {
+		if err == unix.ENOENT {
+			return 0, newQueueError("stat shared memory", q.key, q.id, ErrRemovedID)
+		}
+		return 0, wrapErrShmStat(err, q.key, q.id)
+	}
+	return int(stat.Mode & 0777), nil
+}
@@ -0,0 +1,6 @@
+//go:build linux
+
+package shqueue
+
+// posixShmDir is the directory of POSIX shared memory objects: shm_open(name) opens posixShmDir + name.
+const posixShmDir = "/dev/shm"
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package shqueue
+
+// POSIX shared memory objects are only supported on Linux, where shm_open is a plain open in /dev/shm. Elsewhere the
+// POSIX backend returns ErrNotSupported.
+const posixShmDir = ""
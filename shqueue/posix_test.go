@@ -0,0 +1,191 @@
+package shqueue
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestKeyForName(t *testing.T) {
+	assert.Equal(t, KeyForName("orders"), KeyForName("orders"))
+	assert.NotEqual(t, KeyForName("orders"), KeyForName("payments"))
+	for _, name := range []string{"", "orders", "/orders", "a much longer name of a queue"} {
+		key := KeyForName(name)
+		assert.Positive(t, key)
+		assert.NoError(t, checkKey("create shared memory", key, newOptions([]Option{WithStrictKey()})))
+	}
+}
+
+func TestCreateAuto(t *testing.T) {
+	// testName returns a name that no other test uses.
+	testName := func(t *testing.T) string {
+		return fmt.Sprintf("shqueue-test-%d-%s", os.Getpid(), t.Name()[len("TestCreateAuto/"):])
+	}
+
+	t.Run("system v by default", func(t *testing.T) {
+		name := testName(t)
+		queue, err := CreateAuto(name, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+		assert.Equal(t, BackendSysV, queue.Backend())
+		require.True(t, queue.EnqueueTry(testMsgA))
+
+		opened, err := OpenAuto(name)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, opened.Close()) }()
+		assert.Equal(t, BackendSysV, opened.Backend())
+		toMsg := make([]byte, 16)
+		require.True(t, opened.DequeueTry(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+	})
+
+	t.Run("fall back when system v is disabled", func(t *testing.T) {
+		assert.True(t, sysvUnavailable(unix.ENOSYS))
+		assert.True(t, sysvUnavailable(unix.EPERM))
+		assert.False(t, sysvUnavailable(unix.ENOENT))
+		assert.False(t, sysvUnavailable(unix.EACCES))
+		assert.False(t, sysvUnavailable(nil))
+		// EPERM of a later step, e.g. deleting a too small segment of another user, doesn't mean System V is disabled.
+		assert.False(t, sysvUnavailable(newQueueError("delete shared memory", 1, 2, unix.EPERM)))
+		assert.False(t, sysvDisabled(KeyForName(t.Name())))
+	})
+
+	t.Run("posix backend", func(t *testing.T) {
+		name := testName(t)
+		queue, err := createPosix(name, 16, 5, newOptions(nil))
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, queue.Close()) }()
+		assert.Equal(t, BackendPOSIX, queue.Backend())
+		mode, err := queue.Mode()
+		require.NoError(t, err)
+		assert.Equal(t, defaultAccess, mode)
+
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+
+		// There's no System V segment with the key, so OpenAuto finds the POSIX one.
+		opened, err := OpenAuto(name)
+		require.NoError(t, err)
+		assert.Equal(t, BackendPOSIX, opened.Backend())
+		toMsg := make([]byte, 16)
+		require.True(t, opened.DequeueTry(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+		assert.Equal(t, 1, TransferTry(opened, testQueue(t, 0, 0), 1))
+		assert.NoError(t, opened.Close())
+
+		deleted, err := queue.IsDeleted()
+		require.NoError(t, err)
+		assert.False(t, deleted)
+		require.NoError(t, queue.Delete())
+		deleted, err = queue.IsDeleted()
+		require.NoError(t, err)
+		assert.True(t, deleted)
+		assert.ErrorIs(t, queue.Delete(), ErrRemovedID)
+
+		assert.Equal(t, ErrSegmentDeleted, queue.EnqueueTryErr(testMsgC))
+		_, err = OpenAuto(name)
+		assert.ErrorIs(t, err, ErrNotExist)
+	})
+
+	t.Run("posix backend recover and reset", func(t *testing.T) {
+		name := testName(t)
+		prev, err := createPosix(name, 16, 5, newOptions(nil))
+		require.NoError(t, err)
+		require.True(t, prev.EnqueueTry(testMsgA))
+		require.NoError(t, prev.Close())
+
+		recovered, err := createPosix(name, 16, 5, newOptions([]Option{WithRecover()}))
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), recovered.seg.getQueueLen())
+		require.NoError(t, recovered.Close())
+
+		_, err = createPosix(name, 24, 5, newOptions([]Option{WithRecover()}))
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+
+		reset, err := createPosix(name, 16, 5, newOptions(nil))
+		require.NoError(t, err)
+		assert.Zero(t, reset.seg.getQueueLen())
+		require.NoError(t, reset.Close())
+		require.NoError(t, reset.Delete())
+	})
+
+	t.Run("posix backend concurrent create", func(t *testing.T) {
+		name := testName(t)
+		for i := 0; i < 20; i++ {
+			var queues [2]*Queue
+			var errs [2]error
+			start := make(chan struct{})
+			done := make(chan struct{})
+			for j := range queues {
+				j := j
+				go func() {
+					<-start
+					queues[j], errs[j] = createPosix(name, 16, 5, newOptions(nil))
+					done <- struct{}{}
+				}()
+			}
+			close(start)
+			<-done
+			<-done
+
+			require.NoError(t, errs[0])
+			require.NoError(t, errs[1])
+			assert.Equal(t, queues[0].ExportID(), queues[1].ExportID())
+			require.True(t, queues[0].EnqueueTry(testMsgA))
+			assert.Equal(t, uint32(1), queues[1].seg.getQueueLen())
+
+			assert.NoError(t, queues[0].Close())
+			assert.NoError(t, queues[1].Close())
+			assert.NoError(t, queues[0].Delete())
+		}
+	})
+
+	t.Run("posix backend adopts object created in between", func(t *testing.T) {
+		name := testName(t)
+		path, err := posixPath(name)
+		require.NoError(t, err)
+		prev, err := createPosix(name, 16, 5, newOptions(nil))
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, prev.Close())
+			assert.NoError(t, prev.Delete())
+		}()
+		require.True(t, prev.EnqueueTry(testMsgA))
+
+		queue, err := adoptPosix(path, prev.key, totalShmSize(16, 5), 16, 5, newOptions(nil))
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, queue.Close()) }()
+		assert.False(t, queue.Created())
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+
+		_, err = adoptPosix(path, prev.key, totalShmSize(16, 6), 16, 6, newOptions(nil))
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+		_, err = adoptPosix(path, prev.key, totalShmSize(16, 4), 16, 4, newOptions(nil))
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+	})
+
+	t.Run("posix backend gives up waiting for object", func(t *testing.T) {
+		path, err := posixPath(testName(t))
+		require.NoError(t, err)
+		fd, err := unix.Open(path, unix.O_RDWR|unix.O_CREAT|unix.O_EXCL|unix.O_CLOEXEC, 0600)
+		require.NoError(t, err)
+		require.NoError(t, unix.Close(fd))
+		defer func() { assert.NoError(t, unix.Unlink(path)) }()
+
+		_, err = adoptPosix(path, 1, totalShmSize(16, 5), 16, 5, newOptions([]Option{WithCreateRetries(2)}))
+		assert.ErrorIs(t, err, ErrInvalidMagic)
+	})
+
+	t.Run("posix backend unsupported options", func(t *testing.T) {
+		_, err := createPosix(testName(t), 16, 5, newOptions([]Option{WithSemaphore()}))
+		assert.ErrorIs(t, err, ErrNotSupported)
+		_, err = createPosix("a/b", 16, 5, newOptions(nil))
+		assert.ErrorIs(t, err, ErrInvalidKey)
+	})
+}
@@ -2,301 +2,1857 @@ package shqueue
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
 type Queue struct {
-	key int
-	id  int
-	seg *segment
+	key   int
+	id    int
+	semID int // ID of the companion semaphore set, or -1. It's kept here, so Delete works after Close.
+	seg   *segment
+	opts  options
+	subs  subscribers
+
+	channel bool // The queue is a channel of a MultiQueue, which owns the segment.
+
+	posix *posixShm // POSIX shared memory object backing the queue (see CreateAuto), or nil for System V.
+
+	created bool // The queue was initialized by the call that returned it, see Created.
+
+	rrNext uint32 // Destination to try first in RoundRobinEnqueue if the queue is the first one. Accessed atomically.
+
+	deleted uint32 // Delete was called on this queue, so its operations fail with ErrSegmentDeleted. Accessed atomically.
 }
 
 const (
 	magicSize   = 8
-	paramsSize  = 8
-	headerSize  = 16
+	paramsSize  = 40
+	headerSize  = 464
 	msgLockSize = 8
-	access      = 0600
+
+	// shmLock and shmUnlock are the shmctl commands to lock and unlock the segment in memory.
+	shmLock   = 11
+	shmUnlock = 12
+	// shmDest is the SHM_DEST flag of shm_perm.mode: the segment is marked for destruction.
+	shmDest = 01000
+	// createRetryInterval is the interval between the attempts of Create to adopt a queue created by another process.
+	createRetryInterval = time.Millisecond
+	// maxOpenRetryInterval is the max interval between the attempts of OpenCtx and OpenWait to open a queue.
+	maxOpenRetryInterval = 100 * time.Millisecond
+	// pingLockTimeout is how long Ping waits for the header lock.
+	pingLockTimeout = 100 * time.Millisecond
+	// leaveGroupLockTimeout is how long Delete waits for the header lock to take the queue out of its group.
+	leaveGroupLockTimeout = 100 * time.Millisecond
+	// deletedCheckPeriod is the number of iterations after which the blocking calls check if the segment is deleted.
+	deletedCheckPeriod = 1024
 )
 
 // Create a new IPC shared memory queue.
-// key must be unique to the whole system.
+// key must be unique to the whole system. If a segment with the key already exists and is big enough, it's reused and
+// reset, so all its messages are lost. Otherwise, it's deleted and recreated. Pass WithRecover to keep the messages of
+// an existing queue instead, and use Created to tell whether it was kept.
 // msgSize is specified in 64-bit words. All messages in one queue must be of the same length.
 // maxLen is the max number of messages that the queue can hold at the same time.
 // In Linux, the actual total size of the queue will be rounded up to a multiple of PAGE_SIZE.
-func Create(key int, msgSize, maxLen uint32) (*Queue, error) {
-	msgSize *= 8
+func Create(key int, msgSize, maxLen uint32, opts ...Option) (*Queue, error) {
+	return CreateBytes(key, 8*msgSize, maxLen, opts...)
+}
+
+// CreateBytes works like Create, but msgSize is specified in bytes and may be any. Each message slot is padded up to
+// a multiple of 8 bytes, so the lock words stay aligned, but messages must be exactly msgSize bytes long, and
+// MessageSize returns msgSize.
+func CreateBytes(key int, msgSize, maxLen uint32, opts ...Option) (*Queue, error) {
+	return createBytes(key, msgSize, maxLen, newOptions(opts))
+}
+
+func createBytes(key int, msgSize, maxLen uint32, o options) (*Queue, error) {
+	if err := checkKey("create shared memory", key, o); err != nil {
+		return nil, err
+	}
+	dataSize := msgSize
+	msgSize = slotMsgSize(dataSize, o)
 	totalSize := totalShmSize(msgSize, maxLen)
 
 	create := false
-	id, err := unix.SysvShmGet(key, totalSize, access)
+	id, err := unix.SysvShmGet(key, totalSize, o.access)
 	if err == unix.ENOENT {
 		create = true
-		id, err = unix.SysvShmGet(key, totalSize, access|unix.IPC_CREAT|unix.IPC_EXCL)
+		id, err = unix.SysvShmGet(key, totalSize, o.access|unix.IPC_CREAT|unix.IPC_EXCL)
+		if err == unix.EEXIST {
+			// Another process has created the queue in between, so adopt it instead of resetting.
+			return adoptQueue(key, totalSize, dataSize, maxLen, o)
+		}
 	} else if err == unix.EINVAL {
-		err = deleteShm(key)
-		if err != nil {
-			return nil, err
+		if o.recover {
+			// The existing segment is too small to hold the requested geometry.
+			return nil, newQueueError("create shared memory", key, -1, ErrGeometryMismatch)
 		}
-		create = true
-		id, err = unix.SysvShmGet(key, totalSize, access|unix.IPC_CREAT|unix.IPC_EXCL)
+		return recreateQueue(key, totalSize, dataSize, maxLen, o)
 	}
 	if err != nil {
-		return nil, wrapErrShmGet(err, create)
+		return nil, wrapErrShmGet(err, create, key)
 	}
 
-	mem, err := unix.SysvShmAttach(id, 0, 0)
-	if err != nil {
-		return nil, wrapErrShmAttach(err)
+	if !create && o.recover {
+		return recoverQueue(key, id, totalSize, dataSize, maxLen, o)
 	}
+	return createQueue(key, id, totalSize, dataSize, maxLen, o)
+}
 
-	if !create {
-		mem = mem[:totalSize]
+// OpenOrCreate opens the queue with the given key if it exists, or creates it otherwise, and returns whether it was
+// created. Unlike calling Open and Create in turn, it's atomic: if several processes call it at the same time, exactly
+// one of them creates the queue, and the others open it. An existing queue is never reset, and if its geometry differs
+// from the requested one, an error wrapping ErrGeometryMismatch is returned.
+// msgWords and maxLen are the same as in Create.
+func OpenOrCreate(key int, msgWords, maxLen uint32, opts ...Option) (q *Queue, created bool, err error) {
+	o := newOptions(opts)
+	if err = checkKey("create shared memory", key, o); err != nil {
+		return nil, false, err
 	}
+	dataSize := 8 * msgWords
+	totalSize := totalShmSize(slotMsgSize(dataSize, o), maxLen)
 
-	seg := newSegment(mem)
-	seg.setMagic()
-	seg.setMsgSize(msgSize)
-	seg.setMaxLen(maxLen)
-	seg.setStartIdx(0)
-	seg.setQueueLen(0)
+	id, err := unix.SysvShmGet(key, totalSize, o.access|unix.IPC_CREAT|unix.IPC_EXCL)
+	if err == unix.EEXIST {
+		q, err = adoptQueue(key, totalSize, dataSize, maxLen, o)
+		return q, false, err
+	}
+	if err != nil {
+		return nil, false, wrapErrShmGet(err, true, key)
+	}
+	q, err = createQueue(key, id, totalSize, dataSize, maxLen, o)
+	if err != nil {
+		return nil, false, err
+	}
+	return q, true, nil
+}
 
-	return newQueue(key, id, seg), nil
+// CreatePrivate creates a new IPC shared memory queue that has no key (IPC_PRIVATE is used instead). It can't be
+// opened with Open, so it's only reachable within this process and its children forked after the call, or by its
+// segment ID. It never collides with other queues, which makes it perfect for tests.
+// msgSize and maxLen are the same as in Create.
+func CreatePrivate(msgSize, maxLen uint32, opts ...Option) (*Queue, error) {
+	return createPrivate(8*msgSize, maxLen, newOptions(opts))
 }
 
-func deleteShm(key int) error {
-	id, err := unix.SysvShmGet(key, 0, access)
+// createPrivate works like CreatePrivate, but dataSize is specified in bytes, like in CreateBytes.
+func createPrivate(dataSize, maxLen uint32, o options) (*Queue, error) {
+	totalSize := totalShmSize(slotMsgSize(dataSize, o), maxLen)
+
+	id, err := unix.SysvShmGet(unix.IPC_PRIVATE, totalSize, o.access|unix.IPC_CREAT)
 	if err != nil {
-		return wrapErrShmGet(err, false)
+		return nil, wrapErrShmGet(err, true, unix.IPC_PRIVATE)
 	}
-	_, err = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+	queue, err := createQueue(unix.IPC_PRIVATE, id, totalSize, dataSize, maxLen, o)
 	if err != nil {
-		return wrapErrShmDelete(err)
+		// Nobody else can find the segment, so don't leak it.
+		_, _ = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+		return nil, err
 	}
-	return nil
+	return queue, nil
 }
 
-// Open an existing IPC shared memory queue.
-func Open(key int) (*Queue, error) {
-	id, seg, err := openShm(key, paramsSize)
+// CreateFitPage works like Create, but picks maxLen itself: the largest one, not less than minLen, that fits into the
+// number of pages needed for minLen messages. Since Linux rounds the segment size up to a multiple of PAGE_SIZE anyway,
+// this uses the tail of the last page instead of wasting it. The chosen maxLen is returned along with the queue.
+// msgWords is the message size in 64-bit words, as in Create.
+func CreateFitPage(key int, msgWords, minLen uint32, opts ...Option) (q *Queue, maxLen uint32, err error) {
+	maxLen = fitPageLen(slotMsgSize(msgWords*8, newOptions(opts)), minLen, uint64(os.Getpagesize()))
+	q, err = Create(key, msgWords, maxLen, opts...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	totalSize := totalShmSize(seg.getMsgSize(), seg.getMaxLen())
-	err = unix.SysvShmDetach(seg.mem)
-	if err != nil {
-		return nil, wrapErrShmDetach(err)
+	return q, maxLen, nil
+}
+
+// fitPageLen returns the largest max length, not less than minLen, of a queue with messages of msgSize bytes that fits
+// into the number of pages needed for minLen messages.
+func fitPageLen(msgSize, minLen uint32, pageSize uint64) uint32 {
+	size := uint64(totalShmSize(msgSize, minLen))
+	pagesSize := (size + pageSize - 1) / pageSize * pageSize
+	maxLen := (pagesSize - magicSize - paramsSize - headerSize) / (uint64(msgSize) + msgLockSize)
+	if maxLen > math.MaxUint32 {
+		maxLen = math.MaxUint32
 	}
+	return uint32(maxLen)
+}
 
-	id, seg, err = openShm(key, totalSize)
+// createQueue initializes a new queue in the segment. dataSize is the message size in bytes, as requested by the user.
+func createQueue(key, id, totalSize int, dataSize, maxLen uint32, o options) (*Queue, error) {
+	mem, err := attachShm(key, id, o)
 	if err != nil {
 		return nil, err
 	}
+	mem = mem[:totalSize]
+
+	seg := newSegment(mem)
+	if seg.checkMagic() == nil && seg.checkVersion() == nil {
+		// The segment is reused, so its old semaphore set would leak, and its old messages would keep counting in its
+		// group.
+		if semID := seg.getSemID(); semID >= 0 {
+			_ = removeSem(semID)
+		}
+		leaveGroup(seg)
+	}
+	semID := -1
+	if o.semaphore {
+		semID, err = createSem(o.access)
+		if err != nil {
+			_ = unix.SysvShmDetach(mem)
+			return nil, wrapErrSemGet(err, key, id)
+		}
+	}
+
+	initSegment(seg, dataSize, maxLen, semID, o)
+
+	queue := newQueue(key, id, seg, o)
+	queue.created = true
+	if err = queue.setup(); err != nil {
+		_ = queue.Close()
+		return nil, err
+	}
+	return queue, nil
+}
 
-	return newQueue(key, id, seg), nil
+// initSegment writes the params and resets the header of a new queue with messages of dataSize bytes.
+func initSegment(seg *segment, dataSize, maxLen uint32, semID int, o options) {
+	if o.byteOrder != nil {
+		seg.byteOrder = o.byteOrder
+	} else {
+		seg.byteOrder = detectByteOrder()
+	}
+	seg.setByteOrder()
+	seg.setVersion()
+	seg.setMsgSize(slotMsgSize(dataSize, o))
+	seg.setDataSize(dataSize)
+	seg.setMetaSize(o.metaSize)
+	seg.setMaxLen(maxLen)
+	seg.setSemID(semID)
+	seg.setGroupID(-1)
+	if o.group != nil {
+		seg.setGroupID(o.group.id)
+	}
+	seg.setSchemaID(o.schemaID)
+	seg.setLockPI(o.lockPI && lockPISupported)
+	seg.resetHeader()
+	seg.setSoftCap(maxLen)
+	seg.resetStats(time.Now().UnixNano())
+	seg.syncSem()
+	if o.headerChecksum {
+		seg.setChecksummed()
+		seg.updateHeaderChecksum()
+	}
+	if o.runningSum {
+		seg.setRunningChecksum()
+	}
+	if o.timestamps {
+		seg.setTimestamped()
+	}
+	// The magic is written last, so a process that races to create the same queue (see adoptQueue) sees a complete
+	// queue once it sees the magic.
+	seg.setMagic()
 }
 
-func openShm(key, size int) (id int, seg *segment, err error) {
-	id, err = unix.SysvShmGet(key, size, access)
-	if err != nil {
-		return 0, nil, wrapErrShmGet(err, false)
+// adoptQueue opens the queue that another process has just created with the same key, keeping its messages. The
+// other process may still be initializing it, so the magic is awaited for a while (see WithCreateRetries). The geometry
+// must match.
+func adoptQueue(key, totalSize int, dataSize, maxLen uint32, o options) (*Queue, error) {
+	id, err := unix.SysvShmGet(key, totalSize, o.access)
+	if err == unix.EINVAL {
+		// The existing segment is too small to hold the requested geometry.
+		return nil, newQueueError("open shared memory", key, -1, ErrGeometryMismatch)
 	}
-	mem, err := unix.SysvShmAttach(id, 0, 0)
 	if err != nil {
-		return 0, nil, wrapErrShmAttach(err)
+		return nil, wrapErrShmGet(err, false, key)
 	}
-	seg = newSegment(mem)
-	if err = seg.checkMagic(); err != nil {
-		return 0, nil, err
+	for i := 0; ; i++ {
+		queue, err := recoverQueue(key, id, totalSize, dataSize, maxLen, o)
+		if err == nil || !errors.Is(err, ErrInvalidMagic) || i >= o.createRetries {
+			return queue, err
+		}
+		time.Sleep(createRetryInterval)
 	}
-	return id, seg, nil
 }
 
-func totalShmSize(msgSize, maxLen uint32) int {
-	return int(magicSize + paramsSize + headerSize + ((msgSize + msgLockSize) * maxLen))
+// recoverQueue adopts the existing queue with the given geometry as is, keeping its messages.
+func recoverQueue(key, id, totalSize int, dataSize, maxLen uint32, o options) (*Queue, error) {
+	mem, err := attachShm(key, id, o)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := attachedSegment(mem)
+	if err != nil {
+		_ = unix.SysvShmDetach(mem)
+		return nil, newQueueError("recover queue", key, id, err)
+	}
+
+	queue := newQueue(key, id, seg, o)
+	if err = queue.checkGeometry(dataSize, maxLen); err == nil {
+		err = queue.checkMetaSize(o.metaSize)
+	}
+	if err == nil {
+		err = seg.checkHeader()
+		if err != nil {
+			err = newQueueError("recover queue", key, id, err)
+		}
+	}
+	if err == nil {
+		err = queue.setup()
+	}
+	if err != nil {
+		_ = queue.Close()
+		return nil, err
+	}
+	return queue, nil
 }
 
-func newQueue(key, id int, seg *segment) *Queue {
-	return &Queue{
-		key: key,
-		id:  id,
-		seg: seg,
+// recreateQueue replaces the segment with the key, which is too small for the requested geometry, with a new queue.
+// Other processes may be doing the same at the same time, so the segment is deleted only while it's still too small,
+// and a segment that fits, recreated by another process in between, is adopted like in OpenOrCreate, keeping its
+// messages. If the key is taken again between the deletion and the creation, the sequence is retried up to
+// createRetries times (see WithCreateRetries).
+func recreateQueue(key, totalSize int, dataSize, maxLen uint32, o options) (*Queue, error) {
+	for i := 0; ; i++ {
+		fits, err := deleteSmallShm(key, totalSize)
+		if err != nil {
+			return nil, err
+		}
+		if fits {
+			return adoptQueue(key, totalSize, dataSize, maxLen, o)
+		}
+		id, err := unix.SysvShmGet(key, totalSize, o.access|unix.IPC_CREAT|unix.IPC_EXCL)
+		if err == nil {
+			return createQueue(key, id, totalSize, dataSize, maxLen, o)
+		}
+		if err != unix.EEXIST || i >= o.createRetries {
+			return nil, wrapErrShmGet(err, true, key)
+		}
 	}
 }
 
-// Close this IPC shared memory queue: that is, detach it from the process memory. The queue will continue to exist in
-// the system until Delete is called.
-func (q *Queue) Close() error {
-	err := unix.SysvShmDetach(q.seg.mem)
+// deleteSmallShm marks the shared memory with the given key as deleted if it's smaller than size, and returns true if
+// it isn't: then it's left as is. The segment is deleted by its ID, so a segment that another process has recreated
+// with the same key in between is never deleted by mistake. A missing segment isn't an error.
+func deleteSmallShm(key, size int) (fits bool, err error) {
+	id, err := unix.SysvShmGet(key, 0, 0)
+	if err == unix.ENOENT {
+		return false, nil
+	}
 	if err != nil {
-		return wrapErrShmDetach(err)
+		return false, wrapErrShmGet(err, false, key)
 	}
-	return nil
+	var desc unix.SysvShmDesc
+	_, err = unix.SysvShmCtl(id, unix.IPC_STAT, &desc)
+	if err == unix.EIDRM || err == unix.EINVAL {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapErrShmStat(err, key, id)
+	}
+	if uint64(desc.Segsz) >= uint64(size) {
+		return true, nil
+	}
+	_, err = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+	if err != nil && err != unix.EIDRM && err != unix.EINVAL {
+		return false, wrapErrShmDelete(err, key, id)
+	}
+	return false, nil
 }
 
-// Delete this IPC shared memory queue from the system. In fact, the queue will continue to exist (although it will be
-// impossible to Open it) until all processes Close it.
-func (q *Queue) Delete() error {
-	_, err := unix.SysvShmCtl(q.id, unix.IPC_RMID, nil)
+// deleteShm marks the shared memory with the given key as deleted. The segment is looked up with zero permission bits,
+// because only its existence matters here: the permission to delete it is checked by IPC_RMID itself, while requesting
+// the queue access mode could fail for a segment created by someone else with different permissions.
+func deleteShm(key int) error {
+	id, err := unix.SysvShmGet(key, 0, 0)
 	if err != nil {
-		return wrapErrShmDelete(err)
+		return wrapErrShmGet(err, false, key)
+	}
+	_, err = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+	if err != nil {
+		return wrapErrShmDelete(err, key, id)
 	}
 	return nil
 }
 
-func (q *Queue) EnqueueShift(msg []byte) {
-	q.seg.lockHeader()
+// Open an existing IPC shared memory queue.
+func Open(key int, opts ...Option) (*Queue, error) {
+	o := newOptions(opts)
+	if err := checkKey("open shared memory", key, o); err != nil {
+		return nil, err
+	}
+	id, seg, err := openShm(key, o)
+	if err != nil {
+		return nil, err
+	}
 
-	curLen := q.seg.getQueueLen()
-	maxLen := q.seg.getMaxLen()
-	startIdx := q.seg.getStartIdx()
+	queue := newQueue(key, id, seg, o)
+	if err = queue.setup(); err != nil {
+		_ = queue.Close()
+		return nil, err
+	}
+	return queue, nil
+}
 
-	msgIdx := startIdx + curLen
-	msgIdx %= maxLen
+// OpenCtx works like Open, but retries on transient errors caused by momentary resource exhaustion, ErrNoMem and
+// ErrTooManyFiles, until it succeeds or the context is done. The interval between the attempts grows exponentially up
+// to 100ms. Other errors, like ErrNotExist or ErrNoAccess, are returned immediately. If the context is done first,
+// ctx.Err() is returned.
+func OpenCtx(ctx context.Context, key int, opts ...Option) (*Queue, error) {
+	return retryTransient(ctx, func() (*Queue, error) {
+		return Open(key, opts...)
+	})
+}
 
-	if curLen < maxLen {
-		q.seg.setQueueLen(curLen + 1)
-	} else {
-		startIdx++
-		startIdx %= maxLen
-		q.seg.setStartIdx(startIdx)
-	}
+// OpenWait works like OpenCtx, but also waits for the queue to be created: it retries on ErrNotExist, so a consumer
+// may start before the producer. Other errors, like ErrNoAccess or ErrInvalidMagic, are returned immediately. If the
+// context is done first, ctx.Err() is returned.
+func OpenWait(ctx context.Context, key int, opts ...Option) (*Queue, error) {
+	return retryOpen(ctx, func() (*Queue, error) {
+		return Open(key, opts...)
+	}, func(err error) bool {
+		return errors.Is(err, ErrNotExist) || isTransientErr(err)
+	})
+}
 
-	q.seg.lockMsg(msgIdx)
-	q.seg.setMsgData(msgIdx, msg)
-	q.seg.unlockHeader()
-	q.seg.unlockMsg(msgIdx)
+// retryTransient calls open until it succeeds, returns a permanent error or the context is done.
+func retryTransient(ctx context.Context, open func() (*Queue, error)) (*Queue, error) {
+	return retryOpen(ctx, open, isTransientErr)
 }
 
-func (q *Queue) EnqueueBlock(ctx context.Context, msg []byte) (err error) {
-	var curLen, maxLen uint32
-	for i := 0; ; i++ {
+// retryOpen calls open until it succeeds, returns an error that isn't retryable or the context is done.
+func retryOpen(ctx context.Context, open func() (*Queue, error), retryable func(error) bool) (*Queue, error) {
+	interval := createRetryInterval
+	for {
+		queue, err := open()
+		if err == nil || !retryable(err) {
+			return queue, err
+		}
+
+		timer := time.NewTimer(interval)
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		default:
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
 			// Go on.
 		}
-
-		curLen = q.seg.getQueueLen()
-		maxLen = q.seg.getMaxLen()
-		if curLen < maxLen {
-			q.seg.lockHeader()
-			curLen = q.seg.getQueueLen()
-			maxLen = q.seg.getMaxLen()
-			if curLen >= maxLen {
-				q.seg.unlockHeader()
-				continue
-			}
-			break
-		}
-		wait := time.Duration(i)
-		if wait > time.Millisecond {
-			wait = time.Millisecond
+		if interval *= 2; interval > maxOpenRetryInterval {
+			interval = maxOpenRetryInterval
 		}
-		time.Sleep(wait)
 	}
+}
 
-	q.seg.setQueueLen(curLen + 1)
+// isTransientErr returns whether the error is caused by a momentary lack of resources, so a retry may succeed.
+func isTransientErr(err error) bool {
+	return errors.Is(err, ErrNoMem) || errors.Is(err, ErrTooManyFiles)
+}
 
-	startIdx := q.seg.getStartIdx()
-	msgIdx := startIdx + curLen
-	msgIdx %= maxLen
+// OpenExpect opens an existing IPC shared memory queue like Open, and then checks that its geometry is the expected
+// one: msgSize (in 64-bit words, as in Create) and maxLen. Otherwise, the queue is closed and an error wrapping
+// ErrGeometryMismatch is returned. This catches a producer and a consumer that disagree on the message format at attach
+// time instead of the first message.
+func OpenExpect(key int, msgSize, maxLen uint32, opts ...Option) (*Queue, error) {
+	queue, err := Open(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = queue.checkGeometry(8*msgSize, maxLen); err != nil {
+		_ = queue.Close()
+		return nil, err
+	}
+	return queue, nil
+}
 
-	q.seg.lockMsg(msgIdx)
-	q.seg.setMsgData(msgIdx, msg)
-	q.seg.unlockHeader()
-	q.seg.unlockMsg(msgIdx)
+// checkGeometry checks that the queue has the given msgSize (in bytes) and maxLen.
+func (q *Queue) checkGeometry(msgSize, maxLen uint32) error {
+	actualMsgSize := q.seg.getDataSize()
+	actualMaxLen := q.seg.getMaxLen()
+	if actualMsgSize != msgSize || actualMaxLen != maxLen {
+		return newQueueError("check geometry", q.key, q.id, fmt.Errorf(
+			"%w: message size %d bytes and max length %d, expected %d bytes and %d",
+			ErrGeometryMismatch, actualMsgSize, actualMaxLen, msgSize, maxLen,
+		))
+	}
+	return nil
+}
 
+// checkMetaSize checks that the queue has the given metadata size (see WithMetadataSize).
+func (q *Queue) checkMetaSize(metaSize uint32) error {
+	if actual := q.seg.getMetaSize(); actual != metaSize {
+		return newQueueError("check geometry", q.key, q.id, fmt.Errorf(
+			"%w: metadata size %d bytes, expected %d", ErrGeometryMismatch, actual, metaSize,
+		))
+	}
 	return nil
 }
 
-func (q *Queue) EnqueueTry(msg []byte) (ok bool) {
-	q.seg.lockHeader()
+// openShm attaches the segment with the key and validates the queue in it. The segment is attached once: shmat maps
+// the whole segment regardless of the size passed to shmget, and the params at its start tell the size of the queue.
+func openShm(key int, o options) (id int, seg *segment, err error) {
+	id, err = unix.SysvShmGet(key, paramsSize, o.access)
+	if err != nil {
+		return 0, nil, wrapErrShmGet(err, false, key)
+	}
+	mem, err := attachShm(key, id, o)
+	if err != nil {
+		return 0, nil, err
+	}
+	seg, err = attachedSegment(mem)
+	if err != nil {
+		_ = unix.SysvShmDetach(mem)
+		return 0, nil, newQueueError("open shared memory", key, id, err)
+	}
+	return id, seg, nil
+}
 
-	curLen := q.seg.getQueueLen()
-	maxLen := q.seg.getMaxLen()
-	if curLen >= maxLen {
-		q.seg.unlockHeader()
-		return false
+// attachShm attaches the segment at the address requested with WithAttachAddr, or at any address by default.
+func attachShm(key, id int, o options) ([]byte, error) {
+	mem, err := unix.SysvShmAttach(id, o.attachAddr, 0)
+	if err != nil {
+		if o.attachAddr != 0 && err == unix.EINVAL {
+			return nil, newQueueError("attach to shared memory", key, id, ErrAttachAddr)
+		}
+		return nil, wrapErrShmAttach(err, key, id)
+	}
+	if o.attachAddr != 0 && uintptr(unsafe.Pointer(&mem[0])) != o.attachAddr {
+		_ = unix.SysvShmDetach(mem)
+		return nil, newQueueError("attach to shared memory", key, id, ErrAttachAddr)
 	}
+	return mem, nil
+}
 
-	q.seg.setQueueLen(curLen + 1)
+// AttachByID attaches an existing IPC shared memory queue by its segment ID, which another process got from ExportID.
+// It's the way to share a queue created by CreatePrivate, but works for any queue. Like Open, it reads the queue
+// parameters from the segment.
+func AttachByID(id int, opts ...Option) (*Queue, error) {
+	o := newOptions(opts)
 
-	startIdx := q.seg.getStartIdx()
-	msgIdx := startIdx + curLen
-	msgIdx %= maxLen
+	var desc unix.SysvShmDesc
+	_, err := unix.SysvShmCtl(id, unix.IPC_STAT, &desc)
+	if err != nil {
+		return nil, wrapErrShmStat(err, unix.IPC_PRIVATE, id)
+	}
+	key := shmKey(&desc)
 
-	q.seg.lockMsg(msgIdx)
-	q.seg.setMsgData(msgIdx, msg)
-	q.seg.unlockHeader()
-	q.seg.unlockMsg(msgIdx)
+	mem, err := attachShm(key, id, o)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := attachedSegment(mem)
+	if err != nil {
+		_ = unix.SysvShmDetach(mem)
+		return nil, newQueueError("attach to shared memory", key, id, err)
+	}
 
-	return true
+	queue := newQueue(key, id, seg, o)
+	if err = queue.setup(); err != nil {
+		_ = queue.Close()
+		return nil, err
+	}
+	return queue, nil
 }
 
-func (q *Queue) DequeueBlock(ctx context.Context, toMsg []byte) (err error) {
-	var curLen uint32
-	for i := 0; ; i++ {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			// Go on.
-		}
+// attachedSegment validates that the attached memory contains a queue and trims it to the queue size.
+func attachedSegment(mem []byte) (*segment, error) {
+	if len(mem) < magicSize+paramsSize {
+		return nil, ErrTooSmall
+	}
+	seg := newSegment(mem)
+	if err := seg.checkMagic(); err != nil {
+		return nil, err
+	}
+	if err := seg.checkVersion(); err != nil {
+		return nil, err
+	}
+	if err := checkAlignment(mem, seg.getMsgSize()); err != nil {
+		return nil, err
+	}
+	if seg.isLockPI() && !lockPISupported {
+		return nil, ErrNotSupported
+	}
+	totalSize := totalShmSize(seg.getMsgSize(), seg.getMaxLen())
+	if len(mem) < totalSize {
+		return nil, ErrTooSmall
+	}
+	seg.mem = mem[:totalSize]
+	if err := seg.checkSlots(); err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
 
-		curLen = q.seg.getQueueLen()
-		if curLen > 0 {
-			q.seg.lockHeader()
-			curLen = q.seg.getQueueLen()
-			if curLen == 0 {
-				q.seg.unlockHeader()
-				continue
-			}
-			break
-		}
-		wait := time.Duration(i)
-		if wait > time.Millisecond {
-			wait = time.Millisecond
-		}
-		time.Sleep(wait)
+// slotMsgSize returns the size of a slot without the lock for messages of dataSize bytes with the options: the
+// timestamp (see WithTimestamps), the metadata and the data, padded to a multiple of 8 bytes.
+func slotMsgSize(dataSize uint32, o options) uint32 {
+	size := padMsgSize(o.metaSize + dataSize)
+	if o.timestamps {
+		size += msgTimeSize
 	}
+	return size
+}
 
-	q.seg.setQueueLen(curLen - 1)
+// padMsgSize rounds the message size up to a multiple of 8 bytes.
+func padMsgSize(size uint32) uint32 {
+	return (size + 7) &^ 7
+}
 
-	startIdx := q.seg.getStartIdx()
-	maxLen := q.seg.getMaxLen()
-	q.seg.setStartIdx((startIdx + 1) % maxLen)
+func totalShmSize(msgSize, maxLen uint32) int {
+	return int(magicSize + paramsSize + headerSize + ((uint64(msgSize) + msgLockSize) * uint64(maxLen)))
+}
 
-	q.seg.lockMsg(startIdx)
-	q.seg.unlockHeader()
-	q.seg.getMsgData(startIdx, toMsg)
-	q.seg.unlockMsg(startIdx)
+func newQueue(key, id int, seg *segment, opts options) *Queue {
+	seg.maxSpinSleep = opts.maxSpinSleep
+	seg.backoff = opts.backoff
+	seg.slowThreshold = opts.slowThreshold
+	seg.slowLog = opts.slowLog
+	return &Queue{
+		key:   key,
+		id:    id,
+		semID: seg.getSemID(),
+		seg:   seg,
+		opts:  opts,
+	}
+}
 
-	return nil
+// BaseAddr returns the virtual address the queue segment is attached at in this process.
+func (q *Queue) BaseAddr() uintptr {
+	return uintptr(unsafe.Pointer(&q.seg.mem[0]))
 }
 
-func (q *Queue) DequeueTry(toMsg []byte) (ok bool) {
-	q.seg.lockHeader()
+// MessageSize returns the size of messages in this queue in bytes.
+func (q *Queue) MessageSize() int {
+	return int(q.seg.getDataSize())
+}
 
-	curLen := q.seg.getQueueLen()
-	if curLen == 0 {
-		q.seg.unlockHeader()
-		return false
-	}
+// NewMessageBuffer returns a new buffer of MessageSize bytes, the recommended way to get buffers for the dequeue calls.
+// Create takes the message size in 64-bit words, while the buffers are in bytes, so a buffer sized by hand is easy to
+// get wrong, and the calls panic on it.
+func (q *Queue) NewMessageBuffer() []byte {
+	return make([]byte, q.seg.getDataSize())
+}
+
+// SchemaID returns the schema ID stored in the queue on creation (see WithSchemaID), or 0 if there is none.
+func (q *Queue) SchemaID() uint32 {
+	return q.seg.getSchemaID()
+}
+
+// Created reports whether the queue was initialized by the call that returned this *Queue: a new segment was created,
+// or an existing one was reset by Create. Then the queue starts empty, and one-time initialization, like seeding
+// initial messages, is up to this process. It's false if an existing queue was opened or adopted with its messages:
+// by Open or AttachByID, by Create with WithRecover, or by Create and OpenOrCreate when another process has created the
+// queue first. After OpenOrCreate, it's the same as the returned created flag.
+func (q *Queue) Created() bool {
+	return q.created
+}
+
+// ExportID returns the ID of the shared memory segment of this queue. Pass it to another process (e.g. a forked child)
+// to attach the queue with AttachByID. A queue backed by POSIX shared memory (see CreateAuto) has no segment ID, and
+// the inode of its object is returned instead, which AttachByID doesn't accept.
+func (q *Queue) ExportID() int {
+	return q.id
+}
+
+// setup checks the schema ID and applies the per-process options to a just created or opened queue.
+func (q *Queue) setup() error {
+	if err := q.setupGroup(); err != nil {
+		return err
+	}
+	if q.opts.schemaID != 0 {
+		if schemaID := q.seg.getSchemaID(); schemaID != q.opts.schemaID {
+			return newQueueError("check schema", q.key, q.id, fmt.Errorf(
+				"%w: schema ID %d, expected %d", ErrSchemaMismatch, schemaID, q.opts.schemaID,
+			))
+		}
+	}
+	if q.opts.lockedMemory {
+		if err := q.LockMemory(); err != nil {
+			return err
+		}
+	}
+	if q.opts.eventFD {
+		if err := q.setupEventFDs(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close this IPC shared memory queue: that is, detach it from the process memory. The queue will continue to exist in
+// the system until Delete is called.
+func (q *Queue) Close() error {
+	if q.channel {
+		return newQueueError("detach from shared memory", q.key, q.id, errChannel)
+	}
+	if q.seg.events != nil {
+		q.seg.stopWatchingEvents()
+		q.seg.events.close()
+		q.seg.events = nil
+	}
+	q.closeGroup()
+	if q.posix != nil {
+		return q.posix.close(q)
+	}
+	err := unix.SysvShmDetach(q.seg.mem)
+	if err != nil {
+		return wrapErrShmDetach(err, q.key, q.id)
+	}
+	return nil
+}
+
+// CloseQueue signals all processes that no more messages are coming, like closing a Go channel. Unlike Close, it
+// doesn't detach the queue. Once it's closed, EnqueueBlock and EnqueueVarTry return an error wrapping ErrQueueClosed,
+// and the other enqueue calls enqueue nothing and return false. Consumers still dequeue the remaining messages, and
+// then DequeueBlock, DequeueBatchBlock and WaitDepth return an error wrapping ErrQueueClosed instead of waiting
+// forever. A closed queue can't be reopened for producers: create a new one instead.
+func (q *Queue) CloseQueue() {
+	// The flag isn't covered by the header checksum, so the queue is closed even if the header is corrupted.
+	err := q.seg.lockHeader()
+	q.seg.setClosed()
+	q.seg.notifyEvents()
+	if err == nil {
+		q.seg.syncEvents()
+		q.seg.unlockHeader()
+	}
+}
+
+// Delete this IPC shared memory queue from the system. In fact, the queue will continue to exist (although it will be
+// impossible to Open it) until all processes Close it. The companion IPC objects, like the semaphore set (see
+// WithSemaphore), are removed immediately, so the calls blocked on them return an error wrapping ErrSegmentDeleted.
+// If some of them can't be removed, the others are removed anyway, and the first error is returned. A queue in a group
+// (see WithGroup) leaves it.
+//
+// Once the segment is deleted, enqueue, dequeue and peek calls on this *Queue fail with ErrSegmentDeleted instead of
+// working with the memory that vanishes on Close: the bool-returning ones return false, and the Try*Err ones return it
+// unwrapped. Other processes aren't affected until they check IsDeleted. Delete only during shutdown, after the
+// operations of this process have ceased, and Close right after it.
+func (q *Queue) Delete() error {
+	if !q.channel {
+		q.leaveGroupOnDelete()
+	}
+	if err := q.delete(); err != nil {
+		return err
+	}
+	atomic.StoreUint32(&q.deleted, 1)
+	return nil
+}
+
+// delete works like Delete, but the queue keeps working in this process.
+func (q *Queue) delete() error {
+	if q.channel {
+		return newQueueError("delete shared memory", q.key, q.id, errChannel)
+	}
+	if q.posix != nil {
+		return q.posix.delete(q)
+	}
+	_, err := unix.SysvShmCtl(q.id, unix.IPC_RMID, nil)
+	if err != nil {
+		return wrapErrShmDelete(err, q.key, q.id)
+	}
+	for _, c := range q.companions() {
+		if removeErr := c.remove(); removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// companion is an IPC object created along with the queue, which lives and dies with it.
+type companion struct {
+	remove func() error // Removes the object. An object that's already removed isn't an error.
+}
+
+// companions returns the companion IPC objects of the queue, which Delete removes along with the segment. Every kind
+// of IPC object that a queue may create must be listed here, so it doesn't leak.
+func (q *Queue) companions() []companion {
+	var cs []companion
+	if q.semID >= 0 {
+		semID := q.semID
+		cs = append(cs, companion{remove: func() error {
+			err := removeSem(semID)
+			if err != nil && err != unix.EINVAL && err != unix.EIDRM {
+				return wrapErrSemDelete(err, q.key, q.id)
+			}
+			return nil
+		}})
+	}
+	return cs
+}
+
+// CloseAndDelete closes the queue, and deletes it if no other process has it attached. It returns whether the queue
+// was deleted. The check is done after detaching, so a queue is never deleted under the feet of another process that
+// has it attached, but it may be deleted right before another process attaches it. If several processes call it at
+// the same time, only one of them deletes the queue.
+func (q *Queue) CloseAndDelete() (deleted bool, err error) {
+	if q.posix != nil {
+		// The number of processes that have a POSIX object mapped isn't known.
+		return false, newQueueError("delete shared memory", q.key, q.id, fmt.Errorf(
+			"%w: CloseAndDelete can't be used with POSIX shared memory", ErrNotSupported,
+		))
+	}
+	if err = q.Close(); err != nil {
+		return false, err
+	}
+
+	var desc unix.SysvShmDesc
+	_, err = unix.SysvShmCtl(q.id, unix.IPC_STAT, &desc)
+	switch {
+	case err == unix.EIDRM || err == unix.EINVAL:
+		// Somebody else has deleted it.
+		return false, nil
+	case err != nil:
+		return false, wrapErrShmStat(err, q.key, q.id)
+	case desc.Nattch > 0 || desc.Perm.Mode&shmDest != 0:
+		return false, nil
+	}
+
+	err = q.Delete()
+	if errors.Is(err, ErrRemovedID) || errors.Is(err, unix.EINVAL) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Mode returns the current permission bits of this IPC shared memory queue.
+func (q *Queue) Mode() (int, error) {
+	if q.posix != nil {
+		return q.posix.mode(q)
+	}
+	var desc unix.SysvShmDesc
+	_, err := unix.SysvShmCtl(q.id, unix.IPC_STAT, &desc)
+	if err != nil {
+		return 0, wrapErrShmStat(err, q.key, q.id)
+	}
+	return int(desc.Perm.Mode & 0777), nil
+}
+
+// LockMemory locks this IPC shared memory queue in RAM, so it's never swapped out, and faults in all its pages, so
+// there are no page faults on the first access. It affects all processes using the queue until UnlockMemory is called.
+// Locking requires the CAP_IPC_LOCK capability or enough headroom in RLIMIT_MEMLOCK. Segments backed by huge pages are
+// never swapped anyway, so there's no need to lock them.
+func (q *Queue) LockMemory() error {
+	var err error
+	if q.posix != nil {
+		err = unix.Mlock(q.seg.mem)
+	} else {
+		_, err = unix.SysvShmCtl(q.id, shmLock, nil)
+	}
+	if err != nil {
+		return wrapErrShmLock(err, q.key, q.id)
+	}
+	pageSize := os.Getpagesize()
+	for i := 0; i < len(q.seg.mem); i += pageSize {
+		_ = atomic.LoadUint32((*uint32)(unsafe.Pointer(&q.seg.mem[i])))
+	}
+	return nil
+}
+
+// UnlockMemory allows this IPC shared memory queue to be swapped out again.
+func (q *Queue) UnlockMemory() error {
+	var err error
+	if q.posix != nil {
+		err = unix.Munlock(q.seg.mem)
+	} else {
+		_, err = unix.SysvShmCtl(q.id, shmUnlock, nil)
+	}
+	if err != nil {
+		return wrapErrShmLock(err, q.key, q.id)
+	}
+	return nil
+}
+
+// IsDeleted reports whether this IPC shared memory queue is marked for destruction, that is, Delete was called by this
+// or another process. Such a queue will vanish once all processes Close it.
+func (q *Queue) IsDeleted() (bool, error) {
+	if q.posix != nil {
+		return q.posix.isDeleted(q)
+	}
+	var desc unix.SysvShmDesc
+	_, err := unix.SysvShmCtl(q.id, unix.IPC_STAT, &desc)
+	switch err {
+	case nil:
+		return desc.Perm.Mode&shmDest != 0, nil
+	case unix.EIDRM, unix.EINVAL:
+		return true, nil
+	default:
+		return false, wrapErrShmStat(err, q.key, q.id)
+	}
+}
+
+// Ping is a cheap health check of the queue, suitable for frequent liveness and readiness probes. It checks the magic,
+// the layout version and the geometry, and that the header lock can be taken and released within a short time. If the
+// header lock is held longer, e.g. by a crashed process, an error wrapping ErrLockTimeout is returned. Messages aren't
+// inspected, so a successful Ping doesn't guarantee that their locks are fine (see RepairLocks).
+func (q *Queue) Ping() error {
+	err := q.seg.checkMagic()
+	if err == nil {
+		err = q.seg.checkVersion()
+	}
+	if err == nil {
+		err = q.seg.checkHeader()
+	}
+	if err == nil && !q.seg.tryLockHeader(pingLockTimeout) {
+		err = ErrLockTimeout
+	}
+	if err != nil {
+		return newQueueError("ping", q.key, q.id, err)
+	}
+	err = q.seg.checkHeaderChecksum()
+	if err != nil {
+		// Don't let unlockHeader fix the checksum.
+		q.seg.releaseHeaderLock()
+		return newQueueError("ping", q.key, q.id, err)
+	}
+	q.seg.unlockHeader()
+	return nil
+}
+
+// deletedHere reports whether Delete was called on this queue.
+func (q *Queue) deletedHere() bool {
+	return atomic.LoadUint32(&q.deleted) != 0
+}
+
+// checkDeleted is called by the blocking loops on every iteration, but checks the segment only every
+// deletedCheckPeriod iterations to keep the syscall out of the hot path. A queue deleted by this process is noticed
+// at once.
+func (q *Queue) checkDeleted(iteration int) error {
+	if q.deletedHere() {
+		return newQueueError("wait", q.key, q.id, ErrSegmentDeleted)
+	}
+	if iteration%deletedCheckPeriod != deletedCheckPeriod-1 {
+		return nil
+	}
+	deleted, err := q.IsDeleted()
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return newQueueError("wait", q.key, q.id, ErrSegmentDeleted)
+	}
+	return nil
+}
+
+// EnqueueShift enqueues the message. If the queue is full, a message is dropped according to the overflow policy (see
+// WithOverflowPolicy): by default, the oldest one. false is returned if a message is dropped and the policy asks to
+// report it: the new message with DropNewest, and the oldest one with DropAndNotify. With DropOldest, true is always
+// returned.
+func (q *Queue) EnqueueShift(msg []byte) (ok bool) {
+	_, _, ok, _ = q.enqueueShift(msg)
+	return ok
+}
+
+// EnqueueShiftNotify works like EnqueueShift and returns the same result, but if the queue length is at or above the
+// high-water mark (see WithHighWater) before the enqueue, it calls onPressure with that length and the capacity of the
+// queue (see Cap). This lets a producer apply backpressure upstream without polling the queue length separately.
+// onPressure is only called if the message is enqueued, after all locks are released.
+func (q *Queue) EnqueueShiftNotify(msg []byte, onPressure func(depth, cap uint32)) (ok bool) {
+	depth, capLen, ok, err := q.enqueueShift(msg)
+	if err == nil && depth >= q.highWater(capLen) {
+		onPressure(depth, capLen)
+	}
+	return ok
+}
+
+// enqueueShift enqueues the message, dropping one if the queue is full, and returns the queue length before the
+// enqueue, the capacity (see Cap), and false if a message is dropped and the overflow policy asks to report it. If the
+// message isn't enqueued, an error is returned as well: ErrFull if the overflow policy drops it, or the reason it
+// can't be, unwrapped like in EnqueueTryErr.
+func (q *Queue) enqueueShift(msg []byte) (curLen, capLen uint32, ok bool, err error) {
+	if q.deletedHere() {
+		return 0, 0, false, ErrSegmentDeleted
+	}
+	if err = q.seg.lockHeader(); err != nil {
+		return 0, 0, false, err
+	}
+
+	// Reclaimed slots at the head are dropped first, and a reserved head is never dropped.
+	headReady := q.seg.readyLen(1) > 0
+	curLen = q.seg.getQueueLen()
+	capLen = q.seg.getCap()
+	if q.seg.isClosed() {
+		q.seg.unlockHeader()
+		return curLen, capLen, false, ErrQueueClosed
+	}
+	maxLen := q.seg.getMaxLen()
+	startIdx := q.seg.getStartIdx()
+
+	msgIdx := startIdx + curLen
+	msgIdx %= maxLen
+
+	if curLen >= capLen && (q.opts.overflowPolicy == DropNewest || !headReady) {
+		q.seg.addRejected(1)
+		q.seg.unlockHeader()
+		return curLen, capLen, false, ErrFull
+	}
+	if err = q.seg.lockMsg(msgIdx); err != nil {
+		q.seg.unlockHeader()
+		return curLen, capLen, false, err
+	}
+
+	ok = true
+	if curLen < capLen {
+		q.seg.setQueueLen(curLen + 1)
+	} else {
+		startIdx++
+		startIdx %= maxLen
+		q.seg.setStartIdx(startIdx)
+		q.seg.addDropped(1)
+		ok = q.opts.overflowPolicy != DropAndNotify
+	}
+	q.seg.addEnqueued(1)
+
+	q.seg.zeroMsgMeta(msgIdx)
+	q.seg.setMsgData(msgIdx, msg)
+	q.seg.finishEnqueue(msgIdx)
+	q.seg.unlockHeader()
+	q.seg.unlockMsg(msgIdx)
+
+	return curLen, capLen, ok, nil
+}
+
+// highWater returns the high-water mark of a queue with the given capacity: the length at which the producers are
+// notified about pressure.
+func (q *Queue) highWater(capLen uint32) uint32 {
+	return uint32(math.Ceil(q.opts.highWater * float64(capLen)))
+}
+
+func (q *Queue) EnqueueBlock(ctx context.Context, msg []byte) (err error) {
+	return q.enqueueBlockMeta(ctx, nil, msg)
+}
+
+// enqueueBlockMeta works like EnqueueBlock, but also writes the metadata of the message. If meta is nil, zero metadata
+// is written.
+func (q *Queue) enqueueBlockMeta(ctx context.Context, meta, msg []byte) error {
+	if meta != nil {
+		q.seg.checkMetaSize(len(meta))
+	}
+	if q.opts.fairEnqueue {
+		return q.enqueueBlockFair(ctx, meta, msg)
+	}
+	return q.enqueueBlock(ctx, meta, msg)
+}
+
+// EnqueueBlockTimed works like EnqueueBlock, but also returns how long the call took, mostly waiting for free space.
+// It's also returned along with an error, e.g. the time waited before the context was cancelled.
+func (q *Queue) EnqueueBlockTimed(ctx context.Context, msg []byte) (waited time.Duration, err error) {
+	start := time.Now()
+	err = q.EnqueueBlock(ctx, msg)
+	return time.Since(start), err
+}
+
+// enqueueBlockFair waits for the turn of this producer in the line of fair producers, and then enqueues the message.
+// The turn is passed to the next producer after the message is enqueued or the context is cancelled. If the line is
+// full, the message is enqueued as without WithFairEnqueue.
+func (q *Queue) enqueueBlockFair(ctx context.Context, meta, msg []byte) (err error) {
+	ticket, ok := q.seg.takeTicket()
+	if !ok {
+		return q.enqueueBlock(ctx, meta, msg)
+	}
+	for i := 0; q.seg.servingTicket() != ticket; i++ {
+		select {
+		case <-ctx.Done():
+			q.seg.abandonTicket(ticket)
+			return ctx.Err()
+		default:
+			// Go on.
+		}
+
+		if err = q.checkDeleted(i); err != nil {
+			q.seg.abandonTicket(ticket)
+			return err
+		}
+		backoff(i, q.opts.maxSpinSleep)
+	}
+
+	err = q.enqueueBlock(ctx, meta, msg)
+	q.seg.serveNextTicket(ticket)
+	return err
+}
+
+func (q *Queue) enqueueBlock(ctx context.Context, meta, msg []byte) (err error) {
+	var curLen, maxLen uint32
+	var start time.Time
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// Go on.
+		}
+
+		if q.deletedHere() {
+			return newQueueError("enqueue", q.key, q.id, ErrSegmentDeleted)
+		}
+		if q.seg.isClosed() {
+			return newQueueError("enqueue", q.key, q.id, ErrQueueClosed)
+		}
+		curLen = q.seg.getQueueLen()
+		if curLen < q.seg.getCap() {
+			if err = q.seg.lockHeader(); err != nil {
+				return newQueueError("enqueue", q.key, q.id, err)
+			}
+			curLen = q.seg.getQueueLen()
+			maxLen = q.seg.getMaxLen()
+			if curLen >= q.seg.getCap() || q.seg.isClosed() {
+				q.seg.unlockHeader()
+				continue
+			}
+			break
+		}
+		start = q.seg.startSlow(start)
+		if err = q.checkDeleted(i); err != nil {
+			return err
+		}
+		if err = q.waitLen(semEmpty, i); err != nil {
+			return err
+		}
+	}
+	q.seg.logSlow("enqueue", start)
+
+	startIdx := q.seg.getStartIdx()
+	msgIdx := startIdx + curLen
+	msgIdx %= maxLen
+
+	// The slot is locked before the header is changed, so a cancellation leaves the queue intact.
+	if err = q.seg.lockMsgCtx(ctx, msgIdx); err != nil {
+		q.seg.unlockHeader()
+		return err
+	}
+	q.seg.setQueueLen(curLen + 1)
+	q.seg.addEnqueued(1)
+
+	if meta != nil {
+		copy(q.seg.msgMeta(msgIdx), meta)
+	} else {
+		q.seg.zeroMsgMeta(msgIdx)
+	}
+	q.seg.setMsgData(msgIdx, msg)
+	q.seg.finishEnqueue(msgIdx)
+	q.seg.unlockHeader()
+	q.seg.unlockMsg(msgIdx)
+
+	return nil
+}
+
+func (q *Queue) EnqueueTry(msg []byte) (ok bool) {
+	_, err := q.enqueueTryAt(nil, msg)
+	return err == nil
+}
+
+// EnqueueTryErr works like EnqueueTry, but reports why the message isn't enqueued: ErrFull if the queue is full,
+// ErrQueueClosed if it's closed with CloseQueue, or ErrSegmentDeleted if it's deleted by this process. These errors
+// aren't wrapped, so the failing path doesn't allocate, and a producer can cheaply tell when to back off from when to
+// give up. Only an error wrapping ErrSegmentCorrupt is, if the slot of the message doesn't fit into the segment.
+func (q *Queue) EnqueueTryErr(msg []byte) error {
+	_, err := q.enqueueTryAt(nil, msg)
+	return err
+}
+
+// EnqueueTryAt works like EnqueueTry, but also returns the physical index of the slot the message is written to.
+// With several producers or consumers the index quickly becomes stale: the message may be dequeued and the slot reused
+// right after the call. It's mostly useful for diagnostics and single-writer scenarios.
+func (q *Queue) EnqueueTryAt(msg []byte) (idx uint32, ok bool) {
+	idx, err := q.enqueueTryAt(nil, msg)
+	return idx, err == nil
+}
+
+// EnqueueIfBelow enqueues the message only if the queue has fewer than threshold messages, and returns whether it did
+// along with the queue length observed before the enqueue. Both are decided under one header lock, so unlike reading
+// the length and enqueuing separately, no other producer can fill the queue in between. It suits load-shedding
+// producers that adapt their sampling rate to the depth. A full or closed queue enqueues nothing, like EnqueueTry.
+func (q *Queue) EnqueueIfBelow(msg []byte, threshold uint32) (enqueued bool, depth uint32) {
+	_, depth, err := q.enqueueTryBelow(nil, msg, threshold)
+	return err == nil, depth
+}
+
+// enqueueTryAt enqueues the message with the metadata if the queue isn't full or closed, and returns the physical
+// index of its slot. If meta is nil, zero metadata is written.
+func (q *Queue) enqueueTryAt(meta, msg []byte) (idx uint32, err error) {
+	idx, _, err = q.enqueueTryBelow(meta, msg, math.MaxUint32)
+	return idx, err
+}
+
+// enqueueTryBelow works like enqueueTryAt, but the queue is also full once it has threshold messages. The queue length
+// before the enqueue is returned as well.
+func (q *Queue) enqueueTryBelow(meta, msg []byte, threshold uint32) (idx, curLen uint32, err error) {
+	if meta != nil {
+		q.seg.checkMetaSize(len(meta))
+	}
+	if q.deletedHere() {
+		return 0, 0, ErrSegmentDeleted
+	}
+	if err = q.seg.lockHeader(); err != nil {
+		return 0, 0, err
+	}
+
+	curLen = q.seg.getQueueLen()
+	maxLen := q.seg.getMaxLen()
+	if q.seg.isClosed() {
+		q.seg.unlockHeader()
+		return 0, curLen, ErrQueueClosed
+	}
+	if curLen >= q.seg.getCap() || curLen >= threshold {
+		q.seg.syncEvents()
+		q.seg.unlockHeader()
+		return 0, curLen, ErrFull
+	}
+
+	startIdx := q.seg.getStartIdx()
+	msgIdx := startIdx + curLen
+	msgIdx %= maxLen
+
+	if err = q.seg.lockMsg(msgIdx); err != nil {
+		q.seg.unlockHeader()
+		return 0, curLen, err
+	}
+	q.seg.setQueueLen(curLen + 1)
+	q.seg.addEnqueued(1)
+	q.seg.fault(faultEnqueueWrite)
+	if meta != nil {
+		copy(q.seg.msgMeta(msgIdx), meta)
+	} else {
+		q.seg.zeroMsgMeta(msgIdx)
+	}
+	q.seg.setMsgData(msgIdx, msg)
+	q.seg.finishEnqueue(msgIdx)
+	q.seg.unlockHeader()
+	q.seg.unlockMsg(msgIdx)
+
+	return msgIdx, curLen, nil
+}
+
+// EnqueueAllTry enqueues either all the messages or none of them. If there's not enough space in the queue for all the
+// messages, nothing is written and false is returned. The messages are placed one after another, so no other producer
+// can interleave them.
+func (q *Queue) EnqueueAllTry(msgs [][]byte) (ok bool) {
+	for _, msg := range msgs {
+		q.seg.checkMsgSize(len(msg))
+	}
+	if q.deletedHere() {
+		return false
+	}
+
+	if q.seg.lockHeader() != nil {
+		return false
+	}
+
+	curLen := q.seg.getQueueLen()
+	maxLen := q.seg.getMaxLen()
+	if uint64(curLen)+uint64(len(msgs)) > uint64(q.seg.getCap()) || q.seg.isClosed() {
+		q.seg.unlockHeader()
+		return false
+	}
+
+	return q.enqueueAllLocked(context.Background(), curLen, maxLen, msgs) == nil
+}
+
+// EnqueueAllBlock works like EnqueueAllTry, but waits until there's space for all the messages at once, so the batch
+// isn't interleaved with the messages of other producers. The space is checked again under the header lock, so
+// concurrent batches never overfill the queue. If there are more messages than the max length of the queue, an error
+// wrapping ErrNoSpace is returned immediately, since they never fit. If the context is cancelled or the queue is
+// deleted while waiting, an error is returned, and if the queue is closed with CloseQueue, an error wrapping
+// ErrQueueClosed. A big batch waits for the queue to drain enough, so single messages of other producers may
+// overtake it.
+func (q *Queue) EnqueueAllBlock(ctx context.Context, msgs [][]byte) error {
+	for _, msg := range msgs {
+		q.seg.checkMsgSize(len(msg))
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if maxLen := q.seg.getMaxLen(); uint64(len(msgs)) > uint64(maxLen) {
+		return newQueueError("enqueue", q.key, q.id, fmt.Errorf(
+			"%w: %d messages, max length %d", ErrNoSpace, len(msgs), maxLen,
+		))
+	}
+
+	n := uint64(len(msgs))
+	var curLen, maxLen uint32
+	var start time.Time
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// Go on.
+		}
+
+		if q.deletedHere() {
+			return newQueueError("enqueue", q.key, q.id, ErrSegmentDeleted)
+		}
+		if q.seg.isClosed() {
+			return newQueueError("enqueue", q.key, q.id, ErrQueueClosed)
+		}
+		curLen = q.seg.getQueueLen()
+		capLen := q.seg.getCap()
+		if uint64(curLen)+n <= uint64(capLen) {
+			if err := q.seg.lockHeader(); err != nil {
+				return newQueueError("enqueue", q.key, q.id, err)
+			}
+			curLen = q.seg.getQueueLen()
+			maxLen = q.seg.getMaxLen()
+			if uint64(curLen)+n > uint64(q.seg.getCap()) || q.seg.isClosed() {
+				q.seg.unlockHeader()
+				continue
+			}
+			break
+		}
+		start = q.seg.startSlow(start)
+		if err := q.checkDeleted(i); err != nil {
+			return err
+		}
+		if curLen < capLen {
+			// There's some free space, so the semaphore won't block until there's enough.
+			backoff(i, q.opts.maxSpinSleep)
+			continue
+		}
+		if err := q.waitLen(semEmpty, i); err != nil {
+			return err
+		}
+	}
+	q.seg.logSlow("enqueue", start)
+
+	return q.enqueueAllLocked(ctx, curLen, maxLen, msgs)
+}
+
+// enqueueAllLocked appends the messages to the queue of the given length, and unlocks the header. The header must be
+// locked, and the messages must fit. If the context is done while waiting for the message locks, nothing is enqueued
+// and its error is returned.
+func (q *Queue) enqueueAllLocked(ctx context.Context, curLen, maxLen uint32, msgs [][]byte) error {
+	startIdx := q.seg.getStartIdx()
+	msgIdxs := make([]uint32, len(msgs))
+	for i := range msgs {
+		msgIdx := startIdx + curLen + uint32(i)
+		msgIdx %= maxLen
+		msgIdxs[i] = msgIdx
+	}
+	if err := q.seg.lockMsgsCtx(ctx, msgIdxs); err != nil {
+		q.seg.unlockHeader()
+		return err
+	}
+	q.seg.setQueueLen(curLen + uint32(len(msgs)))
+	q.seg.addEnqueued(uint64(len(msgs)))
+	q.seg.unlockHeader()
+
+	for i, msg := range msgs {
+		q.seg.zeroMsgMeta(msgIdxs[i])
+		q.seg.setMsgData(msgIdxs[i], msg)
+		q.seg.finishEnqueue(msgIdxs[i])
+		q.seg.unlockMsg(msgIdxs[i])
+	}
+	return nil
+}
+
+func (q *Queue) DequeueBlock(ctx context.Context, toMsg []byte) (err error) {
+	_, err = q.DequeueBlockN(ctx, toMsg)
+	return err
+}
+
+// DequeueBlockTimed works like DequeueBlock, but also returns how long the call took, mostly waiting for a message.
+// It's also returned along with an error, e.g. the time waited before the context was cancelled.
+func (q *Queue) DequeueBlockTimed(ctx context.Context, toMsg []byte) (waited time.Duration, err error) {
+	start := time.Now()
+	err = q.DequeueBlock(ctx, toMsg)
+	return time.Since(start), err
+}
+
+// DequeueBlockN works like DequeueBlock, but also returns the number of messages remaining in the queue right after
+// the dequeue. It's read under the same header lock, so it costs nothing extra, but it's only a snapshot: other
+// processes may change the queue immediately.
+func (q *Queue) DequeueBlockN(ctx context.Context, toMsg []byte) (remaining uint32, err error) {
+	curLen, err := q.lockHeaderNotEmpty(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The message is locked before the header is changed, so a cancellation leaves the queue intact. The start index
+	// is read and advanced under the header lock, so concurrent consumers never take the same slot, and the old index
+	// kept here stays locked until the message is copied out, so a producer wrapping around to it waits.
+	startIdx := q.seg.getStartIdx()
+	if err = q.seg.lockMsgCtx(ctx, startIdx); err != nil {
+		q.seg.unlockHeader()
+		return 0, err
+	}
 
 	q.seg.setQueueLen(curLen - 1)
+	q.seg.addDequeued(1)
+
+	maxLen := q.seg.getMaxLen()
+	q.seg.setStartIdx((startIdx + 1) % maxLen)
+
+	q.seg.unlockHeader()
+	q.seg.getMsgData(startIdx, toMsg)
+	q.seg.sumDequeued(startIdx)
+	if q.opts.zeroOnDequeue {
+		q.seg.zeroMsgData(startIdx)
+	}
+	q.seg.unlockMsg(startIdx)
+
+	return curLen - 1, nil
+}
+
+// DequeueBatchBlock waits until the queue isn't empty, and then dequeues up to max oldest messages at once, copying
+// them into new slices. If the context is cancelled while the queue is empty, its error is returned.
+func (q *Queue) DequeueBatchBlock(ctx context.Context, max int) ([][]byte, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+
+	curLen, err := q.lockHeaderNotEmpty(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	n := curLen
+	if uint64(max) < uint64(n) {
+		n = uint32(max)
+	}
+	n = q.seg.readyLen(n)
+	startIdx := q.seg.getStartIdx()
+	maxLen := q.seg.getMaxLen()
+	msgIdxs := make([]uint32, n)
+	for i := range msgIdxs {
+		msgIdxs[i] = (startIdx + uint32(i)) % maxLen
+	}
+	if err = q.seg.lockMsgsCtx(ctx, msgIdxs); err != nil {
+		q.seg.unlockHeader()
+		return nil, err
+	}
+
+	q.seg.setQueueLen(curLen - n)
+	q.seg.addDequeued(uint64(n))
+	q.seg.setStartIdx((startIdx + n) % maxLen)
+	q.seg.unlockHeader()
+
+	msgSize := q.seg.getDataSize()
+	msgs := make([][]byte, n)
+	for i, msgIdx := range msgIdxs {
+		msgs[i] = make([]byte, msgSize)
+		q.seg.getMsgData(msgIdx, msgs[i])
+		q.seg.sumDequeued(msgIdx)
+		if q.opts.zeroOnDequeue {
+			q.seg.zeroMsgData(msgIdx)
+		}
+		q.seg.unlockMsg(msgIdx)
+	}
+
+	return msgs, nil
+}
+
+// lockHeaderNotEmpty waits until the queue has a message ready to be dequeued (see Reserve) and locks the header. The
+// current queue length is returned. If the context is cancelled, the segment is deleted, or the queue is closed and
+// drained while waiting, an error is returned and the header isn't locked.
+func (q *Queue) lockHeaderNotEmpty(ctx context.Context) (curLen uint32, err error) {
+	var start time.Time
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+			// Go on.
+		}
+
+		if q.deletedHere() {
+			return 0, newQueueError("dequeue", q.key, q.id, ErrSegmentDeleted)
+		}
+		// The flag is read first: once it's set, nothing is enqueued, so a length of 0 read afterwards is final.
+		closed := q.seg.isClosed()
+		curLen = q.seg.getQueueLen()
+		if curLen > 0 {
+			if err = q.seg.lockHeader(); err != nil {
+				return 0, newQueueError("dequeue", q.key, q.id, err)
+			}
+			if q.seg.readyLen(1) > 0 {
+				q.seg.logSlow("dequeue", start)
+				return q.seg.getQueueLen(), nil
+			}
+			curLen = q.seg.getQueueLen()
+			q.seg.unlockHeader()
+			if curLen == 0 {
+				continue
+			}
+		} else if closed {
+			return 0, newQueueError("dequeue", q.key, q.id, ErrQueueClosed)
+		}
+		start = q.seg.startSlow(start)
+		if err = q.checkDeleted(i); err != nil {
+			return 0, err
+		}
+		if curLen > 0 {
+			// The head is reserved, so the semaphore won't block until it's committed.
+			backoff(i, q.opts.maxSpinSleep)
+			continue
+		}
+		if err = q.waitLen(semFilled, i); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// DequeueBlockNotify works like DequeueBlock, but if the queue length right after the dequeue is below the low-water
+// mark (see WithLowWater), it calls onLow with that length. onLow is called after all locks are released.
+func (q *Queue) DequeueBlockNotify(ctx context.Context, toMsg []byte, onLow func(depth uint32)) error {
+	remaining, err := q.DequeueBlockN(ctx, toMsg)
+	if err != nil {
+		return err
+	}
+	if remaining < q.lowWater() {
+		onLow(remaining)
+	}
+	return nil
+}
+
+// WaitDepth waits until the queue holds at least min messages, e.g. to drain them in one batch. Nothing is dequeued.
+// If the context is cancelled or the queue is deleted while waiting, an error is returned, and if the queue is closed
+// with CloseQueue before it gets deep enough, an error wrapping ErrQueueClosed. If min is greater than the max length,
+// an error wrapping ErrInvalidDepth is returned immediately, since the queue never gets that deep.
+func (q *Queue) WaitDepth(ctx context.Context, min uint32) error {
+	if maxLen := q.seg.getMaxLen(); min > maxLen {
+		return newQueueError("wait", q.key, q.id, fmt.Errorf("%w: %d, max length %d", ErrInvalidDepth, min, maxLen))
+	}
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// Go on.
+		}
+
+		closed := q.seg.isClosed()
+		if q.seg.getQueueLen() >= min {
+			return nil
+		}
+		if closed {
+			return newQueueError("wait", q.key, q.id, ErrQueueClosed)
+		}
+		if err := q.checkDeleted(i); err != nil {
+			return err
+		}
+		backoff(i, q.opts.maxSpinSleep)
+	}
+}
+
+// waitLen waits a bit before the next check of the queue length in a blocking call. If the queue has a companion
+// semaphore set, it sleeps in the kernel until the given semaphore is non-zero, but no longer than semWaitTimeout.
+// Otherwise, it backs off.
+func (q *Queue) waitLen(semNum, iteration int) error {
+	if q.semID >= 0 {
+		err := waitSem(q.semID, semNum, semWaitTimeout)
+		if err != nil {
+			return wrapErrSemWait(err, q.key, q.id)
+		}
+		return nil
+	}
+	backoff(iteration, q.opts.maxSpinSleep)
+	return nil
+}
+
+func (q *Queue) DequeueTry(toMsg []byte) (ok bool) {
+	_, err := q.dequeueTry(nil, toMsg)
+	return err == nil
+}
+
+// DequeueTryErr works like DequeueTry, but reports why no message is dequeued: ErrQueueClosed if the queue is closed
+// with CloseQueue and drained, so no message will ever come, ErrSegmentDeleted if it's deleted by this process, or
+// ErrEmpty otherwise. Like in EnqueueTryErr, the errors aren't wrapped.
+func (q *Queue) DequeueTryErr(toMsg []byte) error {
+	_, err := q.dequeueTry(nil, toMsg)
+	return err
+}
+
+// DequeueNotify works like DequeueTry, but if the queue length right after the dequeue is below the low-water mark
+// (see WithLowWater), it calls onLow with that length. The length is read under the header lock already held by the
+// dequeue, and onLow is called after all locks are released.
+func (q *Queue) DequeueNotify(toMsg []byte, onLow func(depth uint32)) (ok bool) {
+	remaining, err := q.dequeueTry(nil, toMsg)
+	ok = err == nil
+	if ok && remaining < q.lowWater() {
+		onLow(remaining)
+	}
+	return ok
+}
+
+// lowWater returns the low-water mark of the queue: the length below which the consumers are notified that the queue
+// is running dry. The capacity is only read if the mark is set, since it takes the header lock.
+func (q *Queue) lowWater() uint32 {
+	if q.opts.lowWater == 0 {
+		return 0
+	}
+	return uint32(math.Ceil(q.opts.lowWater * float64(q.Cap())))
+}
+
+// DequeueIfDepth dequeues the oldest message into toMsg only if the queue has exactly exact messages, and returns
+// whether it did. The length is checked and the message is dequeued under one header lock, so of several consumers
+// that call it with the same exact, at most one succeeds until the length changes again. It suits simple coordination,
+// like letting the one consumer that finds the queue full drain the batch. The length counts reserved messages too
+// (see Reserve), and if the head is reserved, nothing is dequeued.
+func (q *Queue) DequeueIfDepth(exact uint32, toMsg []byte) (ok bool) {
+	_, err := q.dequeueTryDepth(nil, toMsg, func(curLen uint32) bool { return curLen == exact })
+	return err == nil
+}
+
+// dequeueTry dequeues the oldest message into toMsg, and its metadata into toMeta unless it's nil, if the queue isn't
+// empty, and returns the number of messages remaining in the queue right after the dequeue.
+func (q *Queue) dequeueTry(toMeta, toMsg []byte) (remaining uint32, err error) {
+	return q.dequeueTryDepth(toMeta, toMsg, nil)
+}
+
+// dequeueTryDepth works like dequeueTry, but if depthOK isn't nil, the message is only dequeued if depthOK returns
+// true for the queue length. Otherwise, ErrEmpty is returned.
+func (q *Queue) dequeueTryDepth(toMeta, toMsg []byte, depthOK func(curLen uint32) bool) (remaining uint32, err error) {
+	if toMeta != nil {
+		q.seg.checkMetaSize(len(toMeta))
+	}
+	if q.deletedHere() {
+		return 0, ErrSegmentDeleted
+	}
+	if err = q.seg.lockHeader(); err != nil {
+		return 0, err
+	}
+
+	if q.seg.readyLen(1) == 0 {
+		err = ErrEmpty
+		if q.seg.isClosed() && q.seg.getQueueLen() == 0 {
+			err = ErrQueueClosed
+		}
+		q.seg.syncEvents()
+		q.seg.unlockHeader()
+		return 0, err
+	}
+	curLen := q.seg.getQueueLen()
+	if depthOK != nil && !depthOK(curLen) {
+		q.seg.unlockHeader()
+		return 0, ErrEmpty
+	}
 
 	startIdx := q.seg.getStartIdx()
+	if err = q.seg.lockMsg(startIdx); err != nil {
+		q.seg.unlockHeader()
+		return 0, err
+	}
+
+	q.seg.setQueueLen(curLen - 1)
+	q.seg.addDequeued(1)
+
 	maxLen := q.seg.getMaxLen()
 	q.seg.setStartIdx((startIdx + 1) % maxLen)
 
-	q.seg.lockMsg(startIdx)
 	q.seg.unlockHeader()
+	q.seg.fault(faultDequeueRead)
+	copy(toMeta, q.seg.msgMeta(startIdx))
+	q.seg.getMsgData(startIdx, toMsg)
+	q.seg.sumDequeued(startIdx)
+	if q.opts.zeroOnDequeue {
+		q.seg.zeroMsgData(startIdx)
+	}
+	q.seg.unlockMsg(startIdx)
+
+	return curLen - 1, nil
+}
+
+// DequeueIf copies the oldest message into toMsg and dequeues it only if pred returns true for it. Otherwise, the queue
+// is left unchanged. If the queue is empty, false is returned and pred isn't called. The check and the dequeue are done
+// under the header lock, so no other consumer can take the message in between. For the same reason, pred must be fast
+// and must not call other methods of the queue.
+func (q *Queue) DequeueIf(pred func(msg []byte) bool, toMsg []byte) (ok bool) {
+	if q.deletedHere() {
+		return false
+	}
+	if q.seg.lockHeader() != nil {
+		return false
+	}
+
+	if q.seg.readyLen(1) == 0 {
+		q.seg.unlockHeader()
+		return false
+	}
+	curLen := q.seg.getQueueLen()
+
+	startIdx := q.seg.getStartIdx()
+	if err := q.seg.lockMsg(startIdx); err != nil {
+		q.seg.unlockHeader()
+		return false
+	}
 	q.seg.getMsgData(startIdx, toMsg)
+	if !pred(toMsg) {
+		q.seg.unlockMsg(startIdx)
+		q.seg.unlockHeader()
+		return false
+	}
+
+	q.seg.setQueueLen(curLen - 1)
+	q.seg.addDequeued(1)
+	maxLen := q.seg.getMaxLen()
+	q.seg.setStartIdx((startIdx + 1) % maxLen)
+
+	q.seg.unlockHeader()
+	q.seg.sumDequeued(startIdx)
+	if q.opts.zeroOnDequeue {
+		q.seg.zeroMsgData(startIdx)
+	}
 	q.seg.unlockMsg(startIdx)
 
 	return true
 }
+
+// DequeueAll dequeues all the messages at once, e.g. to flush accumulated events periodically, copying them into new
+// slices in the FIFO order. Unlike a loop of DequeueTry, it takes the header lock once, so no producer can slip a
+// message in between: every message enqueued before the call is returned, and every one enqueued after it stays in
+// the queue. The queue is left empty and starts over from the first slot, unless a reserved message (see Reserve)
+// keeps it and the messages after it in the queue. nil is returned if the queue is empty.
+func (q *Queue) DequeueAll() [][]byte {
+	if q.deletedHere() {
+		return nil
+	}
+	if q.seg.lockHeader() != nil {
+		return nil
+	}
+
+	n := q.seg.readyLen(math.MaxUint32)
+	if n == 0 {
+		q.seg.unlockHeader()
+		return nil
+	}
+	curLen := q.seg.getQueueLen()
+	startIdx := q.seg.getStartIdx()
+	maxLen := q.seg.getMaxLen()
+	msgIdxs := make([]uint32, n)
+	for i := range msgIdxs {
+		msgIdxs[i] = (startIdx + uint32(i)) % maxLen
+	}
+	if err := q.seg.lockMsgs(msgIdxs); err != nil {
+		q.seg.unlockHeader()
+		return nil
+	}
+
+	// One buffer is cut into the messages, capped, so appending to one of them doesn't overwrite the next.
+	msgSize := int(q.seg.getDataSize())
+	buf := make([]byte, int(n)*msgSize)
+	msgs := make([][]byte, n)
+	for i, msgIdx := range msgIdxs {
+		msgs[i] = buf[i*msgSize : (i+1)*msgSize : (i+1)*msgSize]
+		q.seg.getMsgData(msgIdx, msgs[i])
+		q.seg.sumDequeued(msgIdx)
+		if q.opts.zeroOnDequeue {
+			q.seg.zeroMsgData(msgIdx)
+		}
+		q.seg.unlockMsg(msgIdx)
+	}
+
+	if n == curLen {
+		startIdx = 0
+	} else {
+		startIdx = (startIdx + n) % maxLen
+	}
+	q.seg.setQueueLen(curLen - n)
+	q.seg.addDequeued(uint64(n))
+	q.seg.setStartIdx(startIdx)
+	q.seg.unlockHeader()
+
+	return msgs
+}
+
+// DequeueSkip discards up to n oldest messages without copying them out, e.g. after peeking at them and finding
+// duplicates, and returns the number of discarded messages, which is less than n if the queue is shorter. The messages
+// are removed under one header lock, so it's cheaper than dequeuing them one by one. They count as dequeued in Stats.
+func (q *Queue) DequeueSkip(n uint32) (skipped uint32) {
+	if q.deletedHere() {
+		return 0
+	}
+	if q.seg.lockHeader() != nil {
+		return 0
+	}
+
+	n = q.seg.readyLen(n)
+	curLen := q.seg.getQueueLen()
+	startIdx := q.seg.getStartIdx()
+	maxLen := q.seg.getMaxLen()
+
+	if (q.opts.zeroOnDequeue || q.seg.isRunningChecksum()) && n > 0 {
+		msgIdxs := make([]uint32, n)
+		for i := range msgIdxs {
+			msgIdxs[i] = (startIdx + uint32(i)) % maxLen
+		}
+		if err := q.seg.lockMsgs(msgIdxs); err != nil {
+			q.seg.unlockHeader()
+			return 0
+		}
+		for _, msgIdx := range msgIdxs {
+			q.seg.sumDequeued(msgIdx)
+			if q.opts.zeroOnDequeue {
+				q.seg.zeroMsgData(msgIdx)
+			}
+			q.seg.unlockMsg(msgIdx)
+		}
+	}
+	q.seg.setQueueLen(curLen - n)
+	q.seg.addDequeued(uint64(n))
+	q.seg.setStartIdx((startIdx + n) % maxLen)
+	q.seg.unlockHeader()
+
+	return n
+}
+
+// DequeueExchange dequeues the oldest message into take and enqueues give in its place, under one header lock, so the
+// queue length stays the same. It suits object pools kept in a queue, where a consumer hands back a spent buffer as
+// it takes a fresh one without allocating: on a full queue, give is written into the very slot that take is copied
+// from. Both slices must be of the message size and must not overlap. If the queue is empty, or it's closed with
+// CloseQueue, so nothing can be enqueued, nothing is exchanged and false is returned.
+func (q *Queue) DequeueExchange(give, take []byte) (ok bool) {
+	q.seg.checkMsgSize(len(give))
+	q.seg.checkMsgSize(len(take))
+	if q.deletedHere() {
+		return false
+	}
+	if q.seg.lockHeader() != nil {
+		return false
+	}
+
+	if q.seg.readyLen(1) == 0 || q.seg.isClosed() {
+		q.seg.unlockHeader()
+		return false
+	}
+	curLen := q.seg.getQueueLen()
+	startIdx := q.seg.getStartIdx()
+	maxLen := q.seg.getMaxLen()
+	tailIdx := (startIdx + curLen) % maxLen
+
+	// Both slots are locked up front, so if one of them doesn't fit into the segment, nothing is changed.
+	msgIdxs := []uint32{startIdx}
+	if tailIdx != startIdx {
+		msgIdxs = append(msgIdxs, tailIdx)
+	}
+	if err := q.seg.lockMsgs(msgIdxs); err != nil {
+		q.seg.unlockHeader()
+		return false
+	}
+	q.seg.getMsgData(startIdx, take)
+	q.seg.sumDequeued(startIdx)
+	if tailIdx != startIdx {
+		if q.opts.zeroOnDequeue {
+			q.seg.zeroMsgData(startIdx)
+		}
+		q.seg.unlockMsg(startIdx)
+	}
+	q.seg.zeroMsgMeta(tailIdx)
+	q.seg.setMsgData(tailIdx, give)
+	q.seg.finishEnqueue(tailIdx)
+	q.seg.unlockMsg(tailIdx)
+
+	q.seg.setStartIdx((startIdx + 1) % maxLen)
+	q.seg.addDequeued(1)
+	q.seg.addEnqueued(1)
+	q.seg.unlockHeader()
+
+	return true
+}
@@ -0,0 +1,12 @@
+//go:build linux
+
+package shqueue
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// shmKey returns the key of the segment described by desc.
+func shmKey(desc *unix.SysvShmDesc) int {
+	return int(desc.Perm.Key)
+}
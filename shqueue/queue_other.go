@@ -0,0 +1,13 @@
+//go:build !linux
+
+package shqueue
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// shmKey returns IPC_PRIVATE: the segment descriptor doesn't expose the key outside Linux, so queues attached by ID
+// report no key there.
+func shmKey(desc *unix.SysvShmDesc) int {
+	return unix.IPC_PRIVATE
+}
@@ -3,10 +3,20 @@ package shqueue
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestQueue(t *testing.T) {
@@ -87,6 +97,134 @@ func TestQueue(t *testing.T) {
 		assert.Equal(t, totalShmSize(8*5, 20), len(queue.seg.mem))
 	})
 
+	t.Run("adopt previous recreated concurrently", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		prev, err := Create(key, 4, 16)
+		require.NoError(t, err)
+		require.NoError(t, prev.Close())
+
+		// Both processes see that the segment is too small, but the other one recreates it first and enqueues a
+		// message, so this one must adopt the new segment instead of deleting it.
+		other, err := Create(key, 5, 20)
+		require.NoError(t, err)
+		require.True(t, other.EnqueueTry(make([]byte, 8*5)))
+		defer func() {
+			// The segment is deleted by deleteSmallShm below.
+			assert.NoError(t, other.Close())
+		}()
+
+		queue, err := recreateQueue(key, totalShmSize(8*5, 20), 8*5, 20, newOptions(nil))
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+		}()
+		assert.Equal(t, other.id, queue.id)
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+
+		fits, err := deleteSmallShm(key, totalShmSize(8*5, 20))
+		require.NoError(t, err)
+		assert.True(t, fits)
+		fits, err = deleteSmallShm(key, totalShmSize(8*5, 21))
+		require.NoError(t, err)
+		assert.False(t, fits)
+		isDeleted, err := queue.IsDeleted()
+		require.NoError(t, err)
+		assert.True(t, isDeleted)
+	})
+
+	t.Run("recover previous", func(t *testing.T) {
+		// createPrev creates a queue with messages and closes it.
+		createPrev := func(t *testing.T) int {
+			key, err := FindFreeKey()
+			require.NoError(t, err)
+
+			prev, err := Create(key, 2, 5)
+			require.NoError(t, err)
+			prev.seg.setStartIdx(3)
+			ok := prev.EnqueueAllTry([][]byte{testMsgA, testMsgB})
+			require.True(t, ok)
+			err = prev.Close()
+			require.NoError(t, err)
+			return key
+		}
+		deleteQueue := func(t *testing.T, queue *Queue) {
+			err := queue.Close()
+			assert.NoError(t, err)
+			err = queue.Delete()
+			assert.NoError(t, err)
+		}
+
+		t.Run("adopt messages with recover", func(t *testing.T) {
+			key := createPrev(t)
+
+			queue, err := Create(key, 2, 5, WithRecover())
+			require.NoError(t, err)
+			defer deleteQueue(t, queue)
+
+			assert.Equal(t, uint32(3), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+			for _, want := range [][]byte{testMsgA, testMsgB} {
+				got := make([]byte, 8*2)
+				ok := queue.DequeueTry(got)
+				assert.True(t, ok)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("drop messages with reset", func(t *testing.T) {
+			key := createPrev(t)
+
+			queue, err := Create(key, 2, 5, WithRecover(), WithReset())
+			require.NoError(t, err)
+			defer deleteQueue(t, queue)
+
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		})
+
+		t.Run("create new with recover", func(t *testing.T) {
+			key, err := FindFreeKey()
+			require.NoError(t, err)
+
+			queue, err := Create(key, 2, 5, WithRecover())
+			require.NoError(t, err)
+			defer deleteQueue(t, queue)
+
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		})
+
+		t.Run("fail on different geometry", func(t *testing.T) {
+			key := createPrev(t)
+			defer func() {
+				err := deleteShm(key)
+				assert.NoError(t, err)
+			}()
+
+			_, err := Create(key, 2, 4, WithRecover())
+			assert.ErrorIs(t, err, ErrGeometryMismatch)
+			_, err = Create(key, 3, 5, WithRecover())
+			assert.ErrorIs(t, err, ErrGeometryMismatch)
+		})
+
+		t.Run("fail on corrupted header", func(t *testing.T) {
+			key := createPrev(t)
+			defer func() {
+				err := deleteShm(key)
+				assert.NoError(t, err)
+			}()
+			prev, err := Open(key)
+			require.NoError(t, err)
+			prev.seg.setQueueLen(6)
+			err = prev.Close()
+			require.NoError(t, err)
+
+			_, err = Create(key, 2, 5, WithRecover())
+			assert.ErrorIs(t, err, ErrHeaderCorrupt)
+		})
+	})
+
 	t.Run("open previous", func(t *testing.T) {
 		key, err := FindFreeKey()
 		require.NoError(t, err)
@@ -113,357 +251,2357 @@ func TestQueue(t *testing.T) {
 		assert.Equal(t, totalShmSize(8*4, 16), len(queue.seg.mem))
 	})
 
-	t.Run("enqueue shift", func(t *testing.T) {
-		t.Run("append when empty", func(t *testing.T) {
-			queue := testQueue(t, 0, 0)
+	t.Run("open segment bigger than queue", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
 
-			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
-			for _, msg := range msgs {
-				queue.EnqueueShift(msg)
-			}
+		big, err := Create(key, 8, 64)
+		require.NoError(t, err)
+		require.NoError(t, big.Close())
+		// The bigger segment is reused by the smaller queue.
+		prev, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, prev.Close())
+			assert.NoError(t, prev.Delete())
+		}()
+		require.Equal(t, big.id, prev.id)
+		require.True(t, prev.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
 
-			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+		queue, err := Open(key)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, queue.Close()) }()
+
+		assert.Equal(t, totalShmSize(8*2, 5), len(queue.seg.mem))
+		assert.Equal(t, uint32(8*2), queue.seg.getMsgSize())
+		assert.Equal(t, uint32(5), queue.seg.getMaxLen())
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+		got := make([]byte, 8*2)
+		require.True(t, queue.DequeueTry(got))
+		assert.Equal(t, testMsgA, got)
+		require.True(t, queue.DequeueTry(got))
+		assert.Equal(t, testMsgB, got)
+	})
 
-			got := make([]byte, 8*2)
-			for i, want := range msgs {
-				queue.seg.getMsgData(uint32(i), got)
-				assert.Equal(t, want, got)
-			}
-		})
+	t.Run("create private", func(t *testing.T) {
+		queue, err := CreatePrivate(4, 16)
+		require.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+			err = queue.Delete()
+			assert.NoError(t, err)
+		}()
 
-		t.Run("shift when full", func(t *testing.T) {
-			queue := testQueue(t, 0, 5)
+		assert.Equal(t, unix.IPC_PRIVATE, queue.key)
+		assert.Equal(t, uint32(8*4), queue.seg.getMsgSize())
+		assert.Equal(t, uint32(16), queue.seg.getMaxLen())
+		assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
 
-			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
-			for _, msg := range msgs {
-				queue.EnqueueShift(msg)
-			}
+		assert.Equal(t, totalShmSize(8*4, 16), len(queue.seg.mem))
+	})
 
-			assert.Equal(t, uint32(3), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+	t.Run("create private twice", func(t *testing.T) {
+		first := testQueue(t, 0, 0)
+		second := testQueue(t, 0, 0)
+		assert.NotEqual(t, first.id, second.id)
+	})
 
-			got := make([]byte, 8*2)
-			for i, want := range msgs {
-				queue.seg.getMsgData(uint32(i), got)
-				assert.Equal(t, want, got)
-			}
+	t.Run("attach private by id", func(t *testing.T) {
+		prev := testQueue(t, 3, 0)
+
+		queue, err := AttachByID(prev.ExportID())
+		require.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+		}()
+
+		assert.Equal(t, uint32(8*2), queue.seg.getMsgSize())
+		assert.Equal(t, uint32(5), queue.seg.getMaxLen())
+		assert.Equal(t, uint32(3), queue.seg.getStartIdx())
+		assert.Equal(t, totalShmSize(8*2, 5), len(queue.seg.mem))
+
+		ok := prev.EnqueueTry(testMsgA)
+		require.True(t, ok)
+		got := make([]byte, 8*2)
+		ok = queue.DequeueTry(got)
+		assert.True(t, ok)
+		assert.Equal(t, testMsgA, got)
+	})
+
+	t.Run("attach by id fails on invalid magic", func(t *testing.T) {
+		id, err := unix.SysvShmGet(unix.IPC_PRIVATE, 64, 0600|unix.IPC_CREAT)
+		require.NoError(t, err)
+		defer func() {
+			_, err = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+			assert.NoError(t, err)
+		}()
+
+		_, err = AttachByID(id)
+		assert.ErrorIs(t, err, ErrInvalidMagic)
+	})
+
+	t.Run("attach by id fails on invalid id", func(t *testing.T) {
+		_, err := AttachByID(-1)
+		assert.ErrorIs(t, err, ErrInvalidID)
+	})
+
+	t.Run("open ctx", func(t *testing.T) {
+		t.Run("succeed", func(t *testing.T) {
+			key, err := FindFreeKey()
+			require.NoError(t, err)
+			prev, err := Create(key, 2, 5)
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, prev.Close())
+				assert.NoError(t, prev.Delete())
+			}()
+
+			queue, err := OpenCtx(context.Background(), key)
+			require.NoError(t, err)
+			assert.NoError(t, queue.Close())
 		})
 
-		t.Run("cycle when full with max shift", func(t *testing.T) {
-			queue := testQueue(t, 4, 5)
+		t.Run("fail immediately on permanent error", func(t *testing.T) {
+			key, err := FindFreeKey()
+			require.NoError(t, err)
 
-			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
-			for _, msg := range msgs {
-				queue.EnqueueShift(msg)
-			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			_, err = OpenCtx(ctx, key)
+			assert.ErrorIs(t, err, ErrNotExist)
+		})
 
-			assert.Equal(t, uint32(2), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+		t.Run("retry transient errors", func(t *testing.T) {
+			attempts := 0
+			want := &Queue{}
+			queue, err := retryTransient(context.Background(), func() (*Queue, error) {
+				attempts++
+				switch attempts {
+				case 1:
+					return nil, newQueueError("open shared memory", 1, -1, ErrNoMem)
+				case 2:
+					return nil, newQueueError("open shared memory", 1, -1, ErrTooManyFiles)
+				default:
+					return want, nil
+				}
+			})
+			require.NoError(t, err)
+			assert.Same(t, want, queue)
+			assert.Equal(t, 3, attempts)
+		})
 
-			msgsByIdx := map[int][]byte{
-				4: testMsgA,
-				0: testMsgB,
-				1: testMsgC,
-			}
-			got := make([]byte, 8*2)
-			for i, want := range msgsByIdx {
-				queue.seg.getMsgData(uint32(i), got)
-				assert.Equal(t, want, got)
-			}
+		t.Run("stop on context done", func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := retryTransient(ctx, func() (*Queue, error) {
+				return nil, newQueueError("open shared memory", 1, -1, ErrNoMem)
+			})
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
 		})
 	})
 
-	t.Run("enqueue block", func(t *testing.T) {
-		t.Run("append when empty", func(t *testing.T) {
-			queue := testQueue(t, 0, 0)
+	t.Run("open wait", func(t *testing.T) {
+		t.Run("wait for creation", func(t *testing.T) {
+			key, err := FindFreeKey()
+			require.NoError(t, err)
 
-			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
-			for _, msg := range msgs {
-				err := queue.EnqueueBlock(context.Background(), msg)
+			created := make(chan *Queue)
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				queue, err := Create(key, 2, 5)
 				assert.NoError(t, err)
-			}
-
-			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+				created <- queue
+			}()
 
-			got := make([]byte, 8*2)
-			for i, want := range msgs {
-				queue.seg.getMsgData(uint32(i), got)
-				assert.Equal(t, want, got)
-			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			queue, err := OpenWait(ctx, key)
+			prev := <-created
+			require.NoError(t, err)
+			assert.Equal(t, prev.id, queue.id)
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, prev.Close())
+			assert.NoError(t, prev.Delete())
 		})
 
-		t.Run("append when shifted", func(t *testing.T) {
-			queue := testQueue(t, 2, 0)
+		t.Run("stop on context done", func(t *testing.T) {
+			key, err := FindFreeKey()
+			require.NoError(t, err)
 
-			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
-			for _, msg := range msgs {
-				err := queue.EnqueueBlock(context.Background(), msg)
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err = OpenWait(ctx, key)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		})
+
+		t.Run("fail immediately on permanent error", func(t *testing.T) {
+			key, err := FindFreeKey()
+			require.NoError(t, err)
+			id, err := unix.SysvShmGet(key, 64, unix.IPC_CREAT|unix.IPC_EXCL|0600)
+			require.NoError(t, err)
+			defer func() {
+				_, err := unix.SysvShmCtl(id, unix.IPC_RMID, nil)
 				assert.NoError(t, err)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			_, err = OpenWait(ctx, key)
+			assert.Error(t, err)
+			assert.NotErrorIs(t, err, context.DeadlineExceeded)
+		})
+	})
+
+	t.Run("open expect", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		prev, err := Create(key, 4, 16)
+		require.NoError(t, err)
+		defer func() {
+			err = prev.Close()
+			assert.NoError(t, err)
+			err = prev.Delete()
+			assert.NoError(t, err)
+		}()
+
+		t.Run("succeed on same geometry", func(t *testing.T) {
+			queue, err := OpenExpect(key, 4, 16)
+			require.NoError(t, err)
+			err = queue.Close()
+			assert.NoError(t, err)
+		})
+
+		t.Run("fail on different message size", func(t *testing.T) {
+			_, err := OpenExpect(key, 2, 16)
+			assert.ErrorIs(t, err, ErrGeometryMismatch)
+			assert.Contains(t, err.Error(), "message size 32 bytes and max length 16, expected 16 bytes and 16")
+		})
+
+		t.Run("fail on different max length", func(t *testing.T) {
+			_, err := OpenExpect(key, 4, 15)
+			assert.ErrorIs(t, err, ErrGeometryMismatch)
+		})
+	})
+
+	t.Run("schema id", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		prev, err := Create(key, 2, 4, WithSchemaID(7))
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, prev.Close())
+			assert.NoError(t, prev.Delete())
+		}()
+		assert.Equal(t, uint32(7), prev.SchemaID())
+
+		t.Run("succeed on same schema", func(t *testing.T) {
+			queue, err := Open(key, WithSchemaID(7))
+			require.NoError(t, err)
+			assert.Equal(t, uint32(7), queue.SchemaID())
+			assert.NoError(t, queue.Close())
+		})
+
+		t.Run("succeed without schema", func(t *testing.T) {
+			queue, err := Open(key)
+			require.NoError(t, err)
+			assert.NoError(t, queue.Close())
+		})
+
+		t.Run("fail on different schema", func(t *testing.T) {
+			_, err := Open(key, WithSchemaID(8))
+			assert.ErrorIs(t, err, ErrSchemaMismatch)
+			assert.Contains(t, err.Error(), "schema ID 7, expected 8")
+
+			_, _, err = OpenOrCreate(key, 2, 4, WithSchemaID(8))
+			assert.ErrorIs(t, err, ErrSchemaMismatch)
+		})
+
+		t.Run("list", func(t *testing.T) {
+			infos, err := List()
+			require.NoError(t, err)
+			for _, info := range infos {
+				if info.ID == prev.ExportID() {
+					assert.Equal(t, uint32(7), info.SchemaID)
+					return
+				}
 			}
+			t.Error("queue not found")
+		})
+	})
 
-			assert.Equal(t, uint32(2), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+	t.Run("alignment", func(t *testing.T) {
+		t.Run("lock words are aligned", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
 
-			msgsByIdx := map[int][]byte{
-				2: testMsgA,
-				3: testMsgB,
-				4: testMsgC,
+			assert.Zero(t, uintptr(unsafe.Pointer(&queue.seg.mem[startHeaderLock]))%8)
+			for idx := uint32(0); idx < queue.seg.getMaxLen(); idx++ {
+				assert.Zero(t, uintptr(unsafe.Pointer(&queue.seg.mem[queue.seg.startMsgLock(idx)]))%8)
 			}
-			got := make([]byte, 8*2)
-			for i, want := range msgsByIdx {
-				queue.seg.getMsgData(uint32(i), got)
-				assert.Equal(t, want, got)
+		})
+
+		t.Run("create pads unaligned message size", func(t *testing.T) {
+			for _, size := range []uint32{7, 13, 20} {
+				t.Run(fmt.Sprint(size), func(t *testing.T) {
+					key, err := FindFreeKey()
+					require.NoError(t, err)
+
+					queue, err := CreateBytes(key, size, 3)
+					require.NoError(t, err)
+					defer func() {
+						assert.NoError(t, queue.Close())
+						assert.NoError(t, queue.Delete())
+					}()
+
+					assert.Equal(t, int(size), queue.MessageSize())
+					assert.Equal(t, padMsgSize(size), queue.seg.getMsgSize())
+					assert.Zero(t, queue.seg.getMsgSize()%8)
+					for idx := uint32(0); idx < queue.seg.getMaxLen(); idx++ {
+						assert.Zero(t, uintptr(unsafe.Pointer(&queue.seg.mem[queue.seg.startMsgLock(idx)]))%8)
+					}
+
+					msgs := make([][]byte, 3)
+					for i := range msgs {
+						msgs[i] = bytes.Repeat([]byte{byte(i + 1)}, int(size))
+						require.True(t, queue.EnqueueTry(msgs[i]))
+					}
+					toMsg := make([]byte, size)
+					for i := range msgs {
+						require.True(t, queue.DequeueTry(toMsg))
+						assert.Equal(t, msgs[i], toMsg)
+					}
+
+					assert.Panics(t, func() { queue.EnqueueTry(make([]byte, padMsgSize(size))) })
+				})
 			}
 		})
 
-		t.Run("block until context is cancelled when full", func(t *testing.T) {
-			queue := testQueue(t, 0, 5)
+		t.Run("message size of word-sized queue", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			assert.Equal(t, 16, queue.MessageSize())
+		})
 
-			ctx, cancel := context.WithCancel(context.Background())
-			done := make(chan bool)
-			go func(msg []byte) {
-				err := queue.EnqueueBlock(ctx, msg)
-				assert.ErrorIs(t, err, context.Canceled)
-				done <- true
-			}(testMsgA)
-			select {
-			case <-done:
-				t.Fatal("EnqueueBlock didn't block until context is cancelled")
-			default:
-				// Go on.
-			}
-			cancel()
-			<-done
+		t.Run("new message buffer", func(t *testing.T) {
+			queue := testQueue(t, 0, 1)
+			queue.seg.setMsgData(0, testMsgA)
 
-			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+			buf := queue.NewMessageBuffer()
+			assert.Len(t, buf, queue.MessageSize())
+			require.True(t, queue.DequeueTry(buf))
+			assert.Equal(t, testMsgA, buf)
 
-			got := make([]byte, 8*2)
-			queue.seg.getMsgData(uint32(0), got)
-			assert.Equal(t, testMsgNil, got)
+			require.True(t, queue.EnqueueTry(testMsgB))
+			assert.PanicsWithValue(t,
+				"message size must be 16 bytes, but got 2: is it in 64-bit words? Use NewMessageBuffer",
+				func() { queue.DequeueTry(make([]byte, 2)) },
+			)
 		})
 
-		t.Run("block until space is available when full", func(t *testing.T) {
-			queue := testQueue(t, 0, 5)
+		t.Run("attach fails on unaligned message size", func(t *testing.T) {
+			prev := testQueue(t, 0, 0)
+			prev.seg.setMsgSize(12)
+			defer prev.seg.setMsgSize(16)
 
-			done := make(chan bool)
-			go func(msg []byte) {
-				err := queue.EnqueueBlock(context.Background(), msg)
-				assert.NoError(t, err)
-				done <- true
-			}(testMsgA)
+			_, err := AttachByID(prev.ExportID())
+			assert.ErrorIs(t, err, ErrUnaligned)
+		})
+	})
+
+	t.Run("message data copy", func(t *testing.T) {
+		queue, err := CreatePrivate(512, 3)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		msg := make([]byte, 4096)
+		for i := range msg {
+			msg[i] = byte(i * 7)
+		}
+		queue.seg.setMsgData(1, msg)
+
+		data := queue.seg.msgData(1)
+		for i := range msg {
+			require.Equal(t, msg[i], data[i], "byte %d", i)
+		}
+		toMsg := make([]byte, len(msg))
+		queue.seg.getMsgData(1, toMsg)
+		assert.Equal(t, msg, toMsg)
+		assert.Equal(t, make([]byte, len(msg)), queue.seg.msgData(0))
+		assert.Equal(t, make([]byte, len(msg)), queue.seg.msgData(2))
+		assert.Zero(t, queue.seg.msgLockOwner(2))
+	})
+
+	t.Run("byte order", func(t *testing.T) {
+		native := detectByteOrder()
+		var nonNative binary.ByteOrder = binary.BigEndian
+		if native == binary.BigEndian {
+			nonNative = binary.LittleEndian
+		}
+
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5, WithByteOrder(nonNative))
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		assert.Equal(t, uint32(5), nonNative.Uint32(queue.seg.mem[startMaxLen:endMaxLen]))
+		assert.Equal(t, uint32(16), nonNative.Uint32(queue.seg.mem[startMsgSize:endMsgSize]))
+		assert.Equal(t, uint32(layoutVersion), nonNative.Uint32(queue.seg.mem[startVersion:endVersion]))
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+		assert.Equal(t, uint32(2), nonNative.Uint32(queue.seg.mem[startQueueLen:endQueueLen]))
+
+		opened, err := Open(key)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, opened.Close())
+		}()
+		assert.Equal(t, nonNative, opened.seg.byteOrder)
+		assert.Equal(t, uint32(5), opened.seg.getMaxLen())
+		assert.Equal(t, uint32(2), opened.seg.getQueueLen())
+
+		toMsg := make([]byte, len(testMsgA))
+		require.True(t, opened.DequeueTry(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+		assert.Equal(t, uint32(1), queue.seg.getStartIdx())
+
+		t.Run("native by default", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			assert.Equal(t, native, queue.seg.byteOrder)
+		})
+	})
+
+	t.Run("open fails on different layout version", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		prev, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			err = prev.Close()
+			assert.NoError(t, err)
+			err = prev.Delete()
+			assert.NoError(t, err)
+		}()
+		prev.seg.byteOrder.PutUint32(prev.seg.mem[startVersion:endVersion], layoutVersion+1)
+
+		_, err = Open(key)
+		assert.ErrorIs(t, err, ErrVersionMismatch)
+		_, err = AttachByID(prev.ExportID())
+		assert.ErrorIs(t, err, ErrVersionMismatch)
+	})
+
+	t.Run("attach at address", func(t *testing.T) {
+		t.Run("attach at requested address", func(t *testing.T) {
+			prev := testQueue(t, 0, 0)
+
+			// Find a free address by attaching and detaching.
+			probe, err := AttachByID(prev.ExportID())
+			require.NoError(t, err)
+			addr := probe.BaseAddr()
+			err = probe.Close()
+			require.NoError(t, err)
+
+			queue, err := AttachByID(prev.ExportID(), WithAttachAddr(addr))
+			require.NoError(t, err)
+			defer func() {
+				err = queue.Close()
+				assert.NoError(t, err)
+			}()
+			assert.Equal(t, addr, queue.BaseAddr())
+		})
+
+		t.Run("fail on unaligned address", func(t *testing.T) {
+			prev := testQueue(t, 0, 0)
+
+			_, err := AttachByID(prev.ExportID(), WithAttachAddr(prev.BaseAddr()+1))
+			assert.ErrorIs(t, err, ErrAttachAddr)
+		})
+
+		t.Run("fail on occupied address", func(t *testing.T) {
+			prev := testQueue(t, 0, 0)
+
+			_, err := AttachByID(prev.ExportID(), WithAttachAddr(prev.BaseAddr()))
+			assert.ErrorIs(t, err, ErrAttachAddr)
+		})
+	})
+
+	t.Run("create with default access", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		mode, err := queue.Mode()
+		assert.NoError(t, err)
+		assert.Equal(t, 0600, mode)
+	})
+
+	t.Run("create with custom access and open it", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		prev, err := Create(key, 4, 16, WithAccess(0660))
+		assert.NoError(t, err)
+		err = prev.Close()
+		assert.NoError(t, err)
+
+		queue, err := Open(key, WithAccess(0660))
+		assert.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+			err = queue.Delete()
+			assert.NoError(t, err)
+		}()
+
+		mode, err := queue.Mode()
+		assert.NoError(t, err)
+		assert.Equal(t, 0660, mode)
+	})
+
+	t.Run("lock memory", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		err := queue.LockMemory()
+		if errors.Is(err, ErrLockNotPermitted) {
+			t.Skip("locking memory isn't permitted")
+		}
+		assert.NoError(t, err)
+		err = queue.UnlockMemory()
+		assert.NoError(t, err)
+	})
+
+	t.Run("create with locked memory", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		queue, err := Create(key, 2, 5, WithLockedMemory())
+		if errors.Is(err, ErrLockNotPermitted) {
+			assert.NoError(t, deleteShm(key))
+			t.Skip("locking memory isn't permitted")
+		}
+		require.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+			err = queue.Delete()
+			assert.NoError(t, err)
+		}()
+
+		var desc unix.SysvShmDesc
+		_, err = unix.SysvShmCtl(queue.id, unix.IPC_STAT, &desc)
+		require.NoError(t, err)
+		assert.NotZero(t, desc.Perm.Mode&02000, "SHM_LOCKED flag must be set")
+	})
+
+	t.Run("is deleted", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+		}()
+
+		deleted, err := queue.IsDeleted()
+		assert.NoError(t, err)
+		assert.False(t, deleted)
+
+		err = queue.Delete()
+		assert.NoError(t, err)
+
+		deleted, err = queue.IsDeleted()
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+	})
+
+	t.Run("operations fail after delete", func(t *testing.T) {
+		queue, err := CreatePrivate(2, 5)
+		require.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+		}()
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		require.NoError(t, queue.Delete())
+
+		toMsg := make([]byte, 8*2)
+		assert.Equal(t, ErrSegmentDeleted, queue.EnqueueTryErr(testMsgC))
+		assert.False(t, queue.EnqueueShift(testMsgC))
+		assert.False(t, queue.EnqueueAllTry([][]byte{testMsgC}))
+		assert.Equal(t, ErrSegmentDeleted, queue.DequeueTryErr(toMsg))
+		assert.False(t, queue.DequeueTry(toMsg))
+		_, _, _, ok := queue.Bounds()
+		assert.False(t, ok)
+		assert.ErrorIs(t, queue.CopyOutChunked(0, toMsg, 0), ErrSegmentDeleted)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.ErrorIs(t, queue.EnqueueBlock(ctx, testMsgC), ErrSegmentDeleted)
+		assert.ErrorIs(t, queue.DequeueBlock(ctx, toMsg), ErrSegmentDeleted)
+		assert.ErrorIs(t, queue.WaitDepth(ctx, 5), ErrSegmentDeleted)
+
+		// The messages are left untouched.
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+	})
+
+	t.Run("enqueue shift", func(t *testing.T) {
+		t.Run("append when empty", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
+			for _, msg := range msgs {
+				queue.EnqueueShift(msg)
+			}
+
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+
+			got := make([]byte, 8*2)
+			for i, want := range msgs {
+				queue.seg.getMsgData(uint32(i), got)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("shift when full", func(t *testing.T) {
+			queue := testQueue(t, 0, 5)
+
+			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
+			for _, msg := range msgs {
+				queue.EnqueueShift(msg)
+			}
+
+			assert.Equal(t, uint32(3), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+
+			got := make([]byte, 8*2)
+			for i, want := range msgs {
+				queue.seg.getMsgData(uint32(i), got)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("cycle when full with max shift", func(t *testing.T) {
+			queue := testQueue(t, 4, 5)
+
+			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
+			for _, msg := range msgs {
+				queue.EnqueueShift(msg)
+			}
+
+			assert.Equal(t, uint32(2), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+
+			msgsByIdx := map[int][]byte{
+				4: testMsgA,
+				0: testMsgB,
+				1: testMsgC,
+			}
+			got := make([]byte, 8*2)
+			for i, want := range msgsByIdx {
+				queue.seg.getMsgData(uint32(i), got)
+				assert.Equal(t, want, got)
+			}
+		})
+	})
+
+	t.Run("concurrent create of the same key", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			key, err := FindFreeKey()
+			require.NoError(t, err)
+
+			var queues [2]*Queue
+			var errs [2]error
+			start := make(chan struct{})
+			done := make(chan struct{})
+			for j := range queues {
+				j := j
+				go func() {
+					<-start
+					queues[j], errs[j] = Create(key, 2, 5)
+					done <- struct{}{}
+				}()
+			}
+			close(start)
+			<-done
+			<-done
+
+			require.NoError(t, errs[0])
+			require.NoError(t, errs[1])
+			assert.Equal(t, queues[0].ExportID(), queues[1].ExportID())
+			require.True(t, queues[0].EnqueueTry(testMsgA))
+			assert.Equal(t, uint32(1), queues[1].seg.getQueueLen())
+
+			assert.NoError(t, queues[0].Close())
+			assert.NoError(t, queues[1].Close())
+			assert.NoError(t, queues[0].Delete())
+		}
+	})
+
+	t.Run("create adopts queue created in between", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		prev, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, prev.Close())
+			assert.NoError(t, prev.Delete())
+		}()
+		require.True(t, prev.EnqueueTry(testMsgA))
+
+		queue, err := adoptQueue(key, totalShmSize(16, 5), 16, 5, newOptions(nil))
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+		}()
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+
+		_, err = adoptQueue(key, totalShmSize(16, 4), 16, 4, newOptions(nil))
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+	})
+
+	t.Run("create gives up waiting for magic", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		totalSize := totalShmSize(16, 5)
+		id, err := unix.SysvShmGet(key, totalSize, 0600|unix.IPC_CREAT|unix.IPC_EXCL)
+		require.NoError(t, err)
+		defer func() {
+			_, err = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+			assert.NoError(t, err)
+		}()
+
+		_, err = adoptQueue(key, totalSize, 16, 5, newOptions([]Option{WithCreateRetries(2)}))
+		assert.ErrorIs(t, err, ErrInvalidMagic)
+	})
+
+	t.Run("open or create", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		queue, created, err := OpenOrCreate(key, 2, 5)
+		require.NoError(t, err)
+		assert.True(t, created)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+		require.True(t, queue.EnqueueTry(testMsgA))
+
+		opened, created, err := OpenOrCreate(key, 2, 5)
+		require.NoError(t, err)
+		assert.False(t, created)
+		defer func() {
+			assert.NoError(t, opened.Close())
+		}()
+		assert.Equal(t, queue.ExportID(), opened.ExportID())
+		assert.Equal(t, uint32(1), opened.seg.getQueueLen())
+		assert.True(t, queue.Created())
+		assert.False(t, opened.Created())
+
+		_, _, err = OpenOrCreate(key, 2, 4)
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+		_, _, err = OpenOrCreate(key, 4, 50)
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+	})
+
+	t.Run("created", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+		assert.True(t, queue.Created())
+
+		opened, err := Open(key)
+		require.NoError(t, err)
+		assert.False(t, opened.Created())
+		assert.NoError(t, opened.Close())
+
+		recovered, err := Create(key, 2, 5, WithRecover())
+		require.NoError(t, err)
+		assert.False(t, recovered.Created())
+		assert.NoError(t, recovered.Close())
+
+		reset, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		assert.Equal(t, queue.ExportID(), reset.ExportID())
+		assert.True(t, reset.Created(), "a reset queue is initialized anew")
+		assert.NoError(t, reset.Close())
+	})
+
+	t.Run("create fit page", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		queue, maxLen, err := CreateFitPage(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		pageSize := os.Getpagesize()
+		assert.GreaterOrEqual(t, maxLen, uint32(5))
+		assert.Equal(t, maxLen, queue.seg.getMaxLen())
+		assert.LessOrEqual(t, totalShmSize(16, maxLen), pageSize)
+		assert.Greater(t, totalShmSize(16, maxLen+1), pageSize)
+
+		t.Run("exact fit is kept", func(t *testing.T) {
+			assert.Equal(t, uint32(5), fitPageLen(16, 5, uint64(totalShmSize(16, 5))))
+		})
+	})
+
+	t.Run("enqueue shift overflow policy", func(t *testing.T) {
+		t.Run("drop oldest", func(t *testing.T) {
+			queue := testQueue(t, 0, 5, WithOverflowPolicy(DropOldest))
+
+			assert.True(t, queue.EnqueueShift(testMsgC))
+			assert.Equal(t, uint32(1), queue.seg.getStartIdx())
+			assert.Equal(t, testMsgC, queue.seg.msgData(0))
+		})
+
+		t.Run("drop newest", func(t *testing.T) {
+			queue := testQueue(t, 0, 5, WithOverflowPolicy(DropNewest))
+			prev := append([]byte(nil), queue.seg.msgData(0)...)
+
+			assert.False(t, queue.EnqueueShift(testMsgC))
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+			assert.Equal(t, prev, queue.seg.msgData(0))
+			assert.Equal(t, uint64(1), queue.Stats().Dropped)
+
+			toMsg := make([]byte, len(testMsgC))
+			require.True(t, queue.DequeueTry(toMsg))
+			assert.True(t, queue.EnqueueShift(testMsgC))
+		})
+
+		t.Run("drop and notify", func(t *testing.T) {
+			queue := testQueue(t, 0, 4, WithOverflowPolicy(DropAndNotify))
+
+			assert.True(t, queue.EnqueueShift(testMsgC))
+			assert.False(t, queue.EnqueueShift(testMsgC))
+			assert.Equal(t, uint32(1), queue.seg.getStartIdx())
+			assert.Equal(t, testMsgC, queue.seg.msgData(0))
+		})
+	})
+
+	t.Run("enqueue shift notify", func(t *testing.T) {
+		t.Run("notify at high water", func(t *testing.T) {
+			queue := testQueue(t, 0, 0, WithHighWater(0.6))
+
+			var depths []uint32
+			for i := 0; i < 6; i++ {
+				queue.EnqueueShiftNotify(testMsgA, func(depth, cap uint32) {
+					assert.Equal(t, uint32(5), cap)
+					depths = append(depths, depth)
+				})
+			}
+			assert.Equal(t, []uint32{3, 4, 5}, depths)
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+			assert.Equal(t, uint32(1), queue.seg.getStartIdx())
+		})
+
+		t.Run("notify only when full by default", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+
+			notified := 0
+			for i := 0; i < 3; i++ {
+				queue.EnqueueShiftNotify(testMsgA, func(depth, cap uint32) {
+					notified++
+				})
+			}
+			assert.Equal(t, 1, notified)
+		})
+
+		t.Run("mark is relative to soft cap", func(t *testing.T) {
+			queue := testQueue(t, 0, 2, WithHighWater(0.5))
+			require.NoError(t, queue.SetSoftCap(4))
+
+			var depths []uint32
+			for i := 0; i < 3; i++ {
+				ok := queue.EnqueueShiftNotify(testMsgA, func(depth, cap uint32) {
+					assert.Equal(t, uint32(4), cap)
+					depths = append(depths, depth)
+				})
+				assert.True(t, ok)
+			}
+			assert.Equal(t, []uint32{2, 3, 4}, depths)
+		})
+
+		t.Run("no notification when not enqueued", func(t *testing.T) {
+			queue := testQueue(t, 0, 5, WithHighWater(0.5), WithOverflowPolicy(DropNewest))
+
+			notified := false
+			onPressure := func(depth, cap uint32) { notified = true }
+			assert.False(t, queue.EnqueueShiftNotify(testMsgA, onPressure))
+			queue.CloseQueue()
+			queue.seg.setQueueLen(0)
+			assert.False(t, queue.EnqueueShiftNotify(testMsgA, onPressure))
+			assert.False(t, notified)
+		})
+	})
+
+	t.Run("enqueue block", func(t *testing.T) {
+		t.Run("append when empty", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
+			for _, msg := range msgs {
+				err := queue.EnqueueBlock(context.Background(), msg)
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+
+			got := make([]byte, 8*2)
+			for i, want := range msgs {
+				queue.seg.getMsgData(uint32(i), got)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("append when shifted", func(t *testing.T) {
+			queue := testQueue(t, 2, 0)
+
+			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
+			for _, msg := range msgs {
+				err := queue.EnqueueBlock(context.Background(), msg)
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, uint32(2), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+
+			msgsByIdx := map[int][]byte{
+				2: testMsgA,
+				3: testMsgB,
+				4: testMsgC,
+			}
+			got := make([]byte, 8*2)
+			for i, want := range msgsByIdx {
+				queue.seg.getMsgData(uint32(i), got)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("block until context is cancelled when full", func(t *testing.T) {
+			queue := testQueue(t, 0, 5)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan bool)
+			go func(msg []byte) {
+				err := queue.EnqueueBlock(ctx, msg)
+				assert.ErrorIs(t, err, context.Canceled)
+				done <- true
+			}(testMsgA)
+			select {
+			case <-done:
+				t.Fatal("EnqueueBlock didn't block until context is cancelled")
+			default:
+				// Go on.
+			}
+			cancel()
+			<-done
+
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+
+			got := make([]byte, 8*2)
+			queue.seg.getMsgData(uint32(0), got)
+			assert.Equal(t, testMsgNil, got)
+		})
+
+		t.Run("block until space is available when full", func(t *testing.T) {
+			queue := testQueue(t, 0, 5)
+
+			done := make(chan bool)
+			go func(msg []byte) {
+				err := queue.EnqueueBlock(context.Background(), msg)
+				assert.NoError(t, err)
+				done <- true
+			}(testMsgA)
+			select {
+			case <-done:
+				t.Fatal("EnqueueBlock didn't block until space is available")
+			default:
+				// Go on.
+			}
+			queue.seg.setQueueLen(4)
+			<-done
+
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+
+			got := make([]byte, 8*2)
+			queue.seg.getMsgData(uint32(4), got)
+			assert.Equal(t, testMsgA, got)
+		})
+	})
+
+	t.Run("enqueue block returns error when deleted while full", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+		}()
+		queue.seg.setQueueLen(5)
+
+		done := make(chan bool)
+		go func(msg []byte) {
+			err := queue.EnqueueBlock(context.Background(), msg)
+			assert.ErrorIs(t, err, ErrSegmentDeleted)
+			done <- true
+		}(testMsgA)
+		err = queue.Delete()
+		require.NoError(t, err)
+		<-done
+	})
+
+	t.Run("fair enqueue block", func(t *testing.T) {
+		// waitTickets waits until n tickets are taken, so producers are started in a known order.
+		waitTickets := func(queue *Queue, n uint32) {
+			for queue.seg.byteOrder.Uint32(queue.seg.mem[startNextTicket:endNextTicket]) != n {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		t.Run("serve blocked producers in order of arrival", func(t *testing.T) {
+			queue := testQueue(t, 0, 5, WithFairEnqueue())
+
+			done := make(chan int)
+			for i := 0; i < 4; i++ {
+				go func(i int) {
+					err := queue.EnqueueBlock(context.Background(), testMsgA)
+					assert.NoError(t, err)
+					done <- i
+				}(i)
+				waitTickets(queue, uint32(i+1))
+			}
+
+			got := make([]byte, 8*2)
+			for want := 0; want < 4; want++ {
+				ok := queue.DequeueTry(got)
+				require.True(t, ok)
+				assert.Equal(t, want, <-done)
+			}
+		})
+
+		t.Run("skip cancelled producers", func(t *testing.T) {
+			queue := testQueue(t, 0, 5, WithFairEnqueue())
+
+			done := make(chan int)
+			ctx, cancel := context.WithCancel(context.Background())
+			for i := 0; i < 3; i++ {
+				go func(i int) {
+					producerCtx := context.Background()
+					if i == 1 {
+						producerCtx = ctx
+					}
+					err := queue.EnqueueBlock(producerCtx, testMsgA)
+					if i == 1 {
+						assert.ErrorIs(t, err, context.Canceled)
+					} else {
+						assert.NoError(t, err)
+					}
+					done <- i
+				}(i)
+				waitTickets(queue, uint32(i+1))
+			}
+			cancel()
+			assert.Equal(t, 1, <-done)
+
+			got := make([]byte, 8*2)
+			for _, want := range []int{0, 2} {
+				ok := queue.DequeueTry(got)
+				require.True(t, ok)
+				assert.Equal(t, want, <-done)
+			}
+		})
+
+		t.Run("enqueue out of line when it's full", func(t *testing.T) {
+			queue := testQueue(t, 0, 0, WithFairEnqueue())
+			atomic.StoreUint32((*uint32)(unsafe.Pointer(&queue.seg.mem[startNextTicket])), maxPendingTickets)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			require.NoError(t, queue.EnqueueBlock(ctx, testMsgA))
+			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+		})
+
+		t.Run("skip turns of dead producers", func(t *testing.T) {
+			queue := testQueue(t, 0, 0, WithFairEnqueue())
+
+			cmd := exec.Command("true")
+			require.NoError(t, cmd.Run())
+			atomic.StoreUint32((*uint32)(unsafe.Pointer(&queue.seg.mem[startNextTicket])), 1)
+			atomic.StoreUint32(queue.seg.ticketOwnerPtr(0), uint32(cmd.Process.Pid))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			assert.ErrorIs(t, queue.EnqueueBlock(ctx, testMsgA), context.DeadlineExceeded)
+
+			repaired, err := queue.RepairLocks()
+			require.NoError(t, err)
+			assert.Equal(t, 1, repaired)
+			require.NoError(t, queue.EnqueueBlock(context.Background(), testMsgA))
+			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+		})
+	})
+
+	t.Run("enqueue try", func(t *testing.T) {
+		t.Run("successfully append when empty", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
+			for _, msg := range msgs {
+				ok := queue.EnqueueTry(msg)
+				assert.True(t, ok)
+			}
+
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+
+			got := make([]byte, 8*2)
+			for i, want := range msgs {
+				queue.seg.getMsgData(uint32(i), got)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("successfully append when shifted", func(t *testing.T) {
+			queue := testQueue(t, 2, 0)
+
+			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
+			for _, msg := range msgs {
+				ok := queue.EnqueueTry(msg)
+				assert.True(t, ok)
+			}
+
+			assert.Equal(t, uint32(2), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+
+			msgsByIdx := map[int][]byte{
+				2: testMsgA,
+				3: testMsgB,
+				4: testMsgC,
+			}
+			got := make([]byte, 8*2)
+			for i, want := range msgsByIdx {
+				queue.seg.getMsgData(uint32(i), got)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("fail when full", func(t *testing.T) {
+			queue := testQueue(t, 0, 5)
+
+			ok := queue.EnqueueTry(testMsgA)
+			assert.False(t, ok)
+
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+
+			got := make([]byte, 8*2)
+			queue.seg.getMsgData(uint32(0), got)
+			assert.Equal(t, testMsgNil, got)
+		})
+	})
+
+	t.Run("enqueue try err", func(t *testing.T) {
+		queue := testQueue(t, 3, 4)
+
+		assert.NoError(t, queue.EnqueueTryErr(testMsgA))
+		assert.Equal(t, ErrFull, queue.EnqueueTryErr(testMsgB))
+		queue.CloseQueue()
+		assert.Equal(t, ErrQueueClosed, queue.EnqueueTryErr(testMsgB))
+	})
+
+	t.Run("enqueue try at", func(t *testing.T) {
+		t.Run("return slot index", func(t *testing.T) {
+			queue := testQueue(t, 3, 1)
+
+			for _, want := range []uint32{4, 0, 1} {
+				idx, ok := queue.EnqueueTryAt(testMsgA)
+				assert.True(t, ok)
+				assert.Equal(t, want, idx)
+
+				got := make([]byte, 8*2)
+				queue.seg.getMsgData(idx, got)
+				assert.Equal(t, testMsgA, got)
+			}
+		})
+
+		t.Run("fail when full", func(t *testing.T) {
+			queue := testQueue(t, 3, 5)
+
+			_, ok := queue.EnqueueTryAt(testMsgA)
+			assert.False(t, ok)
+		})
+	})
+
+	t.Run("enqueue if below", func(t *testing.T) {
+		t.Run("below threshold", func(t *testing.T) {
+			queue := testQueue(t, 3, 1)
+
+			enqueued, depth := queue.EnqueueIfBelow(testMsgA, 3)
+			assert.True(t, enqueued)
+			assert.Equal(t, uint32(1), depth)
+			enqueued, depth = queue.EnqueueIfBelow(testMsgB, 3)
+			assert.True(t, enqueued)
+			assert.Equal(t, uint32(2), depth)
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+		})
+
+		t.Run("at threshold", func(t *testing.T) {
+			queue := testQueue(t, 3, 2)
+
+			enqueued, depth := queue.EnqueueIfBelow(testMsgA, 2)
+			assert.False(t, enqueued)
+			assert.Equal(t, uint32(2), depth)
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+		})
+
+		t.Run("full or closed", func(t *testing.T) {
+			queue := testQueue(t, 3, 5)
+
+			enqueued, depth := queue.EnqueueIfBelow(testMsgA, 10)
+			assert.False(t, enqueued)
+			assert.Equal(t, uint32(5), depth)
+
+			queue = testQueue(t, 3, 1)
+			queue.CloseQueue()
+			enqueued, depth = queue.EnqueueIfBelow(testMsgA, 10)
+			assert.False(t, enqueued)
+			assert.Equal(t, uint32(1), depth)
+		})
+	})
+
+	t.Run("enqueue all block", func(t *testing.T) {
+		t.Run("append all when there is space", func(t *testing.T) {
+			queue := testQueue(t, 3, 1)
+
+			require.NoError(t, queue.EnqueueAllBlock(context.Background(), [][]byte{testMsgB, testMsgC}))
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+			assert.Equal(t, testMsgB, queue.seg.msgData(4))
+			assert.Equal(t, testMsgC, queue.seg.msgData(0))
+		})
+
+		t.Run("wait for space for the whole batch", func(t *testing.T) {
+			queue := testQueue(t, 0, 4)
+
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				queue.DequeueTry(make([]byte, 16))
+				time.Sleep(20 * time.Millisecond)
+				queue.DequeueTry(make([]byte, 16))
+			}()
+			require.NoError(t, queue.EnqueueAllBlock(context.Background(), [][]byte{testMsgB, testMsgC, testMsgA}))
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+			assert.Equal(t, uint32(2), queue.seg.getStartIdx())
+			assert.Equal(t, testMsgB, queue.seg.msgData(4))
+			assert.Equal(t, testMsgC, queue.seg.msgData(0))
+			assert.Equal(t, testMsgA, queue.seg.msgData(1))
+		})
+
+		t.Run("fail when batch never fits", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			msgs := [][]byte{testMsgA, testMsgB, testMsgC, testMsgA, testMsgB, testMsgC}
+			err := queue.EnqueueAllBlock(context.Background(), msgs)
+			assert.ErrorIs(t, err, ErrNoSpace)
+		})
+
+		t.Run("stop on cancel", func(t *testing.T) {
+			queue := testQueue(t, 0, 4)
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			err := queue.EnqueueAllBlock(ctx, [][]byte{testMsgA, testMsgB})
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			assert.Equal(t, uint32(4), queue.seg.getQueueLen())
+		})
+
+		t.Run("fail when closed", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			queue.CloseQueue()
+
+			err := queue.EnqueueAllBlock(context.Background(), [][]byte{testMsgA})
+			assert.ErrorIs(t, err, ErrQueueClosed)
+		})
+	})
+
+	t.Run("enqueue all try", func(t *testing.T) {
+		t.Run("append all when there is space", func(t *testing.T) {
+			queue := testQueue(t, 3, 1)
+
+			ok := queue.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC})
+			assert.True(t, ok)
+
+			assert.Equal(t, uint32(3), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(4), queue.seg.getQueueLen())
+
+			msgsByIdx := map[int][]byte{
+				4: testMsgA,
+				0: testMsgB,
+				1: testMsgC,
+			}
+			got := make([]byte, 8*2)
+			for i, want := range msgsByIdx {
+				queue.seg.getMsgData(uint32(i), got)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("append nothing when there is not enough space", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+
+			ok := queue.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC})
+			assert.False(t, ok)
+
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+
+			got := make([]byte, 8*2)
+			for _, i := range []uint32{3, 4} {
+				queue.seg.getMsgData(i, got)
+				assert.Equal(t, testMsgNil, got)
+			}
+		})
+
+		t.Run("succeed with no messages", func(t *testing.T) {
+			queue := testQueue(t, 0, 5)
+
+			ok := queue.EnqueueAllTry(nil)
+			assert.True(t, ok)
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+		})
+
+		t.Run("panic on wrong message size before writing", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			assert.Panics(t, func() {
+				queue.EnqueueAllTry([][]byte{testMsgA, make([]byte, 8)})
+			})
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		})
+	})
+
+	t.Run("dequeue block", func(t *testing.T) {
+		t.Run("dequeue from half full", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+
+			queue.seg.setMsgData(0, testMsgA)
+			queue.seg.setMsgData(1, testMsgB)
+			queue.seg.setMsgData(2, testMsgC)
+
+			for _, want := range [][]byte{testMsgA, testMsgB, testMsgC} {
+				got := make([]byte, 8*2)
+				err := queue.DequeueBlock(context.Background(), got)
+				assert.NoError(t, err)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("dequeue from shifted", func(t *testing.T) {
+			queue := testQueue(t, 3, 3)
+
+			queue.seg.setMsgData(3, testMsgA)
+			queue.seg.setMsgData(4, testMsgB)
+			queue.seg.setMsgData(0, testMsgC)
+
+			dequeue := func(want []byte) {
+				got := make([]byte, 8*2)
+				err := queue.DequeueBlock(context.Background(), got)
+				assert.NoError(t, err)
+				assert.Equal(t, want, got)
+			}
+
+			dequeue(testMsgA)
+			assert.Equal(t, uint32(4), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+
+			dequeue(testMsgB)
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+
+			dequeue(testMsgC)
+			assert.Equal(t, uint32(1), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		})
+
+		t.Run("block while empty", func(t *testing.T) {
+			queue := testQueue(t, 4, 0)
+
+			done := make(chan bool)
+			go func() {
+				got := make([]byte, 8*2)
+				err := queue.DequeueBlock(context.Background(), got)
+				assert.NoError(t, err)
+				done <- true
+			}()
+			select {
+			case <-done:
+				t.Fatal("DequeueBlock didn't block while queue is empty")
+			default:
+				// Go on.
+			}
+			queue.seg.setQueueLen(1)
+			<-done
+		})
+
+		t.Run("block until context is cancelled when empty", func(t *testing.T) {
+			queue := testQueue(t, 4, 0)
+
+			done := make(chan bool)
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				got := make([]byte, 8*2)
+				err := queue.DequeueBlock(ctx, got)
+				assert.ErrorIs(t, err, context.Canceled)
+				done <- true
+			}()
+			select {
+			case <-done:
+				t.Fatal("DequeueBlock didn't block while queue is empty")
+			default:
+				// Go on.
+			}
+			cancel()
+			<-done
+		})
+
+		t.Run("concurrent consumers get each message once", func(t *testing.T) {
+			queue, err := CreatePrivate(1, 8, WithMaxSpinSleep(100*time.Microsecond))
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, queue.Close())
+				assert.NoError(t, queue.Delete())
+			}()
+
+			const producers, consumers, perProducer = 3, 4, 1000
+			var producersWG sync.WaitGroup
+			for p := 0; p < producers; p++ {
+				producersWG.Add(1)
+				go func(p int) {
+					defer producersWG.Done()
+					msg := make([]byte, 8)
+					for i := 0; i < perProducer; i++ {
+						binary.LittleEndian.PutUint64(msg, uint64(p)<<32|uint64(i))
+						assert.NoError(t, queue.EnqueueBlock(context.Background(), msg))
+					}
+				}(p)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var mu sync.Mutex
+			seen := make(map[uint64]int)
+			var received int32
+			var consumersWG sync.WaitGroup
+			for c := 0; c < consumers; c++ {
+				consumersWG.Add(1)
+				go func() {
+					defer consumersWG.Done()
+					// A consumer sees the messages of each producer in the order they were enqueued.
+					last := make(map[uint64]int64)
+					msg := make([]byte, 8)
+					for queue.DequeueBlock(ctx, msg) == nil {
+						n := binary.LittleEndian.Uint64(msg)
+						p, i := n>>32, int64(n&0xFFFFFFFF)
+						if prev, ok := last[p]; ok {
+							assert.Greater(t, i, prev, "producer %d", p)
+						}
+						last[p] = i
+						mu.Lock()
+						seen[n]++
+						mu.Unlock()
+						if atomic.AddInt32(&received, 1) == producers*perProducer {
+							cancel()
+						}
+					}
+				}()
+			}
+			producersWG.Wait()
+			consumersWG.Wait()
+
+			assert.Len(t, seen, producers*perProducer)
+			for n, count := range seen {
+				assert.Equal(t, 1, count, "message %d of producer %d", n&0xFFFFFFFF, n>>32)
+			}
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		})
+	})
+
+	t.Run("dequeue block returns error when deleted while empty", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			err = queue.Close()
+			assert.NoError(t, err)
+		}()
+
+		done := make(chan bool)
+		go func() {
+			got := make([]byte, 8*2)
+			err := queue.DequeueBlock(context.Background(), got)
+			assert.ErrorIs(t, err, ErrSegmentDeleted)
+			done <- true
+		}()
+		err = queue.Delete()
+		require.NoError(t, err)
+		<-done
+	})
+
+	t.Run("blocking calls honor cancellation on message lock", func(t *testing.T) {
+		// withTimeout returns a context that is cancelled soon.
+		withTimeout := func(t *testing.T) context.Context {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			t.Cleanup(cancel)
+			return ctx
+		}
+
+		t.Run("dequeue", func(t *testing.T) {
+			queue := testQueue(t, 3, 2)
+			queue.seg.lockMsg(3)
+
+			err := queue.DequeueBlock(withTimeout(t), make([]byte, 8*2))
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			_, err = queue.DequeueBatchBlock(withTimeout(t), 2)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			_, err = queue.DequeueVarBlock(withTimeout(t), nil)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			err = queue.ConsumeBatch(withTimeout(t), 2, func([][]byte) error { return nil })
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+			// The queue is left intact.
+			assert.Zero(t, queue.seg.headerLockOwner())
+			assert.Equal(t, uint32(3), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+			assert.Zero(t, queue.seg.msgLockOwner(4))
+			queue.seg.unlockMsg(3)
+			assert.True(t, queue.DequeueTry(make([]byte, 8*2)))
+		})
+
+		t.Run("enqueue", func(t *testing.T) {
+			queue := testQueue(t, 3, 1)
+			queue.seg.lockMsg(4)
+
+			err := queue.EnqueueBlock(withTimeout(t), testMsgA)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			err = queue.EnqueueAllBlock(withTimeout(t), [][]byte{testMsgA, testMsgB})
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+			assert.Zero(t, queue.seg.headerLockOwner())
+			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+			assert.Zero(t, queue.seg.msgLockOwner(0))
+			queue.seg.unlockMsg(4)
+			assert.NoError(t, queue.EnqueueBlock(context.Background(), testMsgA))
+		})
+	})
+
+	t.Run("wait depth", func(t *testing.T) {
+		t.Run("already deep enough", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+			assert.NoError(t, queue.WaitDepth(context.Background(), 3))
+			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+		})
+
+		t.Run("wait for producers", func(t *testing.T) {
+			queue := testQueue(t, 0, 1)
+
+			go func() {
+				for i := 0; i < 3; i++ {
+					time.Sleep(5 * time.Millisecond)
+					queue.EnqueueShift(testMsgA)
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			require.NoError(t, queue.WaitDepth(ctx, 4))
+			assert.GreaterOrEqual(t, queue.seg.getQueueLen(), uint32(4))
+		})
+
+		t.Run("cancelled", func(t *testing.T) {
+			queue := testQueue(t, 0, 1)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			assert.ErrorIs(t, queue.WaitDepth(ctx, 2), context.DeadlineExceeded)
+		})
+
+		t.Run("unreachable depth", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			assert.ErrorIs(t, queue.WaitDepth(context.Background(), 6), ErrInvalidDepth)
+		})
+	})
+
+	t.Run("block timed", func(t *testing.T) {
+		t.Run("dequeue", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			go func() {
+				time.Sleep(30 * time.Millisecond)
+				queue.EnqueueShift(testMsgA)
+			}()
+
+			toMsg := make([]byte, len(testMsgA))
+			waited, err := queue.DequeueBlockTimed(context.Background(), toMsg)
+			require.NoError(t, err)
+			assert.Equal(t, testMsgA, toMsg)
+			assert.GreaterOrEqual(t, waited, 30*time.Millisecond)
+		})
+
+		t.Run("enqueue", func(t *testing.T) {
+			queue := testQueue(t, 0, 5)
+
+			go func() {
+				time.Sleep(30 * time.Millisecond)
+				queue.DequeueTry(make([]byte, len(testMsgA)))
+			}()
+
+			waited, err := queue.EnqueueBlockTimed(context.Background(), testMsgA)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, waited, 30*time.Millisecond)
+		})
+
+		t.Run("no wait", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			waited, err := queue.EnqueueBlockTimed(context.Background(), testMsgA)
+			require.NoError(t, err)
+			assert.Less(t, waited, 30*time.Millisecond)
+		})
+
+		t.Run("cancelled", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			waited, err := queue.DequeueBlockTimed(ctx, make([]byte, len(testMsgA)))
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			assert.GreaterOrEqual(t, waited, 20*time.Millisecond)
+		})
+	})
+
+	t.Run("dequeue block n", func(t *testing.T) {
+		t.Run("return remaining", func(t *testing.T) {
+			queue := testQueue(t, 3, 3)
+
+			queue.seg.setMsgData(3, testMsgA)
+			queue.seg.setMsgData(4, testMsgB)
+			queue.seg.setMsgData(0, testMsgC)
+
+			for i, want := range [][]byte{testMsgA, testMsgB, testMsgC} {
+				got := make([]byte, 8*2)
+				remaining, err := queue.DequeueBlockN(context.Background(), got)
+				assert.NoError(t, err)
+				assert.Equal(t, want, got)
+				assert.Equal(t, uint32(2-i), remaining)
+			}
+		})
+
+		t.Run("block until context is cancelled when empty", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			got := make([]byte, 8*2)
+			remaining, err := queue.DequeueBlockN(ctx, got)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Equal(t, uint32(0), remaining)
+		})
+	})
+
+	t.Run("dequeue batch block", func(t *testing.T) {
+		t.Run("dequeue all available", func(t *testing.T) {
+			queue := testQueue(t, 3, 3)
+			queue.seg.setMsgData(3, testMsgA)
+			queue.seg.setMsgData(4, testMsgB)
+			queue.seg.setMsgData(0, testMsgC)
+
+			msgs, err := queue.DequeueBatchBlock(context.Background(), 10)
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{testMsgA, testMsgB, testMsgC}, msgs)
+			assert.Equal(t, uint32(1), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		})
+
+		t.Run("dequeue at most max", func(t *testing.T) {
+			queue := testQueue(t, 3, 3)
+			queue.seg.setMsgData(3, testMsgA)
+			queue.seg.setMsgData(4, testMsgB)
+
+			msgs, err := queue.DequeueBatchBlock(context.Background(), 2)
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{testMsgA, testMsgB}, msgs)
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+		})
+
+		t.Run("block while empty", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			done := make(chan [][]byte)
+			go func() {
+				msgs, err := queue.DequeueBatchBlock(context.Background(), 10)
+				assert.NoError(t, err)
+				done <- msgs
+			}()
 			select {
 			case <-done:
-				t.Fatal("EnqueueBlock didn't block until space is available")
+				t.Fatal("DequeueBatchBlock didn't block while queue is empty")
 			default:
 				// Go on.
 			}
-			queue.seg.setQueueLen(4)
-			<-done
+			ok := queue.EnqueueTry(testMsgA)
+			require.True(t, ok)
+			assert.Equal(t, [][]byte{testMsgA}, <-done)
+		})
+
+		t.Run("return context error when cancelled while empty", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			msgs, err := queue.DequeueBatchBlock(ctx, 10)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Nil(t, msgs)
+		})
+	})
+
+	t.Run("dequeue try err", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		toMsg := make([]byte, 16)
+
+		assert.Equal(t, ErrEmpty, queue.DequeueTryErr(toMsg))
+		require.True(t, queue.EnqueueTry(testMsgA))
+		queue.CloseQueue()
+		assert.NoError(t, queue.DequeueTryErr(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+		assert.Equal(t, ErrQueueClosed, queue.DequeueTryErr(toMsg))
+	})
+
+	t.Run("dequeue try", func(t *testing.T) {
+		t.Run("dequeue from half full", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+
+			queue.seg.setMsgData(0, testMsgA)
+			queue.seg.setMsgData(1, testMsgB)
+			queue.seg.setMsgData(2, testMsgC)
+
+			for _, want := range [][]byte{testMsgA, testMsgB, testMsgC} {
+				got := make([]byte, 8*2)
+				ok := queue.DequeueTry(got)
+				assert.True(t, ok)
+				assert.Equal(t, want, got)
+			}
+		})
+
+		t.Run("dequeue from shifted", func(t *testing.T) {
+			queue := testQueue(t, 3, 3)
+
+			queue.seg.setMsgData(3, testMsgA)
+			queue.seg.setMsgData(4, testMsgB)
+			queue.seg.setMsgData(0, testMsgC)
+
+			dequeue := func(want []byte) {
+				got := make([]byte, 8*2)
+				ok := queue.DequeueTry(got)
+				assert.True(t, ok)
+				assert.Equal(t, want, got)
+			}
+
+			dequeue(testMsgA)
+			assert.Equal(t, uint32(4), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+
+			dequeue(testMsgB)
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+
+			dequeue(testMsgC)
+			assert.Equal(t, uint32(1), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		})
+
+		t.Run("return false if empty", func(t *testing.T) {
+			queue := testQueue(t, 4, 0)
+			got := make([]byte, 8*2)
+			ok := queue.DequeueTry(got)
+			assert.False(t, ok)
+		})
+	})
+
+	t.Run("close and delete", func(t *testing.T) {
+		t.Run("last attacher deletes", func(t *testing.T) {
+			queue, err := CreatePrivate(2, 5)
+			require.NoError(t, err)
+
+			deleted, err := queue.CloseAndDelete()
+			require.NoError(t, err)
+			assert.True(t, deleted)
+			_, err = unix.SysvShmCtl(queue.id, unix.IPC_STAT, &unix.SysvShmDesc{})
+			assert.Error(t, err)
+		})
+
+		t.Run("other attachers keep the queue", func(t *testing.T) {
+			queue, err := CreatePrivate(2, 5)
+			require.NoError(t, err)
+			other, err := AttachByID(queue.ExportID())
+			require.NoError(t, err)
+
+			deleted, err := queue.CloseAndDelete()
+			require.NoError(t, err)
+			assert.False(t, deleted)
+			isDeleted, err := other.IsDeleted()
+			require.NoError(t, err)
+			assert.False(t, isDeleted)
+
+			deleted, err = other.CloseAndDelete()
+			require.NoError(t, err)
+			assert.True(t, deleted)
+		})
+	})
+
+	t.Run("close queue", func(t *testing.T) {
+		t.Run("drain and stop", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			require.True(t, queue.EnqueueTry(testMsgA))
+			require.True(t, queue.EnqueueTry(testMsgB))
+			queue.CloseQueue()
+
+			assert.False(t, queue.EnqueueTry(testMsgC))
+			assert.False(t, queue.EnqueueShift(testMsgC))
+			assert.False(t, queue.EnqueueAllTry([][]byte{testMsgC}))
+			err := queue.EnqueueBlock(context.Background(), testMsgC)
+			assert.ErrorIs(t, err, ErrQueueClosed)
+			_, err = queue.EnqueueVarTry(testMsgC[:4])
+			assert.ErrorIs(t, err, ErrQueueClosed)
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+
+			toMsg := make([]byte, 16)
+			require.NoError(t, queue.DequeueBlock(context.Background(), toMsg))
+			assert.Equal(t, testMsgA, toMsg)
+			require.NoError(t, queue.DequeueBlock(context.Background(), toMsg))
+			assert.Equal(t, testMsgB, toMsg)
+			err = queue.DequeueBlock(context.Background(), toMsg)
+			assert.ErrorIs(t, err, ErrQueueClosed)
+			_, err = queue.DequeueBatchBlock(context.Background(), 2)
+			assert.ErrorIs(t, err, ErrQueueClosed)
+			assert.ErrorIs(t, queue.WaitDepth(context.Background(), 1), ErrQueueClosed)
+			assert.False(t, queue.DequeueTry(toMsg))
+		})
+
+		t.Run("wake blocked consumer", func(t *testing.T) {
+			queue := testQueue(t, 0, 0, WithMaxSpinSleep(time.Microsecond))
+
+			errs := make(chan error)
+			go func() {
+				errs <- queue.DequeueBlock(context.Background(), make([]byte, 16))
+			}()
+			time.Sleep(10 * time.Millisecond)
+			queue.CloseQueue()
+
+			select {
+			case err := <-errs:
+				assert.ErrorIs(t, err, ErrQueueClosed)
+			case <-time.After(10 * time.Second):
+				t.Fatal("consumer isn't woken up")
+			}
+		})
+
+		t.Run("wake blocked producer", func(t *testing.T) {
+			queue := testQueue(t, 0, 5, WithMaxSpinSleep(time.Microsecond))
+
+			errs := make(chan error)
+			go func() {
+				errs <- queue.EnqueueBlock(context.Background(), testMsgA)
+			}()
+			time.Sleep(10 * time.Millisecond)
+			queue.CloseQueue()
+
+			select {
+			case err := <-errs:
+				assert.ErrorIs(t, err, ErrQueueClosed)
+			case <-time.After(10 * time.Second):
+				t.Fatal("producer isn't woken up")
+			}
+		})
+
+		t.Run("visible to other processes", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			other, err := AttachByID(queue.ExportID())
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, other.Close())
+			}()
+
+			queue.CloseQueue()
+			assert.False(t, other.EnqueueTry(testMsgA))
+		})
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		t.Run("healthy", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+			assert.NoError(t, queue.Ping())
+		})
+
+		t.Run("header lock is held", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+
+			queue.seg.lockHeader()
+			defer queue.seg.unlockHeader()
+			assert.ErrorIs(t, queue.Ping(), ErrLockTimeout)
+		})
+
+		t.Run("corrupt header", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+
+			queue.seg.setQueueLen(6)
+			defer queue.seg.setQueueLen(3)
+			assert.ErrorIs(t, queue.Ping(), ErrHeaderCorrupt)
+		})
+
+		t.Run("corrupt geometry", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+
+			queue.seg.setMsgSize(1 << 20)
+			assert.ErrorIs(t, queue.Ping(), ErrHeaderCorrupt)
+			queue.seg.setMsgSize(16)
+
+			queue.seg.setDataSize(24)
+			assert.ErrorIs(t, queue.Ping(), ErrHeaderCorrupt)
+			queue.seg.setDataSize(16)
+
+			assert.NoError(t, queue.Ping())
+		})
+
+		t.Run("invalid magic", func(t *testing.T) {
+			queue := testQueue(t, 0, 3)
+
+			queue.seg.mem[0]++
+			defer func() { queue.seg.mem[0]-- }()
+			assert.ErrorIs(t, queue.Ping(), ErrInvalidMagic)
+		})
+	})
+
+	t.Run("max spin sleep", func(t *testing.T) {
+		t.Run("default", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			assert.Equal(t, time.Millisecond, queue.seg.maxSpinSleep)
+		})
+
+		t.Run("pure spin", func(t *testing.T) {
+			queue := testQueue(t, 0, 0, WithMaxSpinSleep(0))
+			assert.Equal(t, time.Duration(0), queue.seg.maxSpinSleep)
+
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				queue.EnqueueShift(testMsgB)
+			}()
+
+			toMsg := make([]byte, len(testMsgB))
+			require.NoError(t, queue.DequeueBlock(context.Background(), toMsg))
+			assert.Equal(t, testMsgB, toMsg)
+		})
+
+		t.Run("negative is zero", func(t *testing.T) {
+			queue := testQueue(t, 0, 0, WithMaxSpinSleep(-time.Second))
+			assert.Equal(t, time.Duration(0), queue.opts.maxSpinSleep)
+		})
+	})
+
+	t.Run("dequeue notify", func(t *testing.T) {
+		t.Run("notify below low water", func(t *testing.T) {
+			queue := testQueue(t, 0, 5, WithLowWater(0.4))
+
+			var depths []uint32
+			toMsg := make([]byte, len(testMsgA))
+			for i := 0; i < 5; i++ {
+				ok := queue.DequeueNotify(toMsg, func(depth uint32) {
+					depths = append(depths, depth)
+				})
+				assert.True(t, ok)
+			}
+			assert.Equal(t, []uint32{1, 0}, depths)
+
+			ok := queue.DequeueNotify(toMsg, func(depth uint32) {
+				t.Error("notified on empty queue")
+			})
+			assert.False(t, ok)
+		})
+
+		t.Run("mark is relative to soft cap", func(t *testing.T) {
+			queue := testQueue(t, 0, 2, WithLowWater(0.5))
+			require.NoError(t, queue.SetSoftCap(2))
+
+			var depths []uint32
+			toMsg := make([]byte, len(testMsgA))
+			for i := 0; i < 2; i++ {
+				assert.True(t, queue.DequeueNotify(toMsg, func(depth uint32) {
+					depths = append(depths, depth)
+				}))
+			}
+			assert.Equal(t, []uint32{0}, depths)
+		})
+
+		t.Run("never notify by default", func(t *testing.T) {
+			queue := testQueue(t, 0, 1)
+
+			toMsg := make([]byte, len(testMsgA))
+			ok := queue.DequeueNotify(toMsg, func(depth uint32) {
+				t.Error("notified without low water")
+			})
+			assert.True(t, ok)
+		})
+
+		t.Run("block", func(t *testing.T) {
+			queue := testQueue(t, 0, 2, WithLowWater(0.4))
+
+			var depths []uint32
+			toMsg := make([]byte, len(testMsgA))
+			for i := 0; i < 2; i++ {
+				err := queue.DequeueBlockNotify(context.Background(), toMsg, func(depth uint32) {
+					depths = append(depths, depth)
+				})
+				require.NoError(t, err)
+			}
+			assert.Equal(t, []uint32{1, 0}, depths)
+		})
+	})
+
+	t.Run("dequeue skip", func(t *testing.T) {
+		t.Run("skip messages", func(t *testing.T) {
+			queue := testQueue(t, 4, 0, WithZeroOnDequeue())
+			for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC} {
+				require.True(t, queue.EnqueueTry(msg))
+			}
+
+			assert.Equal(t, uint32(2), queue.DequeueSkip(2))
+			assert.Equal(t, make([]byte, 16), queue.seg.msgData(4))
+			assert.Equal(t, make([]byte, 16), queue.seg.msgData(0))
+			assert.Equal(t, uint64(2), queue.Stats().Dequeued)
 
+			toMsg := make([]byte, 16)
+			require.True(t, queue.DequeueTry(toMsg))
+			assert.Equal(t, testMsgC, toMsg)
+		})
+
+		t.Run("bounded by length", func(t *testing.T) {
+			queue := testQueue(t, 2, 3)
+
+			assert.Equal(t, uint32(3), queue.DequeueSkip(10))
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
 			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+			assert.Equal(t, uint32(0), queue.DequeueSkip(1))
+		})
 
-			got := make([]byte, 8*2)
-			queue.seg.getMsgData(uint32(4), got)
-			assert.Equal(t, testMsgA, got)
+		t.Run("stop at reserved message", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			require.True(t, queue.EnqueueTry(testMsgA))
+			token, dst, ok := queue.Reserve()
+			require.True(t, ok)
+			copy(dst, testMsgB)
+
+			assert.Equal(t, uint32(1), queue.DequeueSkip(2))
+			require.NoError(t, queue.Commit(token))
+			assert.Equal(t, uint32(1), queue.DequeueSkip(2))
 		})
 	})
 
-	t.Run("enqueue try", func(t *testing.T) {
-		t.Run("successfully append when empty", func(t *testing.T) {
+	t.Run("dequeue exchange", func(t *testing.T) {
+		t.Run("swap head of full queue in place", func(t *testing.T) {
+			queue := testQueue(t, 3, 0)
+			for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC, testMsgA, testMsgB} {
+				require.True(t, queue.EnqueueTry(msg))
+			}
+
+			take := make([]byte, 16)
+			require.True(t, queue.DequeueExchange(testMsgC, take))
+			assert.Equal(t, testMsgA, take)
+			assert.Equal(t, testMsgC, queue.seg.msgData(3))
+			assert.Equal(t, uint32(4), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+			assert.Equal(t, uint64(6), queue.Stats().Enqueued)
+			assert.Equal(t, uint64(1), queue.Stats().Dequeued)
+
+			msgs := queue.DequeueAll()
+			assert.Equal(t, [][]byte{testMsgB, testMsgC, testMsgA, testMsgB, testMsgC}, msgs)
+		})
+
+		t.Run("enqueue at tail of partial queue", func(t *testing.T) {
+			queue := testQueue(t, 4, 0, WithZeroOnDequeue())
+			require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+
+			take := make([]byte, 16)
+			require.True(t, queue.DequeueExchange(testMsgC, take))
+			assert.Equal(t, testMsgA, take)
+			assert.Equal(t, make([]byte, 16), queue.seg.msgData(4))
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+			assert.Equal(t, [][]byte{testMsgB, testMsgC}, queue.DequeueAll())
+		})
+
+		t.Run("empty", func(t *testing.T) {
 			queue := testQueue(t, 0, 0)
 
-			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
-			for _, msg := range msgs {
-				ok := queue.EnqueueTry(msg)
-				assert.True(t, ok)
-			}
+			assert.False(t, queue.DequeueExchange(testMsgA, make([]byte, 16)))
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		})
 
-			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+		t.Run("closed", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			require.True(t, queue.EnqueueTry(testMsgA))
+			queue.CloseQueue()
 
-			got := make([]byte, 8*2)
-			for i, want := range msgs {
-				queue.seg.getMsgData(uint32(i), got)
-				assert.Equal(t, want, got)
-			}
+			assert.False(t, queue.DequeueExchange(testMsgB, make([]byte, 16)))
+			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
 		})
 
-		t.Run("successfully append when shifted", func(t *testing.T) {
-			queue := testQueue(t, 2, 0)
+		t.Run("stop at reserved message", func(t *testing.T) {
+			queue := testQueue(t, 0, 0)
+			_, _, ok := queue.Reserve()
+			require.True(t, ok)
 
-			msgs := [][]byte{testMsgA, testMsgB, testMsgC}
-			for _, msg := range msgs {
-				ok := queue.EnqueueTry(msg)
-				assert.True(t, ok)
-			}
+			assert.False(t, queue.DequeueExchange(testMsgA, make([]byte, 16)))
+		})
+	})
 
-			assert.Equal(t, uint32(2), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+	t.Run("dequeue if", func(t *testing.T) {
+		t.Run("dequeue when predicate is true", func(t *testing.T) {
+			queue := testQueue(t, 4, 2)
+			queue.seg.setMsgData(4, testMsgA)
+			queue.seg.setMsgData(0, testMsgB)
 
-			msgsByIdx := map[int][]byte{
-				2: testMsgA,
-				3: testMsgB,
-				4: testMsgC,
-			}
 			got := make([]byte, 8*2)
-			for i, want := range msgsByIdx {
-				queue.seg.getMsgData(uint32(i), got)
-				assert.Equal(t, want, got)
-			}
+			ok := queue.DequeueIf(func(msg []byte) bool {
+				return bytes.Equal(msg, testMsgA)
+			}, got)
+			assert.True(t, ok)
+			assert.Equal(t, testMsgA, got)
+			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
 		})
 
-		t.Run("fail when full", func(t *testing.T) {
-			queue := testQueue(t, 0, 5)
+		t.Run("keep message when predicate is false", func(t *testing.T) {
+			queue := testQueue(t, 4, 2)
+			queue.seg.setMsgData(4, testMsgA)
 
-			ok := queue.EnqueueTry(testMsgA)
+			got := make([]byte, 8*2)
+			ok := queue.DequeueIf(func(msg []byte) bool {
+				return bytes.Equal(msg, testMsgB)
+			}, got)
 			assert.False(t, ok)
+			assert.Equal(t, testMsgA, got)
+			assert.Equal(t, uint32(4), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+		})
 
-			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+		t.Run("return false without calling predicate when empty", func(t *testing.T) {
+			queue := testQueue(t, 4, 0)
 
-			got := make([]byte, 8*2)
-			queue.seg.getMsgData(uint32(0), got)
-			assert.Equal(t, testMsgNil, got)
+			called := false
+			ok := queue.DequeueIf(func(msg []byte) bool {
+				called = true
+				return true
+			}, make([]byte, 8*2))
+			assert.False(t, ok)
+			assert.False(t, called)
 		})
 	})
 
-	t.Run("dequeue block", func(t *testing.T) {
-		t.Run("dequeue from half full", func(t *testing.T) {
-			queue := testQueue(t, 0, 3)
-
-			queue.seg.setMsgData(0, testMsgA)
-			queue.seg.setMsgData(1, testMsgB)
-			queue.seg.setMsgData(2, testMsgC)
+	t.Run("dequeue if depth", func(t *testing.T) {
+		t.Run("dequeue at exact depth", func(t *testing.T) {
+			queue := testQueue(t, 4, 5)
+			queue.seg.setMsgData(4, testMsgA)
 
-			for _, want := range [][]byte{testMsgA, testMsgB, testMsgC} {
-				got := make([]byte, 8*2)
-				err := queue.DequeueBlock(context.Background(), got)
-				assert.NoError(t, err)
-				assert.Equal(t, want, got)
-			}
+			got := make([]byte, 8*2)
+			assert.True(t, queue.DequeueIfDepth(5, got))
+			assert.Equal(t, testMsgA, got)
+			assert.Equal(t, uint32(4), queue.seg.getQueueLen())
+			assert.False(t, queue.DequeueIfDepth(5, got), "the depth has changed")
 		})
 
-		t.Run("dequeue from shifted", func(t *testing.T) {
-			queue := testQueue(t, 3, 3)
+		t.Run("keep message at other depth", func(t *testing.T) {
+			queue := testQueue(t, 4, 2)
 
-			queue.seg.setMsgData(3, testMsgA)
-			queue.seg.setMsgData(4, testMsgB)
-			queue.seg.setMsgData(0, testMsgC)
+			assert.False(t, queue.DequeueIfDepth(3, make([]byte, 8*2)))
+			assert.False(t, queue.DequeueIfDepth(1, make([]byte, 8*2)))
+			assert.Equal(t, uint32(4), queue.seg.getStartIdx())
+			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+			assert.False(t, testQueue(t, 0, 0).DequeueIfDepth(0, make([]byte, 8*2)))
+		})
 
-			dequeue := func(want []byte) {
-				got := make([]byte, 8*2)
-				err := queue.DequeueBlock(context.Background(), got)
-				assert.NoError(t, err)
-				assert.Equal(t, want, got)
+		t.Run("only one of concurrent consumers succeeds", func(t *testing.T) {
+			queue := testQueue(t, 0, 5)
+
+			var wg sync.WaitGroup
+			var succeeded int32
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if queue.DequeueIfDepth(5, make([]byte, 8*2)) {
+						atomic.AddInt32(&succeeded, 1)
+					}
+				}()
 			}
+			wg.Wait()
+			assert.Equal(t, int32(1), succeeded)
+			assert.Equal(t, uint32(4), queue.seg.getQueueLen())
+		})
+	})
 
-			dequeue(testMsgA)
-			assert.Equal(t, uint32(4), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+	t.Run("dequeue all", func(t *testing.T) {
+		t.Run("dequeue in order and reset", func(t *testing.T) {
+			queue := testQueue(t, 3, 0, WithZeroOnDequeue())
+			require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC}))
 
-			dequeue(testMsgB)
+			msgs := queue.DequeueAll()
+			assert.Equal(t, [][]byte{testMsgA, testMsgB, testMsgC}, msgs)
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
 			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+			assert.Equal(t, testMsgNil, queue.seg.msgData(4))
+			assert.Equal(t, uint64(3), queue.Stats().Dequeued)
 
-			dequeue(testMsgC)
-			assert.Equal(t, uint32(1), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+			msgs[0] = append(msgs[0], 0xFF)
+			assert.Equal(t, testMsgB, msgs[1])
+			assert.Nil(t, queue.DequeueAll())
 		})
 
-		t.Run("block while empty", func(t *testing.T) {
-			queue := testQueue(t, 4, 0)
+		t.Run("stop at reserved message", func(t *testing.T) {
+			queue := testQueue(t, 3, 0)
+			require.True(t, queue.EnqueueTry(testMsgA))
+			token, dst, ok := queue.Reserve()
+			require.True(t, ok)
+			copy(dst, testMsgB)
+			require.True(t, queue.EnqueueTry(testMsgC))
 
-			done := make(chan bool)
-			go func() {
-				got := make([]byte, 8*2)
-				err := queue.DequeueBlock(context.Background(), got)
-				assert.NoError(t, err)
-				done <- true
-			}()
-			select {
-			case <-done:
-				t.Fatal("DequeueBlock didn't block while queue is empty")
-			default:
-				// Go on.
-			}
-			queue.seg.setQueueLen(1)
-			<-done
+			assert.Equal(t, [][]byte{testMsgA}, queue.DequeueAll())
+			assert.Equal(t, uint32(4), queue.seg.getStartIdx())
+			assert.Nil(t, queue.DequeueAll())
+			require.NoError(t, queue.Commit(token))
+			assert.Equal(t, [][]byte{testMsgB, testMsgC}, queue.DequeueAll())
 		})
 
-		t.Run("block until context is cancelled when empty", func(t *testing.T) {
-			queue := testQueue(t, 4, 0)
+		t.Run("no message is lost or duplicated under concurrency", func(t *testing.T) {
+			const producers, perProducer = 4, 500
+			queue, err := CreatePrivate(1, producers*perProducer)
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, queue.Close())
+				assert.NoError(t, queue.Delete())
+			}()
 
-			done := make(chan bool)
-			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			for p := 0; p < producers; p++ {
+				wg.Add(1)
+				go func(p int) {
+					defer wg.Done()
+					msg := make([]byte, 8)
+					for i := 0; i < perProducer; i++ {
+						binary.LittleEndian.PutUint64(msg, uint64(p*perProducer+i))
+						assert.True(t, queue.EnqueueTry(msg))
+					}
+				}(p)
+			}
+			done := make(chan struct{})
 			go func() {
-				got := make([]byte, 8*2)
-				err := queue.DequeueBlock(ctx, got)
-				assert.ErrorIs(t, err, context.Canceled)
-				done <- true
+				wg.Wait()
+				close(done)
 			}()
-			select {
-			case <-done:
-				t.Fatal("DequeueBlock didn't block while queue is empty")
-			default:
-				// Go on.
+
+			seen := make(map[uint64]int)
+			collect := func() {
+				for _, msg := range queue.DequeueAll() {
+					seen[binary.LittleEndian.Uint64(msg)]++
+				}
 			}
-			cancel()
-			<-done
+			for finished := false; !finished; {
+				select {
+				case <-done:
+					finished = true
+				default:
+					// Go on.
+				}
+				collect()
+			}
+			collect()
+
+			assert.Len(t, seen, producers*perProducer)
+			for id, count := range seen {
+				assert.Equal(t, 1, count, "message %d", id)
+			}
+			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
 		})
 	})
 
-	t.Run("dequeue try", func(t *testing.T) {
-		t.Run("dequeue from half full", func(t *testing.T) {
-			queue := testQueue(t, 0, 3)
+	t.Run("zero on dequeue", func(t *testing.T) {
+		t.Run("zero slot after dequeue try", func(t *testing.T) {
+			queue := testQueue(t, 0, 2, WithZeroOnDequeue())
 
 			queue.seg.setMsgData(0, testMsgA)
 			queue.seg.setMsgData(1, testMsgB)
-			queue.seg.setMsgData(2, testMsgC)
 
-			for _, want := range [][]byte{testMsgA, testMsgB, testMsgC} {
-				got := make([]byte, 8*2)
-				ok := queue.DequeueTry(got)
-				assert.True(t, ok)
-				assert.Equal(t, want, got)
-			}
+			got := make([]byte, 8*2)
+			ok := queue.DequeueTry(got)
+			assert.True(t, ok)
+			assert.Equal(t, testMsgA, got)
+
+			queue.seg.getMsgData(0, got)
+			assert.Equal(t, testMsgNil, got)
+			queue.seg.getMsgData(1, got)
+			assert.Equal(t, testMsgB, got)
 		})
 
-		t.Run("dequeue from shifted", func(t *testing.T) {
-			queue := testQueue(t, 3, 3)
+		t.Run("zero slot after dequeue block", func(t *testing.T) {
+			queue := testQueue(t, 4, 1, WithZeroOnDequeue())
 
-			queue.seg.setMsgData(3, testMsgA)
-			queue.seg.setMsgData(4, testMsgB)
-			queue.seg.setMsgData(0, testMsgC)
+			queue.seg.setMsgData(4, testMsgC)
 
-			dequeue := func(want []byte) {
-				got := make([]byte, 8*2)
-				ok := queue.DequeueTry(got)
-				assert.True(t, ok)
-				assert.Equal(t, want, got)
-			}
+			got := make([]byte, 8*2)
+			err := queue.DequeueBlock(context.Background(), got)
+			assert.NoError(t, err)
+			assert.Equal(t, testMsgC, got)
 
-			dequeue(testMsgA)
-			assert.Equal(t, uint32(4), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+			queue.seg.getMsgData(4, got)
+			assert.Equal(t, testMsgNil, got)
+		})
 
-			dequeue(testMsgB)
-			assert.Equal(t, uint32(0), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+		t.Run("keep slot by default", func(t *testing.T) {
+			queue := testQueue(t, 0, 1)
 
-			dequeue(testMsgC)
-			assert.Equal(t, uint32(1), queue.seg.getStartIdx())
-			assert.Equal(t, uint32(0), queue.seg.getQueueLen())
-		})
+			queue.seg.setMsgData(0, testMsgA)
 
-		t.Run("return false if empty", func(t *testing.T) {
-			queue := testQueue(t, 4, 0)
 			got := make([]byte, 8*2)
 			ok := queue.DequeueTry(got)
-			assert.False(t, ok)
+			assert.True(t, ok)
+
+			queue.seg.getMsgData(0, got)
+			assert.Equal(t, testMsgA, got)
 		})
 	})
 }
@@ -475,11 +2613,8 @@ var (
 	testMsgC   = bytes.Repeat([]byte{0xCC}, 16)
 )
 
-func testQueue(t *testing.T, startIdx, curLen uint32) *Queue {
-	key, err := FindFreeKey()
-	require.NoError(t, err)
-
-	queue, err := Create(key, 2, 5)
+func testQueue(t *testing.T, startIdx, curLen uint32, opts ...Option) *Queue {
+	queue, err := CreatePrivate(2, 5, opts...)
 	assert.NoError(t, err)
 	t.Cleanup(func() {
 		err = queue.Close()
@@ -490,6 +2625,215 @@ func testQueue(t *testing.T, startIdx, curLen uint32) *Queue {
 
 	queue.seg.setStartIdx(startIdx)
 	queue.seg.setQueueLen(curLen)
+	if queue.seg.isChecksummed() {
+		queue.seg.updateHeaderChecksum()
+	}
+
+	return queue
+}
+
+var benchMsgSizes = []uint32{1, 8, 64, 512}
+
+func BenchmarkEnqueueDequeue(b *testing.B) {
+	for _, msgSize := range benchMsgSizes {
+		b.Run(fmt.Sprintf("try/%dB", 8*msgSize), func(b *testing.B) {
+			queue := benchQueue(b, msgSize, 16)
+			msg := make([]byte, 8*msgSize)
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				queue.EnqueueTry(msg)
+				queue.DequeueTry(msg)
+			}
+		})
+
+		b.Run(fmt.Sprintf("block/%dB", 8*msgSize), func(b *testing.B) {
+			queue := benchQueue(b, msgSize, 16)
+			msg := make([]byte, 8*msgSize)
+			ctx := context.Background()
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = queue.EnqueueBlock(ctx, msg)
+				_ = queue.DequeueBlock(ctx, msg)
+			}
+		})
+
+		b.Run(fmt.Sprintf("shift/%dB", 8*msgSize), func(b *testing.B) {
+			queue := benchQueue(b, msgSize, 16)
+			msg := make([]byte, 8*msgSize)
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				queue.EnqueueShift(msg)
+				queue.DequeueTry(msg)
+			}
+		})
+	}
+}
+
+func BenchmarkContended(b *testing.B) {
+	for _, workers := range [][2]int{{1, 1}, {4, 1}, {1, 4}, {4, 4}} {
+		producers, consumers := workers[0], workers[1]
+		b.Run(fmt.Sprintf("%dp%dc", producers, consumers), func(b *testing.B) {
+			h := Harness{MsgSize: 8, MaxLen: 256, Producers: producers, Consumers: consumers, Messages: b.N}
+			b.SetBytes(8 * 8)
+			b.ResetTimer()
+			_, err := h.Run(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkBatch(b *testing.B) {
+	const batch = 256
+	for _, msgSize := range benchMsgSizes {
+		b.Run(fmt.Sprintf("try/%dB", 8*msgSize), func(b *testing.B) {
+			queue := benchQueue(b, msgSize, batch)
+			msg := make([]byte, 8*msgSize)
+			b.SetBytes(int64(len(msg)) * batch)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < batch; j++ {
+					queue.EnqueueTry(msg)
+				}
+				for j := 0; j < batch; j++ {
+					queue.DequeueTry(msg)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("block/%dB", 8*msgSize), func(b *testing.B) {
+			queue := benchQueue(b, msgSize, batch)
+			msg := make([]byte, 8*msgSize)
+			ctx := context.Background()
+			b.SetBytes(int64(len(msg)) * batch)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < batch; j++ {
+					_ = queue.EnqueueBlock(ctx, msg)
+				}
+				for j := 0; j < batch; j++ {
+					_ = queue.DequeueBlock(ctx, msg)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("shift/%dB", 8*msgSize), func(b *testing.B) {
+			queue := benchQueue(b, msgSize, batch)
+			msg := make([]byte, 8*msgSize)
+			b.SetBytes(int64(len(msg)) * batch)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 2*batch; j++ {
+					queue.EnqueueShift(msg)
+				}
+				for j := 0; j < batch; j++ {
+					queue.DequeueTry(msg)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMsgData compares copying message data with copy() to the byte-by-byte loop it replaced.
+func BenchmarkMsgData(b *testing.B) {
+	for _, msgSize := range []uint32{512, 2048} {
+		queue := benchQueue(b, msgSize, 1)
+		msg := make([]byte, 8*msgSize)
+
+		b.Run(fmt.Sprintf("set/%dB", 8*msgSize), func(b *testing.B) {
+			b.SetBytes(int64(len(msg)))
+			for i := 0; i < b.N; i++ {
+				queue.seg.setMsgData(0, msg)
+			}
+		})
+		b.Run(fmt.Sprintf("get/%dB", 8*msgSize), func(b *testing.B) {
+			b.SetBytes(int64(len(msg)))
+			for i := 0; i < b.N; i++ {
+				queue.seg.getMsgData(0, msg)
+			}
+		})
+		b.Run(fmt.Sprintf("loop/%dB", 8*msgSize), func(b *testing.B) {
+			b.SetBytes(int64(len(msg)))
+			for i := 0; i < b.N; i++ {
+				data := queue.seg.msgData(0)
+				for j := range data {
+					msg[j] = data[j]
+				}
+			}
+		})
+	}
+}
+
+func benchQueue(b *testing.B, msgSize, maxLen uint32) *Queue {
+	queue, err := CreatePrivate(msgSize, maxLen)
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		err = queue.Close()
+		assert.NoError(b, err)
+		err = queue.Delete()
+		assert.NoError(b, err)
+	})
 
 	return queue
 }
+
+func TestSlotBounds(t *testing.T) {
+	t.Run("in range", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		for idx := uint32(0); idx < 5; idx++ {
+			start, end, err := queue.seg.slotBounds(idx)
+			require.NoError(t, err)
+			assert.Equal(t, uint32(startQueue+idx*24), start)
+			assert.Equal(t, start+24, end)
+		}
+		_, _, err := queue.seg.slotBounds(5)
+		assert.ErrorIs(t, err, ErrHeaderCorrupt)
+	})
+
+	t.Run("corrupted msg size", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		queue.seg.setMsgSize(1 << 31)
+		defer queue.seg.setMsgSize(16)
+
+		_, _, err := queue.seg.slotBounds(4)
+		assert.ErrorIs(t, err, ErrHeaderCorrupt)
+		_, err = queue.seg.getVarMsgData(4, make([]byte, 8))
+		assert.ErrorIs(t, err, ErrHeaderCorrupt)
+		assert.ErrorIs(t, queue.seg.lockMsg(4), ErrSegmentCorrupt)
+		assert.ErrorIs(t, queue.seg.lockMsgs([]uint32{0, 4}), ErrSegmentCorrupt)
+		assert.Zero(t, queue.seg.msgLockOwner(0))
+	})
+
+	t.Run("public calls", func(t *testing.T) {
+		queue := testQueue(t, 0, 2)
+		queue.seg.setMsgSize(1 << 31)
+		defer queue.seg.setMsgSize(16)
+
+		assert.ErrorIs(t, queue.EnqueueTryErr(testMsgA), ErrSegmentCorrupt)
+		assert.False(t, queue.EnqueueTry(testMsgA))
+		assert.False(t, queue.EnqueueShift(testMsgA))
+		assert.False(t, queue.DequeueTry(make([]byte, 16)))
+		assert.Nil(t, queue.DequeueAll())
+		assert.ErrorIs(t, queue.EnqueueBlock(context.Background(), testMsgA), ErrSegmentCorrupt)
+		assert.ErrorIs(t, queue.DequeueBlock(context.Background(), make([]byte, 16)), ErrSegmentCorrupt)
+		assert.ErrorIs(t, queue.RecordAt(0).Read(make([]byte, 16)), ErrSegmentCorrupt)
+
+		_, err := queue.RepairLocks()
+		assert.ErrorIs(t, err, ErrSegmentCorrupt)
+		_, err = queue.Reclaim()
+		assert.ErrorIs(t, err, ErrSegmentCorrupt)
+		_, msgPIDs := queue.LockOwners()
+		assert.Empty(t, msgPIDs)
+
+		// Nothing is changed by the failed calls.
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+		assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+		assert.Equal(t, uint64(0), queue.seg.getDequeued())
+		assert.Equal(t, uint64(0), queue.seg.getEnqueued())
+	})
+}
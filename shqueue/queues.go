@@ -0,0 +1,27 @@
+package shqueue
+
+// Info describes a queue found in the system by List or ForEachQueue.
+type Info struct {
+	Key      int    // Key of the queue, or 0 (IPC_PRIVATE) for private queues.
+	ID       int    // ID of the segment.
+	Mode     int    // Permission bits of the segment.
+	Attached int    // Number of processes that have the segment attached.
+	MsgSize  uint32 // Message size in bytes.
+	MaxLen   uint32 // Max number of messages.
+	Len      uint32 // Number of messages at the moment of the scan.
+	SchemaID uint32 // Schema ID stored on creation (see WithSchemaID), or 0.
+}
+
+// List returns all queues in the system that this process can read. It's built on ForEachQueue, so see it for the
+// details.
+func List() ([]Info, error) {
+	var infos []Info
+	err := ForEachQueue(func(info Info) bool {
+		infos = append(infos, info)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package shqueue
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const procSysvShm = "/proc/sysvipc/shm"
+
+// ForEachQueue calls fn for every queue in the system that this process can read, until fn returns false. The segments
+// are enumerated from /proc/sysvipc/shm one by one, so nothing is accumulated in memory. Each segment is attached
+// read-only for a moment to check that it's a queue of a compatible layout version and to read its geometry; other
+// segments, and segments that can't be attached (e.g. due to permissions), are skipped.
+func ForEachQueue(fn func(Info) bool) error {
+	f, err := os.Open(procSysvShm)
+	if err != nil {
+		return fmt.Errorf("list shared memory: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return fmt.Errorf("list shared memory: no header in %s", procSysvShm)
+	}
+	cols := map[string]int{}
+	for i, name := range strings.Fields(scanner.Text()) {
+		cols[name] = i
+	}
+	for _, name := range []string{"key", "shmid", "perms", "nattch"} {
+		if _, ok := cols[name]; !ok {
+			return fmt.Errorf("list shared memory: no %s column in %s", name, procSysvShm)
+		}
+	}
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < len(cols) {
+			continue
+		}
+		info, ok := queueInfo(fields, cols)
+		if ok && !fn(info) {
+			return nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("list shared memory: %w", err)
+	}
+	return nil
+}
+
+// queueInfo parses a line of /proc/sysvipc/shm and reads the params of the segment. false is returned if the segment
+// isn't a readable queue.
+func queueInfo(fields []string, cols map[string]int) (info Info, ok bool) {
+	key, err1 := strconv.Atoi(fields[cols["key"]])
+	id, err2 := strconv.Atoi(fields[cols["shmid"]])
+	mode, err3 := strconv.ParseInt(fields[cols["perms"]], 8, 64)
+	attached, err4 := strconv.Atoi(fields[cols["nattch"]])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return Info{}, false
+	}
+
+	mem, err := unix.SysvShmAttach(id, 0, unix.SHM_RDONLY)
+	if err != nil {
+		return Info{}, false
+	}
+	defer func() { _ = unix.SysvShmDetach(mem) }()
+	seg, err := attachedSegment(mem)
+	if err != nil {
+		return Info{}, false
+	}
+
+	return Info{
+		Key:      key,
+		ID:       id,
+		Mode:     int(mode & 0777),
+		Attached: attached,
+		MsgSize:  seg.getDataSize(),
+		MaxLen:   seg.getMaxLen(),
+		Len:      seg.getQueueLen(),
+		SchemaID: seg.getSchemaID(),
+	}, true
+}
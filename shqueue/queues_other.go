@@ -0,0 +1,8 @@
+//go:build !linux
+
+package shqueue
+
+// ForEachQueue is only supported on Linux. Elsewhere it returns ErrNotSupported.
+func ForEachQueue(fn func(Info) bool) error {
+	return ErrNotSupported
+}
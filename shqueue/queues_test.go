@@ -0,0 +1,74 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestForEachQueue(t *testing.T) {
+	t.Run("find queue", func(t *testing.T) {
+		queue := testQueue(t, 0, 3, WithAccess(0640))
+
+		var found []Info
+		err := ForEachQueue(func(info Info) bool {
+			if info.ID == queue.ExportID() {
+				found = append(found, info)
+			}
+			return true
+		})
+		require.NoError(t, err)
+		require.Len(t, found, 1)
+		assert.Equal(t, Info{
+			Key:      unix.IPC_PRIVATE,
+			ID:       queue.ExportID(),
+			Mode:     0640,
+			Attached: 1,
+			MsgSize:  16,
+			MaxLen:   5,
+			Len:      3,
+		}, found[0])
+	})
+
+	t.Run("skip other segments", func(t *testing.T) {
+		id, err := unix.SysvShmGet(unix.IPC_PRIVATE, 64, unix.IPC_CREAT|0600)
+		require.NoError(t, err)
+		defer func() {
+			_, err := unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+			assert.NoError(t, err)
+		}()
+
+		err = ForEachQueue(func(info Info) bool {
+			assert.NotEqual(t, id, info.ID)
+			return true
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("stop early", func(t *testing.T) {
+		testQueue(t, 0, 0)
+		testQueue(t, 0, 0)
+
+		calls := 0
+		err := ForEachQueue(func(info Info) bool {
+			calls++
+			return false
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		infos, err := List()
+		require.NoError(t, err)
+		ids := make([]int, len(infos))
+		for i, info := range infos {
+			ids[i] = info.ID
+		}
+		assert.Contains(t, ids, queue.ExportID())
+	})
+}
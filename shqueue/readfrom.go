@@ -0,0 +1,49 @@
+package shqueue
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+var _ io.ReaderFrom = (*Queue)(nil)
+
+// ReadFrom reads messages of MessageSize bytes from r until EOF and enqueues them one by one with EnqueueBlock, so it
+// waits for free space when the queue is full, or with EnqueueShift if the queue is opened with WithReadFromShift. It
+// returns the number of bytes read from r. If r ends in the middle of
+// a message, the partial message isn't enqueued and an error wrapping io.ErrUnexpectedEOF is returned. It implements
+// io.ReaderFrom, e.g. to pre-seed a queue from a file of fixed-size records.
+func (q *Queue) ReadFrom(r io.Reader) (n int64, err error) {
+	msg := make([]byte, q.MessageSize())
+	for {
+		read, err := io.ReadFull(r, msg)
+		n += int64(read)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return n, newQueueError("read from", q.key, q.id, fmt.Errorf(
+				"%w: %d trailing bytes of a %d-byte message", io.ErrUnexpectedEOF, read, len(msg),
+			))
+		}
+		if err != nil {
+			return n, err
+		}
+		if err = q.readFromEnqueue(msg); err != nil {
+			return n, err
+		}
+	}
+}
+
+// readFromEnqueue enqueues one message read by ReadFrom in the mode chosen with WithReadFromShift. A message dropped
+// by the overflow policy isn't an error.
+func (q *Queue) readFromEnqueue(msg []byte) error {
+	if !q.opts.readFromShift {
+		return q.EnqueueBlock(context.Background(), msg)
+	}
+	_, _, _, err := q.enqueueShift(msg)
+	if err != nil && err != ErrFull {
+		return newQueueError("enqueue", q.key, q.id, err)
+	}
+	return nil
+}
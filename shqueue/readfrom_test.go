@@ -0,0 +1,82 @@
+package shqueue
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFrom(t *testing.T) {
+	t.Run("read records", func(t *testing.T) {
+		queue := testQueue(t, 3, 0)
+
+		data := bytes.Join([][]byte{testMsgA, testMsgB, testMsgC}, nil)
+		n, err := queue.ReadFrom(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, int64(48), n)
+
+		toMsg := make([]byte, 16)
+		for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC} {
+			require.True(t, queue.DequeueTry(toMsg))
+			assert.Equal(t, msg, toMsg)
+		}
+		assert.False(t, queue.DequeueTry(toMsg))
+	})
+
+	t.Run("empty reader", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		n, err := queue.ReadFrom(bytes.NewReader(nil))
+		require.NoError(t, err)
+		assert.Zero(t, n)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+	})
+
+	t.Run("partial trailing record", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		data := append(append([]byte(nil), testMsgA...), 1, 2, 3)
+		n, err := queue.ReadFrom(bytes.NewReader(data))
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Contains(t, err.Error(), "3 trailing bytes of a 16-byte message")
+		assert.Equal(t, int64(19), n)
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+	})
+
+	t.Run("shift when full", func(t *testing.T) {
+		queue := testQueue(t, 0, 4, WithReadFromShift())
+
+		data := bytes.Join([][]byte{testMsgA, testMsgB, testMsgC}, nil)
+		n, err := queue.ReadFrom(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, int64(48), n)
+		assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+		assert.Equal(t, uint64(2), queue.Stats().Dropped)
+
+		queue.CloseQueue()
+		_, err = queue.ReadFrom(bytes.NewReader(testMsgA))
+		assert.ErrorIs(t, err, ErrQueueClosed)
+	})
+
+	t.Run("reader error", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		readErr := errors.New("read error")
+		n, err := queue.ReadFrom(io.MultiReader(bytes.NewReader(testMsgA), &errReader{readErr}))
+		assert.ErrorIs(t, err, readErr)
+		assert.Equal(t, int64(16), n)
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+	})
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,66 @@
+package shqueue
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Record is a view of a single message slot of a queue as an addressable record. Together, the records turn the queue
+// into a fixed-size shared array of messages protected by per-slot locks.
+//
+// Records ignore the FIFO state of the queue: reading doesn't dequeue, and writing doesn't enqueue. So a segment should
+// be used either as a queue or as an array of records, but not both at the same time: enqueue and dequeue calls will
+// overwrite and return records without noticing.
+type Record struct {
+	seg *segment
+	idx uint32
+}
+
+// RecordAt returns the record in the slot with the given physical index, which must be less than the max length of the
+// queue.
+func (q *Queue) RecordAt(i uint32) *Record {
+	if maxLen := q.seg.getMaxLen(); i >= maxLen {
+		panic(fmt.Sprintf("record index must be less than %d, but got %d", maxLen, i))
+	}
+	return &Record{seg: q.seg, idx: i}
+}
+
+// Read copies the record into the given slice, which must be of the message size. If the slot of the record doesn't
+// fit into the segment because its header is corrupted, an error wrapping ErrSegmentCorrupt is returned.
+func (r *Record) Read(into []byte) error {
+	if err := r.seg.lockMsg(r.idx); err != nil {
+		return err
+	}
+	r.seg.getMsgData(r.idx, into)
+	r.seg.unlockMsg(r.idx)
+	return nil
+}
+
+// Write copies the given slice, which must be of the message size, into the record. The errors are the same as in
+// Read.
+func (r *Record) Write(from []byte) error {
+	if err := r.seg.lockMsg(r.idx); err != nil {
+		return err
+	}
+	r.seg.setMsgData(r.idx, from)
+	r.seg.unlockMsg(r.idx)
+	return nil
+}
+
+// CompareAndSwap writes new into the record only if it currently equals old, and reports whether it did. Both slices
+// must be of the message size. false is also returned if the slot doesn't fit into the segment (see Read).
+func (r *Record) CompareAndSwap(old, new []byte) (swapped bool) {
+	r.seg.checkMsgSize(len(old))
+	r.seg.checkMsgSize(len(new))
+
+	if err := r.seg.lockMsg(r.idx); err != nil {
+		return false
+	}
+	defer r.seg.unlockMsg(r.idx)
+
+	if !bytes.Equal(r.seg.msgData(r.idx), old) {
+		return false
+	}
+	r.seg.setMsgData(r.idx, new)
+	return true
+}
@@ -0,0 +1,76 @@
+package shqueue
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecord(t *testing.T) {
+	t.Run("write and read", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		queue.RecordAt(3).Write(testMsgA)
+
+		got := make([]byte, 8*2)
+		queue.RecordAt(3).Read(got)
+		assert.Equal(t, testMsgA, got)
+		queue.seg.getMsgData(3, got)
+		assert.Equal(t, testMsgA, got)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		record := queue.RecordAt(1)
+		record.Write(testMsgA)
+
+		swapped := record.CompareAndSwap(testMsgB, testMsgC)
+		assert.False(t, swapped)
+		swapped = record.CompareAndSwap(testMsgA, testMsgC)
+		assert.True(t, swapped)
+
+		got := make([]byte, 8*2)
+		record.Read(got)
+		assert.Equal(t, testMsgC, got)
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		record := queue.RecordAt(0)
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				old := make([]byte, 8*2)
+				new := make([]byte, 8*2)
+				for i := 0; i < 100; i++ {
+					for {
+						record.Read(old)
+						binary.LittleEndian.PutUint64(new, binary.LittleEndian.Uint64(old)+1)
+						if record.CompareAndSwap(old, new) {
+							break
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		got := make([]byte, 8*2)
+		record.Read(got)
+		assert.Equal(t, uint64(400), binary.LittleEndian.Uint64(got))
+	})
+
+	t.Run("panic on index out of range", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		assert.Panics(t, func() {
+			queue.RecordAt(5)
+		})
+	})
+}
@@ -0,0 +1,133 @@
+package shqueue
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// msgReserved is set in the lock word of a slot reserved with Reserve and not committed yet. The rest of the word is
+	// the PID of the producer, as usual.
+	msgReserved = 1 << 63
+	// msgReclaimed is the lock word of a reserved slot whose producer died before Commit, set by Reclaim. The slot holds
+	// no message, and the dequeue calls drop it when it reaches the head.
+	msgReclaimed = 1 << 62
+)
+
+// Reserve claims a slot at the tail of the queue for a message that will be written later, so the space is
+// guaranteed while the message is computed. The message is written into dst, which aliases the slot in the shared
+// memory and must not be used after Commit. If the queue is full, false is returned.
+//
+// The reserved slot counts in the queue length, but it isn't consumed until the message is committed with
+// Commit(token): while it's at the head, the queue is treated as empty by consumers, so messages behind it wait as well
+// to keep the FIFO order. EnqueueShift on a full queue with a reserved head drops the new message instead of the
+// reserved one. If the producer dies before Commit, the slot blocks the queue until Reclaim is called.
+func (q *Queue) Reserve() (token uint64, dst []byte, ok bool) {
+	if q.deletedHere() {
+		return 0, nil, false
+	}
+	if q.seg.lockHeader() != nil {
+		return 0, nil, false
+	}
+
+	curLen := q.seg.getQueueLen()
+	maxLen := q.seg.getMaxLen()
+	if curLen >= q.seg.getCap() || q.seg.isClosed() {
+		q.seg.unlockHeader()
+		return 0, nil, false
+	}
+
+	startIdx := q.seg.getStartIdx()
+	msgIdx := startIdx + curLen
+	msgIdx %= maxLen
+
+	if err := q.seg.lockMsg(msgIdx); err != nil {
+		q.seg.unlockHeader()
+		return 0, nil, false
+	}
+	q.seg.setQueueLen(curLen + 1)
+	q.seg.addEnqueued(1)
+	atomic.StoreUint64(q.seg.msgLockPtr(msgIdx), lockOwner|msgReserved)
+	q.seg.unlockHeader()
+	q.seg.zeroMsgMeta(msgIdx)
+
+	data := q.seg.msgData(msgIdx)
+	return uint64(msgIdx), data[:len(data):len(data)], true
+}
+
+// Commit makes the message reserved with Reserve available to consumers. If the token doesn't belong to a slot
+// reserved by this process, e.g. the message is already committed or reclaimed, an error wrapping ErrNotReserved is
+// returned.
+func (q *Queue) Commit(token uint64) error {
+	if token < uint64(q.seg.getMaxLen()) {
+		if _, _, err := q.seg.slotBounds(uint32(token)); err != nil {
+			return newQueueError("commit", q.key, q.id, err)
+		}
+	}
+	if token >= uint64(q.seg.getMaxLen()) ||
+		!atomic.CompareAndSwapUint64(q.seg.msgLockPtr(uint32(token)), lockOwner|msgReserved, lockOwner) {
+		return newQueueError("commit", q.key, q.id, fmt.Errorf("%w: token %d", ErrNotReserved, token))
+	}
+	// The slot is still locked as a plain message, so consumers wait until it's stamped and summed.
+	q.seg.finishEnqueue(uint32(token))
+	q.seg.unlockMsg(uint32(token))
+	return nil
+}
+
+// Reclaim frees the slots reserved by processes that no longer exist, so they don't block the queue forever. Such
+// slots hold no message and are dropped by the dequeue calls (and counted in Stats.Dropped). The number of reclaimed
+// slots is returned. The owners are identified by PIDs, like in RepairLocks. If the header checksum doesn't match (see
+// WithHeaderChecksum), an error wrapping ErrHeaderCorrupt is returned, and if the slots don't fit into the segment, an
+// error wrapping ErrSegmentCorrupt.
+func (q *Queue) Reclaim() (reclaimed int, err error) {
+	if err = q.seg.lockHeader(); err != nil {
+		return 0, newQueueError("reclaim", q.key, q.id, err)
+	}
+	defer q.seg.unlockHeader()
+
+	if err = q.seg.checkSlots(); err != nil {
+		return 0, newQueueError("reclaim", q.key, q.id, err)
+	}
+	maxLen := q.seg.getMaxLen()
+	for idx := uint32(0); idx < maxLen; idx++ {
+		word := q.seg.msgLockOwner(idx)
+		if word&msgReserved == 0 || processAlive(word&^msgReserved) {
+			continue
+		}
+		if atomic.CompareAndSwapUint64(q.seg.msgLockPtr(idx), word, msgReclaimed) {
+			reclaimed++
+		}
+	}
+	q.seg.readyLen(1)
+	return reclaimed, nil
+}
+
+// readyLen returns the number of messages at the head of the queue, up to max, that can be dequeued: the ones before
+// the first reserved slot. Reclaimed slots at the head are dropped first. It must be called under the header lock.
+func (s *segment) readyLen(max uint32) uint32 {
+	maxLen := s.getMaxLen()
+	for {
+		curLen := s.getQueueLen()
+		startIdx := s.getStartIdx()
+		if curLen == 0 || s.msgLockOwner(startIdx) != msgReclaimed {
+			break
+		}
+		s.unlockMsg(startIdx)
+		s.setStartIdx((startIdx + 1) % maxLen)
+		s.setQueueLen(curLen - 1)
+		s.addDropped(1)
+	}
+
+	curLen := s.getQueueLen()
+	startIdx := s.getStartIdx()
+	n := uint32(0)
+	for n < curLen && n < max && s.msgLockOwner((startIdx+n)%maxLen)&(msgReserved|msgReclaimed) == 0 {
+		n++
+	}
+	return n
+}
+
+func (s *segment) msgLockPtr(idx uint32) *uint64 {
+	return (*uint64)(unsafe.Pointer(&s.mem[s.startMsgLock(idx)]))
+}
@@ -0,0 +1,154 @@
+package shqueue
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReserve(t *testing.T) {
+	t.Run("reserve and commit", func(t *testing.T) {
+		queue := testQueue(t, 4, 0)
+
+		token, dst, ok := queue.Reserve()
+		require.True(t, ok)
+		assert.Len(t, dst, 16)
+		assert.Equal(t, 16, cap(dst))
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+
+		toMsg := make([]byte, 16)
+		assert.False(t, queue.DequeueTry(toMsg))
+
+		copy(dst, testMsgA)
+		require.NoError(t, queue.Commit(token))
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+	})
+
+	t.Run("messages behind reserved head wait", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		token, dst, ok := queue.Reserve()
+		require.True(t, ok)
+		require.True(t, queue.EnqueueTry(testMsgB))
+
+		toMsg := make([]byte, 16)
+		assert.False(t, queue.DequeueTry(toMsg))
+		assert.False(t, queue.DequeueInPlace(func([]byte) {}))
+		assert.Equal(t, 0, TransferTry(queue, testQueue(t, 0, 0), 2))
+		assert.ErrorIs(t, queue.CopyOutChunked(1, toMsg, 0), ErrNoMessage)
+
+		copy(dst, testMsgA)
+		require.NoError(t, queue.Commit(token))
+		msgs, err := queue.DequeueBatchBlock(context.Background(), 5)
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{testMsgA, testMsgB}, msgs)
+	})
+
+	t.Run("batch stops at reserved slot", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		token, _, ok := queue.Reserve()
+		require.True(t, ok)
+		require.True(t, queue.EnqueueTry(testMsgC))
+
+		msgs, err := queue.DequeueBatchBlock(context.Background(), 5)
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{testMsgA}, msgs)
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+		require.NoError(t, queue.Commit(token))
+	})
+
+	t.Run("blocked dequeue waits for commit", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithMaxSpinSleep(time.Microsecond))
+
+		token, dst, ok := queue.Reserve()
+		require.True(t, ok)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			copy(dst, testMsgC)
+			assert.NoError(t, queue.Commit(token))
+		}()
+
+		toMsg := make([]byte, 16)
+		require.NoError(t, queue.DequeueBlock(context.Background(), toMsg))
+		assert.Equal(t, testMsgC, toMsg)
+	})
+
+	t.Run("reserve on full queue", func(t *testing.T) {
+		queue := testQueue(t, 0, 5)
+
+		_, _, ok := queue.Reserve()
+		assert.False(t, ok)
+	})
+
+	t.Run("shift doesn't drop reserved head", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		token, _, ok := queue.Reserve()
+		require.True(t, ok)
+		for i := 0; i < 4; i++ {
+			require.True(t, queue.EnqueueTry(testMsgA))
+		}
+
+		assert.False(t, queue.EnqueueShift(testMsgB))
+		assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+		assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+		require.NoError(t, queue.Commit(token))
+	})
+
+	t.Run("commit twice", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		token, _, ok := queue.Reserve()
+		require.True(t, ok)
+		require.NoError(t, queue.Commit(token))
+		assert.ErrorIs(t, queue.Commit(token), ErrNotReserved)
+		assert.ErrorIs(t, queue.Commit(100), ErrNotReserved)
+	})
+
+	t.Run("reclaim slots of dead producers", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		cmd := exec.Command("true")
+		require.NoError(t, cmd.Run())
+		deadPID := uint64(cmd.Process.Pid)
+
+		_, _, ok := queue.Reserve()
+		require.True(t, ok)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		token, _, ok := queue.Reserve()
+		require.True(t, ok)
+		_, _, ok = queue.Reserve()
+		require.True(t, ok)
+		lockMsgAs(queue, 0, deadPID|msgReserved)
+		lockMsgAs(queue, 3, deadPID|msgReserved)
+
+		repaired, err := queue.RepairLocks()
+		require.NoError(t, err)
+		assert.Zero(t, repaired)
+
+		reclaimed, err := queue.Reclaim()
+		require.NoError(t, err)
+		assert.Equal(t, 2, reclaimed)
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+		assert.Equal(t, uint64(1), queue.Stats().Dropped)
+
+		toMsg := make([]byte, 16)
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.Equal(t, testMsgA, toMsg)
+		assert.False(t, queue.DequeueTry(toMsg))
+
+		require.NoError(t, queue.Commit(token))
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.False(t, queue.DequeueTry(toMsg))
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+		assert.Equal(t, uint64(2), queue.Stats().Dropped)
+		assert.Zero(t, queue.seg.msgLockOwner(3))
+	})
+}
@@ -0,0 +1,158 @@
+package shqueue
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Resize replaces the segment of the queue with a new one of the same key with newMaxLen slots, moving the messages
+// and carrying over the settings (see docs/resize.md). Other processes must reopen the queue. If the messages don't
+// fit, an error wrapping ErrNoSpace is returned. It must not be called concurrently with other calls on this queue.
+func (q *Queue) Resize(newMaxLen uint32) error {
+	if q.channel {
+		return newQueueError("resize", q.key, q.id, errChannel)
+	}
+	if q.posix != nil {
+		return newQueueError("resize", q.key, q.id, fmt.Errorf(
+			"%w: Resize can't be used with POSIX shared memory", ErrNotSupported,
+		))
+	}
+	curLen := q.seg.getQueueLen()
+	if curLen > newMaxLen {
+		return newQueueError("resize", q.key, q.id, fmt.Errorf(
+			"%w: %d messages, new max length %d", ErrNoSpace, curLen, newMaxLen,
+		))
+	}
+	if err := q.seg.checkSlots(); err != nil {
+		return newQueueError("resize", q.key, q.id, err)
+	}
+
+	o := q.opts
+	o.schemaID = q.seg.getSchemaID()
+	o.metaSize = q.seg.getMetaSize()
+	o.headerChecksum = q.seg.isChecksummed()
+	o.runningSum = q.seg.isRunningChecksum()
+	o.timestamps = q.seg.isTimestamped()
+	o.byteOrder = q.seg.byteOrder
+	o.semaphore = q.semID >= 0
+	o.group = q.seg.group
+	o.lockPI = q.seg.isLockPI()
+	// The eventfds of this process are moved to the new segment, so the application keeps polling them.
+	o.eventFD = false
+	o.recover = false
+	// The old segment stays attached until the messages are moved, so the new one can't take its address.
+	o.attachAddr = 0
+	if err := q.delete(); err != nil {
+		return err
+	}
+	var newQueue *Queue
+	var err error
+	if q.key == unix.IPC_PRIVATE {
+		newQueue, err = createPrivate(q.seg.getDataSize(), newMaxLen, o)
+	} else {
+		newQueue, err = createBytes(q.key, q.seg.getDataSize(), newMaxLen, o)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The messages stay in the group, so the group isn't told about the move.
+	oldGroup, newGroup := q.seg.group, newQueue.seg.group
+	q.seg.group, newQueue.seg.group = nil, nil
+	moved, err := q.moveAll(newQueue)
+	q.seg.group, newQueue.seg.group = oldGroup, newGroup
+	if err != nil {
+		_ = newQueue.Close()
+		_ = newQueue.Delete()
+		return newQueueError("resize", q.key, q.id, fmt.Errorf("moved %d of %d messages: %w", moved, curLen, err))
+	}
+	newQueue.seg.carryStats(q.seg, uint64(moved))
+	if q.seg.isClosed() {
+		newQueue.seg.setClosed()
+	}
+
+	moveEventFDs(q.seg, newQueue.seg)
+
+	old := &Queue{key: q.key, id: q.id, semID: -1, seg: q.seg}
+	q.id, q.semID, q.seg = newQueue.id, newQueue.semID, newQueue.seg
+	return old.Close()
+}
+
+// moveAll moves all the messages of the queue into the empty newQueue, in the head-to-tail order starting at index 0,
+// and returns their number. Unlike TransferTry, it ignores the capacity of newQueue and doesn't stop at reserved slots,
+// which are moved as reclaimed. The soft cap of the queue is applied to newQueue afterwards. The headers are changed
+// like by TransferTry, but only once every slot is moved: if a header or a slot can't be locked, the error is returned
+// along with the number of slots moved before it, and the queue keeps all its messages.
+func (q *Queue) moveAll(newQueue *Queue) (moved uint32, err error) {
+	first, second := q, newQueue
+	if newQueue.transferPeer().less(q.transferPeer()) {
+		first, second = newQueue, q
+	}
+	if err = first.seg.lockHeader(); err != nil {
+		return 0, err
+	}
+	defer first.seg.unlockHeader()
+	if err = second.seg.lockHeader(); err != nil {
+		return 0, err
+	}
+	defer second.seg.unlockHeader()
+
+	src, dst := q.seg, newQueue.seg
+	curLen := src.getQueueLen()
+	maxLen := src.getMaxLen()
+	startIdx := src.getStartIdx()
+	for ; moved < curLen; moved++ {
+		srcIdx := (startIdx + moved) % maxLen
+		if src.msgLockOwner(srcIdx)&(msgReserved|msgReclaimed) != 0 {
+			atomic.StoreUint64(dst.msgLockPtr(moved), msgReclaimed)
+			continue
+		}
+		if err = src.lockMsg(srcIdx); err != nil {
+			return moved, err
+		}
+		if err = dst.lockMsg(moved); err != nil {
+			src.unlockMsg(srcIdx)
+			return moved, err
+		}
+		copy(dst.msgMeta(moved), src.msgMeta(srcIdx))
+		copy(dst.msgData(moved), src.msgData(srcIdx))
+		dst.copyMsgTime(moved, src, srcIdx)
+		dst.sumEnqueued(moved)
+		dst.unlockMsg(moved)
+		src.unlockMsg(srcIdx)
+	}
+
+	src.setQueueLen(0)
+	src.setStartIdx((startIdx + curLen) % maxLen)
+	src.addDequeued(uint64(curLen))
+	src.addDequeuedChecksum(dst.getEnqueuedChecksum())
+	dst.setQueueLen(curLen)
+	dst.addEnqueued(uint64(curLen))
+	// The soft cap is only applied once the messages are in, so the ones above it aren't lost.
+	if softCap := src.getSoftCap(); softCap < dst.getMaxLen() {
+		dst.setSoftCap(softCap)
+	}
+	return moved, nil
+}
+
+// carryStats adds the stats counters of the old segment, from which moved messages have been transferred to this one,
+// to the counters of this segment, and takes over the reset time and the head and tail sequences. The transfer itself
+// isn't counted. So far, the running checksums of this segment only cover the moved messages, so they're carried over
+// the same way.
+func (s *segment) carryStats(old *segment, moved uint64) {
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startEnqueued])), old.getEnqueued()-moved)
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startTailSeq])), old.getTailSeq()-moved)
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startDequeued])), old.getDequeued()-moved)
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startHeadSeq])), old.getHeadSeq()-moved)
+	movedSum := s.getEnqueuedChecksum()
+	s.addEnqueuedChecksum(old.getEnqueuedChecksum() - movedSum)
+	s.addDequeuedChecksum(old.getDequeuedChecksum() - movedSum)
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startDropped])), old.getDropped())
+	s.addRejected(old.getRejected())
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startHeaderLockSpins])), old.getHeaderLockSpins())
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startMsgLockSpins])), old.getMsgLockSpins())
+	atomic.StoreInt64((*int64)(unsafe.Pointer(&s.mem[startStatsResetTime])), old.getStatsResetTime())
+}
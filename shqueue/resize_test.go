@@ -0,0 +1,135 @@
+package shqueue
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResize(t *testing.T) {
+	// seqMsg returns a message holding the sequence number.
+	seqMsg := func(seq uint64) []byte {
+		msg := make([]byte, 16)
+		binary.LittleEndian.PutUint64(msg, seq)
+		return msg
+	}
+
+	t.Run("preserve order and stats", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5, WithSchemaID(3))
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		// Wrap the ring around, so the head isn't at index 0.
+		for seq := uint64(0); seq < 5; seq++ {
+			require.True(t, queue.EnqueueTry(seqMsg(seq)))
+		}
+		require.Equal(t, uint32(3), queue.DequeueSkip(3))
+		for seq := uint64(5); seq < 8; seq++ {
+			require.True(t, queue.EnqueueTry(seqMsg(seq)))
+		}
+		before := queue.Stats()
+		oldID := queue.id
+
+		require.NoError(t, queue.Resize(10))
+		assert.NotEqual(t, oldID, queue.id)
+		assert.Equal(t, uint32(10), queue.HardCap())
+		assert.Equal(t, uint32(3), queue.SchemaID())
+		assert.Equal(t, uint32(0), queue.seg.getStartIdx())
+		assert.Equal(t, before, queue.Stats())
+
+		reopened, err := Open(key)
+		require.NoError(t, err)
+		assert.Equal(t, queue.id, reopened.id)
+		assert.NoError(t, reopened.Close())
+
+		toMsg := make([]byte, 16)
+		for seq := uint64(3); seq < 8; seq++ {
+			require.True(t, queue.DequeueTry(toMsg))
+			assert.Equal(t, seqMsg(seq), toMsg)
+		}
+		assert.False(t, queue.DequeueTry(toMsg))
+	})
+
+	t.Run("shrink", func(t *testing.T) {
+		queue := testQueue(t, 3, 3)
+		require.NoError(t, queue.SetSoftCap(4))
+
+		require.NoError(t, queue.Resize(3))
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+		assert.Equal(t, uint32(3), queue.Cap())
+	})
+
+	t.Run("keep messages above soft cap", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		for seq := uint64(0); seq < 5; seq++ {
+			require.True(t, queue.EnqueueTry(seqMsg(seq)))
+		}
+		require.NoError(t, queue.SetSoftCap(2))
+
+		require.NoError(t, queue.Resize(10))
+		assert.Equal(t, uint32(5), queue.seg.getQueueLen())
+		assert.Equal(t, uint32(2), queue.Cap())
+		assert.False(t, queue.EnqueueTry(testMsgA))
+
+		toMsg := make([]byte, 16)
+		for seq := uint64(0); seq < 5; seq++ {
+			require.True(t, queue.DequeueTry(toMsg))
+			assert.Equal(t, seqMsg(seq), toMsg)
+		}
+	})
+
+	t.Run("keep messages behind reserved slot", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueTry(seqMsg(0)))
+		token, _, ok := queue.Reserve()
+		require.True(t, ok)
+		for seq := uint64(2); seq < 4; seq++ {
+			require.True(t, queue.EnqueueTry(seqMsg(seq)))
+		}
+
+		require.NoError(t, queue.Resize(10))
+		assert.Equal(t, uint32(4), queue.seg.getQueueLen())
+		assert.ErrorIs(t, queue.Commit(token), ErrNotReserved)
+
+		toMsg := make([]byte, 16)
+		for _, seq := range []uint64{0, 2, 3} {
+			require.True(t, queue.DequeueTry(toMsg))
+			assert.Equal(t, seqMsg(seq), toMsg)
+		}
+		assert.False(t, queue.DequeueTry(toMsg))
+		stats := queue.Stats()
+		assert.Equal(t, uint64(1), stats.Dropped)
+		assert.Equal(t, stats.Enqueued, stats.Dequeued+stats.Dropped)
+	})
+
+	t.Run("fail on corrupted segment", func(t *testing.T) {
+		queue := testQueue(t, 3, 3)
+		oldID := queue.id
+		queue.seg.setMsgSize(1 << 31)
+		defer queue.seg.setMsgSize(16)
+
+		err := queue.Resize(10)
+		assert.ErrorIs(t, err, ErrSegmentCorrupt)
+		assert.Equal(t, oldID, queue.id)
+		deleted, err := queue.IsDeleted()
+		require.NoError(t, err)
+		assert.False(t, deleted)
+	})
+
+	t.Run("fail when messages don't fit", func(t *testing.T) {
+		queue := testQueue(t, 3, 3)
+		oldID := queue.id
+
+		err := queue.Resize(2)
+		assert.ErrorIs(t, err, ErrNoSpace)
+		assert.Equal(t, oldID, queue.id)
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+	})
+}
@@ -0,0 +1,77 @@
+package shqueue
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// RoundRobinEnqueue enqueues the message to one of the destination queues, spreading messages evenly among them, and
+// returns the index of the destination in dests. The destinations are tried in rotation, starting after the one that
+// got the previous message, and the message goes to the first one that isn't full or closed. The rotation cursor is
+// kept in the first destination in this process, so calls with the same dests continue the rotation, and concurrent
+// callers share it. It's a producer-side building block for distributing work among the queues of several workers.
+//
+// If no destination takes the message, -1 and the error of the first destination that failed otherwise than by being
+// full or closed are returned, e.g. a corrupted header. If there's none, ErrQueueClosed is returned if all the
+// destinations are closed, and ErrFull otherwise. The errors are returned as EnqueueTryErr returns them. Use RoundRobinEnqueueBlock to wait for free space instead. The messages
+// of all destinations must be of the same size as msg, and dests must not be empty.
+func RoundRobinEnqueue(msg []byte, dests []*Queue) (int, error) {
+	if len(dests) == 0 {
+		panic("round-robin destinations must not be empty")
+	}
+	for _, q := range dests {
+		q.seg.checkMsgSize(len(msg))
+	}
+
+	cursor := &dests[0].rrNext
+	start := uint64(atomic.LoadUint32(cursor))
+	closed := 0
+	var failErr error
+	for i := range dests {
+		idx := int((start + uint64(i)) % uint64(len(dests)))
+		_, err := dests[idx].enqueueTryAt(nil, msg)
+		switch {
+		case err == nil:
+			atomic.StoreUint32(cursor, uint32(idx+1))
+			return idx, nil
+		case err == ErrQueueClosed:
+			closed++
+		case err != ErrFull && failErr == nil:
+			failErr = err
+		}
+	}
+	if failErr != nil {
+		return -1, failErr
+	}
+	if closed == len(dests) {
+		return -1, ErrQueueClosed
+	}
+	return -1, ErrFull
+}
+
+// RoundRobinEnqueueBlock works like RoundRobinEnqueue, but if all the destinations are full, it waits until one of
+// them has free space. It can't wait on the semaphores of several queues at once (see WithSemaphore), so it backs off
+// like a producer without them, up to the max spin sleep of the first destination. If the context is cancelled or one
+// of the destinations is deleted while waiting, an error is returned, and if all of them are closed, ErrQueueClosed.
+// Other errors of RoundRobinEnqueue are returned at once.
+func RoundRobinEnqueueBlock(ctx context.Context, msg []byte, dests []*Queue) (int, error) {
+	for i := 0; ; i++ {
+		idx, err := RoundRobinEnqueue(msg, dests)
+		if err != ErrFull {
+			return idx, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		default:
+			// Go on.
+		}
+		for _, q := range dests {
+			if err = q.checkDeleted(i); err != nil {
+				return -1, err
+			}
+		}
+		backoff(i, dests[0].opts.maxSpinSleep)
+	}
+}
@@ -0,0 +1,109 @@
+package shqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundRobinEnqueue(t *testing.T) {
+	t.Run("rotates over destinations", func(t *testing.T) {
+		dests := []*Queue{testQueue(t, 0, 0), testQueue(t, 0, 0), testQueue(t, 0, 0)}
+
+		var got []int
+		for i := 0; i < 7; i++ {
+			idx, err := RoundRobinEnqueue(testMsgA, dests)
+			require.NoError(t, err)
+			got = append(got, idx)
+		}
+		assert.Equal(t, []int{0, 1, 2, 0, 1, 2, 0}, got)
+		assert.Equal(t, uint32(3), dests[0].seg.getQueueLen())
+		assert.Equal(t, uint32(2), dests[1].seg.getQueueLen())
+		assert.Equal(t, uint32(2), dests[2].seg.getQueueLen())
+	})
+
+	t.Run("skips full and closed destinations", func(t *testing.T) {
+		dests := []*Queue{testQueue(t, 0, 0), testQueue(t, 0, 5), testQueue(t, 0, 0)}
+		dests[2].CloseQueue()
+
+		for i := 0; i < 3; i++ {
+			idx, err := RoundRobinEnqueue(testMsgA, dests)
+			require.NoError(t, err)
+			assert.Equal(t, 0, idx)
+		}
+	})
+
+	t.Run("all full", func(t *testing.T) {
+		dests := []*Queue{testQueue(t, 0, 5), testQueue(t, 0, 0)}
+		dests[1].CloseQueue()
+
+		idx, err := RoundRobinEnqueue(testMsgA, dests)
+		assert.Equal(t, -1, idx)
+		assert.Equal(t, ErrFull, err)
+	})
+
+	t.Run("all closed", func(t *testing.T) {
+		dests := []*Queue{testQueue(t, 0, 0), testQueue(t, 0, 0)}
+		for _, q := range dests {
+			q.CloseQueue()
+		}
+
+		_, err := RoundRobinEnqueue(testMsgA, dests)
+		assert.Equal(t, ErrQueueClosed, err)
+	})
+
+	t.Run("destination error", func(t *testing.T) {
+		dests := []*Queue{testQueue(t, 0, 5), testQueue(t, 0, 0, WithHeaderChecksum()), testQueue(t, 0, 0)}
+		dests[1].seg.setStartIdx(4)
+		dests[2].CloseQueue()
+
+		idx, err := RoundRobinEnqueue(testMsgA, dests)
+		assert.Equal(t, -1, idx)
+		assert.ErrorIs(t, err, ErrHeaderCorrupt)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = RoundRobinEnqueueBlock(ctx, testMsgA, dests)
+		assert.ErrorIs(t, err, ErrHeaderCorrupt)
+	})
+
+	t.Run("message size mismatch", func(t *testing.T) {
+		other, err := CreatePrivate(3, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, other.Close())
+			assert.NoError(t, other.Delete())
+		}()
+		dests := []*Queue{testQueue(t, 0, 0), other}
+
+		assert.Panics(t, func() { _, _ = RoundRobinEnqueue(testMsgA, dests) })
+		assert.Zero(t, dests[0].seg.getQueueLen())
+		assert.Panics(t, func() { _, _ = RoundRobinEnqueue(testMsgA, nil) })
+	})
+
+	t.Run("block until space", func(t *testing.T) {
+		dests := []*Queue{testQueue(t, 0, 5), testQueue(t, 0, 5)}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			dests[1].DequeueTry(make([]byte, 16))
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		idx, err := RoundRobinEnqueueBlock(ctx, testMsgA, dests)
+		require.NoError(t, err)
+		assert.Equal(t, 1, idx)
+	})
+
+	t.Run("block cancelled", func(t *testing.T) {
+		dests := []*Queue{testQueue(t, 0, 5)}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := RoundRobinEnqueueBlock(ctx, testMsgA, dests)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -1,8 +1,13 @@
 package shqueue
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"os"
+	"runtime"
+	"sort"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -12,37 +17,184 @@ const (
 	startMagic = 0
 	endMagic   = 8
 
-	startParams  = 8
-	startMaxLen  = 8
-	endMaxLen    = 12
-	startMsgSize = 12
-	endMsgSize   = 16
-	endParams    = 16
-
-	startHeader     = 16
-	startHeaderLock = 16
-	endHeaderLock   = 24
-	startStartIdx   = 24
-	endStartIdx     = 28
-	startQueueLen   = 28
-	endQueueLen     = 32
-	endHeader       = 32
-
-	startQueue = 32
+	startParams    = 8
+	startMaxLen    = 8
+	endMaxLen      = 12
+	startMsgSize   = 12
+	endMsgSize     = 16
+	startVersion   = 16
+	endVersion     = 20
+	startSemID     = 20
+	endSemID       = 24
+	startDataSize  = 24
+	endDataSize    = 28
+	startByteOrder = 28
+	endByteOrder   = 32
+	startSchemaID  = 32
+	endSchemaID    = 36
+	startMetaSize  = 36
+	endMetaSize    = 40
+	startGroupID   = 40
+	endGroupID     = 44
+	startLockPI    = 44
+	endLockPI      = 48
+	endParams      = 48
+
+	startHeader           = 48
+	startHeaderLock       = 48
+	endHeaderLock         = 56
+	startStartIdx         = 56
+	endStartIdx           = 60
+	startQueueLen         = 60
+	endQueueLen           = 64
+	startNextTicket       = 64
+	endNextTicket         = 68
+	startServingTicket    = 68
+	endServingTicket      = 72
+	startAbandonedTickets = 72
+	endAbandonedTickets   = 80
+	startHeaderLockSpins  = 80
+	endHeaderLockSpins    = 88
+	startMsgLockSpins     = 88
+	endMsgLockSpins       = 96
+	startEnqueued         = 96
+	endEnqueued           = 104
+	startDequeued         = 104
+	endDequeued           = 112
+	startDropped          = 112
+	endDropped            = 120
+	startStatsResetTime   = 120
+	endStatsResetTime     = 128
+	startSoftCap          = 128
+	endSoftCap            = 132
+	startClosed           = 132
+	endClosed             = 136
+	startAdaptiveSpins    = 136
+	endAdaptiveSpins      = 144
+	startChecksummed      = 144
+	endChecksummed        = 148
+	startHeaderChecksum   = 148
+	endHeaderChecksum     = 152
+	startRunningChecksum  = 152
+	endRunningChecksum    = 156
+	startTimestamped      = 156
+	endTimestamped        = 160
+	startEnqueuedChecksum = 160
+	endEnqueuedChecksum   = 168
+	startDequeuedChecksum = 168
+	endDequeuedChecksum   = 176
+	startTransferPeerID   = 176
+	endTransferPeerID     = 184
+	startTransferCounter  = 184
+	endTransferCounter    = 192
+	startTransferState    = 192
+	endTransferState      = 196
+	startTransferPeerKind = 196
+	endTransferPeerKind   = 200
+	startTransferPeerOff  = 200
+	endTransferPeerOff    = 204
+	startTransferCount    = 204
+	endTransferCount      = 208
+	startTransferStart    = 208
+	endTransferStart      = 212
+	startTransferLen      = 212
+	endTransferLen        = 216
+	startEventSeq         = 216
+	endEventSeq           = 220
+	startEventWatchers    = 220
+	endEventWatchers      = 224
+	startTicketOwners     = 224
+	endTicketOwners       = 480
+	startRejected         = 480
+	endRejected           = 488
+	startTailSeq          = 488
+	endTailSeq            = 496
+	startTransferSeq      = 496
+	endTransferSeq        = 504
+	startHeadSeq          = 504
+	endHeadSeq            = 512
+	endHeader             = 512
+
+	startQueue = 512
+)
+
+// The lock words and counters are accessed atomically as 64-bit words, so they must be 8-byte aligned. The segment
+// itself is page-aligned, so it's enough to align the offsets. The expressions below don't compile otherwise.
+var (
+	_ = [1]struct{}{}[startHeaderLock%8]
+	_ = [1]struct{}{}[startAbandonedTickets%8]
+	_ = [1]struct{}{}[startHeaderLockSpins%8]
+	_ = [1]struct{}{}[startMsgLockSpins%8]
+	_ = [1]struct{}{}[startEnqueued%8]
+	_ = [1]struct{}{}[startDequeued%8]
+	_ = [1]struct{}{}[startDropped%8]
+	_ = [1]struct{}{}[startStatsResetTime%8]
+	_ = [1]struct{}{}[startAdaptiveSpins%8]
+	_ = [1]struct{}{}[startEnqueuedChecksum%8]
+	_ = [1]struct{}{}[startDequeuedChecksum%8]
+	_ = [1]struct{}{}[startTransferPeerID%8]
+	_ = [1]struct{}{}[startTransferCounter%8]
+	_ = [1]struct{}{}[startRejected%8]
+	_ = [1]struct{}{}[startTailSeq%8]
+	_ = [1]struct{}{}[startTransferSeq%8]
+	_ = [1]struct{}{}[startHeadSeq%8]
+	_ = [1]struct{}{}[startQueue%8]
+	_ = [1]struct{}{}[msgLockSize%8]
 )
 
+// layoutVersion is incremented on every change of the memory layout, so incompatible segments are never opened.
+const layoutVersion = 23
+
+// maxPendingTickets is the max number of fair producers that can wait for their turn at the same time. It's limited
+// by the number of bits in the abandoned tickets bitmap, and the number of ticket owners in the header.
+const maxPendingTickets = 64
+
+// lockOwner is the value stored in the lock words taken by this process: its PID. It lets RepairLocks find the locks
+// left by crashed processes.
+var lockOwner = uint64(os.Getpid())
+
+// byteOrderMark is written in the byte order of the segment, so it can be detected from the order of its bytes.
+const byteOrderMark = 0x01020304
+
 var magic = [8]byte{0x57, 0x6f, 0x72, 0x6b, 0x20, 0x69, 0x73, 0x20}
 
 type segment struct {
-	mem       []byte
-	byteOrder binary.ByteOrder
+	mem          []byte
+	byteOrder    binary.ByteOrder
+	maxSpinSleep time.Duration // Sleep cap of lockHeader, see WithMaxSpinSleep.
+	backoff      Backoff       // Strategy of lockHeader, see WithBackoff.
+	msgsOffset   uint32        // Offset of the first message slot: startQueue, or further for channels of a MultiQueue.
+	offset       uint32        // Offset of mem in the shared memory segment: 0, or further for channels of a MultiQueue.
+
+	slowThreshold time.Duration                         // See WithSlowLog.
+	slowLog       func(op string, waited time.Duration) // See WithSlowLog. nil if slow operations aren't logged.
+
+	events *eventFDs // See WithEventFD. nil if this process doesn't signal eventfds.
+
+	group *Group // The group of the queue attached in this process (see WithGroup), or nil.
 }
 
 func newSegment(mem []byte) *segment {
 	return &segment{
-		mem:       mem,
-		byteOrder: detectByteOrder(),
+		mem:          mem,
+		byteOrder:    detectByteOrder(),
+		maxSpinSleep: defaultMaxSpinSleep,
+		msgsOffset:   startQueue,
+	}
+}
+
+// backoff sleeps between the attempts of a spin loop for a time growing with the iteration, up to max. With a zero
+// max, it only yields the processor.
+func backoff(iteration int, max time.Duration) {
+	if max <= 0 {
+		runtime.Gosched()
+		return
 	}
+	wait := time.Duration(iteration)
+	if wait > max {
+		wait = max
+	}
+	time.Sleep(wait)
 }
 
 func detectByteOrder() (native binary.ByteOrder) {
@@ -76,6 +228,32 @@ func (s *segment) checkMagic() error {
 	return nil
 }
 
+func (s *segment) setVersion() {
+	s.byteOrder.PutUint32(s.mem[startVersion:endVersion], layoutVersion)
+}
+
+// checkVersion detects the byte order of the segment and checks its layout version. Segments without a byte order
+// mark are of older versions.
+func (s *segment) checkVersion() error {
+	switch [4]byte(s.mem[startByteOrder:endByteOrder]) {
+	case [4]byte{1, 2, 3, 4}:
+		s.byteOrder = binary.BigEndian
+	case [4]byte{4, 3, 2, 1}:
+		s.byteOrder = binary.LittleEndian
+	default:
+		return ErrVersionMismatch
+	}
+	if s.byteOrder.Uint32(s.mem[startVersion:endVersion]) != layoutVersion {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// setByteOrder writes the byte order mark of the segment, so other processes read the integers in the same order.
+func (s *segment) setByteOrder() {
+	s.byteOrder.PutUint32(s.mem[startByteOrder:endByteOrder], byteOrderMark)
+}
+
 func (s *segment) getMaxLen() uint32 {
 	return s.byteOrder.Uint32(s.mem[startMaxLen:endMaxLen])
 }
@@ -84,6 +262,33 @@ func (s *segment) setMaxLen(val uint32) {
 	s.byteOrder.PutUint32(s.mem[startMaxLen:endMaxLen], val)
 }
 
+// getDataSize returns the size of message data in bytes, as requested on creation. It may be less than the message
+// size, which is padded to a multiple of 8 bytes, so the lock words stay aligned.
+func (s *segment) getDataSize() uint32 {
+	return s.byteOrder.Uint32(s.mem[startDataSize:endDataSize])
+}
+
+func (s *segment) setDataSize(val uint32) {
+	s.byteOrder.PutUint32(s.mem[startDataSize:endDataSize], val)
+}
+
+func (s *segment) getSchemaID() uint32 {
+	return s.byteOrder.Uint32(s.mem[startSchemaID:endSchemaID])
+}
+
+func (s *segment) setSchemaID(val uint32) {
+	s.byteOrder.PutUint32(s.mem[startSchemaID:endSchemaID], val)
+}
+
+// getMetaSize returns the size of the metadata region at the start of every slot (see WithMetadataSize).
+func (s *segment) getMetaSize() uint32 {
+	return s.byteOrder.Uint32(s.mem[startMetaSize:endMetaSize])
+}
+
+func (s *segment) setMetaSize(val uint32) {
+	s.byteOrder.PutUint32(s.mem[startMetaSize:endMetaSize], val)
+}
+
 func (s *segment) getMsgSize() uint32 {
 	return s.byteOrder.Uint32(s.mem[startMsgSize:endMsgSize])
 }
@@ -92,18 +297,120 @@ func (s *segment) setMsgSize(val uint32) {
 	s.byteOrder.PutUint32(s.mem[startMsgSize:endMsgSize], val)
 }
 
-func (s *segment) lockHeader() {
+// lockHeader locks the header. If the header checksum is maintained and doesn't match (see WithHeaderChecksum), the
+// lock is released and an error wrapping ErrHeaderCorrupt is returned. A priority-inheriting lock whose owner has died
+// isn't taken, and ErrLockOwnerDead is returned.
+func (s *segment) lockHeader() error {
+	if s.isLockPI() {
+		if err := s.lockHeaderPI(time.Time{}); err != nil {
+			return err
+		}
+	} else {
+		s.lockHeaderSpin()
+	}
+	if err := s.checkHeaderChecksum(); err != nil {
+		// Release the lock without fixing the checksum, so the corruption stays visible to other processes.
+		s.releaseHeaderLock()
+		return err
+	}
+	return nil
+}
+
+// lockHeaderSpin takes the header lock spinning on it with the backoff strategy (see WithBackoff).
+func (s *segment) lockHeaderSpin() {
+	lockUintPtr := (*uint64)(unsafe.Pointer(&s.mem[startHeaderLock]))
+	spinsPtr := (*uint64)(unsafe.Pointer(&s.mem[startHeaderLockSpins]))
+	var start time.Time
+	i := 0
+	for ; !atomic.CompareAndSwapUint64(lockUintPtr, 0, lockOwner); i++ {
+		start = s.startSlow(start)
+		atomic.AddUint64(spinsPtr, 1)
+		s.waitHeaderLock(i)
+	}
+	if i > 0 {
+		s.recordHeaderLockWait(i)
+		s.logSlow("lock header", start)
+	}
+}
+
+// takeOverHeaderLock takes the header lock if it's held by a process that no longer exists, and reports whether it
+// did. Then the lock is held by this process, as if lockHeader took it. If the lock is a priority-inheriting futex
+// (see WithPriorityInheritance), the owner is a thread instead.
+func (s *segment) takeOverHeaderLock() bool {
+	if s.isLockPI() {
+		return s.takeOverHeaderLockPI()
+	}
+	lockUintPtr := (*uint64)(unsafe.Pointer(&s.mem[startHeaderLock]))
+	owner := atomic.LoadUint64(lockUintPtr)
+	return owner != 0 && !processAlive(owner) && atomic.CompareAndSwapUint64(lockUintPtr, owner, lockOwner)
+}
+
+// tryLockHeader works like lockHeader, but gives up after the timeout and returns false.
+func (s *segment) tryLockHeader(timeout time.Duration) bool {
+	if s.isLockPI() {
+		return s.lockHeaderPI(time.Now().Add(timeout)) == nil
+	}
 	lockUintPtr := (*uint64)(unsafe.Pointer(&s.mem[startHeaderLock]))
-	for i := 0; !atomic.CompareAndSwapUint64(lockUintPtr, 0, 1); i++ {
-		wait := time.Duration(i)
-		if wait > time.Millisecond {
-			wait = time.Millisecond
+	spinsPtr := (*uint64)(unsafe.Pointer(&s.mem[startHeaderLockSpins]))
+	start := time.Now()
+	deadline := start.Add(timeout)
+	i := 0
+	for ; !atomic.CompareAndSwapUint64(lockUintPtr, 0, lockOwner); i++ {
+		atomic.AddUint64(spinsPtr, 1)
+		if time.Now().After(deadline) {
+			return false
 		}
-		time.Sleep(wait)
+		s.waitHeaderLock(i)
+	}
+	if i > 0 {
+		s.recordHeaderLockWait(i)
+		s.logSlow("lock header", start)
 	}
+	return true
+}
+
+// startSlow returns the time the wait of a slow operation started: start if it's already known, or the current time
+// if slow operations are logged (see WithSlowLog).
+func (s *segment) startSlow(start time.Time) time.Time {
+	if start.IsZero() && s.slowLog != nil {
+		return time.Now()
+	}
+	return start
+}
+
+// logSlow calls the slow log if the wait started at start took at least the threshold. It does nothing if start is
+// zero: the operation didn't wait, or slow operations aren't logged.
+func (s *segment) logSlow(op string, start time.Time) {
+	if start.IsZero() || s.slowLog == nil {
+		return
+	}
+	if waited := time.Since(start); waited >= s.slowThreshold {
+		s.slowLog(op, waited)
+	}
+}
+
+// headerLockOwner returns the PID of the process holding the header lock, or 0 if it isn't locked. If the lock is a
+// priority-inheriting futex (see WithPriorityInheritance), the ID of the owner thread is returned instead.
+func (s *segment) headerLockOwner() uint64 {
+	if s.isLockPI() {
+		return uint64(atomic.LoadUint32(s.headerLockWord()) & futexTIDMask)
+	}
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startHeaderLock])))
 }
 
 func (s *segment) unlockHeader() {
+	if s.isChecksummed() {
+		s.updateHeaderChecksum()
+	}
+	s.releaseHeaderLock()
+}
+
+// releaseHeaderLock unlocks the header without updating its checksum.
+func (s *segment) releaseHeaderLock() {
+	if s.isLockPI() {
+		s.unlockHeaderPI()
+		return
+	}
 	lockUintPtr := (*uint64)(unsafe.Pointer(&s.mem[startHeaderLock]))
 	atomic.StoreUint64(lockUintPtr, 0)
 }
@@ -121,15 +428,396 @@ func (s *segment) getQueueLen() uint32 {
 }
 
 func (s *segment) setQueueLen(val uint32) {
+	if g := s.memberGroup(); g != nil {
+		g.addLen(val - s.getQueueLen())
+	}
 	s.byteOrder.PutUint32(s.mem[startQueueLen:endQueueLen], val)
+	s.syncSem()
+	s.syncEvents()
+	s.notifyEvents()
 }
 
-func (s *segment) lockMsg(idx uint32) {
-	startLock := s.startMsgLock(idx)
+// getSemID returns the ID of the companion semaphore set of the queue, or -1 if it has none. The ID is stored plus one,
+// so zeroed params mean no semaphore set.
+func (s *segment) getSemID() int {
+	return int(s.byteOrder.Uint32(s.mem[startSemID:endSemID])) - 1
+}
+
+func (s *segment) setSemID(id int) {
+	s.byteOrder.PutUint32(s.mem[startSemID:endSemID], uint32(id+1))
+}
+
+// getGroupID returns the ID of the segment of the group of the queue, or -1 if it's not in a group (see WithGroup).
+// Like the semaphore ID, it's stored plus one.
+func (s *segment) getGroupID() int {
+	return int(s.byteOrder.Uint32(s.mem[startGroupID:endGroupID])) - 1
+}
+
+func (s *segment) setGroupID(id int) {
+	s.byteOrder.PutUint32(s.mem[startGroupID:endGroupID], uint32(id+1))
+}
+
+// memberGroup returns the group attached in this process if the queue is still in it, or nil. The queue leaves the
+// group when it's deleted, while other processes may keep the group attached.
+func (s *segment) memberGroup() *Group {
+	if s.group == nil || s.getGroupID() < 0 {
+		return nil
+	}
+	return s.group
+}
+
+// syncSem sets the semaphores of the companion semaphore set, if any, to match the queue length. It must be called
+// under the header lock, so the semaphores are updated in the same order as the length. An error means that the set
+// is removed along with the queue, and the waiters find it out themselves, so it's ignored.
+func (s *segment) syncSem() {
+	if id := s.getSemID(); id >= 0 {
+		_ = setSem(id, semValues(s.getQueueLen(), s.getCap()))
+	}
+}
+
+// syncEvents signals or drains the eventfds of this process, if any, to match the queue length (see WithEventFD). Like
+// syncSem, it must be called under the header lock.
+func (s *segment) syncEvents() {
+	if s.events != nil {
+		s.events.sync(s.getQueueLen(), s.getCap(), s.isClosed())
+	}
+}
+
+// checkAlignment checks that all the lock words of a segment in mem with messages of msgSize bytes are 8-byte aligned.
+// The header is aligned by the layout, and message locks are aligned only if the message size is a multiple of 8.
+func checkAlignment(mem []byte, msgSize uint32) error {
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 || msgSize%8 != 0 {
+		return ErrUnaligned
+	}
+	return nil
+}
+
+// checkHeader checks that the header fields are consistent with the params, and that all the slots fit into the
+// segment.
+func (s *segment) checkHeader() error {
+	maxLen := s.getMaxLen()
+	if s.getStartIdx() >= maxLen || s.getQueueLen() > maxLen || s.getSoftCap() > maxLen {
+		return ErrHeaderCorrupt
+	}
+	return s.checkSlots()
+}
+
+// resetHeader zeroes all the header fields except the lock.
+func (s *segment) resetHeader() {
+	for i := endHeaderLock; i < endHeader; i++ {
+		s.mem[i] = 0
+	}
+}
+
+// isChecksummed returns whether the header checksum is maintained (see WithHeaderChecksum).
+func (s *segment) isChecksummed() bool {
+	return s.byteOrder.Uint32(s.mem[startChecksummed:endChecksummed]) != 0
+}
+
+func (s *segment) setChecksummed() {
+	s.byteOrder.PutUint32(s.mem[startChecksummed:endChecksummed], 1)
+}
+
+// headerChecksum computes the checksum of the params and the header fields that are only changed under the header
+// lock: the start index, the queue length and the soft cap. The atomic counters, tickets and flags are changed without
+// the lock, so they aren't covered.
+func (s *segment) headerChecksum() uint32 {
+	crc := crc32.Update(0, crc32.IEEETable, s.mem[startParams:endParams])
+	crc = crc32.Update(crc, crc32.IEEETable, s.mem[startStartIdx:endQueueLen])
+	return crc32.Update(crc, crc32.IEEETable, s.mem[startSoftCap:endSoftCap])
+}
+
+// updateHeaderChecksum stores the checksum of the header. The header lock must be held.
+func (s *segment) updateHeaderChecksum() {
+	s.byteOrder.PutUint32(s.mem[startHeaderChecksum:endHeaderChecksum], s.headerChecksum())
+}
+
+// checkHeaderChecksum returns ErrHeaderCorrupt if the header checksum is maintained and doesn't match the header. The
+// header lock must be held, otherwise a concurrent update may be taken for a corruption.
+func (s *segment) checkHeaderChecksum() error {
+	if !s.isChecksummed() {
+		return nil
+	}
+	stored := s.byteOrder.Uint32(s.mem[startHeaderChecksum:endHeaderChecksum])
+	if computed := s.headerChecksum(); stored != computed {
+		return fmt.Errorf("%w: header checksum %#08x, computed %#08x", ErrHeaderCorrupt, stored, computed)
+	}
+	return nil
+}
+
+func (s *segment) getSoftCap() uint32 {
+	return s.byteOrder.Uint32(s.mem[startSoftCap:endSoftCap])
+}
+
+func (s *segment) setSoftCap(val uint32) {
+	s.byteOrder.PutUint32(s.mem[startSoftCap:endSoftCap], val)
+}
+
+// getCap returns the number of messages at which the queue is full for producers: the soft cap, which is the max
+// length unless it's lowered with SetSoftCap. If the queue is in a group, it's also limited by the free space left in
+// the group (see WithGroup).
+func (s *segment) getCap() uint32 {
+	capLen := s.getSoftCap()
+	if maxLen := s.getMaxLen(); maxLen < capLen {
+		capLen = maxLen
+	}
+	if g := s.memberGroup(); g != nil {
+		if groupCap := uint64(s.getQueueLen()) + uint64(g.free()); groupCap < uint64(capLen) {
+			capLen = uint32(groupCap)
+		}
+	}
+	return capLen
+}
+
+// isClosed returns whether the queue is closed with CloseQueue. It's read atomically, so it may be checked without the
+// header lock.
+func (s *segment) isClosed() bool {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&s.mem[startClosed]))) != 0
+}
+
+func (s *segment) setClosed() {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&s.mem[startClosed])), 1)
+}
+
+// eventSeq returns the futex word that is incremented on every change of the queue while some process watches it for
+// its eventfds (see WithEventFD). It's accessed atomically, so it's in the native order.
+func (s *segment) eventSeq() *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.mem[startEventSeq]))
+}
+
+// eventWatchers returns the number of handles in all processes that watch eventSeq. It's accessed atomically, so it's
+// in the native order.
+func (s *segment) eventWatchers() *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.mem[startEventWatchers]))
+}
+
+func (s *segment) getHeaderLockSpins() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startHeaderLockSpins])))
+}
+
+func (s *segment) getMsgLockSpins() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startMsgLockSpins])))
+}
+
+// addEnqueued counts messages added at the tail of the queue, both in the stats and in the tail sequence.
+func (s *segment) addEnqueued(n uint64) {
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startEnqueued])), n)
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startTailSeq])), n)
+}
+
+func (s *segment) getEnqueued() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startEnqueued])))
+}
+
+// addDequeued counts messages dequeued from the head of the queue, both in the stats and in the head sequence.
+func (s *segment) addDequeued(n uint64) {
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startDequeued])), n)
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startHeadSeq])), n)
+}
+
+func (s *segment) getDequeued() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startDequeued])))
+}
+
+// addDropped counts messages dropped from the head of the queue, both in the stats and in the head sequence.
+func (s *segment) addDropped(n uint64) {
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startDropped])), n)
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startHeadSeq])), n)
+}
+
+func (s *segment) getDropped() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startDropped])))
+}
+
+// addRejected counts new messages discarded by a full queue. They're reported as dropped, but kept apart from the
+// dropped counter, which only counts the messages removed from the head, like the dequeued one.
+func (s *segment) addRejected(n uint64) {
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&s.mem[startRejected])), n)
+}
+
+func (s *segment) getRejected() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startRejected])))
+}
+
+// getTailSeq returns the number of messages ever added at the tail of the queue. Unlike the enqueued counter, it isn't
+// zeroed by resetStats.
+func (s *segment) getTailSeq() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startTailSeq])))
+}
+
+// getHeadSeq returns the number of messages ever removed from the head of the queue, dequeued or dropped. Unlike the
+// stats counters, it isn't zeroed by resetStats.
+func (s *segment) getHeadSeq() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startHeadSeq])))
+}
+
+// getStatsResetTime returns the time of the last stats reset in Unix nanoseconds.
+func (s *segment) getStatsResetTime() int64 {
+	return atomic.LoadInt64((*int64)(unsafe.Pointer(&s.mem[startStatsResetTime])))
+}
+
+// resetStats zeroes all the stats counters and stores the reset time in Unix nanoseconds.
+func (s *segment) resetStats(now int64) {
+	for _, start := range []int{
+		startHeaderLockSpins, startMsgLockSpins, startEnqueued, startDequeued, startDropped, startRejected,
+	} {
+		atomic.StoreUint64((*uint64)(unsafe.Pointer(&s.mem[start])), 0)
+	}
+	atomic.StoreInt64((*int64)(unsafe.Pointer(&s.mem[startStatsResetTime])), now)
+}
+
+// takeTicket returns the next ticket in the fair producers line, and records this process as its owner. It returns
+// false if maxPendingTickets producers are already in the line: the next ticket would share the abandoned bit and the
+// owner with a pending one.
+func (s *segment) takeTicket() (ticket uint32, ok bool) {
+	nextPtr := (*uint32)(unsafe.Pointer(&s.mem[startNextTicket]))
+	servingPtr := (*uint32)(unsafe.Pointer(&s.mem[startServingTicket]))
+	for {
+		next := atomic.LoadUint32(nextPtr)
+		// The serving ticket only grows, so a stale one only makes the line look longer.
+		if next-atomic.LoadUint32(servingPtr) >= maxPendingTickets {
+			return 0, false
+		}
+		if atomic.CompareAndSwapUint32(nextPtr, next, next+1) {
+			atomic.StoreUint32(s.ticketOwnerPtr(next), uint32(lockOwner))
+			return next, true
+		}
+	}
+}
+
+// ticketOwnerPtr returns the pointer to the PID of the owner of the ticket, which is 0 once the ticket is served or
+// abandoned, or before its owner is recorded.
+func (s *segment) ticketOwnerPtr(ticket uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.mem[startTicketOwners+4*int(ticket%maxPendingTickets)]))
+}
+
+// servingTicket returns the ticket of the producer whose turn it is, skipping the abandoned tickets.
+func (s *segment) servingTicket() uint32 {
+	servingPtr := (*uint32)(unsafe.Pointer(&s.mem[startServingTicket]))
+	abandonedPtr := (*uint64)(unsafe.Pointer(&s.mem[startAbandonedTickets]))
+	for {
+		serving := atomic.LoadUint32(servingPtr)
+		bit := uint64(1) << (serving % maxPendingTickets)
+		abandoned := atomic.LoadUint64(abandonedPtr)
+		if abandoned&bit == 0 {
+			return serving
+		}
+		// Whoever clears the bit passes the turn, and nobody else can pass it, since the owner has gone.
+		if atomic.CompareAndSwapUint64(abandonedPtr, abandoned, abandoned&^bit) {
+			atomic.CompareAndSwapUint32(servingPtr, serving, serving+1)
+		}
+	}
+}
+
+// serveNextTicket passes the turn to the next producer. Must be called only by the producer whose turn it is, with its
+// ticket.
+func (s *segment) serveNextTicket(ticket uint32) {
+	servingPtr := (*uint32)(unsafe.Pointer(&s.mem[startServingTicket]))
+	atomic.StoreUint32(s.ticketOwnerPtr(ticket), 0)
+	atomic.AddUint32(servingPtr, 1)
+}
+
+// abandonTicket marks the ticket as abandoned, so its turn is skipped.
+func (s *segment) abandonTicket(ticket uint32) {
+	atomic.StoreUint32(s.ticketOwnerPtr(ticket), 0)
+	abandonedPtr := (*uint64)(unsafe.Pointer(&s.mem[startAbandonedTickets]))
+	bit := uint64(1) << (ticket % maxPendingTickets)
+	for {
+		abandoned := atomic.LoadUint64(abandonedPtr)
+		if atomic.CompareAndSwapUint64(abandonedPtr, abandoned, abandoned|bit) {
+			return
+		}
+	}
+}
+
+// abandonDeadTickets abandons the pending tickets whose owners no longer exist, waiting for their turn or holding it,
+// and returns their number. The header lock must be held, so that RepairLocks calls don't race for the same ticket.
+func (s *segment) abandonDeadTickets() int {
+	next := atomic.LoadUint32((*uint32)(unsafe.Pointer(&s.mem[startNextTicket])))
+	serving := atomic.LoadUint32((*uint32)(unsafe.Pointer(&s.mem[startServingTicket])))
+	abandoned := 0
+	for ticket := serving; ticket != next && ticket-serving < maxPendingTickets; ticket++ {
+		owner := atomic.LoadUint32(s.ticketOwnerPtr(ticket))
+		if owner == 0 || processAlive(uint64(owner)) {
+			continue
+		}
+		if atomic.CompareAndSwapUint32(s.ticketOwnerPtr(ticket), owner, 0) {
+			s.abandonTicket(ticket)
+			abandoned++
+		}
+	}
+	return abandoned
+}
+
+// lockMsg locks the message. An error wrapping ErrSegmentCorrupt is returned if the slot doesn't fit into the segment
+// (see slotBounds), and then nothing is locked.
+func (s *segment) lockMsg(idx uint32) error {
+	return s.lockMsgCtx(context.Background(), idx)
+}
+
+// lockMsgCtx works like lockMsg, but gives up once the context is done and returns its error, so the blocking calls
+// don't hang on a message locked by a wedged process after they're cancelled.
+func (s *segment) lockMsgCtx(ctx context.Context, idx uint32) error {
+	startLock, _, err := s.slotBounds(idx)
+	if err != nil {
+		return err
+	}
 	lockUintPtr := (*uint64)(unsafe.Pointer(&s.mem[startLock]))
-	for i := 0; !atomic.CompareAndSwapUint64(lockUintPtr, 0, 1); i++ {
+	spinsPtr := (*uint64)(unsafe.Pointer(&s.mem[startMsgLockSpins]))
+	var start time.Time
+	for i := 0; !atomic.CompareAndSwapUint64(lockUintPtr, 0, lockOwner); i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// Go on.
+		}
+		start = s.startSlow(start)
+		atomic.AddUint64(spinsPtr, 1)
 		time.Sleep(time.Duration(i))
 	}
+	s.logSlow("lock message", start)
+	return nil
+}
+
+// lockMsgs locks several messages of the queue in the ascending order of their physical indexes, whatever the order of
+// idxs is. All multi-message operations must lock messages this way, so they never deadlock with each other, even when
+// they don't hold the header lock. The messages may be unlocked in any order. The errors are the same as in lockMsg,
+// and then none of the messages are left locked.
+func (s *segment) lockMsgs(idxs []uint32) error {
+	return s.lockMsgsCtx(context.Background(), idxs)
+}
+
+// lockMsgsCtx works like lockMsgs, but gives up once the context is done and returns its error. Then the messages
+// locked so far are unlocked.
+func (s *segment) lockMsgsCtx(ctx context.Context, idxs []uint32) error {
+	sorted := append([]uint32(nil), idxs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, idx := range sorted {
+		if err := s.lockMsgCtx(ctx, idx); err != nil {
+			for _, locked := range sorted[:i] {
+				s.unlockMsg(locked)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// msgLockOwner returns the PID of the process holding the lock of the message, or 0 if it isn't locked. A slot that
+// doesn't fit into the segment reads as unlocked, so the callers find out about it when they try to lock it.
+func (s *segment) msgLockOwner(idx uint32) uint64 {
+	startLock, _, err := s.slotBounds(idx)
+	if err != nil {
+		return 0
+	}
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.mem[startLock])))
+}
+
+// releaseMsgLock unlocks the message only if it's still locked by the given owner, and reports if it did.
+func (s *segment) releaseMsgLock(idx uint32, owner uint64) bool {
+	startLock := s.startMsgLock(idx)
+	return atomic.CompareAndSwapUint64((*uint64)(unsafe.Pointer(&s.mem[startLock])), owner, 0)
 }
 
 func (s *segment) unlockMsg(idx uint32) {
@@ -139,35 +827,167 @@ func (s *segment) unlockMsg(idx uint32) {
 }
 
 func (s *segment) getMsgData(idx uint32, to []byte) {
+	s.checkMsgSize(len(to))
+	copy(to, s.msgData(idx))
+}
+
+func (s *segment) setMsgData(idx uint32, data []byte) {
+	s.checkMsgSize(len(data))
+	copy(s.msgData(idx), data)
+}
+
+func (s *segment) msgData(idx uint32) []byte {
+	start, _ := s.startEndMsgData(idx)
+	return s.mem[start : start+s.getDataSize()]
+}
+
+// varCapacity returns the max length of a variable-length message: the message size without the length prefix.
+func (s *segment) varCapacity() int {
+	return int(s.getMsgSize()) - int(s.timestampSize()) - int(s.getMetaSize()) - varLenPrefixSize
+}
+
+// setVarMsgData writes the length prefix and the data of a variable-length message. The tail of the slot after the
+// data is zeroed only if zeroTail is true, otherwise it keeps the bytes of older messages.
+func (s *segment) setVarMsgData(idx uint32, data []byte, zeroTail bool) {
 	start, end := s.startEndMsgData(idx)
-	if len(to) != int(end-start) {
-		panic(fmt.Sprintf("message size must be %d, but got %d", end-start, len(to)))
+	if len(data) > int(end-start)-varLenPrefixSize {
+		panic(fmt.Sprintf("message size must be at most %d, but got %d", int(end-start)-varLenPrefixSize, len(data)))
 	}
-	for i := start; i < end; i++ {
-		to[i-start] = s.mem[i]
+	s.byteOrder.PutUint64(s.mem[start:start+varLenPrefixSize], uint64(len(data)))
+	start += varLenPrefixSize
+	copy(s.mem[start:end], data)
+	if zeroTail {
+		for i := start + uint32(len(data)); i < end; i++ {
+			s.mem[i] = 0
+		}
 	}
 }
 
-func (s *segment) setMsgData(idx uint32, data []byte) {
-	start, end := s.startEndMsgData(idx)
-	if len(data) != int(end-start) {
-		panic(fmt.Sprintf("message size must be %d, but got %d", end-start, len(data)))
+// getVarMsgData copies the data of a variable-length message and returns its length. If the length prefix doesn't
+// fit into the slot, nothing is copied and ErrCorruptLength is returned. If the slot itself doesn't fit into the
+// segment, ErrHeaderCorrupt is returned.
+func (s *segment) getVarMsgData(idx uint32, to []byte) (int, error) {
+	data, err := s.varMsgData(idx)
+	if err != nil {
+		return 0, err
 	}
+	return copy(to, data), nil
+}
+
+// varMsgData returns the data of a variable-length message, which aliases the shared memory. The errors are the same
+// as in getVarMsgData.
+func (s *segment) varMsgData(idx uint32) ([]byte, error) {
+	start, end, err := s.slotBounds(idx)
+	if err != nil {
+		return nil, err
+	}
+	start += msgLockSize + s.timestampSize() + s.getMetaSize()
+	size := s.byteOrder.Uint64(s.mem[start : start+varLenPrefixSize])
+	start += varLenPrefixSize
+	if size > uint64(end-start) {
+		return nil, ErrCorruptLength
+	}
+	return s.mem[start : start+uint32(size)], nil
+}
+
+func (s *segment) checkMsgSize(size int) {
+	if dataSize := s.getDataSize(); size != int(dataSize) {
+		if size*8 == int(dataSize) {
+			// The size of a queue made by Create is in 64-bit words, and it's easy to size a buffer with it.
+			panic(fmt.Sprintf(
+				"message size must be %d bytes, but got %d: is it in 64-bit words? Use NewMessageBuffer", dataSize, size,
+			))
+		}
+		panic(fmt.Sprintf("message size must be %d, but got %d", dataSize, size))
+	}
+}
+
+func (s *segment) checkMetaSize(size int) {
+	if metaSize := s.getMetaSize(); size != int(metaSize) {
+		panic(fmt.Sprintf("metadata size must be %d, but got %d", metaSize, size))
+	}
+}
+
+// zeroMsgData zeroes the metadata and the data of the slot.
+func (s *segment) zeroMsgData(idx uint32) {
+	start, _ := s.startEndMsgMeta(idx)
+	_, end := s.startEndMsgData(idx)
 	for i := start; i < end; i++ {
-		s.mem[i] = data[i-start]
+		s.mem[i] = 0
+	}
+}
+
+// msgMeta returns the metadata region of the slot, which is empty if the queue has no metadata.
+func (s *segment) msgMeta(idx uint32) []byte {
+	start, end := s.startEndMsgMeta(idx)
+	return s.mem[start:end]
+}
+
+// zeroMsgMeta zeroes the metadata of the slot. The enqueue calls that don't take metadata call it, so a new message
+// doesn't inherit the metadata of the previous message in the slot.
+func (s *segment) zeroMsgMeta(idx uint32) {
+	if s.getMetaSize() == 0 {
+		return
+	}
+	meta := s.msgMeta(idx)
+	for i := range meta {
+		meta[i] = 0
 	}
 }
 
+// slotBounds returns the offsets of the lock and the end of the slot with the given index. The geometry is read from
+// the shared memory, so if it's corrupted, the slot may not fit into the segment: then an error wrapping both
+// ErrSegmentCorrupt and ErrHeaderCorrupt is returned rather than an offset past the end of the segment.
+func (s *segment) slotBounds(idx uint32) (uint32, uint32, error) {
+	msgTotalSize := uint64(s.getMsgSize()) + msgLockSize
+	start := uint64(s.msgsOffset) + uint64(idx)*msgTotalSize
+	end := start + msgTotalSize
+	payloadSize := uint64(s.timestampSize()) + uint64(s.getMetaSize()) + uint64(s.getDataSize())
+	if end > uint64(len(s.mem)) || payloadSize > msgTotalSize-msgLockSize {
+		return 0, 0, fmt.Errorf("%w: %w: slot %d doesn't fit into the segment", ErrSegmentCorrupt, ErrHeaderCorrupt, idx)
+	}
+	return uint32(start), uint32(end), nil
+}
+
+// checkSlots checks that all the slots fit into the segment, so none of the slot offsets computed from the geometry
+// is out of range.
+func (s *segment) checkSlots() error {
+	maxLen := s.getMaxLen()
+	if maxLen == 0 {
+		return nil
+	}
+	_, _, err := s.slotBounds(maxLen - 1)
+	return err
+}
+
+// startMsgLock returns the offset of the lock of the slot. It panics with the error of slotBounds if the slot doesn't
+// fit into the segment, so the operations check the slot first by locking it with lockMsg, which returns the error
+// instead. Once the slot is locked, its offsets are known to be in range.
 func (s *segment) startMsgLock(idx uint32) uint32 {
-	msgSize := s.getMsgSize()
-	msgTotalSize := msgSize + msgLockSize
-	start := startQueue + (idx * msgTotalSize)
+	start, _, err := s.slotBounds(idx)
+	if err != nil {
+		panic(err)
+	}
 	return start
 }
 
+// startEndMsgMeta returns the offsets of the metadata of the slot, right after the lock and the enqueue timestamp (see
+// WithTimestamps), panicking like startMsgLock.
+func (s *segment) startEndMsgMeta(idx uint32) (uint32, uint32) {
+	start, _, err := s.slotBounds(idx)
+	if err != nil {
+		panic(err)
+	}
+	start += msgLockSize + s.timestampSize()
+	return start, start + s.getMetaSize()
+}
+
+// startEndMsgData returns the offsets of the data of the slot, right after the metadata, up to the end of the slot
+// with padding. It panics like startMsgLock.
 func (s *segment) startEndMsgData(idx uint32) (uint32, uint32) {
-	msgSize := s.getMsgSize()
-	msgTotalSize := msgSize + msgLockSize
-	start := startQueue + (idx * msgTotalSize)
-	return start + msgLockSize, start + msgTotalSize
+	start, end, err := s.slotBounds(idx)
+	if err != nil {
+		panic(err)
+	}
+	return start + msgLockSize + s.timestampSize() + s.getMetaSize(), end
 }
@@ -0,0 +1,53 @@
+package shqueue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// SelfTest checks that the system supports shqueue: it creates a tiny private queue, enqueues and dequeues a message
+// through it, checks the round-trip and deletes the queue. It's meant as a one-call preflight check at startup, e.g.
+// in containers that restrict IPC. The error names the failed step and, for common causes, the likely reason, and
+// wraps the underlying error, so errors.Is works.
+func SelfTest() error {
+	queue, err := CreatePrivate(1, 1)
+	if err != nil {
+		return selfTestError("create queue", err)
+	}
+
+	msg := []byte("shqueue!")
+	got := make([]byte, len(msg))
+	if !queue.EnqueueTry(msg) {
+		err = selfTestError("enqueue", fmt.Errorf("queue is full"))
+	} else if !queue.DequeueTry(got) {
+		err = selfTestError("dequeue", fmt.Errorf("queue is empty"))
+	} else if !bytes.Equal(got, msg) {
+		err = selfTestError("round-trip", fmt.Errorf("dequeued %q, enqueued %q", got, msg))
+	}
+
+	if closeErr := queue.Close(); closeErr != nil && err == nil {
+		err = selfTestError("close queue", closeErr)
+	}
+	if deleteErr := queue.Delete(); deleteErr != nil && err == nil {
+		err = selfTestError("delete queue", deleteErr)
+	}
+	return err
+}
+
+// selfTestError describes the failed step of SelfTest.
+func selfTestError(step string, err error) error {
+	switch {
+	case errors.Is(err, unix.ENOSYS):
+		return fmt.Errorf("shqueue self-test: %s: System V IPC is disabled in this kernel: %w", step, err)
+	case errors.Is(err, ErrNoAccess), errors.Is(err, unix.EPERM):
+		return fmt.Errorf("shqueue self-test: %s: IPC isn't permitted in this namespace or sandbox: %w", step, err)
+	case errors.Is(err, ErrInvalidSize), errors.Is(err, ErrNoIDs), errors.Is(err, ErrNoMem):
+		return fmt.Errorf("shqueue self-test: %s: System V shared memory limits are too low (see kernel.shmmax, "+
+			"kernel.shmall and kernel.shmmni): %w", step, err)
+	default:
+		return fmt.Errorf("shqueue self-test: %s: %w", step, err)
+	}
+}
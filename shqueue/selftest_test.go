@@ -0,0 +1,24 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSelfTest(t *testing.T) {
+	t.Run("pass", func(t *testing.T) {
+		assert.NoError(t, SelfTest())
+	})
+
+	t.Run("describe failures", func(t *testing.T) {
+		err := selfTestError("create queue", wrapErrShmGet(unix.ENOSYS, true, unix.IPC_PRIVATE))
+		assert.ErrorIs(t, err, unix.ENOSYS)
+		assert.Contains(t, err.Error(), "System V IPC is disabled")
+
+		err = selfTestError("create queue", wrapErrShmGet(unix.ENOSPC, true, unix.IPC_PRIVATE))
+		assert.ErrorIs(t, err, ErrNoIDs)
+		assert.Contains(t, err.Error(), "limits are too low")
+	})
+}
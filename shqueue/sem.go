@@ -0,0 +1,39 @@
+package shqueue
+
+import (
+	"time"
+)
+
+const (
+	// semFilled and semEmpty are the numbers of the semaphores in the companion semaphore set of a queue: the number of
+	// messages in the queue, and the number of free slots.
+	semFilled = 0
+	semEmpty  = 1
+	semCount  = 2
+
+	// semMaxVal is the max value of a semaphore (SEMVMX). The semaphores are only used to sleep until they're non-zero,
+	// so greater values are clamped to it.
+	semMaxVal = 32767
+
+	// semWaitTimeout is how long a blocking call sleeps on a semaphore at once. It limits how late a cancellation of the
+	// context is noticed.
+	semWaitTimeout = 10 * time.Millisecond
+)
+
+// semValues returns the values of the semaphores for a queue of the given length and capacity.
+func semValues(curLen, capLen uint32) [semCount]uint16 {
+	clamp := func(val uint32) uint16 {
+		if val > semMaxVal {
+			return semMaxVal
+		}
+		return uint16(val)
+	}
+	free := uint32(0)
+	if curLen < capLen {
+		free = capLen - curLen
+	}
+	return [semCount]uint16{
+		semFilled: clamp(curLen),
+		semEmpty:  clamp(free),
+	}
+}
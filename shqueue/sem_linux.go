@@ -0,0 +1,73 @@
+//go:build linux && !386 && !mips && !mipsle && !ppc
+
+package shqueue
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// semGetAll and semSetAll are the GETALL and SETALL commands of semctl, missing in x/sys/unix.
+	semGetAll = 13
+	semSetAll = 17
+)
+
+// sembuf is struct sembuf of semop.
+type sembuf struct {
+	num uint16
+	op  int16
+	flg int16
+}
+
+func createSem(access int) (int, error) {
+	id, _, errno := unix.Syscall(unix.SYS_SEMGET, unix.IPC_PRIVATE, semCount, uintptr(access|unix.IPC_CREAT))
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(id), nil
+}
+
+func removeSem(id int) error {
+	_, _, errno := unix.Syscall(unix.SYS_SEMCTL, uintptr(id), 0, unix.IPC_RMID)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setSem(id int, vals [semCount]uint16) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SEMCTL, uintptr(id), 0, semSetAll, uintptr(unsafe.Pointer(&vals[0])), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getSem(id int) (vals [semCount]uint16, err error) {
+	_, _, errno := unix.Syscall6(unix.SYS_SEMCTL, uintptr(id), 0, semGetAll, uintptr(unsafe.Pointer(&vals[0])), 0, 0)
+	if errno != 0 {
+		return vals, errno
+	}
+	return vals, nil
+}
+
+// waitSem sleeps until the semaphore num of the set is non-zero, or until the timeout expires. The value isn't
+// changed: it's decremented and incremented back in one atomic operation. The timeout isn't an error.
+func waitSem(id, num int, timeout time.Duration) error {
+	ops := [2]sembuf{
+		{num: uint16(num), op: -1},
+		{num: uint16(num), op: 1},
+	}
+	ts := unix.NsecToTimespec(int64(timeout))
+	_, _, errno := unix.Syscall6(unix.SYS_SEMTIMEDOP, uintptr(id), uintptr(unsafe.Pointer(&ops[0])), uintptr(len(ops)),
+		uintptr(unsafe.Pointer(&ts)), 0, 0)
+	switch errno {
+	case 0, unix.EAGAIN, unix.EINTR:
+		return nil
+	default:
+		return errno
+	}
+}
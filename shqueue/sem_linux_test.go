@@ -0,0 +1,176 @@
+//go:build linux && !386 && !mips && !mipsle && !ppc
+
+package shqueue
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSemaphore(t *testing.T) {
+	t.Run("follows queue length", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithSemaphore())
+		semID := queue.seg.getSemID()
+		require.GreaterOrEqual(t, semID, 0)
+
+		vals, err := getSem(semID)
+		require.NoError(t, err)
+		assert.Equal(t, [semCount]uint16{semFilled: 0, semEmpty: 5}, vals)
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+		vals, err = getSem(semID)
+		require.NoError(t, err)
+		assert.Equal(t, [semCount]uint16{semFilled: 2, semEmpty: 3}, vals)
+
+		toMsg := make([]byte, len(testMsgA))
+		require.True(t, queue.DequeueTry(toMsg))
+		vals, err = getSem(semID)
+		require.NoError(t, err)
+		assert.Equal(t, [semCount]uint16{semFilled: 1, semEmpty: 4}, vals)
+	})
+
+	t.Run("follows soft cap", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithSemaphore())
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+
+		require.NoError(t, queue.SetSoftCap(3))
+		vals, err := getSem(queue.seg.getSemID())
+		require.NoError(t, err)
+		assert.Equal(t, [semCount]uint16{semFilled: 2, semEmpty: 1}, vals)
+
+		require.NoError(t, queue.SetSoftCap(1))
+		vals, err = getSem(queue.seg.getSemID())
+		require.NoError(t, err)
+		assert.Equal(t, [semCount]uint16{semFilled: 2, semEmpty: 0}, vals)
+	})
+
+	t.Run("no semaphore by default", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		assert.Equal(t, -1, queue.seg.getSemID())
+	})
+
+	t.Run("blocked dequeue wakes up on enqueue", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithSemaphore())
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			queue.EnqueueShift(testMsgC)
+		}()
+
+		toMsg := make([]byte, len(testMsgC))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, queue.DequeueBlock(ctx, toMsg))
+		assert.Equal(t, testMsgC, toMsg)
+	})
+
+	t.Run("blocked enqueue wakes up on dequeue", func(t *testing.T) {
+		queue := testQueue(t, 0, 5, WithSemaphore())
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			queue.DequeueTry(make([]byte, len(testMsgA)))
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, queue.EnqueueBlock(ctx, testMsgC))
+	})
+
+	t.Run("blocked dequeue honors context", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithSemaphore())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		defer cancel()
+		err := queue.DequeueBlock(ctx, make([]byte, len(testMsgA)))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("delete removes semaphore", func(t *testing.T) {
+		queue, err := CreatePrivate(2, 5, WithSemaphore())
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+		}()
+		semID := queue.seg.getSemID()
+
+		errs := make(chan error)
+		go func() {
+			errs <- queue.DequeueBlock(context.Background(), make([]byte, len(testMsgA)))
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		require.NoError(t, queue.Delete())
+		_, err = getSem(semID)
+		assert.ErrorIs(t, err, unix.EINVAL)
+		assert.ErrorIs(t, <-errs, ErrSegmentDeleted)
+	})
+
+	t.Run("delete leaves no IPC objects", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5, WithSemaphore())
+		require.NoError(t, err)
+		shmID, semID := queue.ExportID(), queue.seg.getSemID()
+		assert.Contains(t, sysvipcIDs(t, "/proc/sysvipc/shm", "shmid"), shmID)
+		assert.Contains(t, sysvipcIDs(t, "/proc/sysvipc/sem", "semid"), semID)
+
+		require.NoError(t, queue.Close())
+		require.NoError(t, queue.Delete())
+		assert.NotContains(t, sysvipcIDs(t, "/proc/sysvipc/shm", "shmid"), shmID)
+		assert.NotContains(t, sysvipcIDs(t, "/proc/sysvipc/sem", "semid"), semID)
+	})
+
+	t.Run("create removes semaphore of reset queue", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		queue, err := Create(key, 2, 5, WithSemaphore())
+		require.NoError(t, err)
+		oldSemID := queue.seg.getSemID()
+		require.NoError(t, queue.Close())
+
+		queue, err = Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		assert.Equal(t, -1, queue.seg.getSemID())
+		_, err = getSem(oldSemID)
+		assert.ErrorIs(t, err, unix.EINVAL)
+	})
+}
+
+// sysvipcIDs returns the IDs of the IPC objects listed in a /proc/sysvipc file, like ipcs does.
+func sysvipcIDs(t *testing.T, path, idColumn string) []int {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	col := -1
+	for i, name := range strings.Fields(lines[0]) {
+		if name == idColumn {
+			col = i
+		}
+	}
+	require.GreaterOrEqual(t, col, 0)
+
+	var ids []int
+	for _, line := range lines[1:] {
+		id, err := strconv.Atoi(strings.Fields(line)[col])
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,30 @@
+//go:build !linux || 386 || mips || mipsle || ppc
+
+package shqueue
+
+import (
+	"time"
+)
+
+// Semaphore sets are only supported on Linux on the architectures that have the semtimedop syscall. Elsewhere they
+// can't be created, so no queue has one.
+
+func createSem(access int) (int, error) {
+	return -1, ErrNotSupported
+}
+
+func removeSem(id int) error {
+	return ErrNotSupported
+}
+
+func setSem(id int, vals [semCount]uint16) error {
+	return ErrNotSupported
+}
+
+func getSem(id int) (vals [semCount]uint16, err error) {
+	return vals, ErrNotSupported
+}
+
+func waitSem(id, num int, timeout time.Duration) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,33 @@
+// Package shqueuetest provides utilities for testing code that uses shqueue.
+package shqueuetest
+
+import (
+	"testing"
+
+	"github.com/rdjjke/shqueue-go/shqueue"
+)
+
+// MustCreateTemp creates a queue for the test, and closes and deletes it when the test and its subtests complete.
+// msgSize and maxLen are the same as in shqueue.Create. The queue is created with shqueue.CreatePrivate, so it has no
+// key: parallel tests never collide with each other or with other processes, and no key needs to be guessed. The
+// code under test can reach the queue in this process, or in another one by the segment ID from ExportID (see
+// shqueue.AttachByID).
+//
+// If the queue can't be created, the test is stopped with t.Fatal. Errors closing or deleting the queue are reported
+// with t.Error.
+func MustCreateTemp(t testing.TB, msgSize, maxLen uint32, opts ...shqueue.Option) *shqueue.Queue {
+	t.Helper()
+	queue, err := shqueue.CreatePrivate(msgSize, maxLen, opts...)
+	if err != nil {
+		t.Fatalf("create temporary queue: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := queue.Close(); err != nil {
+			t.Errorf("close temporary queue: %v", err)
+		}
+		if err := queue.Delete(); err != nil {
+			t.Errorf("delete temporary queue: %v", err)
+		}
+	})
+	return queue
+}
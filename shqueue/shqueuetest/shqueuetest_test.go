@@ -0,0 +1,50 @@
+package shqueuetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rdjjke/shqueue-go/shqueue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMustCreateTemp(t *testing.T) {
+	t.Run("isolated in parallel", func(t *testing.T) {
+		ids := make(chan int, 8)
+		t.Run("group", func(t *testing.T) {
+			for i := 0; i < cap(ids); i++ {
+				t.Run(fmt.Sprint(i), func(t *testing.T) {
+					t.Parallel()
+					queue := MustCreateTemp(t, 2, 5)
+					ids <- queue.ExportID()
+
+					msg := []byte(t.Name())[:16]
+					require.True(t, queue.EnqueueTry(msg))
+					got := make([]byte, 16)
+					require.True(t, queue.DequeueTry(got))
+					assert.Equal(t, msg, got)
+				})
+			}
+		})
+		close(ids)
+
+		seen := map[int]bool{}
+		for id := range ids {
+			assert.False(t, seen[id], "segment %d is shared", id)
+			seen[id] = true
+		}
+	})
+
+	t.Run("deleted on cleanup", func(t *testing.T) {
+		var id int
+		t.Run("create", func(t *testing.T) {
+			queue := MustCreateTemp(t, 1, 4, shqueue.WithSchemaID(7))
+			assert.Equal(t, uint32(7), queue.SchemaID())
+			id = queue.ExportID()
+		})
+
+		_, err := shqueue.AttachByID(id)
+		assert.Error(t, err)
+	})
+}
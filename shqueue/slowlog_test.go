@@ -0,0 +1,96 @@
+package shqueue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowLogRecorder collects the calls of a slow log.
+type slowLogRecorder struct {
+	mu     sync.Mutex
+	ops    []string
+	waited []time.Duration
+}
+
+func (r *slowLogRecorder) log(op string, waited time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, op)
+	r.waited = append(r.waited, waited)
+}
+
+func (r *slowLogRecorder) calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ops...)
+}
+
+func TestWithSlowLog(t *testing.T) {
+	const threshold = 10 * time.Millisecond
+	const delay = 30 * time.Millisecond
+
+	t.Run("fast path", func(t *testing.T) {
+		var rec slowLogRecorder
+		queue := testQueue(t, 0, 0, WithSlowLog(threshold, rec.log))
+
+		require.NoError(t, queue.EnqueueBlock(context.Background(), testMsgA))
+		require.NoError(t, queue.DequeueBlock(context.Background(), make([]byte, 16)))
+		assert.Empty(t, rec.calls())
+	})
+
+	t.Run("slow dequeue", func(t *testing.T) {
+		var rec slowLogRecorder
+		queue := testQueue(t, 0, 0, WithSlowLog(threshold, rec.log))
+
+		go func() {
+			time.Sleep(delay)
+			queue.EnqueueTry(testMsgA)
+		}()
+		require.NoError(t, queue.DequeueBlock(context.Background(), make([]byte, 16)))
+		assert.Equal(t, []string{"dequeue"}, rec.calls())
+		assert.GreaterOrEqual(t, rec.waited[0], threshold)
+	})
+
+	t.Run("slow enqueue", func(t *testing.T) {
+		var rec slowLogRecorder
+		queue := testQueue(t, 0, 5, WithSlowLog(threshold, rec.log))
+
+		go func() {
+			time.Sleep(delay)
+			queue.DequeueTry(make([]byte, 16))
+		}()
+		require.NoError(t, queue.EnqueueBlock(context.Background(), testMsgA))
+		assert.Equal(t, []string{"enqueue"}, rec.calls())
+	})
+
+	t.Run("slow header lock", func(t *testing.T) {
+		var rec slowLogRecorder
+		queue := testQueue(t, 0, 0, WithSlowLog(threshold, rec.log))
+
+		queue.seg.lockHeader()
+		go func() {
+			time.Sleep(delay)
+			queue.seg.unlockHeader()
+		}()
+		queue.seg.lockHeader()
+		queue.seg.unlockHeader()
+		assert.Equal(t, []string{"lock header"}, rec.calls())
+	})
+
+	t.Run("below threshold", func(t *testing.T) {
+		var rec slowLogRecorder
+		queue := testQueue(t, 0, 0, WithSlowLog(time.Hour, rec.log))
+
+		go func() {
+			time.Sleep(delay)
+			queue.EnqueueTry(testMsgA)
+		}()
+		require.NoError(t, queue.DequeueBlock(context.Background(), make([]byte, 16)))
+		assert.Empty(t, rec.calls())
+	})
+}
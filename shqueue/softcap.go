@@ -0,0 +1,43 @@
+package shqueue
+
+import (
+	"fmt"
+)
+
+// SetSoftCap lowers the capacity of the queue to n messages without reallocating it, e.g. to throttle producers live.
+// The enqueue calls treat the queue as full once it has n messages, while the slots above n stay unused. The soft cap
+// is stored in the shared memory, so it applies to all processes. Messages that are already in the queue are kept, even
+// if there are more than n of them. n must not exceed HardCap, otherwise an error wrapping ErrInvalidCap is returned;
+// setting it to HardCap removes the soft cap.
+func (q *Queue) SetSoftCap(n uint32) error {
+	if maxLen := q.seg.getMaxLen(); n > maxLen {
+		return newQueueError("set soft cap", q.key, q.id, fmt.Errorf("%w: %d, max length %d", ErrInvalidCap, n, maxLen))
+	}
+
+	if err := q.seg.lockHeader(); err != nil {
+		return newQueueError("set soft cap", q.key, q.id, err)
+	}
+	q.seg.setSoftCap(n)
+	q.seg.syncSem()
+	q.seg.syncEvents()
+	q.seg.notifyEvents()
+	q.seg.unlockHeader()
+	return nil
+}
+
+// Cap returns the number of messages at which the enqueue calls treat the queue as full: the soft cap set with
+// SetSoftCap, or HardCap if there is none. If the queue is in a group (see WithGroup), it's lowered to the current
+// length plus the free space left in the group.
+func (q *Queue) Cap() uint32 {
+	if q.seg.lockHeader() != nil {
+		return 0
+	}
+	capLen := q.seg.getCap()
+	q.seg.unlockHeader()
+	return capLen
+}
+
+// HardCap returns the max length of the queue, i.e. the number of message slots allocated on creation.
+func (q *Queue) HardCap() uint32 {
+	return q.seg.getMaxLen()
+}
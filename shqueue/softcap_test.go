@@ -0,0 +1,73 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSoftCap(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		assert.Equal(t, uint32(5), queue.Cap())
+		assert.Equal(t, uint32(5), queue.HardCap())
+	})
+
+	t.Run("enqueue up to soft cap", func(t *testing.T) {
+		queue := testQueue(t, 3, 0)
+		require.NoError(t, queue.SetSoftCap(2))
+		assert.Equal(t, uint32(2), queue.Cap())
+		assert.Equal(t, uint32(5), queue.HardCap())
+
+		assert.True(t, queue.EnqueueTry(testMsgA))
+		assert.True(t, queue.EnqueueTry(testMsgB))
+		assert.False(t, queue.EnqueueTry(testMsgC))
+		assert.False(t, queue.EnqueueAllTry([][]byte{testMsgC}))
+		assert.False(t, queue.EnqueueInPlaceTry(func(dst []byte) {}))
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+
+		require.NoError(t, queue.SetSoftCap(5))
+		assert.True(t, queue.EnqueueTry(testMsgC))
+
+		toMsg := make([]byte, 16)
+		for _, msg := range [][]byte{testMsgA, testMsgB, testMsgC} {
+			require.True(t, queue.DequeueTry(toMsg))
+			assert.Equal(t, msg, toMsg)
+		}
+	})
+
+	t.Run("shift drops at soft cap", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.NoError(t, queue.SetSoftCap(2))
+
+		queue.EnqueueShift(testMsgA)
+		queue.EnqueueShift(testMsgB)
+		queue.EnqueueShift(testMsgC)
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+		assert.Equal(t, uint64(1), queue.Stats().Dropped)
+
+		toMsg := make([]byte, 16)
+		require.True(t, queue.DequeueTry(toMsg))
+		assert.Equal(t, testMsgB, toMsg)
+	})
+
+	t.Run("lower than length", func(t *testing.T) {
+		queue := testQueue(t, 0, 4)
+		require.NoError(t, queue.SetSoftCap(1))
+
+		assert.Equal(t, uint32(4), queue.seg.getQueueLen())
+		assert.False(t, queue.EnqueueTry(testMsgA))
+		toMsg := make([]byte, 16)
+		assert.True(t, queue.DequeueTry(toMsg))
+		assert.False(t, queue.EnqueueTry(testMsgA))
+	})
+
+	t.Run("greater than max length", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		err := queue.SetSoftCap(6)
+		assert.ErrorIs(t, err, ErrInvalidCap)
+		assert.Equal(t, uint32(5), queue.Cap())
+	})
+
+}
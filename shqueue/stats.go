@@ -0,0 +1,111 @@
+package shqueue
+
+import (
+	"os"
+	"time"
+)
+
+// Stats are the statistics of a queue. They are kept in the shared memory, so they cover all processes using the
+// queue. The counters are cumulative since the creation of the queue or the last ResetStats.
+type Stats struct {
+	// Enqueued is the number of enqueued messages.
+	Enqueued uint64
+	// Dequeued is the number of dequeued messages.
+	Dequeued uint64
+	// Dropped is the number of old messages overwritten by EnqueueShift on a full queue, new messages discarded by it,
+	// and slots freed by Reclaim.
+	Dropped uint64
+	// HeaderLockSpins is the number of failed attempts to take the header lock. A fast growth means high contention
+	// between producers and consumers, or a process that holds the lock for too long.
+	HeaderLockSpins uint64
+	// MsgLockSpins is the number of failed attempts to take message locks. A fast growth means that messages are
+	// accessed right while they are written or read, or a process that holds a message lock for too long.
+	MsgLockSpins uint64
+	// EnqueuedChecksum and DequeuedChecksum are the running checksums of the enqueued and dequeued messages, if the
+	// queue is created with WithRunningChecksum, or 0. Unlike the counters, they aren't zeroed by ResetStats, since the
+	// messages in the queue at that moment would keep them apart forever.
+	EnqueuedChecksum uint64
+	DequeuedChecksum uint64
+	// Since is the time of the queue creation or the last ResetStats.
+	Since time.Time
+}
+
+// Stats returns the current statistics of the queue.
+func (q *Queue) Stats() Stats {
+	return q.seg.stats()
+}
+
+func (s *segment) stats() Stats {
+	return Stats{
+		Enqueued:         s.getEnqueued(),
+		Dequeued:         s.getDequeued(),
+		Dropped:          s.getDropped() + s.getRejected(),
+		HeaderLockSpins:  s.getHeaderLockSpins(),
+		MsgLockSpins:     s.getMsgLockSpins(),
+		EnqueuedChecksum: s.getEnqueuedChecksum(),
+		DequeuedChecksum: s.getDequeuedChecksum(),
+		Since:            time.Unix(0, s.getStatsResetTime()),
+	}
+}
+
+// ResetStats zeroes all the stats counters of the queue for all processes, and starts a new measurement interval.
+// It's safe to call while producers and consumers are active. The running checksums (see WithRunningChecksum) are
+// kept.
+func (q *Queue) ResetStats() {
+	if q.seg.lockHeader() != nil {
+		return
+	}
+	q.seg.resetStats(time.Now().UnixNano())
+	q.seg.unlockHeader()
+}
+
+// Rate returns the average number of enqueued and dequeued messages per second since the queue creation or the last
+// ResetStats. The interval starts at the time stored in the shared memory, so all processes get consistent rates.
+func (q *Queue) Rate() (enqPerSec, deqPerSec float64) {
+	if q.seg.lockHeader() != nil {
+		return 0, 0
+	}
+	enqueued := q.seg.getEnqueued()
+	dequeued := q.seg.getDequeued()
+	since := q.seg.getStatsResetTime()
+	q.seg.unlockHeader()
+
+	elapsed := time.Duration(time.Now().UnixNano() - since).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(enqueued) / elapsed, float64(dequeued) / elapsed
+}
+
+// BytesUsed returns the number of bytes of the shared memory occupied by the messages in the queue right now: the queue
+// length times the size of a slot, which includes the message lock and the metadata (see WithMetadataSize). Reserved
+// messages count too (see Reserve). Compared to BytesReserved, it tells the logical usage from the physical footprint,
+// e.g. for a supervisor that budgets memory across many queues and decides which of them to resize.
+func (q *Queue) BytesUsed() int {
+	if q.seg.lockHeader() != nil {
+		return 0
+	}
+	curLen := q.seg.getQueueLen()
+	q.seg.unlockHeader()
+	return int(uint64(curLen) * (uint64(q.seg.getMsgSize()) + msgLockSize))
+}
+
+// BytesReserved returns the number of bytes of the shared memory allocated for the queue: the size of the whole queue,
+// with the header and all the slots, rounded up to a multiple of the page size, like the kernel does. A segment reused
+// by Create may be even bigger, but the extra space is never touched, so it isn't counted.
+func (q *Queue) BytesReserved() int {
+	pageSize := os.Getpagesize()
+	return (totalShmSize(q.seg.getMsgSize(), q.seg.getMaxLen()) + pageSize - 1) / pageSize * pageSize
+}
+
+// Utilization returns the fraction of the slots of the queue that hold messages right now, from 0 to 1: the queue
+// length divided by HardCap. Unlike the depth relative to Cap, it measures the usage of the allocated memory, so a
+// queue throttled with SetSoftCap may stay underutilized.
+func (q *Queue) Utilization() float64 {
+	if q.seg.lockHeader() != nil {
+		return 0
+	}
+	curLen := q.seg.getQueueLen()
+	q.seg.unlockHeader()
+	return float64(curLen) / float64(q.seg.getMaxLen())
+}
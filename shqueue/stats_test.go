@@ -0,0 +1,135 @@
+package shqueue
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue_Stats(t *testing.T) {
+	t.Run("no spins without contention", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		queue.EnqueueTry(testMsgA)
+		queue.DequeueTry(make([]byte, 8*2))
+
+		stats := queue.Stats()
+		assert.Zero(t, stats.HeaderLockSpins)
+		assert.Zero(t, stats.MsgLockSpins)
+	})
+
+	t.Run("count messages", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		before := time.Now()
+		for i := 0; i < 7; i++ {
+			queue.EnqueueShift(testMsgA)
+		}
+		got := make([]byte, 8*2)
+		for i := 0; i < 3; i++ {
+			queue.DequeueTry(got)
+		}
+		queue.EnqueueTry(testMsgA)
+
+		stats := queue.Stats()
+		assert.Equal(t, uint64(8), stats.Enqueued)
+		assert.Equal(t, uint64(3), stats.Dequeued)
+		assert.Equal(t, uint64(2), stats.Dropped)
+		assert.False(t, stats.Since.After(before))
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		queue.EnqueueTry(testMsgA)
+		queue.DequeueTry(make([]byte, 8*2))
+
+		before := time.Now()
+		queue.ResetStats()
+
+		stats := queue.Stats()
+		assert.Zero(t, stats.Enqueued)
+		assert.Zero(t, stats.Dequeued)
+		assert.False(t, stats.Since.Before(before))
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		queue.ResetStats()
+		for i := 0; i < 4; i++ {
+			queue.EnqueueTry(testMsgA)
+		}
+		queue.DequeueTry(make([]byte, 8*2))
+		time.Sleep(10 * time.Millisecond)
+
+		enqPerSec, deqPerSec := queue.Rate()
+		assert.Greater(t, enqPerSec, float64(0))
+		assert.Greater(t, deqPerSec, float64(0))
+		assert.InDelta(t, 4, enqPerSec/deqPerSec, 0.001)
+		assert.Less(t, enqPerSec, float64(400))
+	})
+
+	t.Run("count header lock spins", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		queue.seg.lockHeader()
+		done := make(chan bool)
+		go func() {
+			queue.EnqueueTry(testMsgA)
+			done <- true
+		}()
+		time.Sleep(10 * time.Millisecond)
+		queue.seg.unlockHeader()
+		<-done
+
+		stats := queue.Stats()
+		assert.NotZero(t, stats.HeaderLockSpins)
+		assert.Zero(t, stats.MsgLockSpins)
+	})
+
+	t.Run("count message lock spins", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		queue.seg.lockMsg(0)
+		done := make(chan bool)
+		go func() {
+			queue.EnqueueTry(testMsgA)
+			done <- true
+		}()
+		time.Sleep(10 * time.Millisecond)
+		queue.seg.unlockMsg(0)
+		<-done
+
+		stats := queue.Stats()
+		assert.NotZero(t, stats.MsgLockSpins)
+	})
+
+	t.Run("bytes and utilization", func(t *testing.T) {
+		queue := testQueue(t, 3, 0)
+		assert.Zero(t, queue.BytesUsed())
+		assert.Zero(t, queue.Utilization())
+
+		pageSize := os.Getpagesize()
+		reserved := queue.BytesReserved()
+		assert.GreaterOrEqual(t, reserved, totalShmSize(16, 5))
+		assert.Less(t, reserved-pageSize, totalShmSize(16, 5))
+		assert.Zero(t, reserved%pageSize)
+
+		require.True(t, queue.EnqueueAllTry([][]byte{testMsgA, testMsgB}))
+		assert.Equal(t, 2*(16+msgLockSize), queue.BytesUsed())
+		assert.InDelta(t, 0.4, queue.Utilization(), 1e-9)
+
+		require.NoError(t, queue.SetSoftCap(2))
+		assert.InDelta(t, 0.4, queue.Utilization(), 1e-9)
+		assert.Equal(t, reserved, queue.BytesReserved())
+	})
+
+	t.Run("bytes used with metadata", func(t *testing.T) {
+		queue := testQueue(t, 0, 3, WithMetadataSize(8))
+		assert.Equal(t, 3*(24+msgLockSize), queue.BytesUsed())
+	})
+}
@@ -0,0 +1,93 @@
+package shqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// subscribers are the in-process handlers of a queue registered with Subscribe.
+type subscribers struct {
+	mu       sync.Mutex
+	handlers map[uint64]func([]byte)
+	nextID   uint64
+	cancel   context.CancelFunc // Stops the dispatcher. nil if it isn't running.
+}
+
+// Subscribe registers a handler that receives a copy of every message dequeued by an internal dispatcher goroutine.
+// All the handlers of the queue in this process share one dispatcher, so each of them receives every message (fan-out).
+// It's an in-process convenience on top of DequeueBlock: for other processes, the queue remains a destructive FIFO,
+// and the dispatcher competes with their consumers. The dispatcher starts with the first subscriber and stops when the
+// last one leaves. A message dequeued while the last subscriber leaves is lost.
+// The handler is removed when unsubscribe is called or ctx is cancelled, whichever comes first. Handlers are called one
+// by one from the dispatcher goroutine, so a slow handler delays the others. If the queue is deleted, the dispatcher
+// stops, and the handlers stop receiving messages.
+func (q *Queue) Subscribe(ctx context.Context, handler func([]byte)) (unsubscribe func()) {
+	s := &q.subs
+	s.mu.Lock()
+	if s.handlers == nil {
+		s.handlers = make(map[uint64]func([]byte))
+	}
+	id := s.nextID
+	s.nextID++
+	s.handlers[id] = handler
+	if s.cancel == nil {
+		var dispatchCtx context.Context
+		dispatchCtx, s.cancel = context.WithCancel(context.Background())
+		go q.dispatch(dispatchCtx)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	var once sync.Once
+	unsubscribe = func() {
+		once.Do(func() {
+			close(done)
+			s.mu.Lock()
+			delete(s.handlers, id)
+			if len(s.handlers) == 0 && s.cancel != nil {
+				s.cancel()
+				s.cancel = nil
+			}
+			s.mu.Unlock()
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			unsubscribe()
+		case <-done:
+		}
+	}()
+	return unsubscribe
+}
+
+// dispatch dequeues messages and passes their copies to all the subscribers until ctx is cancelled or the queue is
+// deleted.
+func (q *Queue) dispatch(ctx context.Context) {
+	s := &q.subs
+	buf := make([]byte, q.MessageSize())
+	var handlers []func([]byte)
+	for {
+		if err := q.DequeueBlock(ctx, buf); err != nil {
+			s.mu.Lock()
+			if ctx.Err() == nil {
+				// The queue is deleted, so let the next Subscribe start a new dispatcher.
+				s.cancel()
+				s.cancel = nil
+			}
+			s.mu.Unlock()
+			return
+		}
+
+		handlers = handlers[:0]
+		s.mu.Lock()
+		for _, handler := range s.handlers {
+			handlers = append(handlers, handler)
+		}
+		s.mu.Unlock()
+
+		for _, handler := range handlers {
+			handler(append([]byte(nil), buf...))
+		}
+	}
+}
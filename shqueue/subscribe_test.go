@@ -0,0 +1,76 @@
+package shqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	t.Run("every subscriber receives every message", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		received1 := make(chan []byte, 10)
+		received2 := make(chan []byte, 10)
+		unsubscribe1 := queue.Subscribe(context.Background(), func(msg []byte) { received1 <- msg })
+		defer unsubscribe1()
+		unsubscribe2 := queue.Subscribe(context.Background(), func(msg []byte) { received2 <- msg })
+		defer unsubscribe2()
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+		for _, received := range []chan []byte{received1, received2} {
+			assert.Equal(t, testMsgA, receive(t, received))
+			assert.Equal(t, testMsgB, receive(t, received))
+		}
+	})
+
+	t.Run("dispatcher stops when last subscriber leaves", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		unsubscribe1 := queue.Subscribe(context.Background(), func(msg []byte) {})
+		unsubscribe2 := queue.Subscribe(context.Background(), func(msg []byte) {})
+		unsubscribe1()
+		unsubscribe1()
+		queue.subs.mu.Lock()
+		assert.NotNil(t, queue.subs.cancel)
+		queue.subs.mu.Unlock()
+
+		unsubscribe2()
+		queue.subs.mu.Lock()
+		assert.Nil(t, queue.subs.cancel)
+		queue.subs.mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+	})
+
+	t.Run("context cancellation unsubscribes", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		queue.Subscribe(ctx, func(msg []byte) {})
+		cancel()
+
+		assert.Eventually(t, func() bool {
+			queue.subs.mu.Lock()
+			defer queue.subs.mu.Unlock()
+			return len(queue.subs.handlers) == 0 && queue.subs.cancel == nil
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func receive(t *testing.T, ch chan []byte) []byte {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
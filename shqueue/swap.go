@@ -0,0 +1,57 @@
+package shqueue
+
+import (
+	"fmt"
+	"math"
+)
+
+// Swap replaces the segment behind this queue with the segment of newQueue, e.g. a resized copy or a queue with a new
+// message format. The messages left in this queue are moved to newQueue first, then the old segment is closed and
+// deleted, and this *Queue starts working with the new segment, so the code that holds it keeps going without
+// reopening. newQueue must not be used or closed after a successful Swap: this queue owns its segment now. The
+// eventfds of this queue (see WithEventFD), if any, are kept and follow the new segment.
+//
+// Swap must not be called concurrently with other calls on this queue or newQueue in this process. Other processes
+// keep using the old segment until they reopen the queue by the key of newQueue, and producers of other processes that
+// keep enqueueing to the old segment until it's deleted lose their messages.
+//
+// If the old queue has messages and the message sizes differ, an error wrapping ErrGeometryMismatch is returned. If
+// not all the messages are moved, the moved ones stay in newQueue, the rest stay in this queue, and an error is
+// returned: wrapping ErrNoSpace if newQueue is full, or the cause of the failed move, e.g. a corrupted header. Nothing
+// is swapped in these cases. An error closing or deleting the old segment is returned after the swap.
+func (q *Queue) Swap(newQueue *Queue) error {
+	moved := 0
+	if q.seg.getDataSize() == newQueue.seg.getDataSize() {
+		var err error
+		moved, err = transferTry(q, newQueue, math.MaxInt32)
+		if err != nil {
+			return newQueueError("swap", q.key, q.id, fmt.Errorf(
+				"move incomplete after %d messages: %w", moved, err,
+			))
+		}
+	} else if oldLen := q.seg.getQueueLen(); oldLen > 0 {
+		return newQueueError("swap", q.key, q.id, fmt.Errorf(
+			"%w: %d messages of %d bytes can't be moved to a queue of %d-byte messages",
+			ErrGeometryMismatch, oldLen, q.seg.getDataSize(), newQueue.seg.getDataSize(),
+		))
+	}
+	if oldLen := q.seg.getQueueLen(); oldLen > 0 {
+		if newQueue.seg.getQueueLen() >= newQueue.Cap() {
+			return newQueueError("swap", q.key, q.id, fmt.Errorf(
+				"%w: %d messages moved, %d left in the old queue", ErrNoSpace, moved, oldLen,
+			))
+		}
+		// The rest is behind a reserved message (see Reserve), or is enqueued by another process in the meantime.
+		return newQueueError("swap", q.key, q.id, fmt.Errorf(
+			"move incomplete: %d messages moved, %d left in the old queue", moved, oldLen,
+		))
+	}
+
+	moveEventFDs(q.seg, newQueue.seg)
+	old := &Queue{key: q.key, id: q.id, semID: q.semID, posix: q.posix, seg: q.seg}
+	q.key, q.id, q.semID, q.posix, q.seg = newQueue.key, newQueue.id, newQueue.semID, newQueue.posix, newQueue.seg
+	if err := old.Close(); err != nil {
+		return err
+	}
+	return old.Delete()
+}
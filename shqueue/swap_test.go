@@ -0,0 +1,117 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSwap(t *testing.T) {
+	t.Run("move messages and delete old segment", func(t *testing.T) {
+		queue, err := CreatePrivate(2, 3)
+		require.NoError(t, err)
+		oldID := queue.ExportID()
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+
+		newQueue, err := CreatePrivate(2, 10)
+		require.NoError(t, err)
+		require.True(t, newQueue.EnqueueTry(testMsgC))
+
+		require.NoError(t, queue.Swap(newQueue))
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		assert.Equal(t, newQueue.ExportID(), queue.ExportID())
+		assert.Equal(t, uint32(10), queue.HardCap())
+		_, err = unix.SysvShmCtl(oldID, unix.IPC_STAT, &unix.SysvShmDesc{})
+		assert.Error(t, err)
+
+		toMsg := make([]byte, 16)
+		for _, msg := range [][]byte{testMsgC, testMsgA, testMsgB} {
+			require.True(t, queue.DequeueTry(toMsg))
+			assert.Equal(t, msg, toMsg)
+		}
+		assert.True(t, queue.EnqueueTry(testMsgA))
+	})
+
+	t.Run("different message size", func(t *testing.T) {
+		queue := testQueue(t, 0, 1)
+		newQueue, err := CreatePrivate(3, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, newQueue.Close())
+			assert.NoError(t, newQueue.Delete())
+		}()
+
+		err = queue.Swap(newQueue)
+		assert.ErrorIs(t, err, ErrGeometryMismatch)
+		assert.Equal(t, uint32(1), queue.seg.getQueueLen())
+	})
+
+	t.Run("different message size of empty queue", func(t *testing.T) {
+		queue, err := CreatePrivate(2, 5)
+		require.NoError(t, err)
+		newQueue, err := CreatePrivate(3, 5)
+		require.NoError(t, err)
+
+		require.NoError(t, queue.Swap(newQueue))
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+		assert.Equal(t, 24, queue.MessageSize())
+	})
+
+	t.Run("not enough space", func(t *testing.T) {
+		queue := testQueue(t, 0, 4)
+		newQueue, err := CreatePrivate(2, 2)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, newQueue.Close())
+			assert.NoError(t, newQueue.Delete())
+		}()
+
+		err = queue.Swap(newQueue)
+		assert.ErrorIs(t, err, ErrNoSpace)
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+		assert.Equal(t, uint32(2), newQueue.seg.getQueueLen())
+	})
+
+	t.Run("reserved message", func(t *testing.T) {
+		queue := testQueue(t, 0, 1)
+		_, _, ok := queue.Reserve()
+		require.True(t, ok)
+		newQueue, err := CreatePrivate(2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, newQueue.Close())
+			assert.NoError(t, newQueue.Delete())
+		}()
+
+		err = queue.Swap(newQueue)
+		assert.ErrorContains(t, err, "move incomplete: 1 messages moved, 1 left in the old queue")
+		assert.NotErrorIs(t, err, ErrNoSpace)
+		assert.Equal(t, uint32(1), newQueue.seg.getQueueLen())
+	})
+
+	t.Run("corrupted new queue", func(t *testing.T) {
+		queue := testQueue(t, 0, 2)
+		newQueue, err := CreatePrivate(2, 5, WithHeaderChecksum())
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, newQueue.Close())
+			assert.NoError(t, newQueue.Delete())
+		}()
+		newQueue.seg.setStartIdx(4)
+
+		err = queue.Swap(newQueue)
+		assert.ErrorIs(t, err, ErrHeaderCorrupt)
+		assert.NotErrorIs(t, err, ErrNoSpace)
+		assert.Equal(t, uint32(2), queue.seg.getQueueLen())
+	})
+}
@@ -0,0 +1,66 @@
+package shqueue
+
+import (
+	"fmt"
+)
+
+// tagSize is the size of the type tag at the start of a tagged message.
+const tagSize = 2
+
+// TaggedQueue is a view of a queue that carries messages of several kinds, so consumers can dispatch on the kind. Each
+// message starts with a 2-byte type tag in the byte order of the segment, followed by the payload padded with zeros to
+// the rest of the message size. The tags are up to the caller, like the schema ID (see WithSchemaID).
+//
+// Tagged messages must be dequeued with DequeueTagged, and mixing them with untagged messages in one queue is up to
+// the caller. Like Record, a TaggedQueue is just a view: the queue stays usable, and must be closed as usual.
+type TaggedQueue struct {
+	q *Queue
+}
+
+// Tagged returns the tagged view of the queue.
+func (q *Queue) Tagged() *TaggedQueue {
+	return &TaggedQueue{q: q}
+}
+
+// Capacity returns the max length of a payload: the message size minus the 2-byte tag.
+func (t *TaggedQueue) Capacity() int {
+	return t.q.MessageSize() - tagSize
+}
+
+// EnqueueTagged enqueues the payload with the tag. The payload may be shorter than Capacity: the rest of the slot is
+// zeroed. If the queue is full or closed, false is returned. If the payload is longer than Capacity, an error wrapping
+// ErrMessageTooLarge is returned and nothing is enqueued. The message is written directly into the slot, so nothing is
+// allocated.
+func (t *TaggedQueue) EnqueueTagged(tag uint16, payload []byte) (ok bool, err error) {
+	if capacity := t.Capacity(); len(payload) > capacity {
+		return false, newQueueError("enqueue", t.q.key, t.q.id, fmt.Errorf(
+			"%w: payload of %d bytes, capacity %d", ErrMessageTooLarge, len(payload), capacity,
+		))
+	}
+
+	byteOrder := t.q.seg.byteOrder
+	ok = t.q.EnqueueInPlaceTry(func(dst []byte) {
+		byteOrder.PutUint16(dst[:tagSize], tag)
+		tail := dst[tagSize+copy(dst[tagSize:], payload):]
+		for i := range tail {
+			tail[i] = 0
+		}
+	})
+	return ok, nil
+}
+
+// DequeueTagged dequeues the oldest message and returns its tag and payload. The payload is a new slice of Capacity
+// bytes: a shorter payload comes back padded with zeros, so the payload format must tell its own length if it varies.
+// If the queue is empty, false is returned.
+func (t *TaggedQueue) DequeueTagged() (tag uint16, payload []byte, ok bool) {
+	byteOrder := t.q.seg.byteOrder
+	payload = make([]byte, t.Capacity())
+	ok = t.q.DequeueInPlace(func(src []byte) {
+		tag = byteOrder.Uint16(src[:tagSize])
+		copy(payload, src[tagSize:])
+	})
+	if !ok {
+		return 0, nil, false
+	}
+	return tag, payload, true
+}
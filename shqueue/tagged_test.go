@@ -0,0 +1,68 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaggedQueue(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		tagged := testQueue(t, 4, 0).Tagged()
+		assert.Equal(t, 14, tagged.Capacity())
+
+		payloads := map[uint16][]byte{
+			1:      []byte("order"),
+			0xbeef: testMsgA[:14],
+		}
+		for _, tag := range []uint16{1, 0xbeef} {
+			ok, err := tagged.EnqueueTagged(tag, payloads[tag])
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+
+		tag, payload, ok := tagged.DequeueTagged()
+		require.True(t, ok)
+		assert.Equal(t, uint16(1), tag)
+		assert.Equal(t, append([]byte("order"), make([]byte, 9)...), payload)
+
+		tag, payload, ok = tagged.DequeueTagged()
+		require.True(t, ok)
+		assert.Equal(t, uint16(0xbeef), tag)
+		assert.Equal(t, testMsgA[:14], payload)
+
+		_, payload, ok = tagged.DequeueTagged()
+		assert.False(t, ok)
+		assert.Nil(t, payload)
+	})
+
+	t.Run("shorter payload clears old bytes", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		queue.seg.setMsgData(0, testMsgA)
+
+		tagged := queue.Tagged()
+		ok, err := tagged.EnqueueTagged(7, []byte{1})
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		got := make([]byte, 16)
+		queue.seg.getMsgData(0, got)
+		assert.Equal(t, append([]byte{1}, make([]byte, 13)...), got[tagSize:])
+	})
+
+	t.Run("payload too large", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		ok, err := queue.Tagged().EnqueueTagged(1, make([]byte, 15))
+		assert.False(t, ok)
+		assert.ErrorIs(t, err, ErrMessageTooLarge)
+		assert.Zero(t, queue.seg.getQueueLen())
+	})
+
+	t.Run("full", func(t *testing.T) {
+		ok, err := testQueue(t, 0, 5).Tagged().EnqueueTagged(1, nil)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
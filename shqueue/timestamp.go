@@ -0,0 +1,92 @@
+package shqueue
+
+import (
+	"time"
+)
+
+// msgTimeSize is the size of the enqueue timestamp of a slot, right after its lock (see WithTimestamps).
+const msgTimeSize = 8
+
+// isTimestamped returns whether the messages are stamped with their enqueue time (see WithTimestamps).
+func (s *segment) isTimestamped() bool {
+	return s.byteOrder.Uint32(s.mem[startTimestamped:endTimestamped]) != 0
+}
+
+func (s *segment) setTimestamped() {
+	s.byteOrder.PutUint32(s.mem[startTimestamped:endTimestamped], 1)
+}
+
+// timestampSize returns the size of the enqueue timestamp of every slot: msgTimeSize if the messages are stamped, or 0.
+func (s *segment) timestampSize() uint32 {
+	if s.isTimestamped() {
+		return msgTimeSize
+	}
+	return 0
+}
+
+// getMsgTime returns the enqueue time of the message in the slot in Unix nanoseconds. The queue must be timestamped,
+// and the message lock must be held.
+func (s *segment) getMsgTime(idx uint32) int64 {
+	start := s.startMsgLock(idx) + msgLockSize
+	return int64(s.byteOrder.Uint64(s.mem[start : start+msgTimeSize]))
+}
+
+func (s *segment) setMsgTime(idx uint32, unixNano int64) {
+	start := s.startMsgLock(idx) + msgLockSize
+	s.byteOrder.PutUint64(s.mem[start:start+msgTimeSize], uint64(unixNano))
+}
+
+// copyMsgTime stamps the message moved into the slot from the slot of src with its enqueue time in src, or with the
+// current time if src isn't timestamped. It does nothing if this queue isn't timestamped. Both message locks must be
+// held.
+func (s *segment) copyMsgTime(idx uint32, src *segment, srcIdx uint32) {
+	switch {
+	case !s.isTimestamped():
+		// Go on.
+	case src.isTimestamped():
+		s.setMsgTime(idx, src.getMsgTime(srcIdx))
+	default:
+		s.setMsgTime(idx, time.Now().UnixNano())
+	}
+}
+
+// finishEnqueue stamps the message just written into the slot with the enqueue time, if the queue is timestamped, and
+// adds it to the enqueued checksum, if it's maintained. The message lock must be held.
+func (s *segment) finishEnqueue(idx uint32) {
+	if s.isTimestamped() {
+		s.setMsgTime(idx, time.Now().UnixNano())
+	}
+	s.sumEnqueued(idx)
+}
+
+// HeadAge returns how long the oldest message has been waiting in the queue since it was enqueued, for latency
+// monitoring: a short queue of old messages means a stalled consumer, which the length alone doesn't show. It returns
+// false if the queue is empty or isn't created with WithTimestamps. A reserved slot at the head (see Reserve) counts as
+// empty, like for consumers. The stamp is read under the header lock and the lock of the message, so it's never torn by
+// a concurrent producer.
+func (q *Queue) HeadAge() (age time.Duration, ok bool) {
+	if !q.seg.isTimestamped() || q.deletedHere() {
+		return 0, false
+	}
+	if q.seg.lockHeader() != nil {
+		return 0, false
+	}
+	defer q.seg.unlockHeader()
+
+	if q.seg.readyLen(1) == 0 {
+		return 0, false
+	}
+	idx := q.seg.getStartIdx()
+	if err := q.seg.lockMsg(idx); err != nil {
+		return 0, false
+	}
+	enqueued := q.seg.getMsgTime(idx)
+	q.seg.unlockMsg(idx)
+
+	age = time.Since(time.Unix(0, enqueued))
+	if age < 0 {
+		// The clock of the producer is ahead of the one of this process.
+		age = 0
+	}
+	return age, true
+}
@@ -0,0 +1,128 @@
+package shqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadAge(t *testing.T) {
+	const wait = 20 * time.Millisecond
+
+	t.Run("age of oldest message", func(t *testing.T) {
+		queue := testQueue(t, 3, 0, WithTimestamps())
+		_, ok := queue.HeadAge()
+		assert.False(t, ok)
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		time.Sleep(wait)
+		require.True(t, queue.EnqueueTry(testMsgB))
+
+		age, ok := queue.HeadAge()
+		require.True(t, ok)
+		assert.GreaterOrEqual(t, age, wait)
+
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+		age, ok = queue.HeadAge()
+		require.True(t, ok)
+		assert.Less(t, age, wait)
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		require.True(t, queue.EnqueueTry(testMsgA))
+		_, ok := queue.HeadAge()
+		assert.False(t, ok)
+		assert.Zero(t, queue.LayoutDescriptor().TimestampSize)
+	})
+
+	t.Run("messages and metadata are intact", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithTimestamps(), WithMetadataSize(8), WithRunningChecksum())
+		assert.Equal(t, 8, queue.LayoutDescriptor().TimestampSize)
+		assert.Equal(t, 32, queue.LayoutDescriptor().MsgSize)
+
+		require.True(t, queue.EnqueueMeta([]byte("metadata"), testMsgA))
+		ok, err := queue.EnqueueVarTry([]byte("hello"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.True(t, queue.EnqueueInPlaceTry(func(dst []byte) { copy(dst, testMsgC) }))
+
+		meta, msg := make([]byte, 8), make([]byte, 16)
+		require.True(t, queue.DequeueMeta(meta, msg))
+		assert.Equal(t, []byte("metadata"), meta)
+		assert.Equal(t, testMsgA, msg)
+		varMsg, err := queue.DequeueVarBlock(context.Background(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("hello"), varMsg)
+		require.True(t, queue.DequeueTry(msg))
+		assert.Equal(t, testMsgC, msg)
+
+		stats := queue.Stats()
+		assert.Equal(t, stats.EnqueuedChecksum, stats.DequeuedChecksum)
+	})
+
+	t.Run("reserved head", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithTimestamps())
+		token, dst, ok := queue.Reserve()
+		require.True(t, ok)
+		copy(dst, testMsgA)
+		_, ok = queue.HeadAge()
+		assert.False(t, ok)
+
+		require.NoError(t, queue.Commit(token))
+		age, ok := queue.HeadAge()
+		require.True(t, ok)
+		assert.Less(t, age, wait)
+	})
+
+	t.Run("kept by transfer", func(t *testing.T) {
+		src := testQueue(t, 0, 0, WithTimestamps())
+		dst := testQueue(t, 0, 0, WithTimestamps())
+		require.True(t, src.EnqueueTry(testMsgA))
+		time.Sleep(wait)
+
+		assert.Equal(t, 1, TransferTry(src, dst, 1))
+		age, ok := dst.HeadAge()
+		require.True(t, ok)
+		assert.GreaterOrEqual(t, age, wait)
+	})
+
+	t.Run("stamped by transfer from queue without timestamps", func(t *testing.T) {
+		src := testQueue(t, 0, 0)
+		dst := testQueue(t, 0, 0, WithTimestamps())
+		require.True(t, src.EnqueueTry(testMsgA))
+		time.Sleep(wait)
+
+		assert.Equal(t, 1, TransferTry(src, dst, 1))
+		age, ok := dst.HeadAge()
+		require.True(t, ok)
+		assert.Less(t, age, wait)
+		got := make([]byte, 16)
+		require.True(t, dst.DequeueTry(got))
+		assert.Equal(t, testMsgA, got)
+	})
+
+	t.Run("followed by other handles and resize", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithTimestamps())
+		other, err := AttachByID(queue.ExportID())
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, other.Close()) }()
+
+		require.True(t, other.EnqueueTry(testMsgA))
+		time.Sleep(wait)
+		require.NoError(t, queue.Resize(8))
+		age, ok := queue.HeadAge()
+		require.True(t, ok)
+		assert.GreaterOrEqual(t, age, wait)
+	})
+
+	t.Run("multi queue", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		_, err = CreateMulti(key, 2, 2, 5, WithTimestamps())
+		assert.ErrorIs(t, err, ErrNotSupported)
+	})
+}
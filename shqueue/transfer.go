@@ -0,0 +1,163 @@
+package shqueue
+
+import (
+	"math"
+)
+
+// TransferTry moves up to n oldest messages from src to dst and returns the number of moved messages, which is limited
+// by the length of src and the free space in dst, and stops early at a slot that doesn't fit into its segment because
+// the header is corrupted (see ErrSegmentCorrupt). Nothing is moved if the header checksum of either queue doesn't
+// match (see WithHeaderChecksum). With WithZeroOnDequeue on src, the moved slots of src are zeroed. Messages of both
+// queues must be of the same size. Their metadata (see WithMetadataSize) is moved along: it's truncated or padded with
+// zeros if the metadata sizes differ.
+//
+// Both header locks are held during the transfer, so no other process can observe a message that is in both queues or
+// in neither of them. The header and message locks of the two queues are taken in the order of segment IDs (and of
+// the channels of one MultiQueue), so concurrent transfers in opposite directions don't deadlock. The messages are
+// copied into the free slots of dst first, and then the transfer is committed with an intent record in the headers
+// (see docs/memory_layout.md). If the process crashes in the middle, RepairLocks of either queue rolls the transfer
+// forward or back in both of them, so every message ends up in exactly one queue.
+func TransferTry(src, dst *Queue, n int) int {
+	count, _ := transferTry(src, dst, n)
+	return count
+}
+
+// transferTry works like TransferTry, but also returns why it stopped before moving all the ready messages of src
+// that fit into dst: ErrSegmentDeleted if either queue is deleted by this process, ErrQueueClosed if dst is closed, or
+// the error of a failed lock. Running out of free space or ready messages isn't an error.
+func transferTry(src, dst *Queue, n int) (int, error) {
+	srcPeer, dstPeer := src.transferPeer(), dst.transferPeer()
+	if n <= 0 || srcPeer == dstPeer {
+		return 0, nil
+	}
+	if src.deletedHere() || dst.deletedHere() {
+		return 0, ErrSegmentDeleted
+	}
+	src.seg.checkMsgSize(int(dst.seg.getDataSize()))
+
+	first, second := src, dst
+	if dstPeer.less(srcPeer) {
+		first, second = dst, src
+	}
+	if err := first.seg.lockHeader(); err != nil {
+		return 0, err
+	}
+	if err := second.seg.lockHeader(); err != nil {
+		first.seg.unlockHeader()
+		return 0, err
+	}
+
+	// Only the messages before the first reserved one are moved (see Reserve). Reclaimed slots at the head of src are
+	// dropped by readyLen, so the header of src is read afterwards.
+	count := uint32(math.MaxUint32)
+	if uint64(n) < uint64(count) {
+		count = uint32(n)
+	}
+	count = src.seg.readyLen(count)
+	var err error
+	if count > 0 && dst.seg.isClosed() {
+		count, err = 0, ErrQueueClosed
+	}
+
+	srcLen := src.seg.getQueueLen()
+	srcMaxLen := src.seg.getMaxLen()
+	srcStartIdx := src.seg.getStartIdx()
+	dstLen := dst.seg.getQueueLen()
+	dstMaxLen := dst.seg.getMaxLen()
+	dstStartIdx := dst.seg.getStartIdx()
+
+	free := uint32(0)
+	if dstCap := dst.seg.getCap(); dstLen < dstCap {
+		free = dstCap - dstLen
+	}
+	if count > free {
+		count = free
+	}
+
+	for i := uint32(0); i < count; i++ {
+		srcIdx := (srcStartIdx + i) % srcMaxLen
+		dstIdx := (dstStartIdx + dstLen + i) % dstMaxLen
+		firstIdx, secondIdx := srcIdx, dstIdx
+		if first != src {
+			firstIdx, secondIdx = dstIdx, srcIdx
+		}
+		if err = first.seg.lockMsg(firstIdx); err != nil {
+			count = i
+			break
+		}
+		if err = second.seg.lockMsg(secondIdx); err != nil {
+			first.seg.unlockMsg(firstIdx)
+			count = i
+			break
+		}
+		dst.seg.zeroMsgMeta(dstIdx)
+		copy(dst.seg.msgMeta(dstIdx), src.seg.msgMeta(srcIdx))
+		copy(dst.seg.msgData(dstIdx), src.seg.msgData(srcIdx))
+		dst.seg.copyMsgTime(dstIdx, src.seg, srcIdx)
+		src.seg.sumDequeued(srcIdx)
+		dst.seg.sumEnqueued(dstIdx)
+		dst.seg.unlockMsg(dstIdx)
+		src.seg.unlockMsg(srcIdx)
+	}
+
+	if count > 0 {
+		dstRec := transferRecord{
+			state: transferDest, peer: src.transferPeer(), count: count, len: dstLen, counter: dst.seg.getEnqueued(),
+			seq: dst.seg.getTailSeq(),
+		}
+		srcRec := transferRecord{
+			state: transferSource, peer: dst.transferPeer(), count: count, start: srcStartIdx, len: srcLen,
+			counter: src.seg.getDequeued(), seq: src.seg.getHeadSeq(),
+		}
+		dst.seg.setTransfer(dstRec)
+		src.seg.fault(faultTransferPrepare)
+		src.seg.setTransfer(srcRec)
+		src.seg.fault(faultTransferCommit)
+		dst.seg.applyTransfer(dstRec)
+		src.seg.applyTransfer(srcRec)
+		dst.seg.clearTransfer()
+		src.seg.clearTransfer()
+		if src.opts.zeroOnDequeue {
+			// The moved slots are free now, but no producer of src can reuse them until the header is unlocked.
+			for i := uint32(0); i < count; i++ {
+				srcIdx := (srcStartIdx + i) % srcMaxLen
+				if src.seg.lockMsg(srcIdx) == nil {
+					src.seg.zeroMsgData(srcIdx)
+					src.seg.unlockMsg(srcIdx)
+				}
+			}
+		}
+	}
+
+	second.seg.unlockHeader()
+	first.seg.unlockHeader()
+
+	return int(count), err
+}
+
+// dequeueIntoChunk is the max number of messages DequeueInto moves under one pair of header locks.
+const dequeueIntoChunk = 64
+
+// DequeueInto moves up to max oldest messages from this queue to dst and returns the number of moved messages, like a
+// consumer that forwards every message to another queue, but without a buffer in between: each message is copied
+// once, from its slot in this queue to its slot in dst. Messages of both queues must be of the same size.
+//
+// Unlike TransferTry, the move isn't atomic as a whole: it's done in chunks, and the header locks are released between
+// them, so a big move doesn't block other processes for long. Each chunk is moved like by TransferTry, so no message is
+// ever lost or observed in both queues, but other producers and consumers may interleave with the chunks. It stops
+// early once this queue is empty or dst is full.
+func (q *Queue) DequeueInto(dst *Queue, max int) int {
+	moved := 0
+	for moved < max {
+		n := max - moved
+		if n > dequeueIntoChunk {
+			n = dequeueIntoChunk
+		}
+		chunk := TransferTry(q, dst, n)
+		moved += chunk
+		if chunk < n {
+			break
+		}
+	}
+	return moved
+}
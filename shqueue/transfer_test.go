@@ -0,0 +1,202 @@
+package shqueue
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferTry(t *testing.T) {
+	t.Run("move all when there is space", func(t *testing.T) {
+		src := testQueue(t, 4, 2)
+		src.seg.setMsgData(4, testMsgA)
+		src.seg.setMsgData(0, testMsgB)
+		dst := testQueue(t, 1, 1)
+
+		moved := TransferTry(src, dst, 10)
+		assert.Equal(t, 2, moved)
+
+		assert.Equal(t, uint32(1), src.seg.getStartIdx())
+		assert.Equal(t, uint32(0), src.seg.getQueueLen())
+		assert.Equal(t, uint32(1), dst.seg.getStartIdx())
+		assert.Equal(t, uint32(3), dst.seg.getQueueLen())
+
+		got := make([]byte, 8*2)
+		dst.seg.getMsgData(2, got)
+		assert.Equal(t, testMsgA, got)
+		dst.seg.getMsgData(3, got)
+		assert.Equal(t, testMsgB, got)
+	})
+
+	t.Run("zero moved slots", func(t *testing.T) {
+		src := testQueue(t, 4, 0, WithZeroOnDequeue())
+		require.True(t, src.EnqueueAllTry([][]byte{testMsgA, testMsgB, testMsgC}))
+		dst := testQueue(t, 0, 0)
+
+		assert.Equal(t, 2, TransferTry(src, dst, 2))
+		assert.Equal(t, make([]byte, 16), src.seg.msgData(4))
+		assert.Equal(t, make([]byte, 16), src.seg.msgData(0))
+		assert.Equal(t, testMsgC, src.seg.msgData(1))
+
+		assert.Equal(t, 1, src.DequeueInto(dst, 1))
+		assert.Equal(t, make([]byte, 16), src.seg.msgData(1))
+	})
+
+	t.Run("move as many as fit into destination", func(t *testing.T) {
+		src := testQueue(t, 0, 3)
+		src.seg.setMsgData(0, testMsgA)
+		src.seg.setMsgData(1, testMsgB)
+		src.seg.setMsgData(2, testMsgC)
+		dst := testQueue(t, 0, 4)
+
+		moved := TransferTry(src, dst, 3)
+		assert.Equal(t, 1, moved)
+
+		assert.Equal(t, uint32(1), src.seg.getStartIdx())
+		assert.Equal(t, uint32(2), src.seg.getQueueLen())
+		assert.Equal(t, uint32(5), dst.seg.getQueueLen())
+
+		got := make([]byte, 8*2)
+		dst.seg.getMsgData(4, got)
+		assert.Equal(t, testMsgA, got)
+	})
+
+	t.Run("move at most n", func(t *testing.T) {
+		src := testQueue(t, 0, 3)
+		dst := testQueue(t, 0, 0)
+
+		moved := TransferTry(src, dst, 2)
+		assert.Equal(t, 2, moved)
+		assert.Equal(t, uint32(1), src.seg.getQueueLen())
+		assert.Equal(t, uint32(2), dst.seg.getQueueLen())
+	})
+
+	t.Run("move nothing to itself", func(t *testing.T) {
+		queue := testQueue(t, 0, 3)
+
+		moved := TransferTry(queue, queue, 2)
+		assert.Equal(t, 0, moved)
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+	})
+
+	t.Run("move nothing to another handle of itself", func(t *testing.T) {
+		queue := testQueue(t, 0, 3)
+		other, err := AttachByID(queue.ExportID())
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, other.Close()) }()
+
+		assert.Equal(t, 0, TransferTry(queue, other, 2))
+		assert.Equal(t, uint32(3), queue.seg.getQueueLen())
+	})
+
+	t.Run("move between channels", func(t *testing.T) {
+		mq := testMultiQueue(t, 3)
+		src, dst := mq.Channel(2), mq.Channel(0)
+		require.True(t, src.EnqueueTry(testMsgA))
+		require.True(t, src.EnqueueTry(testMsgB))
+		require.True(t, dst.EnqueueTry(testMsgC))
+
+		assert.Equal(t, 0, TransferTry(src, src, 2))
+		assert.Equal(t, 2, TransferTry(src, dst, 2))
+		assert.Equal(t, 1, dst.DequeueInto(mq.Channel(1), 1))
+		assert.Equal(t, uint32(0), src.seg.getQueueLen())
+
+		got := make([]byte, 16)
+		require.True(t, mq.Channel(1).DequeueTry(got))
+		assert.Equal(t, testMsgC, got)
+		require.True(t, dst.DequeueTry(got))
+		assert.Equal(t, testMsgA, got)
+		require.True(t, dst.DequeueTry(got))
+		assert.Equal(t, testMsgB, got)
+	})
+
+	t.Run("panic on different message sizes", func(t *testing.T) {
+		src := testQueue(t, 0, 3)
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		dst, err := Create(key, 3, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, dst.Close())
+			assert.NoError(t, dst.Delete())
+		}()
+
+		assert.Panics(t, func() {
+			TransferTry(src, dst, 1)
+		})
+	})
+
+	t.Run("don't deadlock on opposite transfers", func(t *testing.T) {
+		a := testQueue(t, 0, 5)
+		b := testQueue(t, 0, 0)
+
+		var wg sync.WaitGroup
+		for _, pair := range [][2]*Queue{{a, b}, {b, a}} {
+			wg.Add(1)
+			go func(src, dst *Queue) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					TransferTry(src, dst, 2)
+				}
+			}(pair[0], pair[1])
+		}
+		wg.Wait()
+
+		assert.Equal(t, uint32(5), a.seg.getQueueLen()+b.seg.getQueueLen())
+	})
+}
+
+func TestDequeueInto(t *testing.T) {
+	// bigQueue returns a queue of 8-byte messages with many slots, so the moves take several chunks.
+	bigQueue := func(t *testing.T, maxLen uint32) *Queue {
+		queue, err := CreatePrivate(1, maxLen)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		})
+		return queue
+	}
+
+	t.Run("move in order over several chunks", func(t *testing.T) {
+		src := bigQueue(t, 3*dequeueIntoChunk)
+		dst := bigQueue(t, 3*dequeueIntoChunk)
+		for i := 0; i < 2*dequeueIntoChunk+10; i++ {
+			require.True(t, src.EnqueueTry([]byte{byte(i), 0, 0, 0, 0, 0, 0, 0}))
+		}
+
+		moved := src.DequeueInto(dst, 2*dequeueIntoChunk+5)
+		assert.Equal(t, 2*dequeueIntoChunk+5, moved)
+		assert.Equal(t, uint32(5), src.seg.getQueueLen())
+
+		got := make([]byte, 8)
+		for i := 0; i < moved; i++ {
+			require.True(t, dst.DequeueTry(got))
+			assert.Equal(t, byte(i), got[0])
+		}
+	})
+
+	t.Run("stop when source is empty", func(t *testing.T) {
+		src := bigQueue(t, 2*dequeueIntoChunk)
+		dst := bigQueue(t, 4*dequeueIntoChunk)
+		for i := 0; i < dequeueIntoChunk+3; i++ {
+			require.True(t, src.EnqueueTry(make([]byte, 8)))
+		}
+
+		assert.Equal(t, dequeueIntoChunk+3, src.DequeueInto(dst, 1000))
+		assert.Equal(t, uint32(0), src.seg.getQueueLen())
+		assert.Equal(t, 0, src.DequeueInto(dst, 1000))
+	})
+
+	t.Run("stop when destination is full", func(t *testing.T) {
+		src := testQueue(t, 2, 4)
+		dst := testQueue(t, 0, 3)
+
+		assert.Equal(t, 2, src.DequeueInto(dst, 10))
+		assert.Equal(t, uint32(2), src.seg.getQueueLen())
+		assert.Equal(t, uint32(5), dst.seg.getQueueLen())
+		assert.Equal(t, 0, src.DequeueInto(dst, 10))
+	})
+}
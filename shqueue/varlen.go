@@ -0,0 +1,155 @@
+package shqueue
+
+import "context"
+
+// varLenPrefixSize is the size of the length prefix of a variable-length message. It keeps the data 8-byte aligned.
+const varLenPrefixSize = 8
+
+// VarCapacity returns the max length of a variable-length message in this queue: the message size minus the 8-byte
+// length prefix.
+//
+// Any queue can hold variable-length messages: EnqueueVarTry stores the length of the message in the first 8 bytes of
+// the slot, followed by the data. Such messages must be dequeued with DequeueVarTry or DequeueVarBlock, and mixing
+// them with fixed-length messages in one queue is up to the caller.
+func (q *Queue) VarCapacity() int {
+	return q.seg.varCapacity()
+}
+
+// EnqueueVarTry enqueues a variable-length message of up to VarCapacity bytes. If the queue is full, false is returned.
+// If the message is too long, an error wrapping ErrMessageTooLarge is returned and nothing is enqueued. With
+// WithZeroOnDequeue, the unused tail of the slot is zeroed too, so it doesn't keep the bytes of older messages.
+func (q *Queue) EnqueueVarTry(msg []byte) (ok bool, err error) {
+	if len(msg) > q.seg.varCapacity() {
+		return false, newQueueError("enqueue", q.key, q.id, ErrMessageTooLarge)
+	}
+	if q.deletedHere() {
+		return false, newQueueError("enqueue", q.key, q.id, ErrSegmentDeleted)
+	}
+
+	if err = q.seg.lockHeader(); err != nil {
+		return false, newQueueError("enqueue", q.key, q.id, err)
+	}
+
+	curLen := q.seg.getQueueLen()
+	maxLen := q.seg.getMaxLen()
+	if q.seg.isClosed() {
+		q.seg.unlockHeader()
+		return false, newQueueError("enqueue", q.key, q.id, ErrQueueClosed)
+	}
+	if curLen >= q.seg.getCap() {
+		q.seg.unlockHeader()
+		return false, nil
+	}
+
+	startIdx := q.seg.getStartIdx()
+	msgIdx := startIdx + curLen
+	msgIdx %= maxLen
+
+	if err = q.seg.lockMsg(msgIdx); err != nil {
+		q.seg.unlockHeader()
+		return false, newQueueError("enqueue", q.key, q.id, err)
+	}
+	q.seg.setQueueLen(curLen + 1)
+	q.seg.addEnqueued(1)
+	q.seg.zeroMsgMeta(msgIdx)
+	q.seg.setVarMsgData(msgIdx, msg, q.opts.zeroOnDequeue)
+	q.seg.finishEnqueue(msgIdx)
+	q.seg.unlockHeader()
+	q.seg.unlockMsg(msgIdx)
+
+	return true, nil
+}
+
+// DequeueVarTry dequeues the oldest variable-length message into toMsg, which must be at least VarCapacity bytes long,
+// and returns its length. If the queue is empty, false is returned. If the stored length prefix doesn't fit into the
+// slot (it's corrupted, or the message wasn't enqueued with EnqueueVarTry), the message is dequeued anyway, but nothing
+// is copied and an error wrapping ErrCorruptLength is returned.
+func (q *Queue) DequeueVarTry(toMsg []byte) (n int, ok bool, err error) {
+	if len(toMsg) < q.seg.varCapacity() {
+		panic("message buffer must be at least VarCapacity bytes long")
+	}
+	if q.deletedHere() {
+		return 0, false, newQueueError("dequeue", q.key, q.id, ErrSegmentDeleted)
+	}
+
+	if err = q.seg.lockHeader(); err != nil {
+		return 0, false, newQueueError("dequeue", q.key, q.id, err)
+	}
+
+	if q.seg.readyLen(1) == 0 {
+		q.seg.unlockHeader()
+		return 0, false, nil
+	}
+	curLen := q.seg.getQueueLen()
+
+	startIdx := q.seg.getStartIdx()
+	if err = q.seg.lockMsg(startIdx); err != nil {
+		q.seg.unlockHeader()
+		return 0, false, newQueueError("dequeue", q.key, q.id, err)
+	}
+
+	q.seg.setQueueLen(curLen - 1)
+	q.seg.addDequeued(1)
+
+	maxLen := q.seg.getMaxLen()
+	q.seg.setStartIdx((startIdx + 1) % maxLen)
+
+	q.seg.unlockHeader()
+	n, err = q.seg.getVarMsgData(startIdx, toMsg)
+	q.seg.sumDequeued(startIdx)
+	if q.opts.zeroOnDequeue {
+		q.seg.zeroMsgData(startIdx)
+	}
+	q.seg.unlockMsg(startIdx)
+
+	if err != nil {
+		return 0, true, newQueueError("dequeue", q.key, q.id, err)
+	}
+	return n, true, nil
+}
+
+// DequeueVarBlock waits until the queue isn't empty, and then dequeues the oldest variable-length message. Unlike
+// DequeueVarTry, the caller doesn't need a buffer of VarCapacity bytes: the message is copied into buf re-sliced to
+// its length if buf has enough capacity, or into a new slice of exactly its length otherwise, and the result is
+// returned, like with append.
+// So a consumer can reuse one buffer for all its messages: buf, err = q.DequeueVarBlock(ctx, buf).
+// If the context is cancelled while the queue is empty, or the queue is closed and drained, an error is returned. If
+// the stored length prefix is corrupted, the message is dequeued anyway, and an error wrapping ErrCorruptLength is
+// returned. On errors, buf is returned truncated to zero length.
+func (q *Queue) DequeueVarBlock(ctx context.Context, buf []byte) ([]byte, error) {
+	curLen, err := q.lockHeaderNotEmpty(ctx)
+	if err != nil {
+		return buf[:0], err
+	}
+
+	startIdx := q.seg.getStartIdx()
+	if err = q.seg.lockMsgCtx(ctx, startIdx); err != nil {
+		q.seg.unlockHeader()
+		return buf[:0], err
+	}
+
+	q.seg.setQueueLen(curLen - 1)
+	q.seg.addDequeued(1)
+
+	maxLen := q.seg.getMaxLen()
+	q.seg.setStartIdx((startIdx + 1) % maxLen)
+
+	q.seg.unlockHeader()
+	data, err := q.seg.varMsgData(startIdx)
+	if err == nil {
+		if cap(buf) < len(data) {
+			buf = make([]byte, len(data))
+		}
+		buf = buf[:copy(buf[:len(data)], data)]
+	}
+	q.seg.sumDequeued(startIdx)
+	if q.opts.zeroOnDequeue {
+		q.seg.zeroMsgData(startIdx)
+	}
+	q.seg.unlockMsg(startIdx)
+
+	if err != nil {
+		return buf[:0], newQueueError("dequeue", q.key, q.id, err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,133 @@
+package shqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVarLen(t *testing.T) {
+	t.Run("capacity", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		assert.Equal(t, 8, queue.VarCapacity())
+	})
+
+	t.Run("enqueue and dequeue", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		for _, msg := range [][]byte{{}, {1, 2, 3}, {1, 2, 3, 4, 5, 6, 7, 8}} {
+			ok, err := queue.EnqueueVarTry(msg)
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+
+		toMsg := make([]byte, queue.VarCapacity())
+		for _, msg := range [][]byte{{}, {1, 2, 3}, {1, 2, 3, 4, 5, 6, 7, 8}} {
+			n, ok, err := queue.DequeueVarTry(toMsg)
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, msg, toMsg[:n])
+		}
+
+		_, ok, err := queue.DequeueVarTry(toMsg)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("enqueue to full", func(t *testing.T) {
+		queue := testQueue(t, 0, 5)
+
+		ok, err := queue.EnqueueVarTry([]byte{1})
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("too large message is rejected", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		ok, err := queue.EnqueueVarTry(make([]byte, 9))
+		assert.ErrorIs(t, err, ErrMessageTooLarge)
+		assert.False(t, ok)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+	})
+
+	t.Run("corrupt length is detected", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+
+		require.True(t, queue.EnqueueTry(testMsgC))
+
+		toMsg := make([]byte, queue.VarCapacity())
+		_, ok, err := queue.DequeueVarTry(toMsg)
+		assert.ErrorIs(t, err, ErrCorruptLength)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+	})
+
+	t.Run("tail is zeroed with zero on dequeue", func(t *testing.T) {
+		queue := testQueue(t, 0, 0, WithZeroOnDequeue())
+
+		queue.seg.setMsgData(0, testMsgC)
+		ok, err := queue.EnqueueVarTry([]byte{1, 2})
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, []byte{1, 2, 0, 0, 0, 0, 0, 0}, queue.seg.msgData(0)[varLenPrefixSize:])
+	})
+
+	t.Run("dequeue block into growable buffer", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		ctx := context.Background()
+
+		for _, msg := range [][]byte{{1, 2, 3}, {4}, {1, 2, 3, 4, 5, 6, 7, 8}} {
+			ok, err := queue.EnqueueVarTry(msg)
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+
+		buf := make([]byte, 0, 4)
+		got, err := queue.DequeueVarBlock(ctx, buf)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, got)
+		assert.Same(t, &buf[:1][0], &got[0], "buffer is reused")
+
+		got, err = queue.DequeueVarBlock(ctx, got)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{4}, got)
+
+		got, err = queue.DequeueVarBlock(ctx, got)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, got)
+		assert.Equal(t, 8, cap(got), "new buffer of exact size")
+	})
+
+	t.Run("dequeue block waits", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_, _ = queue.EnqueueVarTry([]byte{7, 7})
+		}()
+
+		got, err := queue.DequeueVarBlock(context.Background(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{7, 7}, got)
+	})
+
+	t.Run("dequeue block errors", func(t *testing.T) {
+		queue := testQueue(t, 0, 0)
+		buf := make([]byte, 3, 8)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		got, err := queue.DequeueVarBlock(ctx, buf)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Empty(t, got)
+
+		require.True(t, queue.EnqueueTry(testMsgC))
+		got, err = queue.DequeueVarBlock(context.Background(), buf)
+		assert.ErrorIs(t, err, ErrCorruptLength)
+		assert.Empty(t, got)
+		assert.Equal(t, uint32(0), queue.seg.getQueueLen())
+	})
+}
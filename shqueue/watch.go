@@ -0,0 +1,69 @@
+package shqueue
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// QueueWatcher is a read-only view of the header of a queue for monitoring daemons that poll many queues. It reads the
+// header on every call and never takes locks, so the values are snapshots that may be slightly inconsistent with each
+// other under load.
+type QueueWatcher struct {
+	key int
+	id  int
+	mem []byte // The whole attached segment, to detach it.
+	seg *segment
+}
+
+// Watch attaches the queue with the given key read-only for monitoring. System V shared memory can only be attached
+// whole, so the address range of the whole segment is reserved, but the watcher only ever touches the magic, the params
+// and the header, which fit into the first page: the pages of the messages are never mapped in, and cost no memory or
+// page tables in this process. The watcher stays attached until Close, so repeated polling costs no syscalls.
+func Watch(key int) (*QueueWatcher, error) {
+	// The segment is looked up with zero permission bits: the read permission is checked by the attach.
+	id, err := unix.SysvShmGet(key, 0, 0)
+	if err != nil {
+		return nil, wrapErrShmGet(err, false, key)
+	}
+	mem, err := unix.SysvShmAttach(id, 0, unix.SHM_RDONLY)
+	if err != nil {
+		return nil, wrapErrShmAttach(err, key, id)
+	}
+
+	err = ErrTooSmall
+	seg := newSegment(mem)
+	if len(mem) >= startQueue {
+		seg.mem = mem[:startQueue]
+		err = seg.checkMagic()
+		if err == nil {
+			err = seg.checkVersion()
+		}
+	}
+	if err != nil {
+		_ = unix.SysvShmDetach(mem)
+		return nil, newQueueError("watch", key, id, err)
+	}
+	return &QueueWatcher{key: key, id: id, mem: mem, seg: seg}, nil
+}
+
+// Depth returns the number of messages in the queue.
+func (w *QueueWatcher) Depth() uint32 {
+	return w.seg.getQueueLen()
+}
+
+// Capacity returns the number of messages at which the queue is full for producers (see Queue.Cap).
+func (w *QueueWatcher) Capacity() uint32 {
+	return w.seg.getCap()
+}
+
+// Stats returns the current statistics of the queue.
+func (w *QueueWatcher) Stats() Stats {
+	return w.seg.stats()
+}
+
+// Close detaches the watcher. The queue isn't affected.
+func (w *QueueWatcher) Close() error {
+	if err := unix.SysvShmDetach(w.mem); err != nil {
+		return wrapErrShmDetach(err, w.key, w.id)
+	}
+	return nil
+}
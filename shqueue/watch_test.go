@@ -0,0 +1,45 @@
+package shqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	t.Run("follow the queue", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+		queue, err := Create(key, 2, 5)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, queue.Close())
+			assert.NoError(t, queue.Delete())
+		}()
+
+		watcher, err := Watch(key)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, watcher.Close())
+		}()
+		assert.Equal(t, uint32(0), watcher.Depth())
+		assert.Equal(t, uint32(5), watcher.Capacity())
+
+		require.True(t, queue.EnqueueTry(testMsgA))
+		require.True(t, queue.EnqueueTry(testMsgB))
+		require.True(t, queue.DequeueTry(make([]byte, 16)))
+		require.NoError(t, queue.SetSoftCap(3))
+		assert.Equal(t, uint32(1), watcher.Depth())
+		assert.Equal(t, uint32(3), watcher.Capacity())
+		assert.Equal(t, queue.Stats(), watcher.Stats())
+	})
+
+	t.Run("fail on missing queue", func(t *testing.T) {
+		key, err := FindFreeKey()
+		require.NoError(t, err)
+
+		_, err = Watch(key)
+		assert.ErrorIs(t, err, ErrNotExist)
+	})
+}